@@ -0,0 +1,84 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter limits how many background fills, such as the backfills of NewLayered
+// and Tiered caches, run at once. The limit adapts to how well the backend copes, with AIMD:
+// it grows by one for every limit's worth of fills which succeed within the target latency,
+// and halves whenever a fill fails or takes longer. Fills over the limit are skipped rather
+// than queued, the data is still served from where it was found.
+type AdaptiveLimiter struct {
+	min, max int
+	target   time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+}
+
+// NewAdaptiveLimiter returns an AdaptiveLimiter whose limit starts at min, and stays between
+// min and max. A fill which takes longer than target counts as an overload.
+func NewAdaptiveLimiter(min, max int, target time.Duration) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &AdaptiveLimiter{
+		min:    min,
+		max:    max,
+		target: target,
+		limit:  float64(min),
+	}
+}
+
+// Acquire returns if a fill may start now, if so Release must be called once it is done.
+func (l *AdaptiveLimiter) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release ends a fill started by Acquire, which took d and failed with err if it isn't nil.
+func (l *AdaptiveLimiter) Release(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if err != nil || d > l.target {
+		l.limit /= 2
+		if l.limit < float64(l.min) {
+			l.limit = float64(l.min)
+		}
+		return
+	}
+	l.limit += 1 / l.limit
+	if l.limit > float64(l.max) {
+		l.limit = float64(l.max)
+	}
+}
+
+// Limit returns how many fills may currently run at once.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// abandonFill discards a fill of key in c which won't be completed.
+func abandonFill(c Cache, key string, w io.WriteCloser) {
+	if a, ok := w.(Aborter); ok {
+		_ = a.Abort()
+		return
+	}
+	w.Close()
+	_ = c.Remove(key)
+}
@@ -0,0 +1,294 @@
+package fscache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAdminSamples is how many Stats samples an AdminHandler keeps for its history.
+const maxAdminSamples = 120
+
+// defaultAdminInterval is how often an AdminHandler samples without an interval,
+// the UI refreshes as often.
+const defaultAdminInterval = 10 * time.Second
+
+// AdminHandler serves an inspection UI for an FSCache, for operators debugging its behavior.
+// It shows the number and size of entries, their size distribution and the hit ratio
+// over time, and lets keys be searched and purged. It should be mounted with a trailing
+// slash, e.g. http.Handle("/cache/", http.StripPrefix("/cache", h)), and protected like
+// any other admin endpoint, since it can remove entries.
+//
+// Besides the UI at "/" it serves:
+//
+//	GET  /stats              Stats, the size distribution and the hit ratio history as JSON.
+//	GET  /keys?q=sub&limit=n the first keys containing sub, in order, with their sizes, as JSON.
+//	POST /purge              removes the key in the form value "key", or the keys
+//	                         starting with the form value "prefix".
+type AdminHandler struct {
+	c        *FSCache
+	interval time.Duration
+
+	mu      sync.Mutex
+	history []AdminSample
+	last    Stats
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// AdminSample is the hit ratio of the Gets during one sampling interval of an AdminHandler.
+type AdminSample struct {
+	Time     time.Time `json:"time"`
+	Hits     int64     `json:"hits"`
+	Misses   int64     `json:"misses"`
+	HitRatio float64   `json:"hitRatio"`
+}
+
+// NewAdminHandler returns an AdminHandler for c, which samples the hit ratio every interval,
+// or every 10s if interval <= 0. Close stops the sampling.
+func NewAdminHandler(c *FSCache, interval time.Duration) *AdminHandler {
+	if interval <= 0 {
+		interval = defaultAdminInterval
+	}
+	h := &AdminHandler{
+		c:        c,
+		interval: interval,
+		last:     c.Stats(),
+		stop:     make(chan struct{}),
+	}
+	go h.sample()
+	return h
+}
+
+// Close stops the AdminHandler's sampling, it can still serve requests.
+func (h *AdminHandler) Close() error {
+	h.once.Do(func() { close(h.stop) })
+	return nil
+}
+
+func (h *AdminHandler) sample() {
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-t.C:
+			s := h.c.Stats()
+			h.mu.Lock()
+			d := Stats{Hits: s.Hits - h.last.Hits, Misses: s.Misses - h.last.Misses}
+			h.history = append(h.history, AdminSample{
+				Time:     now,
+				Hits:     d.Hits,
+				Misses:   d.Misses,
+				HitRatio: d.HitRatio(),
+			})
+			if len(h.history) > maxAdminSamples {
+				h.history = h.history[len(h.history)-maxAdminSamples:]
+			}
+			h.last = s
+			h.mu.Unlock()
+		}
+	}
+}
+
+// adminStats is the reply to /stats.
+type adminStats struct {
+	Stats
+	HitRatio float64       `json:"hitRatio"`
+	Sizes    []sizeBucket  `json:"sizes"`
+	History  []AdminSample `json:"history"`
+}
+
+// sizeBucket counts the entries whose size is less than Max, and at least the previous bucket's Max.
+type sizeBucket struct {
+	Max   int64 `json:"max"`
+	Count int   `json:"count"`
+}
+
+func (h *AdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch strings.TrimSuffix(req.URL.Path, "/") {
+	case "":
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(rw, adminPage)
+
+	case "/stats":
+		// one pass over the entries serves both the totals and the buckets.
+		entries := h.c.entrySizes(everyKey, 0)
+		s := h.c.stats(entries)
+		h.mu.Lock()
+		history := append([]AdminSample(nil), h.history...)
+		h.mu.Unlock()
+		writeJSON(rw, adminStats{
+			Stats:    s,
+			HitRatio: s.HitRatio(),
+			Sizes:    sizeBuckets(entries),
+			History:  history,
+		})
+
+	case "/keys":
+		q := req.FormValue("q")
+		limit, err := strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		writeJSON(rw, h.c.entrySizes(func(key string) bool { return strings.Contains(key, q) }, limit))
+
+	case "/purge":
+		if req.Method != http.MethodPost {
+			http.Error(rw, "purge must be a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var err error
+		if key := req.FormValue("key"); key != "" {
+			err = h.c.RemoveMatching(func(k string) bool { return k == key })
+		} else if prefix := req.FormValue("prefix"); prefix != "" {
+			err = h.c.RemovePrefix(prefix)
+		} else {
+			http.Error(rw, "purge needs a key or prefix", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrImmutable):
+			http.Error(rw, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		default:
+			rw.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+// sizeBuckets counts entries into power of two size buckets, up to the largest entry.
+func sizeBuckets(entries []entrySize) []sizeBucket {
+	var counts [65]int
+	top := 0
+	for _, e := range entries {
+		i := 0
+		if e.Size > 0 {
+			i = bits.Len64(uint64(e.Size))
+		}
+		counts[i]++
+		if i > top {
+			top = i
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	buckets := make([]sizeBucket, top+1)
+	for i := range buckets {
+		buckets[i] = sizeBucket{Max: 1 << uint(i), Count: counts[i]}
+	}
+	return buckets
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>fscache</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 8px; text-align: left; }
+.bar { background: #4a90d9; height: 12px; }
+.chart { display: flex; align-items: flex-end; height: 80px; gap: 1px; }
+.chart div { background: #5cb85c; width: 6px; }
+</style>
+</head>
+<body>
+<h1>fscache</h1>
+<p id="summary"></p>
+
+<h2>Hit ratio</h2>
+<div class="chart" id="history"></div>
+
+<h2>Entry sizes</h2>
+<table id="sizes"></table>
+
+<h2>Keys</h2>
+<form id="search"><input id="q" placeholder="search"> <button>Search</button></form>
+<form id="purge-prefix"><input id="prefix" placeholder="prefix"> <button>Purge prefix</button></form>
+<table id="keys"></table>
+
+<script>
+function fmt(n) {
+  var units = ["B", "KiB", "MiB", "GiB", "TiB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+function el(tag, text) { var e = document.createElement(tag); e.textContent = text; return e; }
+function purge(body) {
+  fetch("purge", {method: "POST", body: body}).then(function(r) {
+    if (!r.ok) { r.text().then(alert); }
+    refresh(); search();
+  });
+}
+function refresh() {
+  fetch("stats").then(function(r) { return r.json(); }).then(function(s) {
+    document.getElementById("summary").textContent = s.entries + " entries, " + fmt(s.size) +
+      ", " + s.hits + " hits, " + s.misses + " misses, hit ratio " + (100 * s.hitRatio).toFixed(1) + "%";
+    var hist = document.getElementById("history");
+    hist.innerHTML = "";
+    (s.history || []).forEach(function(h) {
+      var d = document.createElement("div");
+      d.style.height = Math.max(1, 80 * h.hitRatio) + "px";
+      d.title = new Date(h.time).toLocaleTimeString() + ": " + (100 * h.hitRatio).toFixed(1) + "%";
+      hist.appendChild(d);
+    });
+    var sizes = document.getElementById("sizes"), max = 0;
+    sizes.innerHTML = "";
+    (s.sizes || []).forEach(function(b) { max = Math.max(max, b.count); });
+    (s.sizes || []).forEach(function(b) {
+      var tr = document.createElement("tr"), bar = document.createElement("div");
+      bar.className = "bar";
+      bar.style.width = (max ? 300 * b.count / max : 0) + "px";
+      tr.appendChild(el("td", "< " + fmt(b.max)));
+      tr.appendChild(el("td", b.count));
+      tr.appendChild(document.createElement("td")).appendChild(bar);
+      sizes.appendChild(tr);
+    });
+  });
+}
+function search() {
+  var q = document.getElementById("q").value;
+  fetch("keys?q=" + encodeURIComponent(q)).then(function(r) { return r.json(); }).then(function(keys) {
+    var t = document.getElementById("keys");
+    t.innerHTML = "";
+    (keys || []).forEach(function(k) {
+      var tr = document.createElement("tr"), b = el("button", "purge");
+      b.onclick = function() { purge(new URLSearchParams({key: k.key})); };
+      tr.appendChild(el("td", k.key));
+      tr.appendChild(el("td", fmt(k.size)));
+      tr.appendChild(document.createElement("td")).appendChild(b);
+      t.appendChild(tr);
+    });
+  });
+}
+document.getElementById("search").onsubmit = function(e) { e.preventDefault(); search(); };
+document.getElementById("purge-prefix").onsubmit = function(e) {
+  e.preventDefault();
+  var p = document.getElementById("prefix").value;
+  if (p && confirm("Purge every key starting with " + p + "?")) { purge(new URLSearchParams({prefix: p})); }
+};
+refresh(); search();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
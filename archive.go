@@ -0,0 +1,272 @@
+package fscache
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djherbis/stream"
+)
+
+// ErrReadOnly is returned by a FileSystem which can't be changed, such as an ArchiveFS.
+var ErrReadOnly = errors.New("fscache: file system is read only")
+
+// ArchiveFS is a read-only FileSystem of the files in a zip or tar archive, so a pre-built
+// cache can be shipped as a single artifact. The archive can hold a StandardFS directory,
+// whose file names are decoded into keys as StandardFS does. As the lowest layer of NewLayered
+// it seeds the writable layers above it.
+// Create, Remove and RemoveAll return ErrReadOnly. Access times are only kept in memory.
+type ArchiveFS struct {
+	// DecodeKey converts the base name of a file in the archive into its key, see
+	// StandardFS.DecodeKey. Files it can't decode, and which have no .key file, are skipped.
+	// It must be set before the ArchiveFS is given to a Cache.
+	DecodeKey func(string) (string, bool)
+
+	closer io.Closer
+
+	mu     sync.Mutex
+	files  map[string]*archiveFile
+	atimes map[string]time.Time
+}
+
+// archiveFile is a file in the archive.
+type archiveFile struct {
+	name string
+	size int64
+	mode os.FileMode
+	wt   time.Time
+
+	data *io.SectionReader // set if the file is stored uncompressed
+	zf   *zip.File
+}
+
+// NewZipFs returns an ArchiveFS of the zip archive in r, which is size bytes long.
+// Files stored without compression (e.g. zip -0) are read in place; compressed ones
+// are decompressed into memory each time they are opened.
+func NewZipFs(r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	fs := newArchiveFs()
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		f := &archiveFile{
+			name: zf.Name,
+			size: int64(zf.UncompressedSize64),
+			mode: zf.Mode(),
+			wt:   zf.Modified,
+			zf:   zf,
+		}
+		if zf.Method == zip.Store {
+			off, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			f.data = io.NewSectionReader(r, off, f.size)
+		}
+		fs.files[f.name] = f
+	}
+	return fs, nil
+}
+
+// NewTarFs returns an ArchiveFS of the uncompressed tar archive in r, which is size bytes long.
+// Files are read in place; only regular files are served.
+func NewTarFs(r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	cr := &countingReader{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(cr)
+	fs := newArchiveFs()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// the tar reader reads whole blocks, so a file's data starts where its header ends.
+		fs.files[hdr.Name] = &archiveFile{
+			name: hdr.Name,
+			size: hdr.Size,
+			mode: hdr.FileInfo().Mode(),
+			wt:   hdr.ModTime,
+			data: io.NewSectionReader(r, cr.n, hdr.Size),
+		}
+	}
+}
+
+// OpenArchiveFs opens the archive at path read-only, as a zip archive if its name ends
+// in .zip and a tar archive otherwise. Close closes the file.
+func OpenArchiveFs(path string) (*ArchiveFS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var fs *ArchiveFS
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		fs, err = NewZipFs(f, fi.Size())
+	} else {
+		fs, err = NewTarFs(f, fi.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fs.closer = f
+	return fs, nil
+}
+
+func newArchiveFs() *ArchiveFS {
+	return &ArchiveFS{
+		DecodeKey: B32DecodeKey,
+		files:     make(map[string]*archiveFile),
+		atimes:    make(map[string]time.Time),
+	}
+}
+
+// Close closes the archive file opened by OpenArchiveFs.
+func (fs *ArchiveFS) Close() error {
+	if fs.closer != nil {
+		return fs.closer.Close()
+	}
+	return nil
+}
+
+// Create returns ErrReadOnly.
+func (fs *ArchiveFS) Create(name string) (stream.File, error) { return nil, ErrReadOnly }
+
+// Remove returns ErrReadOnly.
+func (fs *ArchiveFS) Remove(name string) error { return ErrReadOnly }
+
+// RemoveAll returns ErrReadOnly.
+func (fs *ArchiveFS) RemoveAll() error { return ErrReadOnly }
+
+// Open opens the file name of the archive for reading.
+func (fs *ArchiveFS) Open(name string) (stream.File, error) {
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, errors.New("file does not exist")
+	}
+	fs.mu.Lock()
+	fs.atimes[name] = time.Now()
+	fs.mu.Unlock()
+
+	data := f.data
+	if data == nil {
+		rc, err := f.zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		data = io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	} else {
+		data = io.NewSectionReader(data, 0, f.size)
+	}
+	return &archiveReader{SectionReader: data, name: name}, nil
+}
+
+// archiveReader reads a file of an ArchiveFS.
+type archiveReader struct {
+	*io.SectionReader
+	name string
+}
+
+func (r *archiveReader) Name() string                { return r.name }
+func (r *archiveReader) Write(p []byte) (int, error) { return 0, ErrReadOnly }
+func (r *archiveReader) Close() error                { return nil }
+
+// Stat returns the FileInfo of the file name of the archive.
+func (fs *ArchiveFS) Stat(name string) (FileInfo, error) {
+	f, ok := fs.files[name]
+	if !ok {
+		return FileInfo{}, errors.New("file does not exist")
+	}
+	fs.mu.Lock()
+	atime, ok := fs.atimes[name]
+	fs.mu.Unlock()
+	if !ok {
+		atime = f.wt
+	}
+	return FileInfo{
+		FileInfo: &fileInfo{
+			name:     path.Base(name),
+			size:     f.size,
+			fileMode: f.mode,
+			wt:       f.wt,
+		},
+		Atime: atime,
+	}, nil
+}
+
+// Touch sets the access time of name to now.
+func (fs *ArchiveFS) Touch(name string) error {
+	if _, ok := fs.files[name]; !ok {
+		return errors.New("file does not exist")
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.atimes[name] = time.Now()
+	return nil
+}
+
+// Reload returns the files of the archive whose keys can be found, as StandardFS.Reload does.
+func (fs *ArchiveFS) Reload(add func(key, name string)) error {
+	for name := range fs.files {
+		base := path.Base(name)
+		if strings.HasSuffix(base, ".key") || strings.HasSuffix(base, ".meta") || base == ownerFile {
+			continue
+		}
+		if key, ok := fs.key(name); ok {
+			add(key, name)
+		}
+	}
+	return nil
+}
+
+// key returns the key of the file name, from its .key file if it has one.
+func (fs *ArchiveFS) key(name string) (string, bool) {
+	if kf, ok := fs.files[name+".key"]; ok {
+		r, err := fs.Open(kf.name)
+		if err != nil {
+			return "", false
+		}
+		key, err := ioutil.ReadAll(r)
+		r.Close()
+		return string(key), err == nil
+	}
+	return fs.DecodeKey(path.Base(name))
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
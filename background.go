@@ -0,0 +1,73 @@
+package fscache
+
+import (
+	"runtime"
+	"sync"
+)
+
+// BackgroundLimit bounds the CPU used by the background work of caches, such as haunts and
+// the removal of evicted files, so that maintenance can't starve the application under load.
+// At most a fraction of GOMAXPROCS tasks run at once, and at least one; the others wait their
+// turn. A BackgroundLimit can be shared by several caches to bound their total.
+type BackgroundLimit struct {
+	fraction float64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+}
+
+// NewBackgroundLimit returns a BackgroundLimit which runs up to fraction of GOMAXPROCS
+// background tasks at once, e.g. 0.25 lets maintenance use a quarter of the CPUs.
+func NewBackgroundLimit(fraction float64) *BackgroundLimit {
+	l := &BackgroundLimit{fraction: fraction}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Limit returns how many background tasks may run at once, from the current GOMAXPROCS.
+func (l *BackgroundLimit) Limit() int {
+	n := int(l.fraction * float64(runtime.GOMAXPROCS(0)))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Running returns how many background tasks are running.
+func (l *BackgroundLimit) Running() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running
+}
+
+// Do runs fn once there is room under the limit. A nil BackgroundLimit runs fn right away.
+func (l *BackgroundLimit) Do(fn func()) {
+	if l == nil {
+		fn()
+		return
+	}
+	l.mu.Lock()
+	for l.running >= l.Limit() {
+		l.cond.Wait()
+	}
+	l.running++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.running--
+		l.mu.Unlock()
+		l.cond.Signal()
+	}()
+	fn()
+}
+
+// SetBackgroundLimit makes the cache's haunts, and the background removal of evicted files,
+// run under l. A nil l, the default, leaves them unbounded.
+func (c *FSCache) SetBackgroundLimit(l *BackgroundLimit) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.background = l
+	return c
+}
@@ -0,0 +1,123 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaos is returned by the operations a Chaos cache fails on purpose.
+var ErrChaos = errors.New("fscache: injected failure")
+
+// ChaosOp is a set of Cache operations.
+type ChaosOp int
+
+// The Cache operations a ChaosConfig can affect.
+const (
+	ChaosGet ChaosOp = 1 << iota
+	ChaosRemove
+	ChaosExists
+	ChaosClean
+
+	ChaosAll = ChaosGet | ChaosRemove | ChaosExists | ChaosClean
+)
+
+// ChaosConfig is how a Chaos cache misbehaves. The zero value passes every operation through.
+type ChaosConfig struct {
+	// Ops are the operations which may be affected.
+	Ops ChaosOp
+
+	// Rate is the fraction of those operations, from 0 to 1, which are affected.
+	Rate float64
+
+	// Latency, plus a random part of Jitter, delays each affected operation.
+	Latency, Jitter time.Duration
+
+	// ErrorRate is the fraction of affected operations, from 0 to 1, which then fail
+	// with ErrChaos. A failed Exists reports false.
+	ErrorRate float64
+}
+
+// Chaos is a Cache which passes operations to another Cache, misbehaving on some of
+// them as its ChaosConfig says. It can be left in production and configured at
+// runtime, to check that the services using the cache degrade gracefully when it is
+// slow or failing.
+type Chaos struct {
+	cache Cache
+
+	mu  sync.RWMutex
+	cfg ChaosConfig
+}
+
+// NewChaos returns a Chaos cache for c, which passes every operation through until
+// SetConfig is called.
+func NewChaos(c Cache) *Chaos {
+	return &Chaos{cache: c}
+}
+
+// SetConfig replaces the ChaosConfig, it is safe to call while the cache is in use.
+func (c *Chaos) SetConfig(cfg ChaosConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+}
+
+// Config returns the current ChaosConfig.
+func (c *Chaos) Config() ChaosConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
+
+// inject delays op if it is affected, and returns ErrChaos if it should fail.
+func (c *Chaos) inject(op ChaosOp) error {
+	cfg := c.Config()
+	if cfg.Ops&op == 0 || cfg.Rate <= 0 || rand.Float64() >= cfg.Rate {
+		return nil
+	}
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(cfg.Jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if cfg.ErrorRate > 0 && rand.Float64() < cfg.ErrorRate {
+		return ErrChaos
+	}
+	return nil
+}
+
+// Get is the wrapped Cache's Get, unless it is made to fail.
+func (c *Chaos) Get(key string) (ReadAtCloser, io.WriteCloser, error) {
+	if err := c.inject(ChaosGet); err != nil {
+		return nil, nil, err
+	}
+	return c.cache.Get(key)
+}
+
+// Remove is the wrapped Cache's Remove, unless it is made to fail.
+func (c *Chaos) Remove(key string) error {
+	if err := c.inject(ChaosRemove); err != nil {
+		return err
+	}
+	return c.cache.Remove(key)
+}
+
+// Exists is the wrapped Cache's Exists, unless it is made to fail.
+func (c *Chaos) Exists(key string) bool {
+	if err := c.inject(ChaosExists); err != nil {
+		return false
+	}
+	return c.cache.Exists(key)
+}
+
+// Clean is the wrapped Cache's Clean, unless it is made to fail.
+func (c *Chaos) Clean() error {
+	if err := c.inject(ChaosClean); err != nil {
+		return err
+	}
+	return c.cache.Clean()
+}
@@ -0,0 +1,167 @@
+package fscache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/djherbis/fscache/protocol"
+)
+
+// ErrCleanNotConfirmed is returned by ConfirmClean when the token is unknown, was
+// already used, or has expired, and by the Clean of a remote Cache whose Server has
+// a CleanConfirmWindow. Remote Caches also return it when their Server's Cache fails
+// to clean.
+var ErrCleanNotConfirmed = errors.New("clean was not confirmed")
+
+// CleanPreparer is implemented by Caches which can be cleaned in two phases: PrepareClean
+// returns a token, and ConfirmClean(token) cleans the Cache. For a Server with a
+// CleanConfirmWindow this is the only way to clean it, so a single stray Clean from one client
+// can't wipe it. Distributors prepare every Cache before confirming any of them, so a node
+// which is down when the Clean is prepared fails it before anything is cleaned. Confirming is
+// best-effort: the nodes are confirmed one at a time, and those confirmed before a node which
+// fails, e.g. because its token expired, stay cleaned.
+type CleanPreparer interface {
+	PrepareClean() (token string, err error)
+	ConfirmClean(token string) error
+}
+
+// defaultCleanConfirmWindow is how long a prepared Clean is valid on a Server
+// without a CleanConfirmWindow.
+const defaultCleanConfirmWindow = time.Minute
+
+// clean cleans the Server's Cache. Subscribers are told even if it fails,
+// since some of its entries may have been removed.
+func (s *Server) clean() error {
+	err := s.Cache.Clean()
+	s.invalidate(protocol.Invalidation{Action: protocol.ActionClean})
+	return err
+}
+
+// prepareClean returns a new token for confirmClean.
+func (s *Server) prepareClean() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	token := hex.EncodeToString(id[:])
+
+	window := s.CleanConfirmWindow
+	if window <= 0 {
+		window = defaultCleanConfirmWindow
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]time.Time)
+	}
+	for t, expires := range s.tokens {
+		if now.After(expires) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = now.Add(window)
+	return token
+}
+
+// confirmClean returns if token was prepared and hasn't expired, it can only be used once.
+func (s *Server) confirmClean(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.tokens[token]
+	delete(s.tokens, token)
+	return ok && !time.Now().After(expires)
+}
+
+func (rmt *remote) PrepareClean() (string, error) {
+	c, err := rmt.dialer.DialContext(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if err := protocol.WriteAction(c, protocol.ActionCleanPrepare); err != nil {
+		return "", err
+	}
+	return protocol.ReadToken(c)
+}
+
+func (rmt *remote) ConfirmClean(token string) error {
+	c, err := rmt.dialer.DialContext(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := protocol.WriteAction(c, protocol.ActionCleanConfirm); err != nil {
+		return err
+	}
+	if err := protocol.WriteToken(c, token); err != nil {
+		return err
+	}
+	ok, err := protocol.ReadBool(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCleanNotConfirmed
+	}
+	return nil
+}
+
+// tokenSep separates the tokens of the caches of a distrib, server tokens are hex.
+const tokenSep = ","
+
+// PrepareClean prepares every cache which is a CleanPreparer, and fails if any of them does.
+// The other caches are cleaned by ConfirmClean.
+func (d *distrib) PrepareClean() (string, error) {
+	tokens := make([]string, len(d.caches))
+	for i, c := range d.caches {
+		if cp, ok := c.(CleanPreparer); ok {
+			token, err := cp.PrepareClean()
+			if err != nil {
+				return "", err
+			}
+			tokens[i] = token
+		}
+	}
+	return strings.Join(tokens, tokenSep), nil
+}
+
+// ConfirmClean cleans every cache prepared by PrepareClean. It continues even if one of the
+// caches returns an error, but will return the first error encountered.
+func (d *distrib) ConfirmClean(token string) error {
+	tokens := strings.Split(token, tokenSep)
+	if len(tokens) != len(d.caches) {
+		return ErrCleanNotConfirmed
+	}
+	var err1 error
+	for i, c := range d.caches {
+		var err2 error
+		if cp, ok := c.(CleanPreparer); ok {
+			err2 = cp.ConfirmClean(tokens[i])
+		} else {
+			err2 = c.Clean()
+		}
+		if err2 != nil && err1 == nil {
+			err1 = err2
+		}
+	}
+	return err1
+}
+
+func (p *partition) PrepareClean() (string, error) {
+	cp, ok := p.distributor.(CleanPreparer)
+	if !ok {
+		return "", errors.New("distributor can't prepare a clean")
+	}
+	return cp.PrepareClean()
+}
+
+func (p *partition) ConfirmClean(token string) error {
+	cp, ok := p.distributor.(CleanPreparer)
+	if !ok {
+		return errors.New("distributor can't prepare a clean")
+	}
+	return cp.ConfirmClean(token)
+}
@@ -0,0 +1,153 @@
+// Command fscachectl administers fscache directories and clusters.
+//
+// Usage:
+//
+//	fscachectl rebalance -dir DIR -nodes ADDR,ADDR,... [-self ADDR] [flags]
+//
+// rebalance moves the entries of the cache directory DIR to the nodes of a cluster which
+// NewDistributor places them on, after nodes are added or removed, so that they are found
+// there instead of being filled again on a miss. -nodes lists the servers of the cluster
+// after the change, in the order its clients pass them to NewDistributor, and -self is
+// DIR's own entry in that list. Leave -self out to move every entry off a node which is
+// leaving the cluster. The directory is locked while it runs, so stop the node's server
+// first. Keys are placed as the cache stores them, see fscache.FSCache.Rebalance.
+//
+// The flags of rebalance are:
+//
+//	-bps 10M        copy at most this many bytes per second, with an optional K, M or G suffix
+//	-progress 10s   how often to report progress, 0 reports only when done
+//	-resolve 30s    how often to resolve the nodes' host names, see RemoteResolveInterval
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djherbis/fscache"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "fscachectl:", err)
+		os.Exit(1)
+	}
+}
+
+const usage = "usage: fscachectl rebalance -dir DIR -nodes ADDR,ADDR,... [-self ADDR] [-bps N] [-progress D] [-resolve D]"
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "rebalance":
+		return rebalance(args[1:], stdout, stderr)
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
+
+func rebalance(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		dir      = flags.String("dir", "", "the cache directory to move entries from")
+		nodes    = flags.String("nodes", "", "the cluster's servers after the change, comma separated, in placement order")
+		self     = flags.String("self", "", "the directory's own server in -nodes, if it stays in the cluster")
+		bps      = flags.String("bps", "0", "bytes copied per second, with an optional K, M or G suffix, 0 means no limit")
+		interval = flags.Duration("progress", 10*time.Second, "how often to report progress, 0 reports only when done")
+		resolve  = flags.Duration("resolve", 0, "how often to resolve the nodes' host names, 0 leaves it to the system")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" || *nodes == "" {
+		return errors.New(usage)
+	}
+	rate, err := parseBytes(*bps)
+	if err != nil {
+		return fmt.Errorf("bad -bps: %v", err)
+	}
+
+	if _, err := os.Stat(*dir); err != nil {
+		return err
+	}
+	fs, err := fscache.NewFs(*dir, 0700)
+	if err != nil {
+		return err
+	}
+	if err := fs.Lock(nil); err != nil {
+		return err
+	}
+	defer fs.Close()
+	c, err := fscache.NewCache(fs, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var opts []fscache.RemoteOption
+	if *resolve > 0 {
+		opts = append(opts, fscache.RemoteResolveInterval(*resolve))
+	}
+	var caches []fscache.Cache
+	for _, addr := range strings.Split(*nodes, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if addr == *self {
+			caches = append(caches, c)
+		} else {
+			caches = append(caches, fscache.NewRemote(addr, opts...))
+		}
+	}
+
+	report := func(p fscache.RebalanceProgress) {
+		fmt.Fprintf(stdout, "scanned %d/%d keys, moved %d entries, %d bytes\n", p.Scanned, p.Keys, p.Moved, p.Bytes)
+	}
+	last := time.Now()
+	p, err := c.Rebalance(fscache.NewDistributor(caches...), fscache.RebalanceOptions{
+		BytesPerSecond: rate,
+		Progress: func(p fscache.RebalanceProgress) {
+			if *interval > 0 && time.Since(last) >= *interval {
+				last = time.Now()
+				report(p)
+			}
+		},
+	})
+	report(p)
+	return err
+}
+
+// parseBytes parses a count of bytes, with an optional K, M or G suffix for powers of 1024.
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("negative size")
+	}
+	return n << shift, nil
+}
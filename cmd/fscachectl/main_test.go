@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/djherbis/fscache"
+)
+
+func waitForServer(t *testing.T, addr string) {
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fill writes n entries into a new cache directory, and returns it and the keys.
+func fill(t *testing.T, n int) (string, []string) {
+	dir, err := ioutil.TempDir("", "fscachectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := fscache.New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+		keys = append(keys, key)
+	}
+	return dir, keys
+}
+
+func TestRebalance(t *testing.T) {
+	dir, keys := fill(t, 20)
+	defer os.RemoveAll(dir)
+
+	node, err := fscache.NewCache(fscache.NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fscache.Server{Cache: node}
+	go srv.ListenAndServe("localhost:10030")
+	defer srv.Shutdown(context.Background())
+	waitForServer(t, "localhost:10030")
+
+	var out bytes.Buffer
+	args := []string{"rebalance", "-dir", dir, "-self", "me:1", "-nodes", "me:1,localhost:10030", "-bps", "1M", "-progress", "0"}
+	if err := run(args, &out, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := fscache.New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := fscache.NewDistributor(local, node)
+	moved := 0
+	for _, key := range keys {
+		stay := d.GetCache(key) == fscache.Cache(local)
+		if !stay {
+			moved++
+		}
+		if local.Exists(key) != stay || node.Exists(key) == stay {
+			t.Errorf("expected %s to be on one node, the one it's placed on", key)
+		}
+	}
+	if want := fmt.Sprintf("scanned 20/20 keys, moved %d entries, ", moved); !strings.HasPrefix(out.String(), want) {
+		t.Errorf("expected a report like %q, got %q", want, out.String())
+	}
+
+	// without -self, every entry leaves the directory.
+	local.Close()
+	if err := run([]string{"rebalance", "-dir", dir, "-nodes", "localhost:10030", "-progress", "0"}, &out, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !node.Exists(key) {
+			t.Errorf("expected %s to be moved", key)
+		}
+	}
+
+	if err := run([]string{"rebalance", "-dir", dir}, &out, &out); err == nil {
+		t.Error("expected -nodes to be required")
+	}
+	if err := run([]string{"rebalance", "-dir", dir, "-nodes", "localhost:10030", "-bps", "fast"}, &out, &out); err == nil {
+		t.Error("expected a bad -bps to be refused")
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for s, want := range map[string]int64{"0": 0, "512": 512, "10K": 10 << 10, "3m": 3 << 20, "1G": 1 << 30} {
+		if got, err := parseBytes(s); err != nil || got != want {
+			t.Errorf("expected %s to be %d, got %d, %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"", "-1", "M", "1T"} {
+		if _, err := parseBytes(s); err == nil {
+			t.Errorf("expected %q to be refused", s)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package fscache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// ErrMissingPart is returned when a part of a composite entry is no longer cached,
+// e.g. because it was evicted. PutComposite fills it again.
+var ErrMissingPart = errors.New("fscache: part of composite entry is missing")
+
+// compositeManifest is the data of the entry of a composite object.
+type compositeManifest struct {
+	Parts []compositePart `json:"parts"`
+}
+
+type compositePart struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// PutComposite stores the object key in c as a manifest of the entries parts, in order, so
+// that a very large object can be filled by parallel workers. The parts which aren't cached
+// are filled by calling fill, running at most concurrency fills at once; parts which are
+// cached are reused, so keys which identify the content of a part, e.g. its digest, let a new
+// version of an object share the parts which didn't change. The manifest replaces the
+// entry of key once every part is complete. If a fill fails its part is removed, the
+// manifest isn't written, and the first error is returned.
+func PutComposite(c Cache, key string, parts []string, fill func(part string, w io.Writer) error, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		grp  sync.WaitGroup
+		mu   sync.Mutex
+		err1 error
+	)
+	manifest := compositeManifest{Parts: make([]compositePart, len(parts))}
+	sem := make(chan struct{}, concurrency)
+	for i, part := range parts {
+		sem <- struct{}{}
+		grp.Add(1)
+		go func(i int, part string) {
+			defer grp.Done()
+			defer func() { <-sem }()
+			size, err := putPart(c, part, fill)
+			mu.Lock()
+			defer mu.Unlock()
+			manifest.Parts[i] = compositePart{Key: part, Size: size}
+			if err != nil && err1 == nil {
+				err1 = err
+			}
+		}(i, part)
+	}
+	grp.Wait()
+	if err1 != nil {
+		return err1
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := c.Remove(key); err != nil {
+		return err
+	}
+	r, w, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	if w == nil {
+		return fmt.Errorf("fscache: composite entry %q was filled concurrently", key)
+	}
+	if _, err := w.Write(data); err != nil {
+		abandonFill(c, key, w)
+		return err
+	}
+	return w.Close()
+}
+
+// putPart fills part if it isn't cached, and returns its size.
+func putPart(c Cache, part string, fill func(part string, w io.Writer) error) (int64, error) {
+	if fc, ok := c.(*FSCache); ok {
+		if size := fc.completeSize(part); size >= 0 {
+			return size, nil
+		}
+	}
+	r, w, err := c.Get(part)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if w == nil {
+		// cached, or being filled by someone else: its size is known once it is complete.
+		return io.Copy(ioutil.Discard, r)
+	}
+	cw := &countingWriter{w: w}
+	if err := fill(part, cw); err != nil {
+		abandonFill(c, part, w)
+		return 0, err
+	}
+	return cw.n, w.Close()
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// OpenComposite returns a reader of the object key stored by PutComposite, which reads
+// its parts in turn. Reading a part which is no longer cached fails with ErrMissingPart.
+func OpenComposite(c Cache, key string) (ReadAtCloser, error) {
+	r, w, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		r.Close()
+		abandonFill(c, key, w)
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var manifest compositeManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("fscache: bad composite manifest %q: %v", key, err)
+	}
+	cr := &compositeReader{
+		c:       c,
+		parts:   manifest.Parts,
+		offsets: make([]int64, len(manifest.Parts)+1),
+		readers: make([]ReadAtCloser, len(manifest.Parts)),
+	}
+	for i, p := range manifest.Parts {
+		cr.offsets[i+1] = cr.offsets[i] + p.Size
+	}
+	return cr, nil
+}
+
+// compositeReader reads an object from its parts, which it opens as they are needed.
+type compositeReader struct {
+	c       Cache
+	parts   []compositePart
+	offsets []int64 // offsets[i] is where part i starts, the last is the size of the object
+
+	mu      sync.Mutex
+	readers []ReadAtCloser
+	off     int64
+}
+
+// part returns the reader of part i.
+func (r *compositeReader) part(i int) (ReadAtCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readers[i] != nil {
+		return r.readers[i], nil
+	}
+	key := r.parts[i].Key
+	pr, w, err := r.c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		pr.Close()
+		abandonFill(r.c, key, w)
+		return nil, ErrMissingPart
+	}
+	r.readers[i] = pr
+	return pr, nil
+}
+
+func (r *compositeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	size := r.offsets[len(r.offsets)-1]
+	for n < len(p) && off < size {
+		// the part which holds off
+		i := sort.Search(len(r.parts), func(i int) bool { return r.offsets[i+1] > off })
+		pr, err := r.part(i)
+		if err != nil {
+			return n, err
+		}
+		end := len(p) - n
+		if left := r.offsets[i+1] - off; int64(end) > left {
+			end = int(left)
+		}
+		k, err := pr.ReadAt(p[n:n+end], off-r.offsets[i])
+		n += k
+		off += int64(k)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if k < end {
+			return n, ErrMissingPart
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *compositeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *compositeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for _, pr := range r.readers {
+		if pr != nil {
+			if err2 := pr.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	return err
+}
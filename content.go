@@ -0,0 +1,104 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"sync"
+
+	"github.com/djherbis/stream"
+)
+
+// ContentKeyPrefix prefixes the keys of entries written by a ContentWriter,
+// the rest of the key is the hex encoded sha256 of the entry's content.
+const ContentKeyPrefix = "sha256:"
+
+// ContentWriter writes an entry whose key is derived from its content.
+// Nothing is visible in the cache until Commit is called.
+type ContentWriter struct {
+	mu     sync.Mutex
+	c      *FSCache
+	staged *stagedFile
+	h      hash.Hash
+	done   bool
+}
+
+// NewContentWriter returns a ContentWriter which streams a new entry into the cache,
+// hashing it as it is written. The FileSystem must be a FileSystemRenamer.
+func (c *FSCache) NewContentWriter() (*ContentWriter, error) {
+	s, err := c.newStaged()
+	if err != nil {
+		return nil, err
+	}
+	return &ContentWriter{
+		c:      c,
+		staged: s,
+		h:      sha256.New(),
+	}, nil
+}
+
+// Write writes p to the entry.
+func (w *ContentWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return 0, errors.New("write after commit or close")
+	}
+	n, err := w.staged.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+// Commit finishes the entry and makes it available under the returned key.
+// If an entry with the same content is already cached, the written data is
+// discarded and the existing entry is kept. If that entry is being removed, the
+// data is discarded and Commit returns stream.ErrRemoving.
+func (w *ContentWriter) Commit() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return "", errors.New("commit after commit or close")
+	}
+	w.done = true
+	key := ContentKeyPrefix + hex.EncodeToString(w.h.Sum(nil))
+
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		w.staged.abort()
+		return "", ErrClosed
+	}
+	mapped := c.mapKey(key)
+	c.keepContent(mapped)
+	if _, ok := c.files[mapped]; ok {
+		w.staged.abort()
+		return key, nil
+	}
+	if c.removing[mapped] > 0 {
+		// the removal would delete the committed file.
+		w.staged.abort()
+		return "", stream.ErrRemoving
+	}
+	name, err := w.staged.commit(mapped)
+	if err != nil {
+		return "", err
+	}
+	c.setFile(mapped, c.oldFile(name))
+	c.bump(mapped)
+	c.emit(EventCreate, mapped, nil)
+	c.emit(EventWrite, mapped, c.files[mapped])
+	return key, nil
+}
+
+// Close discards the entry if it has not been committed.
+func (w *ContentWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		w.done = true
+		w.staged.abort()
+	}
+	return nil
+}
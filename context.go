@@ -0,0 +1,55 @@
+package fscache
+
+import (
+	"context"
+
+	"github.com/djherbis/stream"
+)
+
+// nextContext is f.next, opening the File of a reloaded entry with ctx.
+func nextContext(ctx context.Context, f fileStream) (*CacheReader, error) {
+	if rf, ok := f.(*reloadedFile); ok {
+		return rf.nextContext(ctx)
+	}
+	return f.next()
+}
+
+// createContextFS creates Files with ctx, a stream keeps its FileSystem to open its
+// readers later, so only Create uses it.
+type createContextFS struct {
+	FileSystem
+	cfs FileSystemContext
+	ctx context.Context
+}
+
+func (fs createContextFS) Create(key string) (stream.File, error) {
+	return fs.cfs.CreateContext(fs.ctx, key)
+}
+
+// withContext runs op, returning ctx's error once ctx is done. A File op returns after
+// that is passed to abandon.
+func withContext(ctx context.Context, op func() (stream.File, error), abandon func(f stream.File)) (stream.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		f   stream.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := op()
+		done <- result{f, err}
+	}()
+	select {
+	case res := <-done:
+		return res.f, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				abandon(res.f)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package fscache
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]func(io.Reader) (io.ReadCloser, error){
+		"gzip": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.ReadCloser, error) {
+			// deflate is zlib wrapped, though some servers send it raw.
+			br := bufio.NewReader(r)
+			if b, err := br.Peek(2); err == nil && (uint16(b[0])<<8|uint16(b[1]))%31 == 0 && b[0]&0x0f == 8 {
+				return zlib.NewReader(br)
+			}
+			return flate.NewReader(br), nil
+		},
+	}
+)
+
+// RegisterDecoder makes Handler and NewIdentityReader decompress entries stored with the
+// Content-Encoding encoding with dec, e.g. a zstd decoder for "zstd". gzip and deflate are
+// registered already.
+func RegisterDecoder(encoding string, dec func(io.Reader) (io.ReadCloser, error)) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[strings.ToLower(encoding)] = dec
+}
+
+func decoder(encoding string) (func(io.Reader) (io.ReadCloser, error), bool) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	dec, ok := decoders[strings.ToLower(strings.TrimSpace(encoding))]
+	return dec, ok
+}
+
+// NewIdentityReader returns a reader of the data of r, an entry's reader, decompressed if
+// Handler stored it with a Content-Encoding, see RegisterDecoder. Entries without one, or
+// whose cache can't store metadata, are read as they are. It returns an error if the entry
+// uses an encoding which has no decoder. Closing the reader closes r.
+func NewIdentityReader(r ReadAtCloser) (io.ReadCloser, error) {
+	mr, ok := r.(MetadataReader)
+	if !ok {
+		return r, nil
+	}
+	// the writer saves the headers before writing the body, so they're available once it has data.
+	br := bufio.NewReader(r)
+	br.Peek(1)
+	var hdr cachedHeader
+	if meta, _ := mr.Metadata(); meta != nil {
+		_ = json.Unmarshal(meta, &hdr)
+	}
+	body := readCloser{Reader: br, Closer: r}
+	enc := hdr.Header.Get("Content-Encoding")
+	if enc == "" || strings.EqualFold(enc, "identity") {
+		return body, nil
+	}
+	dec, ok := decoder(enc)
+	if !ok {
+		r.Close()
+		return nil, fmt.Errorf("fscache: no decoder for content encoding %q", enc)
+	}
+	dr, err := dec(br)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return readCloser{Reader: dr, Closer: closers{dr, r}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes each of its Closers, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// acceptsEncoding reports whether req accepts a response with the Content-Encoding enc.
+// A request without Accept-Encoding accepts any encoding.
+func acceptsEncoding(req *http.Request, enc string) bool {
+	values, ok := req.Header["Accept-Encoding"]
+	if !ok {
+		return true
+	}
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name != enc && name != "*" {
+				continue
+			}
+			rejected := false
+			for _, param := range fields[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+				if strings.HasPrefix(param, "q=") && strings.Trim(param[2:], "0.") == "" {
+					rejected = true
+				}
+			}
+			return !rejected
+		}
+	}
+	return false
+}
+
+// decodeBody returns a decompressing reader of body, and removes the Content-Encoding from h,
+// if the encoding stored in h isn't accepted by req and can be decoded. Otherwise it returns nil.
+func decodeBody(req *http.Request, h http.Header, body io.Reader) (io.ReadCloser, error) {
+	enc := h.Get("Content-Encoding")
+	if enc == "" || strings.EqualFold(enc, "identity") || acceptsEncoding(req, enc) {
+		return nil, nil
+	}
+	dec, ok := decoder(enc)
+	if !ok {
+		return nil, nil
+	}
+	dr, err := dec(body)
+	if err != nil {
+		return nil, err
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return dr, nil
+}
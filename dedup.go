@@ -0,0 +1,115 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// dedupIndex tracks the content hash of completed entries, so that entries with
+// the same content can share storage.
+type dedupIndex struct {
+	byDigest map[string]map[string]bool // digest => keys with that content
+	byKey    map[string]string          // key => digest
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{
+		byDigest: make(map[string]map[string]bool),
+		byKey:    make(map[string]string),
+	}
+}
+
+func (d *dedupIndex) add(key, digest string) {
+	keys, ok := d.byDigest[digest]
+	if !ok {
+		keys = make(map[string]bool)
+		d.byDigest[digest] = keys
+	}
+	keys[key] = true
+	d.byKey[key] = digest
+}
+
+func (d *dedupIndex) remove(key string) {
+	digest, ok := d.byKey[key]
+	if !ok {
+		return
+	}
+	delete(d.byKey, key)
+	if keys := d.byDigest[digest]; len(keys) <= 1 {
+		delete(d.byDigest, digest)
+	} else {
+		delete(keys, key)
+	}
+}
+
+// SetDedup makes entries with identical content share storage. Entries are hashed as
+// they're written, and when a writer closes, its entry is replaced by a link to an
+// existing entry with the same content. Each key still removes independently, the shared
+// data is freed once the last key using it is gone.
+// The FileSystem must be a FileSystemLinker and a FileSystemRenamer, otherwise SetDedup has no effect.
+// Only entries written since SetDedup(true) was called are deduplicated.
+func (c *FSCache) SetDedup(enabled bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, linker := c.fs.(FileSystemLinker)
+	_, renamer := c.fs.(FileSystemRenamer)
+	if !enabled || !linker || !renamer {
+		c.dedup = nil
+	} else if c.dedup == nil {
+		c.dedup = newDedupIndex()
+	}
+	return c
+}
+
+// newDedupHash returns the hash new entries should be fed, or nil. c.mu must be held.
+func (c *FSCache) newDedupHash() hash.Hash {
+	if c.dedup == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+// dedupFile shares the storage of f, whose writer was just closed, with an
+// existing entry of the same content. c.mu must be held.
+func (c *FSCache) dedupFile(f *cachedFile, digest string) {
+	for other := range c.dedup.byDigest[digest] {
+		of, ok := c.files[other]
+		if !ok || !of.complete() {
+			continue
+		}
+		if name, err := c.share(of.Name(), f.Name(), f.key); err == nil {
+			c.setFile(f.key, c.oldFile(name))
+		}
+		break
+	}
+	c.dedup.add(f.key, digest)
+}
+
+// share replaces cur, the file of key, with a link to the file name.
+// The metadata of cur is kept. c.mu must be held.
+func (c *FSCache) share(name, cur, key string) (string, error) {
+	s, err := c.stagedKey()
+	if err != nil {
+		return "", err
+	}
+	linked, err := c.fs.(FileSystemLinker).Link(name, s)
+	if err != nil {
+		return "", err
+	}
+	if m, ok := c.fs.(FileSystemMetadata); ok {
+		meta, err := m.ReadMetadata(cur)
+		if err == nil {
+			err = m.WriteMetadata(linked, meta)
+		}
+		if err != nil {
+			_ = c.fs.Remove(linked)
+			return "", err
+		}
+	}
+	shared, err := c.fs.(FileSystemRenamer).Rename(linked, key)
+	if err != nil {
+		_ = c.fs.Remove(linked)
+		return "", err
+	}
+	return shared, nil
+}
@@ -0,0 +1,246 @@
+package fscache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// RemoteOption configures a Cache returned by NewRemote.
+type RemoteOption func(*remote)
+
+// RemoteResolveInterval makes the remote Cache resolve the server's host name itself, at
+// most once every d, and spread its requests over all of the resolved addresses in turn.
+// A failed dial makes the next request resolve the name again, so that requests move
+// off addresses which have gone away, e.g. when the servers behind the name are rescaled.
+// By default every request dials the name, leaving resolution to the system.
+func RemoteResolveInterval(d time.Duration) RemoteOption {
+	return func(rmt *remote) { rmt.resolveInterval = d }
+}
+
+// RemoteFallbackAddrs adds the addresses of replicas of the server, which are dialed
+// in order when the server can't be, so that a single unreachable address doesn't
+// fail the request.
+func RemoteFallbackAddrs(addrs ...string) RemoteOption {
+	return func(rmt *remote) { rmt.fallbacks = append(rmt.fallbacks, addrs...) }
+}
+
+// RemoteFallbackDelay sets how long a dial waits for an address before it also starts
+// dialing the next one, racing them as in RFC 8305 (Happy Eyeballs). It is 300ms by default,
+// a negative d waits for each dial to fail before starting the next.
+func RemoteFallbackDelay(d time.Duration) RemoteOption {
+	return func(rmt *remote) { rmt.fallbackDelay = d }
+}
+
+// RemoteChunkSize makes the remote Cache stream the entries it fills to the server in
+// Packets of size bytes, sending a partial Packet once it has waited for flushInterval,
+// see protocol.NewChunkEncoder. By default each write to the entry is sent as a Packet.
+func RemoteChunkSize(size int, flushInterval time.Duration) RemoteOption {
+	return func(rmt *remote) { rmt.chunkSize, rmt.flushInterval = size, flushInterval }
+}
+
+// RemoteHeaders makes the remote Cache ask the server to describe cached entries before
+// sending them, so their readers are HeaderReaders and MetadataReaders, see
+// protocol.ActionGetHeader. The server must understand ActionGetHeader.
+func RemoteHeaders() RemoteOption {
+	return func(rmt *remote) { rmt.headers = true }
+}
+
+// defaultFallbackDelay is the connection attempt delay recommended by RFC 8305.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// dialer opens the connection for a single request to a remote server.
+type dialer interface {
+	DialContext(ctx context.Context) (net.Conn, error)
+}
+
+// newDialer returns the dialer for rmt's options.
+func (rmt *remote) newDialer() dialer {
+	d := &multiDialer{delay: rmt.fallbackDelay}
+	for _, addr := range append([]string{rmt.raddr}, rmt.fallbacks...) {
+		t := &dialTarget{addr: addr}
+		if host, port, err := net.SplitHostPort(addr); err == nil && rmt.resolveInterval > 0 {
+			t.host, t.port = host, port
+			t.interval = rmt.resolveInterval
+			t.lookup = net.DefaultResolver.LookupHost
+		}
+		d.targets = append(d.targets, t)
+	}
+	return d
+}
+
+// dialTarget is one address of the server, which may be resolved periodically
+// into several addresses which are used in turn.
+type dialTarget struct {
+	addr       string
+	host, port string
+	interval   time.Duration // 0 leaves resolving addr to net.Dialer
+	lookup     func(ctx context.Context, host string) ([]string, error)
+
+	mu       sync.Mutex
+	addrs    []string
+	resolved time.Time
+	next     int
+}
+
+// candidates returns the addresses to dial for t, rotated so that successive
+// calls start with a different one.
+func (t *dialTarget) candidates(ctx context.Context) ([]string, error) {
+	if t.interval <= 0 {
+		return []string{t.addr}, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.addrs) == 0 || time.Since(t.resolved) >= t.interval {
+		addrs, err := t.lookup(ctx, t.host)
+		if err != nil && len(t.addrs) == 0 {
+			return nil, err
+		}
+		if err == nil && len(addrs) > 0 {
+			t.addrs = addrs
+		}
+		t.resolved = time.Now()
+	}
+	start := t.next % len(t.addrs)
+	t.next++
+	out := make([]string, 0, len(t.addrs))
+	for i := range t.addrs {
+		out = append(out, net.JoinHostPort(t.addrs[(start+i)%len(t.addrs)], t.port))
+	}
+	return out, nil
+}
+
+// expire makes the next call to candidates resolve the host again.
+func (t *dialTarget) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resolved = time.Time{}
+}
+
+// multiDialer dials the addresses of its targets in order, racing them after delay.
+type multiDialer struct {
+	targets []*dialTarget
+	delay   time.Duration
+}
+
+type dialAttempt struct {
+	addr   string
+	target *dialTarget
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	attempt dialAttempt
+}
+
+func (d *multiDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	var (
+		attempts []dialAttempt
+		firstErr error
+	)
+	for _, t := range d.targets {
+		addrs, err := t.candidates(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		var primary []dialAttempt
+		for _, addr := range addrs {
+			primary = append(primary, dialAttempt{addr: addr, target: t})
+		}
+		attempts = append(attempts, interleaveFamilies(primary)...)
+	}
+	if len(attempts) == 0 {
+		return nil, firstErr
+	}
+	return d.race(ctx, attempts)
+}
+
+// race dials attempts in order, starting the next one whenever the last fails or
+// delay passes, and returns the first connection made.
+func (d *multiDialer) race(ctx context.Context, attempts []dialAttempt) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := d.delay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	results := make(chan dialResult, len(attempts))
+	start := func(a dialAttempt) <-chan time.Time {
+		go func() {
+			var nd net.Dialer
+			c, err := nd.DialContext(ctx, "tcp", a.addr)
+			results <- dialResult{conn: c, err: err, attempt: a}
+		}()
+		if delay < 0 {
+			return nil
+		}
+		return time.After(delay)
+	}
+
+	next, pending := 1, 1
+	timeout := start(attempts[0])
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go closeDials(results, pending)
+				return r.conn, nil
+			}
+			r.attempt.target.expire()
+			lastErr = r.err
+		case <-timeout:
+		}
+		if next < len(attempts) {
+			timeout = start(attempts[next])
+			next++
+			pending++
+		}
+	}
+	return nil, lastErr
+}
+
+// closeDials closes the connections of the n dials still running once one has won the race.
+func closeDials(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies orders attempts to alternate between IPv6 and IPv4 addresses,
+// starting with the family of the first, as RFC 8305 recommends.
+func interleaveFamilies(attempts []dialAttempt) []dialAttempt {
+	var first, second []dialAttempt
+	for _, a := range attempts {
+		if isIPv6(a.addr) == isIPv6(attempts[0].addr) {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	out := make([]dialAttempt, 0, len(attempts))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+func isIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,197 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// directBufSize is the size of the aligned buffers direct I/O reads and writes go through.
+const directBufSize = 1 << 20
+
+// alignedBuffer returns a buffer of size bytes whose address is a multiple of directAlign.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlign); rem != 0 {
+		off = directAlign - rem
+	}
+	return buf[off : off+size]
+}
+
+// fder is a File with an os file descriptor, an *os.File or a tmpFile.
+type fder interface {
+	syncer
+	Fd() uintptr
+}
+
+// directWriter writes a File through the page cache until it reaches the StandardFS's
+// DirectIOSize, and bypasses it with aligned writes from then on. Each Write writes its
+// whole blocks, so the entry's readers see them, and holds a partial last block until it
+// is filled or the File is closed.
+type directWriter struct {
+	fder
+	fs      *StandardFS
+	written int64
+	direct  bool
+	cached  bool // the platform refused direct I/O, so the page cache is used throughout
+	buf     []byte
+	n       int
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	var written int
+	if !w.direct {
+		if w.cached || w.written+int64(len(p)) < w.fs.DirectIOSize {
+			n, err := w.fder.Write(p)
+			w.written += int64(n)
+			return n, err
+		}
+		// the switch needs an aligned offset, so write up to it through the page cache.
+		m := int((directAlign - w.written%directAlign) % directAlign)
+		if m > len(p) {
+			m = len(p)
+		}
+		n, err := w.fder.Write(p[:m])
+		w.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+		written, p = m, p[m:]
+		if w.written%directAlign != 0 {
+			return written, nil
+		}
+		if err := setDirect(w.Fd(), true); err != nil {
+			w.cached = true
+			n, err := w.fder.Write(p)
+			w.written += int64(n)
+			return written + n, err
+		}
+		w.direct = true
+		w.buf = alignedBuffer(directBufSize)
+	}
+
+	for len(p) > 0 {
+		m := copy(w.buf[w.n:], p)
+		w.n += m
+		written += m
+		p = p[m:]
+		if err := w.flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// flush writes the whole blocks of the buffer.
+func (w *directWriter) flush() error {
+	k := w.n &^ (directAlign - 1)
+	if k == 0 {
+		return nil
+	}
+	n, err := w.fder.Write(w.buf[:k])
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	w.n = copy(w.buf, w.buf[k:w.n])
+	return nil
+}
+
+func (w *directWriter) Sync() error {
+	if w.direct {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	return w.fder.Sync()
+}
+
+// Close writes the last partial block through the page cache, since direct writes are whole blocks.
+func (w *directWriter) Close() error {
+	var err error
+	if w.direct {
+		err = w.flush()
+		if err == nil {
+			err = setDirect(w.Fd(), false)
+		}
+		if err == nil && w.n > 0 {
+			_, err = w.fder.Write(w.buf[:w.n])
+		}
+	}
+	if cerr := w.fder.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// directBufs holds aligned buffers of directBufSize bytes for directReaders.
+var directBufs = sync.Pool{New: func() interface{} { return alignedBuffer(directBufSize) }}
+
+// directReader reads a File bypassing the page cache, with aligned reads.
+type directReader struct {
+	f   *os.File
+	off int64
+}
+
+func (r *directReader) Name() string               { return r.f.Name() }
+func (r *directReader) Close() error               { return r.f.Close() }
+func (r *directReader) Stat() (os.FileInfo, error) { return r.f.Stat() }
+
+func (r *directReader) Write(p []byte) (int, error) {
+	return 0, errors.New("file is read only")
+}
+
+func (r *directReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *directReader) ReadAt(p []byte, off int64) (int, error) {
+	buf := directBufs.Get().([]byte)
+	defer directBufs.Put(buf)
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		start := pos &^ (directAlign - 1)
+		size := int(pos-start) + len(p) - n
+		if size > len(buf) {
+			size = len(buf)
+		}
+		size = (size + directAlign - 1) &^ (directAlign - 1)
+		m, err := r.f.ReadAt(buf[:size], start)
+		if skip := int(pos - start); m > skip {
+			n += copy(p[n:], buf[skip:m])
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if m < size {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// openDirect opens name for reading without the page cache, if it is a File of at least
+// DirectIOSize bytes and the platform allows it.
+func (fs *StandardFS) openDirect(path string) (*directReader, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() < fs.DirectIOSize || setDirect(f.Fd(), true) != nil {
+		f.Close()
+		return nil, false
+	}
+	return &directReader{f: f}, true
+}
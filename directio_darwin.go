@@ -0,0 +1,18 @@
+package fscache
+
+import "syscall"
+
+// directAlign is 1, since F_NOCACHE has no alignment requirements.
+const directAlign = 1
+
+// setDirect turns F_NOCACHE on or off for fd.
+func setDirect(fd uintptr, on bool) error {
+	var v uintptr
+	if on {
+		v = 1
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_NOCACHE, v); errno != 0 {
+		return errno
+	}
+	return nil
+}
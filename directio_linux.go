@@ -0,0 +1,24 @@
+package fscache
+
+import "syscall"
+
+// directAlign is the alignment of O_DIRECT buffers, offsets and sizes, the logical
+// block size of most devices is a divisor of it.
+const directAlign = 4096
+
+// setDirect turns O_DIRECT on or off for fd.
+func setDirect(fd uintptr, on bool) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if on {
+		flags |= syscall.O_DIRECT
+	} else {
+		flags &^= syscall.O_DIRECT
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package fscache
+
+const directAlign = 1
+
+func setDirect(fd uintptr, on bool) error { return ErrUnsupported }
@@ -0,0 +1,118 @@
+package fscache
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrLowDiskSpace is returned by StandardFS.Create when the free space of the cache's
+// volume is below MinFree.
+var ErrLowDiskSpace = errors.New("free disk space is below the minimum")
+
+// FreeSpace returns how many bytes are available to unprivileged users on the volume which
+// holds the cache directory. It returns ErrUnsupported on platforms where it isn't known.
+func (fs *StandardFS) FreeSpace() (int64, error) {
+	free, _, err := diskSpace(fs.root)
+	return free, err
+}
+
+// DiskSpace returns how many bytes are available to unprivileged users on the volume which
+// holds the cache directory, and the size of the volume. It returns ErrUnsupported on
+// platforms where they aren't known.
+func (fs *StandardFS) DiskSpace() (free, total int64, err error) {
+	return diskSpace(fs.root)
+}
+
+// checkFree returns ErrLowDiskSpace if MinFree is set and there is less free space.
+func (fs *StandardFS) checkFree() error {
+	if fs.MinFree <= 0 {
+		return nil
+	}
+	free, err := fs.FreeSpace()
+	if err != nil || free >= fs.MinFree {
+		return nil
+	}
+	return ErrLowDiskSpace
+}
+
+type minFreeHaunter struct {
+	haunter Haunter
+	minFree func(total int64) int64
+	space   func() (free, total int64, err error)
+}
+
+// NewMinFreeHaunter returns a Haunter which runs h, then evicts the least recently read
+// entries until free reports at least minFree bytes, e.g. StandardFS.FreeSpace. It stops
+// a cache from filling its volume, even between h's evictions if it runs more often.
+// Entries which are in use are kept.
+func NewMinFreeHaunter(h Haunter, minFree int64, free func() (int64, error)) Haunter {
+	return &minFreeHaunter{
+		haunter: h,
+		minFree: func(int64) int64 { return minFree },
+		space: func() (int64, int64, error) {
+			n, err := free()
+			return n, 0, err
+		},
+	}
+}
+
+// NewFreePercentHaunter returns a Haunter like NewMinFreeHaunter, which keeps percent (0 to
+// 100) of the volume free, as reported by space, e.g. StandardFS.DiskSpace, rather than a
+// fixed number of bytes, so that the cache shrinks as other users of the volume grow.
+func NewFreePercentHaunter(h Haunter, percent float64, space func() (free, total int64, err error)) Haunter {
+	return &minFreeHaunter{
+		haunter: h,
+		minFree: func(total int64) int64 { return int64(float64(total) * percent / 100) },
+		space:   space,
+	}
+}
+
+func (h *minFreeHaunter) Haunt(c CacheAccessor) {
+	h.haunter.Haunt(c)
+	free, total, err := h.space()
+	if err != nil {
+		return
+	}
+	minFree := h.minFree(total)
+	if free >= minFree {
+		return
+	}
+
+	type entry struct {
+		key  string
+		size int64
+		read time.Time
+	}
+	var entries []entry
+	c.EnumerateEntries(func(key string, e Entry) bool {
+		if e.InUse() {
+			return true
+		}
+		if fi, err := c.Stat(e.Name()); err == nil {
+			entries = append(entries, entry{key: key, size: fi.Size(), read: fi.AccessTime()})
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].read.Before(entries[j].read) })
+
+	// the files may be removed in the background, so count what they free rather than stat again.
+	for _, e := range entries {
+		if free >= minFree {
+			break
+		}
+		c.RemoveFile(e.key)
+		free += e.size
+	}
+}
+
+func (h *minFreeHaunter) Next() time.Duration {
+	return h.haunter.Next()
+}
+
+func (h *minFreeHaunter) ExpiresAt(key string, lastRead, lastWrite time.Time) (time.Time, bool) {
+	if e, ok := h.haunter.(Expirer); ok {
+		return e.ExpiresAt(key, lastRead, lastWrite)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,11 @@
+package fscache
+
+import "syscall"
+
+func diskSpace(dir string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.F_bavail) * int64(st.F_bsize), int64(st.F_blocks) * int64(st.F_bsize), nil
+}
@@ -0,0 +1,6 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!windows
+
+package fscache
+
+func diskSpace(dir string) (free, total int64, err error) { return 0, 0, ErrUnsupported }
@@ -17,6 +17,25 @@ type Distributor interface {
 	Clean() error
 }
 
+// PlacementAlgorithm names the key to cache mapping used by NewDistributor, and
+// PlacementVersion changes whenever that mapping does. Servers report both,
+// see RemotePlacement, so clients in other languages can check that they
+// place keys the same way.
+const (
+	PlacementAlgorithm = "sha1-uvarint-mod"
+	PlacementVersion   = 1
+)
+
+// Placement returns the index of the cache out of n which NewDistributor assigns key to.
+//
+// The index is computed by taking the sha1 digest of the key's bytes, and decoding its
+// first 8 bytes as an unsigned LEB128 varint: each byte contributes its low 7 bits,
+// least significant group first, and decoding stops after the first byte whose high bit
+// is clear (if all 8 bytes have it set, all 56 bits are used). The result is that value modulo n.
+func Placement(key string, n int) int {
+	return int(stdDistribution(key, uint64(n)))
+}
+
 // stdDistribution distributes the keyspace evenly.
 func stdDistribution(key string, n uint64) uint64 {
 	h := sha1.New()
@@ -27,7 +46,8 @@ func stdDistribution(key string, n uint64) uint64 {
 }
 
 // NewDistributor returns a Distributor which evenly distributes the keyspace
-// into the passed caches.
+// into the passed caches. Its caches may be local, e.g. several FSCaches in one process
+// on directories of their own, to shard a busy cache: each has its own lock and haunter.
 func NewDistributor(caches ...Cache) Distributor {
 	if len(caches) == 0 {
 		return nil
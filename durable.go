@@ -0,0 +1,72 @@
+package fscache
+
+import (
+	"time"
+
+	"github.com/djherbis/stream"
+)
+
+// SyncPolicy is when a StandardFS flushes the Files it writes to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system, a crash may lose or truncate
+	// recently written Files. This is the default, and suits caches which can be refilled.
+	SyncNever SyncPolicy = iota
+
+	// SyncOnClose flushes each File when it is closed, so entries which were complete
+	// survive a crash.
+	SyncOnClose
+
+	// SyncPeriodic flushes each File at most every SyncInterval while it is written,
+	// and when it is closed.
+	SyncPeriodic
+)
+
+// defaultSyncInterval is the SyncInterval of SyncPeriodic when it isn't set.
+const defaultSyncInterval = time.Second
+
+// syncer is a File which can be flushed.
+type syncer interface {
+	stream.File
+	Sync() error
+}
+
+// syncFile flushes a File as its StandardFS's Sync policy says.
+type syncFile struct {
+	syncer
+	fs   *StandardFS
+	last time.Time
+}
+
+func (f *syncFile) Write(p []byte) (int, error) {
+	n, err := f.syncer.Write(p)
+	if err == nil && f.fs.Sync == SyncPeriodic {
+		interval := f.fs.SyncInterval
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		if now := time.Now(); now.Sub(f.last) >= interval {
+			f.last = now
+			err = f.syncer.Sync()
+		}
+	}
+	return n, err
+}
+
+func (f *syncFile) Close() error {
+	err := f.syncer.Sync()
+	if cerr := f.syncer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir flushes the cache directory, so that the names of Files created, renamed or
+// removed in it survive a crash, if SyncDir is set.
+func (fs *StandardFS) syncDir() error {
+	if !fs.SyncDir {
+		return nil
+	}
+	return syncDir(fs.root)
+}
@@ -0,0 +1,81 @@
+package fscache
+
+// EventType is the kind of activity an Event reports.
+type EventType string
+
+// Events sent by a cache.
+const (
+	// EventCreate is sent when a key is added to the cache.
+	EventCreate EventType = "create"
+
+	// EventWrite is sent when a key's writer is closed, Size is the final size of the entry.
+	EventWrite EventType = "write"
+
+	// EventRead is sent when a reader is opened on an existing key.
+	EventRead EventType = "read"
+
+	// EventEvict is sent when the cache's Haunter removes a key.
+	EventEvict EventType = "evict"
+
+	// EventRemove is sent when a key is removed by Remove, or a related method like Clean.
+	EventRemove EventType = "remove"
+
+	// EventOverSoftLimit is sent when the cache grows past a limit of SetSoftLimits, Key is
+	// the key whose change crossed it and Size is the cache's total size.
+	EventOverSoftLimit EventType = "oversoftlimit"
+
+	// EventUnderSoftLimit is sent when the cache is back within the limits of SetSoftLimits.
+	EventUnderSoftLimit EventType = "undersoftlimit"
+)
+
+// Event reports activity on a key in the cache.
+// Key is as the cache stores it, after SetKeyMapper's mapping.
+type Event struct {
+	Type EventType
+	Key  string
+	Size int64
+}
+
+// eventBuffer is the capacity of the channel returned by Events.
+const eventBuffer = 256
+
+// Events returns a channel of the cache's activity. Events are sent without
+// blocking, so they are dropped while the channel's buffer is full.
+// Every call returns the same channel, which is closed by Close.
+func (c *FSCache) Events() <-chan Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.events == nil {
+		c.events = make(chan Event, eventBuffer)
+		if c.closed {
+			close(c.events)
+		}
+	}
+	return c.events
+}
+
+// emit sends an Event for key if anyone is listening, f is the key's entry and
+// is used to find its size. c.mu must be held.
+func (c *FSCache) emit(typ EventType, key string, f fileStream) {
+	if c.events == nil || c.closed {
+		return
+	}
+	var size int64
+	if f != nil {
+		if fi, err := c.fs.Stat(f.Name()); err == nil {
+			size = fi.Size()
+		}
+	}
+	c.send(Event{Type: typ, Key: key, Size: size})
+}
+
+// send sends e without blocking. c.mu must be held.
+func (c *FSCache) send(e Event) {
+	if c.events == nil || c.closed {
+		return
+	}
+	select {
+	case c.events <- e:
+	default:
+	}
+}
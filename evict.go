@@ -0,0 +1,89 @@
+package fscache
+
+import (
+	"sync"
+)
+
+// EvictionProgress reports on the background removal of evicted entries.
+type EvictionProgress struct {
+	Pending int   // entries evicted whose files have not been removed yet
+	Removed int64 // files removed since the cache was created
+	Failed  int64 // files which could not be removed
+}
+
+type evicted struct {
+	key  string
+	name string
+}
+
+// SetEvictionParallelism makes the files of entries evicted by the cache's Haunter be
+// removed in the background, by up to n goroutines at once, instead of one by one
+// while the cache is locked. Evicted keys leave the cache immediately, but can't be
+// filled again until their file has been removed. A zero n, the default, removes
+// files during the haunt.
+func (c *FSCache) SetEvictionParallelism(n int) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n <= 0 {
+		c.evictSem = nil
+	} else {
+		c.evictSem = make(chan struct{}, n)
+	}
+	return c
+}
+
+// SetEvictOnWrite makes closing a writer returned by Get run the cache's Haunter before
+// Close returns, as well as every Haunter period, so that bursty writers can't take the
+// cache far over a budget like NewLRUHaunter's between haunts. Each pass costs what a
+// scheduled one does, e.g. a Stat of every entry for NewLRUHaunter.
+func (c *FSCache) SetEvictOnWrite(enabled bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictOnWrite = enabled
+	return c
+}
+
+// evictAfterWrite runs a haunt if SetEvictOnWrite is enabled.
+func (c *FSCache) evictAfterWrite() {
+	c.mu.RLock()
+	enabled := c.evictOnWrite && c.haunter != nil
+	c.mu.RUnlock()
+	if enabled {
+		c.haunt()
+	}
+}
+
+// EvictionProgress returns the progress of removing evicted entries in the background.
+func (c *FSCache) EvictionProgress() EvictionProgress {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.eviction
+}
+
+// evictAll removes the files of evicted entries using up to cap(sem) goroutines,
+// under the BackgroundLimit background.
+func (c *FSCache) evictAll(sem chan struct{}, background *BackgroundLimit, files []evicted) {
+	var wg sync.WaitGroup
+	for _, e := range files {
+		e := e
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			background.Do(func() { err = c.fs.Remove(e.name) })
+			<-sem
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.doneRemoving(e.key)
+			c.eviction.Pending--
+			if err != nil {
+				c.eviction.Failed++
+			} else {
+				c.eviction.Removed++
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -69,3 +69,29 @@ func ExampleHandler() {
 	// Output:
 	// Hello Client
 }
+
+func ExampleNewLRUHaunter() {
+	fs, err := NewFs("./lru", 0700)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer os.RemoveAll("./lru")
+
+	// keep at most 100 entries and 1MB, checking every minute.
+	c, err := NewCacheWithHaunter(fs, NewLRUHaunterStrategy(NewLRUHaunter(100, 1<<20, time.Minute)))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer c.Clean()
+
+	r, w, err := c.Get("stream")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	w.Write([]byte("hello world\n"))
+	w.Close()
+	io.Copy(os.Stdout, r)
+	r.Close()
+	// Output:
+	// hello world
+}
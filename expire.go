@@ -0,0 +1,24 @@
+package fscache
+
+// OnExpire registers fn to be called with key when its current entry is evicted by the
+// cache's Haunter, so that resources derived from the entry, like thumbnails or indexes,
+// can be cleaned up with it. Callbacks are dropped, without being called, if the entry is
+// removed or replaced in another way. Several callbacks may be registered for an entry,
+// they are called in order, in the Haunter's goroutine once it has released the cache.
+// It returns ErrNotFound if key isn't cached.
+func (c *FSCache) OnExpire(key string, fn func(key string)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	mapped := c.mapKey(key)
+	if _, ok := c.files[mapped]; !ok {
+		return ErrNotFound
+	}
+	if c.onExpire == nil {
+		c.onExpire = make(map[string][]func())
+	}
+	c.onExpire[mapped] = append(c.onExpire[mapped], func() { fn(key) })
+	return nil
+}
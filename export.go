@@ -0,0 +1,149 @@
+package fscache
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"io"
+	"sort"
+)
+
+// paxMetadata is the PAX record which holds an entry's metadata, base64 encoded.
+const paxMetadata = "FSCACHE.metadata"
+
+// Export writes the cache's entries to w as a tar stream, with one file per key.
+// Entries which are still being written are skipped. Keys are written as the
+// cache tracks them internally, see SetKeyMapper. Each entry's access and modification
+// times, and its metadata, are written as PAX records so that Import can restore them.
+func (c *FSCache) Export(w io.Writer) error {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.files))
+	for k := range c.files {
+		keys = append(keys, k)
+	}
+	c.mu.RUnlock()
+	sort.Strings(keys)
+
+	tw := tar.NewWriter(w)
+	for _, key := range keys {
+		if err := c.export(tw, key); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (c *FSCache) export(tw *tar.Writer, key string) error {
+	c.mu.RLock()
+	f, ok := c.files[key]
+	if !ok || !f.complete() {
+		c.mu.RUnlock()
+		return nil
+	}
+	r, err := f.next()
+	c.mu.RUnlock()
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return nil
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     key,
+		Mode:     0600,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	if rt, wt, err := r.Times(); err == nil {
+		hdr.AccessTime, hdr.ModTime = rt, wt
+	}
+	meta, err := r.Metadata()
+	if err != nil && err != ErrUnsupported {
+		return err
+	}
+	if meta != nil {
+		hdr.PAXRecords = map[string]string{paxMetadata: base64.StdEncoding.EncodeToString(meta)}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// Import adds the entries of a tar stream written by Export to the cache.
+// Keys which are already in the cache are left as they are. Entries keep their metadata,
+// and their times if the FileSystem can keep them, see TimesWriter.
+func (c *FSCache) Import(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		cr, w, err := c.get(hdr.Name, "")
+		if err != nil {
+			return err
+		}
+		cr.Close()
+		if w == nil {
+			continue
+		}
+		err = importEntry(w, hdr, tr)
+		w.Close()
+		if err != nil {
+			_ = c.remove(hdr.Name)
+			return err
+		}
+	}
+}
+
+// importEntry writes the metadata, times and data of the entry of hdr, read by r, to w.
+func importEntry(w io.Writer, hdr *tar.Header, r io.Reader) error {
+	if tw, ok := w.(TimesWriter); ok && !hdr.ModTime.IsZero() {
+		rt := hdr.AccessTime
+		if rt.IsZero() {
+			rt = hdr.ModTime
+		}
+		if err := tw.SetTimes(rt, hdr.ModTime); err != nil && err != ErrUnsupported {
+			return err
+		}
+	}
+	if enc, ok := hdr.PAXRecords[paxMetadata]; ok {
+		meta, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return err
+		}
+		mw, ok := w.(MetadataWriter)
+		if !ok {
+			return ErrUnsupported
+		}
+		if err := mw.SetMetadata(meta); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// ImportCache creates a new Cache using NewCache(fs, nil), and adds the entries of
+// a tar stream written by Export to it.
+func ImportCache(fs FileSystem, r io.Reader) (*FSCache, error) {
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Import(r)
+}
@@ -0,0 +1,56 @@
+package fscache
+
+import "os"
+
+// dropWriter drops a File from the page cache once it has been written, if it is at
+// least the StandardFS's DropPagesSize.
+type dropWriter struct {
+	syncer
+	fs      *StandardFS
+	written int64
+}
+
+func (w *dropWriter) Write(p []byte) (int, error) {
+	n, err := w.syncer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *dropWriter) Close() error {
+	err := w.syncer.Close()
+	if err == nil && w.written >= w.fs.DropPagesSize {
+		// the File may only be linked into the directory by Close, so it is opened again.
+		if f, err := os.Open(w.Name()); err == nil {
+			_ = dropPages(f)
+			f.Close()
+		}
+	}
+	return err
+}
+
+// dropReader drops a File from the page cache when it is closed, if it was read
+// sequentially to its end and is at least the StandardFS's DropPagesSize.
+type dropReader struct {
+	*os.File
+	fs  *StandardFS
+	off int64
+	eof bool
+}
+
+func (r *dropReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	r.off += int64(n)
+	if err != nil {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *dropReader) Close() error {
+	if r.eof && r.off >= r.fs.DropPagesSize {
+		if fi, err := r.File.Stat(); err == nil && r.off >= fi.Size() {
+			_ = dropPages(r.File)
+		}
+	}
+	return r.File.Close()
+}
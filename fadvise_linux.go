@@ -0,0 +1,23 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build linux
+// +build amd64 arm64 loong64 mips64 mips64le ppc64 ppc64le riscv64
+
+package fscache
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadvDontNeed is POSIX_FADV_DONTNEED.
+const fadvDontNeed = 4
+
+// dropPages asks the kernel to drop f's clean pages from the page cache, and to start
+// writing back its dirty ones.
+func dropPages(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
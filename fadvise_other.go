@@ -0,0 +1,8 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build !linux !amd64,!arm64,!loong64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64
+
+package fscache
+
+import "os"
+
+func dropPages(f *os.File) error { return ErrUnsupported }
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!ppc64,!ppc64le
+
+package fscache
+
+// ficlone is FICLONE, _IOW(0x94, 9, int).
+const ficlone = 0x40049409
@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le || ppc64 || ppc64le)
+// +build linux
+// +build mips mipsle mips64 mips64le ppc64 ppc64le
+
+package fscache
+
+// ficlone is FICLONE, _IOW(0x94, 9, int), these architectures encode the direction differently.
+const ficlone = 0x80049409
@@ -2,14 +2,22 @@ package fscache
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/djherbis/atime"
@@ -22,6 +30,73 @@ type FileSystemStater interface {
 	Stat(name string) (FileInfo, error)
 }
 
+// FileSystemRenamer implementers can move a File so that it is reloaded under a new key.
+type FileSystemRenamer interface {
+	// Rename takes a File.Name() and moves it to the name Create(key) would use,
+	// replacing any file already stored there. It returns the new File.Name().
+	Rename(name, key string) (string, error)
+}
+
+// FileSystemLinker implementers can make a File available under a second key
+// without copying its data.
+type FileSystemLinker interface {
+	// Link takes the File.Name() of a closed File, and makes its data available at
+	// the name Create(key) would use. It returns the new File.Name().
+	Link(name, key string) (string, error)
+}
+
+// FileSystemFinder implementers can find the File of a key without a Reload, see NewCacheLazy.
+type FileSystemFinder interface {
+	// Find returns the File.Name() of key's File, or ErrNotFound if it has none.
+	Find(key string) (string, error)
+}
+
+// FileSystemContext implementers honor the deadline and cancellation of the call which
+// needs a File, see FSCache.GetContext. Network-backed FileSystems should implement it.
+type FileSystemContext interface {
+	// CreateContext is Create, giving up with ctx's error once ctx is done.
+	CreateContext(ctx context.Context, key string) (stream.File, error)
+
+	// OpenContext is Open, giving up with ctx's error once ctx is done.
+	OpenContext(ctx context.Context, name string) (stream.File, error)
+}
+
+// FileSystemIngester implementers can take in a file from outside of the FileSystem
+// without copying its data.
+type FileSystemIngester interface {
+	// Ingest makes the data of the os file at path available at the name Create(key) would use,
+	// leaving path in place. It returns the new File.Name(), or an error if it would have to copy.
+	Ingest(path, key string) (string, error)
+}
+
+// FileSystemMetadata implementers can store a small blob of metadata alongside a File,
+// which is removed, renamed and linked along with it.
+type FileSystemMetadata interface {
+	// WriteMetadata replaces the metadata of a File.Name().
+	WriteMetadata(name string, data []byte) error
+
+	// ReadMetadata returns the metadata of a File.Name(), or nil if it has none.
+	ReadMetadata(name string) ([]byte, error)
+}
+
+// FileSystemToucher implementers can update the access time of a File.
+type FileSystemToucher interface {
+	// Touch sets the access time of a File.Name() to now, leaving its modification time.
+	Touch(name string) error
+}
+
+// FileSystemChtimes implementers can set the access and modification times of a File.
+type FileSystemChtimes interface {
+	// Chtimes sets the access and modification times of a File.Name().
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// FileSystemPather implementers store Files on the os filesystem.
+type FileSystemPather interface {
+	// Path returns the os path of a File.Name(), and false if it has none.
+	Path(name string) (string, bool)
+}
+
 // FileSystem is used as the source for a Cache.
 type FileSystem interface {
 	// Stream FileSystem
@@ -39,14 +114,17 @@ type FileSystem interface {
 
 // StandardFS is an implemenation of FileSystem which writes to the os Filesystem.
 type StandardFS struct {
-	root string
-	init func() error
+	root  string
+	init  func() error
+	owner *DirOwner // set while Lock holds the directory
 
 	// EncodeKey takes a 'name' given to Create and converts it into a
 	// the Filename that should be used. It should return 'true' if
 	// DecodeKey can convert the returned string back to the original 'name'
 	// and false otherwise.
-	// This must be set before the first call to Create.
+	// This must be set before the first call to Create. It is B32OrMD5HashEncodeKey by
+	// default; SHA256EncodeKey and PlainEncodeKey, with PlainDecodeKey, give names which
+	// are simple to compute for a directory populated out-of-band.
 	EncodeKey func(string) (string, bool)
 
 	// DecodeKey should convert a given Filename into the original 'name' given to
@@ -54,8 +132,125 @@ type StandardFS struct {
 	// will cause it to try and lookup a stored 'encodedName.key' file which holds
 	// the original name.
 	DecodeKey func(string) (string, bool)
+
+	// Duplicates decides what Reload does when it finds several files for one key,
+	// which happens when writers crashed, or several processes shared the directory.
+	Duplicates DuplicatePolicy
+
+	// OnDuplicate, if set, is called by Reload for every key it finds several files for,
+	// with the path of the newest and the paths of the others, before Duplicates is applied.
+	OnDuplicate func(key, newest string, others []string)
+
+	// ReloadProgress, if set, is called by Reload as it goes through the directory, with the
+	// number of files looked at so far and the number there are. LastReload summarizes the result.
+	ReloadProgress func(done, total int)
+
+	// Sync is when Files are flushed to stable storage, SyncNever by default.
+	// SyncInterval is the interval of SyncPeriodic, 1s if it isn't set.
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// SyncDir makes Create, Remove, Rename and Link flush the directory once its entries
+	// change, so that a crash doesn't lose or resurrect Files which were completed or removed.
+	SyncDir bool
+
+	// MinFree, if set, makes Create fail with ErrLowDiskSpace while the volume holding the
+	// directory has fewer bytes free, so that the cache can't fill it and take the host down.
+	// See NewMinFreeHaunter to evict entries when space runs low.
+	MinFree int64
+
+	// DirectIOSize, if set, makes Files which grow past it bypass the OS page cache from then
+	// on, with O_DIRECT on Linux and F_NOCACHE on macOS, and Open read such Files the same way.
+	// Streaming multi-GB entries then doesn't evict the pages the rest of the host depends on.
+	// Other platforms use the page cache as usual.
+	DirectIOSize int64
+
+	// DropPagesSize, if set, makes Files of at least this size leave the OS page cache once
+	// they have been written, or read sequentially to their end, with fadvise(DONTNEED) on
+	// 64-bit Linux, so that the cache's own traffic doesn't crowd out the rest of the host.
+	DropPagesSize int64
+
+	// AtomicCreate makes Create make Files which are only moved into the directory when they
+	// are closed, so a crash never leaves a partly written file for Reload to serve. On Linux
+	// they are unnamed files made with O_TMPFILE, elsewhere, or where the filesystem can't
+	// make those, they are written in the .fscache-tmp subdirectory and renamed into place,
+	// and Reload removes what a crash left there. Files are created as usual on Windows,
+	// where the readers of a File would stop it being renamed.
+	AtomicCreate bool
+
+	// FileMode, if set, is the permissions of the Files made by Create and Link, and of their
+	// .key and .meta files, instead of 0600, e.g. 0640 to let a reader process of the same
+	// group share the directory. It is set regardless of the umask.
+	FileMode os.FileMode
+
+	// ChownFiles makes the Files made by Create and Link, and their .key and .meta files, owned
+	// by Uid and Gid, which needs the privilege to, e.g. running as root. It is ignored on Windows.
+	ChownFiles bool
+	Uid, Gid   int
+
+	// KeyXattr makes Create and Rename keep the key of a File whose name can't be decoded in
+	// the extended attribute user.fscache.key on Linux, rather than in a name.key file beside
+	// it, so an entry is one file which can't be separated from its key. Where extended
+	// attributes aren't supported, and for Link and Ingest, whose Files may share an inode
+	// with another entry, .key files are used as before. Reload reads either.
+	KeyXattr bool
+
+	// VerifyOnLoad makes Reload check, and optionally repair, the directory with Verify
+	// before loading it, see LastVerify.
+	VerifyOnLoad VerifyPolicy
+
+	mu       sync.Mutex
+	pending  map[string]*tmpFile // the files made by AtomicCreate which aren't in place yet
+	report   ReloadReport        // of the last Reload
+	verified *VerifyReport       // of the last Reload's Verify
+}
+
+// ReloadReport summarizes what StandardFS.Reload did with the files of its directory.
+// Paths are in the directory given to NewFs.
+type ReloadReport struct {
+	Loaded     int                 // files reloaded as entries
+	Removed    []string            // files removed, as their key was lost or as duplicates
+	Duplicates map[string][]string // key => the files found for it besides the one reloaded
+	Skipped    []string            // directories, which are left in place
+}
+
+// LastReload returns the ReloadReport of the last Reload.
+func (fs *StandardFS) LastReload() ReloadReport {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.report
 }
 
+// DuplicatePolicy is what StandardFS.Reload does with the files of a key which has several.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesNewest reloads the newest file, and removes the others. This is the default.
+	DuplicatesNewest DuplicatePolicy = iota
+
+	// DuplicatesError fails Reload with a *DuplicateError, leaving every file in place.
+	DuplicatesError
+
+	// DuplicatesKeepAll reloads the newest file, and leaves the others in place for inspection.
+	DuplicatesKeepAll
+)
+
+// ErrDuplicateKeys matches a DuplicateError with errors.Is.
+var ErrDuplicateKeys = errors.New("cache directory has several files for a key")
+
+// DuplicateError is returned by Reload under DuplicatesError, Files holds the paths
+// of the files of each key which has several, newest first.
+type DuplicateError struct {
+	Files map[string][]string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("cache directory has several files for %d keys", len(e.Files))
+}
+
+// Is makes errors.Is(err, ErrDuplicateKeys) true.
+func (e *DuplicateError) Is(target error) bool { return target == ErrDuplicateKeys }
+
 // IdentityCodeKey works as both an EncodeKey and a DecodeKey func, which just returns
 // it's given argument and true. This is expected to be used when your FSCache
 // uses SetKeyMapper to ensure its internal km(key) value is already a valid filename path.
@@ -63,120 +258,471 @@ func IdentityCodeKey(key string) (string, bool) { return key, true }
 
 // NewFs returns a FileSystem rooted at directory dir.
 // Dir is created with perms if it doesn't exist.
-// This also uses the default EncodeKey/DecodeKey functions B64ORMD5HashEncodeKey/B64DecodeKey.
+// This also uses the default EncodeKey/DecodeKey functions B32OrMD5HashEncodeKey/B32DecodeKey.
 func NewFs(dir string, mode os.FileMode) (*StandardFS, error) {
+	root, err := longPath(dir)
+	if err != nil {
+		return nil, err
+	}
 	fs := &StandardFS{
-		root: dir,
+		root: root,
 		init: func() error {
 			return os.MkdirAll(dir, mode)
 		},
-		EncodeKey: B64OrMD5HashEncodeKey,
-		DecodeKey: B64DecodeKey,
+		EncodeKey: B32OrMD5HashEncodeKey,
+		DecodeKey: B32DecodeKey,
 	}
 	return fs, fs.init()
 }
 
 // Reload looks through the dir given to NewFs and returns every key, name pair (Create(key) => name = File.Name())
-// that is managed by this FileSystem.
+// that is managed by this FileSystem. Keys with several files are handled by Duplicates.
 func (fs *StandardFS) Reload(add func(key, name string)) error {
+	if fs.VerifyOnLoad != VerifyNone {
+		verified, err := fs.Verify(fs.VerifyOnLoad == VerifyAndRepair)
+		if err != nil {
+			return err
+		}
+		fs.mu.Lock()
+		fs.verified = verified
+		fs.mu.Unlock()
+	}
+
 	files, err := ioutil.ReadDir(fs.root)
 	if err != nil {
 		return err
 	}
 
-	addfiles := make(map[string]struct {
-		os.FileInfo
-		key string
-	})
+	keyfiles := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".key") {
+			keyfiles[strings.TrimSuffix(f.Name(), ".key")] = true
+		}
+	}
 
+	var entries []os.FileInfo
 	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".key") && !strings.HasSuffix(f.Name(), ".meta") &&
+			f.Name() != ownerFile && f.Name() != stagingDir {
+			entries = append(entries, f)
+		}
+	}
 
-		if strings.HasSuffix(f.Name(), ".key") {
+	report := ReloadReport{Removed: fs.cleanStaging()}
+	defer func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		fs.report = report
+	}()
+	byKey := make(map[string][]os.FileInfo)
+	var keys []string
+	for i, f := range entries {
+		if fs.ReloadProgress != nil {
+			fs.ReloadProgress(i, len(entries))
+		}
+		if f.IsDir() {
+			report.Skipped = append(report.Skipped, filepath.Join(fs.root, f.Name()))
 			continue
 		}
 
-		key, err := fs.getKey(f.Name())
+		key, err := fs.getKey(f.Name(), keyfiles[f.Name()])
 		if err != nil {
 			_ = fs.Remove(filepath.Join(fs.root, f.Name()))
+			report.Removed = append(report.Removed, filepath.Join(fs.root, f.Name()))
+			continue
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], f)
+	}
+
+	var dupErr *DuplicateError
+	for _, key := range keys {
+		fis := byKey[key]
+		if len(fis) < 2 {
 			continue
 		}
-		fi, ok := addfiles[key]
+		// newest first
+		sort.SliceStable(fis, func(i, j int) bool { return fis[j].ModTime().Before(fis[i].ModTime()) })
+		others := make([]string, 0, len(fis)-1)
+		for _, fi := range fis[1:] {
+			others = append(others, filepath.Join(fs.root, fi.Name()))
+		}
+		if fs.OnDuplicate != nil {
+			fs.OnDuplicate(key, filepath.Join(fs.root, fis[0].Name()), others)
+		}
+		if report.Duplicates == nil {
+			report.Duplicates = make(map[string][]string)
+		}
+		report.Duplicates[key] = others
 
-		if !ok || fi.ModTime().Before(f.ModTime()) {
-			if ok {
-				_ = fs.Remove(fi.Name())
+		switch fs.Duplicates {
+		case DuplicatesError:
+			if dupErr == nil {
+				dupErr = &DuplicateError{Files: make(map[string][]string)}
 			}
-			addfiles[key] = struct {
-				os.FileInfo
-				key string
-			}{
-				FileInfo: f,
-				key:      key,
+			dupErr.Files[key] = append([]string{filepath.Join(fs.root, fis[0].Name())}, others...)
+		case DuplicatesNewest:
+			for _, name := range others {
+				_ = fs.Remove(name)
 			}
-		} else {
-			_ = fs.Remove(f.Name())
+			report.Removed = append(report.Removed, others...)
 		}
-
+	}
+	if fs.ReloadProgress != nil {
+		fs.ReloadProgress(len(entries), len(entries))
+	}
+	if dupErr != nil {
+		return dupErr
 	}
 
-	for _, f := range addfiles {
-		path, err := filepath.Abs(filepath.Join(fs.root, f.Name()))
+	for _, key := range keys {
+		path, err := filepath.Abs(filepath.Join(fs.root, byKey[key][0].Name()))
 		if err != nil {
 			return err
 		}
-		add(f.key, path)
+		add(key, path)
+		report.Loaded++
 	}
 
 	return nil
 }
 
+// Find returns the File.Name() Reload would give key's File, or ErrNotFound if it has none.
+func (fs *StandardFS) Find(key string) (string, error) {
+	name, decodable := fs.encodeName(key)
+	if _, err := os.Stat(filepath.Join(fs.root, name)); os.IsNotExist(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if !decodable {
+		// names which aren't decodable are hashes, which another key may share.
+		stored, err := fs.getKey(name, true)
+		if err != nil || stored != key {
+			return "", ErrNotFound
+		}
+	}
+	return filepath.Abs(filepath.Join(fs.root, name))
+}
+
 // Create creates a File for the given 'name', it may not use the given name on the
 // os filesystem, that depends on the implementation of EncodeKey used.
 func (fs *StandardFS) Create(name string) (stream.File, error) {
-	name, err := fs.makeName(name)
-	if err != nil {
+	if err := fs.checkFree(); err != nil {
 		return nil, err
 	}
-	return fs.create(name)
+	key := name
+	name, decodable := fs.encodeName(key)
+	xattr := !decodable && fs.KeyXattr
+	if !decodable && !xattr {
+		if err := fs.writeKeyFile(name, key); err != nil {
+			return nil, err
+		}
+	}
+	var f stream.File
+	var err error
+	if fs.AtomicCreate {
+		if tf, err := fs.createTmp(name); err == nil {
+			f = tf
+		}
+	}
+	if f == nil {
+		if f, err = fs.create(name); err != nil {
+			return nil, err
+		}
+	}
+	if xattr {
+		if err := fs.saveKey(f.Name(), name, key); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, ok := f.(*tmpFile); !ok {
+		// an unnamed File is only linked into the directory when it is closed.
+		if err := fs.syncDir(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if fs.DirectIOSize > 0 {
+		f = &directWriter{fder: f.(fder), fs: fs}
+	}
+	if fs.DropPagesSize > 0 {
+		f = &dropWriter{syncer: f.(syncer), fs: fs}
+	}
+	if fs.Sync != SyncNever {
+		return &syncFile{syncer: f.(syncer), fs: fs, last: time.Now()}, nil
+	}
+	return f, nil
 }
 
 func (fs *StandardFS) create(name string) (stream.File, error) {
-	return os.OpenFile(filepath.Join(fs.root, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	f, err := os.OpenFile(filepath.Join(fs.root, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.setPerms(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// setPerms gives f the FileMode, and the owner if ChownFiles is set.
+func (fs *StandardFS) setPerms(f *os.File) error {
+	if fs.FileMode != 0 {
+		if err := f.Chmod(fs.FileMode); err != nil {
+			return err
+		}
+	}
+	if fs.ChownFiles && runtime.GOOS != "windows" {
+		return f.Chown(fs.Uid, fs.Gid)
+	}
+	return nil
 }
 
 // Open opens a stream.File for the given File.Name() returned by Create().
 func (fs *StandardFS) Open(name string) (stream.File, error) {
-	return os.Open(name)
+	var f stream.File
+	err := fs.withPath(name, func(path string) (err error) {
+		if fs.DirectIOSize > 0 {
+			if r, ok := fs.openDirect(path); ok {
+				f = r
+				return nil
+			}
+		}
+		of, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if fs.DropPagesSize > 0 {
+			f = &dropReader{File: of, fs: fs}
+		} else {
+			f = of
+		}
+		return nil
+	})
+	return f, err
 }
 
 // Remove removes a stream.File for the given File.Name() returned by Create().
 func (fs *StandardFS) Remove(name string) error {
 	os.Remove(fmt.Sprintf("%s.key", name))
-	return os.Remove(name)
+	os.Remove(fmt.Sprintf("%s.meta", name))
+	if fs.dropPending(name) {
+		return nil
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return fs.syncDir()
+}
+
+// Rename moves a File.Name() returned by Create() to the name Create(key) would use.
+func (fs *StandardFS) Rename(name, key string) (string, error) {
+	newName, decodable := fs.encodeName(key)
+	if !decodable {
+		// the key goes with the file, so it is found under either name if Rename is interrupted.
+		save := fs.writeKeyFile
+		if fs.KeyXattr {
+			save = func(newName, key string) error { return fs.saveKey(name, newName, key) }
+		}
+		if err := save(newName, key); err != nil {
+			return "", err
+		}
+	}
+	newName = filepath.Join(fs.root, newName)
+	if err := os.Rename(name, newName); err != nil {
+		return "", err
+	}
+	os.Remove(fmt.Sprintf("%s.key", name))
+	os.Remove(fmt.Sprintf("%s.meta", newName))
+	os.Rename(fmt.Sprintf("%s.meta", name), fmt.Sprintf("%s.meta", newName))
+	return newName, fs.syncDir()
+}
+
+// Link clones a File.Name() returned by Create() to the name Create(key) would use, on
+// filesystems which support copy-on-write clones such as XFS and btrfs on Linux, so the
+// entries' data is shared until either is changed. Otherwise it hard links it.
+func (fs *StandardFS) Link(name, key string) (string, error) {
+	newName, err := fs.makeName(key)
+	if err != nil {
+		return "", err
+	}
+	newName = filepath.Join(fs.root, newName)
+	if err := cloneOrLink(name, newName); err != nil {
+		os.Remove(fmt.Sprintf("%s.key", newName))
+		return "", err
+	}
+	if fs.FileMode != 0 || fs.ChownFiles {
+		// a clone is a new file, a hard link shares name's, which has them already.
+		f, err := os.Open(newName)
+		if err == nil {
+			err = fs.setPerms(f)
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(newName)
+			os.Remove(fmt.Sprintf("%s.key", newName))
+			return "", err
+		}
+	}
+	// WriteMetadata replaces the file rather than writing to it, so the link won't be shared.
+	os.Link(fmt.Sprintf("%s.meta", name), fmt.Sprintf("%s.meta", newName))
+	return newName, fs.syncDir()
+}
+
+// Ingest clones the file at path to the name Create(key) would use, replacing any file
+// already stored there. Where the filesystem can't clone files (see Link), it hard links
+// path instead, and then path must be replaced rather than modified in place while it is
+// cached. It fails if path is on another device than the cache directory.
+// Either way the cache owns its file, so removing the entry leaves path, and removing
+// path leaves the entry.
+func (fs *StandardFS) Ingest(path, key string) (string, error) {
+	newName, err := fs.makeName(key)
+	if err != nil {
+		return "", err
+	}
+	newName = filepath.Join(fs.root, newName)
+	os.Remove(newName)
+	os.Remove(fmt.Sprintf("%s.meta", newName))
+	if err := cloneOrLink(path, newName); err != nil {
+		os.Remove(fmt.Sprintf("%s.key", newName))
+		return "", err
+	}
+	return newName, fs.syncDir()
+}
+
+// cloneOrLink makes dst a copy-on-write clone of src where the filesystem supports it,
+// and a hard link of src otherwise.
+func cloneOrLink(src, dst string) error {
+	if err := clone(src, dst); err == nil {
+		return nil
+	}
+	return os.Link(src, dst)
+}
+
+// clone creates dst as a copy-on-write clone of src, or fails and leaves no dst.
+func clone(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = cloneFile(d, s)
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// Path returns the os path of a File.Name() returned by Create(), which is its name.
+func (fs *StandardFS) Path(name string) (string, bool) { return name, true }
+
+// WriteMetadata replaces the metadata of a File.Name() returned by Create(),
+// it is stored in a .meta file next to it.
+func (fs *StandardFS) WriteMetadata(name string, data []byte) error {
+	tmp := fmt.Sprintf("%s.meta.tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = fs.setPerms(f)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fmt.Sprintf("%s.meta", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadMetadata returns the metadata of a File.Name() returned by Create().
+func (fs *StandardFS) ReadMetadata(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s.meta", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
 }
 
 // RemoveAll deletes all files in the directory managed by this StandardFS.
 // Warning that if you put files in this directory that were not created by
 // StandardFS they will also be deleted.
 func (fs *StandardFS) RemoveAll() error {
+	fs.mu.Lock()
+	for name, f := range fs.pending {
+		delete(fs.pending, name)
+		f.discard()
+	}
+	fs.mu.Unlock()
 	if err := os.RemoveAll(fs.root); err != nil {
 		return err
 	}
-	return fs.init()
+	if err := fs.init(); err != nil {
+		return err
+	}
+	if fs.owner != nil {
+		return fs.writeOwner(*fs.owner, false)
+	}
+	return nil
 }
 
 // AccessTimes returns atime and mtime for the given File.Name() returned by Create().
 func (fs *StandardFS) AccessTimes(name string) (rt, wt time.Time, err error) {
-	fi, err := os.Stat(name)
+	fi, err := fs.stat(name)
 	if err != nil {
 		return rt, wt, err
 	}
 	return atime.Get(fi), fi.ModTime(), nil
 }
 
+// Touch sets the atime of a File.Name() returned by Create() to now.
+func (fs *StandardFS) Touch(name string) error {
+	return fs.withPath(name, func(path string) error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, time.Now(), fi.ModTime())
+	})
+}
+
+// Chtimes sets the access and modification times of a File.Name() returned by Create().
+func (fs *StandardFS) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.withPath(name, func(path string) error {
+		return os.Chtimes(path, atime, mtime)
+	})
+}
+
+func (fs *StandardFS) stat(name string) (fi os.FileInfo, err error) {
+	err = fs.withPath(name, func(path string) error {
+		fi, err = os.Stat(path)
+		return err
+	})
+	return fi, err
+}
+
 // Stat returns FileInfo for the given File.Name() returned by Create().
 func (fs *StandardFS) Stat(name string) (FileInfo, error) {
-	stat, err := os.Stat(name)
+	stat, err := fs.stat(name)
 	if err != nil {
 		return FileInfo{}, err
 	}
@@ -190,8 +736,12 @@ const (
 	maxShort    = 20
 	shortPrefix = "s"
 	longPrefix  = "l"
+	b32Prefix   = "b"
 )
 
+// b32 is lowercase so that names are unique on case-insensitive filesystems.
+var b32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
 func tob64(s string) string {
 	buf := bytes.NewBufferString("")
 	enc := base64.NewEncoder(base64.URLEncoding, buf)
@@ -216,26 +766,129 @@ func B64OrMD5HashEncodeKey(key string) (string, bool) {
 	if len(b64key) < maxShort {
 		return fmt.Sprintf("%s%s%s", shortPrefix, salt, b64key), true
 	}
+	return longName(key), false
+}
 
-	// long name
+// B32OrMD5HashEncodeKey converts a given key into a filesystem name-safe string
+// and returns true iff it can be reversed with B32DecodeKey.
+// Unlike B64OrMD5HashEncodeKey, names never differ only by case, so distinct keys
+// can't collide on case-insensitive filesystems like the macOS and Windows defaults.
+func B32OrMD5HashEncodeKey(key string) (string, bool) {
+	b32key := b32.EncodeToString([]byte(key))
+	if len(b32key) < maxShort {
+		return b32Prefix + salt + b32key, true
+	}
+	return longName(key), false
+}
+
+// SHA256EncodeKey names the file of a key with the hex encoded sha256 of the key, so names
+// are deterministic, of a fixed length, and don't reveal the key. The name can't be reversed,
+// so the key is kept in a name.key file beside it, which a directory populated out-of-band
+// must provide too.
+func SHA256EncodeKey(key string) (string, bool) {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:]), false
+}
+
+// PlainEncodeKey names the file of a key with the key itself, and returns true, if it is a
+// file name which is safe on every platform and can't be mistaken for a name of
+// SHA256EncodeKey or a file StandardFS keeps beside its entries. Other keys are named by
+// SHA256EncodeKey. With PlainDecodeKey, a directory of files named by their keys can be
+// populated out-of-band and reloaded as it is. Keys which differ only by case share a file
+// on case-insensitive filesystems.
+func PlainEncodeKey(key string) (string, bool) {
+	if !windowsSafeName(key) || isHexSHA256(key) || key == ownerFile || key == stagingDir ||
+		strings.HasSuffix(key, ".key") || strings.HasSuffix(key, ".meta") {
+		return SHA256EncodeKey(key)
+	}
+	return key, true
+}
+
+// PlainDecodeKey reverses PlainEncodeKey, the names of other keys have .key files.
+func PlainDecodeKey(name string) (string, bool) {
+	return name, true
+}
+
+func isHexSHA256(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func longName(key string) string {
 	hash := md5.Sum([]byte(key))
-	return fmt.Sprintf("%s%s%x", longPrefix, salt, hash[:]), false
+	return fmt.Sprintf("%s%s%x", longPrefix, salt, hash[:])
+}
+
+// windowsReserved are device names which Windows won't create files as,
+// even with an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// windowsSafeName reports whether name can be used as a file name on Windows.
+func windowsSafeName(name string) bool {
+	if name == "" || len(name) > 255 || strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	for _, r := range name {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return false
+		}
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	return !windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))]
 }
 
 func (fs *StandardFS) makeName(key string) (string, error) {
-	name, decodable := fs.EncodeKey(key)
+	name, decodable := fs.encodeName(key)
 	if decodable {
 		return name, nil
 	}
 
 	// Name is not decodeable, store it.
+	return name, fs.writeKeyFile(name, key)
+}
+
+// encodeName returns the name of key, and whether DecodeKey can recover key from it.
+func (fs *StandardFS) encodeName(key string) (string, bool) {
+	name, decodable := fs.EncodeKey(key)
+	if !validName(name) {
+		name, decodable = longName(key), false
+	}
+	return name, decodable
+}
+
+// writeKeyFile stores key in the .key file of name.
+func (fs *StandardFS) writeKeyFile(name, key string) error {
 	f, err := fs.create(fmt.Sprintf("%s.key", name))
 	if err != nil {
-		return "", err
+		return err
 	}
 	_, err = f.Write([]byte(key))
 	f.Close()
-	return name, err
+	return err
+}
+
+// saveKey stores key, the key of name, in an extended attribute of the File at path,
+// or in the .key file of name if the filesystem can't.
+func (fs *StandardFS) saveKey(path, name, key string) error {
+	err := fs.withPath(path, func(path string) error { return setKeyXattr(path, key) })
+	if err != nil {
+		return fs.writeKeyFile(name, key)
+	}
+	// a .key file left from before would win over the attribute.
+	os.Remove(filepath.Join(fs.root, fmt.Sprintf("%s.key", name)))
+	return nil
 }
 
 // B64DecodeKey converts a string y into x st. y, ok = B64OrMD5HashEncodeKey(x), and ok = true.
@@ -247,14 +900,32 @@ func B64DecodeKey(name string) (string, bool) {
 	return "", false
 }
 
-func (fs *StandardFS) getKey(name string) (string, error) {
-	if key, ok := fs.DecodeKey(name); ok {
-		return key, nil
+// B32DecodeKey reverses B32OrMD5HashEncodeKey if it returned true.
+// Names written by B64OrMD5HashEncodeKey are also decoded, so caches created
+// before the switch to base32 can still be reloaded.
+func B32DecodeKey(name string) (string, bool) {
+	if strings.HasPrefix(name, b32Prefix) && len(name) >= len(b32Prefix)+saltSize {
+		key, err := b32.DecodeString(name[len(b32Prefix)+saltSize:])
+		return string(key), err == nil
+	}
+	return B64DecodeKey(name)
+}
+
+// getKey returns the key stored as name, hasKeyFile is true if name has a
+// .key file which holds its key.
+func (fs *StandardFS) getKey(name string, hasKeyFile bool) (string, error) {
+	if !hasKeyFile {
+		if key, ok := fs.DecodeKey(name); ok {
+			return key, nil
+		}
 	}
 
 	// long name
 	f, err := fs.Open(filepath.Join(fs.root, fmt.Sprintf("%s.key", name)))
 	if err != nil {
+		if key, xerr := getKeyXattr(filepath.Join(fs.root, name)); xerr == nil {
+			return key, nil
+		}
 		return "", err
 	}
 	defer f.Close()
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package fscache
+
+import "os"
+
+func longPath(path string) (string, error) { return path, nil }
+
+func validName(name string) bool { return true }
+
+// syncDir flushes the directory dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
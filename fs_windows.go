@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package fscache
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath returns the \\?\ form of path, which lets it and the files under
+// it exceed MAX_PATH.
+func longPath(path string) (string, error) {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:], nil
+	}
+	return `\\?\` + abs, nil
+}
+
+// validName reports whether name can be created, names which can't be are
+// stored under their hash instead.
+func validName(name string) bool {
+	return windowsSafeName(name)
+}
+
+// syncDir does nothing, Windows can't flush directories and updates their entries
+// with the files' metadata.
+func syncDir(dir string) error { return nil }
@@ -1,9 +1,15 @@
 package fscache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,6 +17,41 @@ import (
 	"github.com/djherbis/stream"
 )
 
+var (
+	// ErrNotFound is returned when an operation requires a key which is not in the cache.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrKeyExists is returned when an operation would replace a key which is already in the cache.
+	ErrKeyExists = errors.New("key already exists")
+
+	// ErrInProgress is returned when an operation requires an entry which has finished being written.
+	ErrInProgress = errors.New("entry is still being written")
+
+	// ErrAborted is returned by a writer whose entry was dropped by the cache, see SetOrphanTimeout.
+	ErrAborted = errors.New("writer was aborted")
+
+	// ErrClosed is returned by operations on a Cache which has been closed.
+	ErrClosed = errors.New("cache is closed")
+
+	// ErrWriterTimeout matches the WriterStalledError returned by a CacheReader
+	// which gave up waiting on its writer, see SetReadTimeout.
+	ErrWriterTimeout = errors.New("timed out waiting for writer")
+)
+
+// WriterStalledError is returned by a CacheReader which gave up waiting on its
+// writer, see SetReadTimeout. errors.Is(err, ErrWriterTimeout) is true for it.
+type WriterStalledError struct {
+	Idle   time.Duration // how long the writer had made no progress
+	Offset int64         // how many bytes the writer had written
+}
+
+func (e *WriterStalledError) Error() string {
+	return fmt.Sprintf("writer idle %v at offset %d", e.Idle, e.Offset)
+}
+
+// Is reports whether target is ErrWriterTimeout.
+func (e *WriterStalledError) Is(target error) bool { return target == ErrWriterTimeout }
+
 // Cache works like a concurrent-safe map for streams.
 type Cache interface {
 	// Get manages access to the streams in the cache.
@@ -36,11 +77,49 @@ type Cache interface {
 
 // FSCache is a Cache which uses a Filesystem to read/write cached data.
 type FSCache struct {
-	mu      sync.RWMutex
-	files   map[string]fileStream
-	km      func(string) string
-	fs      FileSystem
-	haunter Haunter
+	hits, misses int64 // accessed atomically, first for alignment on 32-bit platforms
+
+	mu       sync.RWMutex
+	files    map[string]fileStream
+	removing map[string]int
+	km       func(string) string
+	fs       FileSystem
+	haunter  Haunter
+	timer    *time.Timer
+	closed   bool
+	tracer   *TraceRecorder
+
+	readTimeout time.Duration
+	originals   map[string]string // mapped key => original key, if kept
+	events      chan Event
+	keepEmpty   bool
+	minSize     int64
+
+	orphanTimeout time.Duration
+	exclusions    []string
+	dedup         *dedupIndex
+	evictSem      chan struct{}
+	background    *BackgroundLimit
+	keyTree       *keyTree // set by SetPrefixIndex
+	immutable     []string
+	partials      map[string]partialFill
+	eviction      EvictionProgress
+	gen           uint64            // the last generation given to an entry
+	gens          map[string]uint64 // key => generation of its completed entry
+
+	collecting int32           // set while CollectContent runs, accessed atomically
+	gcMu       sync.Mutex      // guards gcLive
+	gcLive     map[string]bool // content-addressed keys to keep, while CollectContent runs
+
+	lazy     *lazyLoad // set while the Reload started by NewCacheLazy runs
+	onExpire map[string][]func()
+	usage    *usageIndex // set by SetUsageNamespaces
+	tee      func(key string) io.WriteCloser
+
+	priorities   map[string]int // set by SetPriority
+	sampler      *readSampler   // set by SetReadSampler
+	evictOnWrite bool
+	soft         *softLimits // set by SetSoftLimits
 }
 
 // SetKeyMapper will use the given function to transform any given Cache key into the result of km(key).
@@ -56,6 +135,108 @@ func (c *FSCache) SetKeyMapper(km func(string) string) *FSCache {
 	return c
 }
 
+// SetKeepOriginalKeys makes the cache remember the key each entry was created with, before
+// SetKeyMapper's mapping, so that it can be recovered with OriginalKey. Original keys are
+// only kept in memory, they are not available for entries reloaded from the FileSystem.
+func (c *FSCache) SetKeepOriginalKeys(keep bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !keep {
+		c.originals = nil
+	} else if c.originals == nil {
+		c.originals = make(map[string]string)
+	}
+	return c
+}
+
+// OriginalKey returns the key which the entry stored as key was created with, see SetKeepOriginalKeys.
+// key is as the cache stores it, after SetKeyMapper's mapping, like the keys given to a Haunter.
+func (c *FSCache) OriginalKey(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	original, ok := c.originals[key]
+	return original, ok
+}
+
+// SetKeepEmpty controls what happens to entries whose writer is closed without
+// writing anything. By default they are removed, so that a writer which is abandoned
+// (for example after an error before its first Write) doesn't leave an empty hit behind.
+// Use SetKeepEmpty(true) if empty values are intentional.
+// Writers which are garbage collected without being closed are always removed.
+func (c *FSCache) SetKeepEmpty(keep bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keepEmpty = keep
+	return c
+}
+
+// SetMinSize stops the cache from keeping entries smaller than n bytes, for when small
+// values are cheaper to recreate than to store. Small entries are still streamed to
+// the readers which opened them before their writer closed, and are removed once it does.
+// This applies to empty entries even if SetKeepEmpty(true) is set.
+func (c *FSCache) SetMinSize(n int64) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.minSize = n
+	return c
+}
+
+// SetOrphanTimeout aborts writers which neither write nor close for d. Their readers fail with
+// stream.ErrCanceled, their entry is removed so that the key can be filled again, and later
+// calls on the writer return ErrAborted. This stops a writer whose owner has crashed from leaving
+// its key unfilled forever. A zero d, the default, never aborts writers.
+// It applies to writers created after it is called.
+func (c *FSCache) SetOrphanTimeout(d time.Duration) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orphanTimeout = d
+	return c
+}
+
+// SetEvictionExclusions stops the cache's Haunter from evicting keys which match any of patterns.
+// A pattern containing any of the characters *?[ is a path.Match glob like "config/*",
+// otherwise it matches keys which start with it. Keys are matched as the cache stores them,
+// after SetKeyMapper's mapping. Excluded keys are hidden from the Haunter entirely,
+// so they don't count towards its limits. They can still be removed with Remove.
+func (c *FSCache) SetEvictionExclusions(patterns ...string) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exclusions = patterns
+	return c
+}
+
+// excluded reports whether key matches the eviction exclusions. c.mu must be held.
+func (c *FSCache) excluded(key string) bool {
+	for _, pattern := range c.exclusions {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, _ := path.Match(pattern, key); ok {
+				return true
+			}
+		} else if strings.HasPrefix(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetReadTimeout makes readers of a stream which is still being written give up with
+// a WriterStalledError once the writer has made no progress for d. This stops a crashed writer
+// from blocking the readers of its key forever. A zero d, the default, waits forever.
+func (c *FSCache) SetReadTimeout(d time.Duration) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readTimeout = d
+	return c
+}
+
+// SetTraceRecorder records the cache's accesses to t, nil stops recording.
+func (c *FSCache) SetTraceRecorder(t *TraceRecorder) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracer = t
+	return c
+}
+
 func (c *FSCache) mapKey(key string) string {
 	if c.km == nil {
 		return key
@@ -72,6 +253,7 @@ type ReadAtCloser interface {
 
 type fileStream interface {
 	next() (*CacheReader, error)
+	complete() bool
 	InUse() bool
 	io.WriteCloser
 	remove() error
@@ -112,9 +294,11 @@ func NewCache(fs FileSystem, grim Reaper) (*FSCache, error) {
 // Haunter is used to determine when files expire, nil means never expire.
 func NewCacheWithHaunter(fs FileSystem, haunter Haunter) (*FSCache, error) {
 	c := &FSCache{
-		files:   make(map[string]fileStream),
-		haunter: haunter,
-		fs:      fs,
+		files:    make(map[string]fileStream),
+		removing: make(map[string]int),
+		gens:     make(map[string]uint64),
+		haunter:  haunter,
+		fs:       fs,
 	}
 	err := c.load()
 	if err != nil {
@@ -128,22 +312,67 @@ func NewCacheWithHaunter(fs FileSystem, haunter Haunter) (*FSCache, error) {
 }
 
 func (c *FSCache) scheduleHaunt() {
-	c.haunt()
-	time.AfterFunc(c.haunter.Next(), c.scheduleHaunt)
+	c.mu.RLock()
+	background := c.background
+	c.mu.RUnlock()
+	background.Do(c.haunt)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.timer = time.AfterFunc(c.haunter.Next(), c.scheduleHaunt)
+	}
 }
 
 func (c *FSCache) haunt() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
 
-	c.haunter.Haunt(&accessor{c: c})
+	a := &accessor{c: c}
+	c.haunter.Haunt(a)
+	if len(a.evicted) > 0 {
+		c.eviction.Pending += len(a.evicted)
+		go c.evictAll(c.evictSem, c.background, a.evicted)
+	}
+	c.mu.Unlock()
+
+	for _, fn := range a.expired {
+		fn()
+	}
+}
+
+// Close stops the cache's Haunter and makes the cache unusable, further calls
+// return ErrClosed. Open readers and writers can still be used, and the data in the
+// FileSystem is left in place so that another Cache can reload it.
+func (c *FSCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.events != nil {
+		close(c.events)
+	}
+	return nil
 }
 
 func (c *FSCache) load() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return c.fs.Reload(func(key, name string) {
-		c.files[key] = c.oldFile(name)
+		if strings.HasPrefix(key, stagedPrefix) {
+			_ = c.fs.Remove(name)
+			return
+		}
+		c.setFile(key, c.oldFile(name))
+		c.bump(key)
 	})
 }
 
@@ -151,18 +380,129 @@ func (c *FSCache) load() error {
 func (c *FSCache) Exists(key string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	_, ok := c.files[c.mapKey(key)]
+	if c.closed {
+		return false
+	}
+	mapped := c.mapKey(key)
+	c.keepContent(mapped)
+	_, ok := c.files[mapped]
+	if !ok && c.lazy != nil {
+		c.mu.RUnlock()
+		c.mu.Lock()
+		c.resolve(mapped)
+		_, ok = c.files[mapped]
+		c.mu.Unlock()
+		c.mu.RLock()
+	}
 	return ok
 }
 
+// EntrySize returns the size of key's data. The size of an entry which is
+// still being written is the number of bytes written so far.
+func (c *FSCache) EntrySize(key string) (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.files[c.mapKey(key)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// completeSize returns the size of key's data, or -1 if it is missing or still being written.
+func (c *FSCache) completeSize(key string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.files[c.mapKey(key)]
+	if !ok || !f.complete() {
+		return -1
+	}
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// TotalSize returns the sum of the sizes of every entry in the cache,
+// entries which can't be stat'd are not counted.
+func (c *FSCache) TotalSize() int64 {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.files))
+	for _, f := range c.files {
+		names = append(names, f.Name())
+	}
+	c.mu.RUnlock()
+	var total int64
+	for _, name := range names {
+		if fi, err := c.fs.Stat(name); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
 // Get obtains a ReadAtCloser for the given key, and may return a WriteCloser to write the original cache data
-// if this is a cache-miss.
+// if this is a cache-miss. While a Remove of the key waits for its readers, Get returns stream.ErrRemoving
+// instead of a new entry, since the new file could replace the one they are reading; retry once it returns.
 func (c *FSCache) Get(key string) (r ReadAtCloser, w io.WriteCloser, err error) {
 	c.mu.RLock()
-	key = c.mapKey(key)
+	mapped := c.mapKey(key)
+	sampler := c.sampler
+	c.mu.RUnlock()
+	c.keepContent(mapped)
+	r, w, err = c.get(mapped, key)
+	if sampler != nil && err == nil {
+		sampler.sample(key, r)
+	}
+	return r, w, err
+}
+
+// GetContext is Get, passing ctx on to the FileSystem if it is a FileSystemContext, so that
+// a network-backed FileSystem gives up creating or opening the entry's File once ctx is done.
+// Readers of an entry which is still being written open its File as they do for Get, and
+// it returns stream.ErrRemoving as Get does. The reader and writer returned don't use ctx.
+func (c *FSCache) GetContext(ctx context.Context, key string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	c.mu.RLock()
+	mapped := c.mapKey(key)
+	sampler := c.sampler
+	c.mu.RUnlock()
+	c.keepContent(mapped)
+	r, w, err = c.getContext(ctx, mapped, key)
+	if sampler != nil && err == nil {
+		sampler.sample(key, r)
+	}
+	return r, w, err
+}
+
+// get is Get for a key which has already been mapped, original is the key
+// before it was mapped if it is known.
+func (c *FSCache) get(key, original string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	return c.getContext(context.Background(), key, original)
+}
+
+// getContext is get, passing ctx to the FileSystem.
+func (c *FSCache) getContext(ctx context.Context, key, original string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return nil, nil, ErrClosed
+	}
 	f, ok := c.files[key]
 	if ok {
-		r, err = f.next()
+		r, err = nextContext(ctx, f)
+		c.trace(key, OpGet, f)
+		if err == nil {
+			atomic.AddInt64(&c.hits, 1)
+			c.emit(EventRead, key, f)
+		}
 		c.mu.RUnlock()
 		return r, nil, err
 	}
@@ -170,41 +510,383 @@ func (c *FSCache) Get(key string) (r ReadAtCloser, w io.WriteCloser, err error)
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.getLockedContext(ctx, key, original)
+}
 
-	f, ok = c.files[key]
+// getLocked is get with c.mu held for writing.
+func (c *FSCache) getLocked(key, original string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	return c.getLockedContext(context.Background(), key, original)
+}
+
+// getLockedContext is getContext with c.mu held for writing.
+func (c *FSCache) getLockedContext(ctx context.Context, key, original string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+	c.resolve(key)
+
+	f, ok := c.files[key]
 	if ok {
-		r, err = f.next()
+		r, err = nextContext(ctx, f)
+		c.trace(key, OpGet, f)
+		if err == nil {
+			atomic.AddInt64(&c.hits, 1)
+			c.emit(EventRead, key, f)
+		}
 		return r, nil, err
 	}
+	c.trace(key, OpGet, nil)
 
-	f, err = c.newFile(key)
+	// The file for a key which is being removed may still be in use,
+	// so it can't be re-created until the removal has finished.
+	if c.removing[key] > 0 {
+		return nil, nil, stream.ErrRemoving
+	}
+
+	cf, err := c.newFile(ctx, key)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	r, err = f.next()
+	r, err = cf.next()
 	if err != nil {
-		_ = f.Close()
-		_ = c.fs.Remove(f.Name())
+		_ = cf.stream.Close()
+		_ = c.fs.Remove(cf.Name())
 		return nil, nil, err
 	}
 
-	c.files[key] = f
+	if p, ok := c.partials[key]; ok {
+		delete(c.partials, key)
+		cf.resume = &p
+	}
+	if c.tee != nil {
+		teeKey := key
+		if original != "" {
+			teeKey = original
+		}
+		cf.tee = &teeSink{fn: c.tee, key: teeKey}
+	}
+	c.setFile(key, cf)
+	if c.originals != nil && original != "" {
+		c.originals[key] = original
+	}
+	c.emit(EventCreate, key, nil)
+	atomic.AddInt64(&c.misses, 1)
+
+	return r, newEntryWriter(cf), err
+}
+
+// ExpiresAt returns when the entry for key becomes eligible for eviction, according to
+// the cache's Haunter and the entry's current access times. It returns false if the key
+// isn't cached, is excluded from eviction, or the Haunter isn't an Expirer, e.g. an LRUHaunter
+// whose evictions depend on the other entries. The entry is removed at the first haunt after this time.
+func (c *FSCache) ExpiresAt(key string) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.haunter.(Expirer)
+	if !ok || c.closed {
+		return time.Time{}, false
+	}
+	key = c.mapKey(key)
+	f, ok := c.files[key]
+	if !ok || c.excluded(key) {
+		return time.Time{}, false
+	}
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return e.ExpiresAt(key, fi.AccessTime(), fi.ModTime())
+}
 
-	return r, f, err
+// Touch marks the entry for key as just read without opening a reader, so that
+// Haunters which evict by access time keep it. The FileSystem must be a FileSystemToucher.
+func (c *FSCache) Touch(key string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	t, ok := c.fs.(FileSystemToucher)
+	if !ok {
+		return ErrUnsupported
+	}
+	f, ok := c.files[c.mapKey(key)]
+	if !ok {
+		return ErrNotFound
+	}
+	return t.Touch(f.Name())
 }
 
 // Remove removes the specified key from the cache.
 func (c *FSCache) Remove(key string) error {
-	c.mu.Lock()
+	c.mu.RLock()
 	key = c.mapKey(key)
+	err := c.checkMutable(key)
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return c.remove(key)
+}
+
+// RemoveMatching removes every key for which match returns true, blocking
+// until all of their files can be deleted. Keys are matched as the cache
+// stores them, that is after SetKeyMapper's mapping. It returns the first error encountered.
+func (c *FSCache) RemoveMatching(match func(key string) bool) error {
+	var (
+		grp  sync.WaitGroup
+		mu   sync.Mutex
+		err1 error
+	)
+	c.mu.RLock()
+	var keys []string
+	for key := range c.files {
+		if !match(key) {
+			continue
+		}
+		if err := c.checkMutable(key); err != nil {
+			if err1 == nil {
+				err1 = err
+			}
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	for _, key := range keys {
+		grp.Add(1)
+		go func(key string) {
+			defer grp.Done()
+			if err2 := c.remove(key); err2 != nil {
+				mu.Lock()
+				if err1 == nil {
+					err1 = err2
+				}
+				mu.Unlock()
+			}
+		}(key)
+	}
+	grp.Wait()
+	return err1
+}
+
+// RemovePrefix removes every key which starts with prefix, see RemoveMatching.
+func (c *FSCache) RemovePrefix(prefix string) error {
+	return c.RemoveMatching(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// remove is Remove for a key which has already been mapped.
+func (c *FSCache) remove(key string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.dropPartial(key)
+	c.resolve(key)
 	f, ok := c.files[key]
-	delete(c.files, key)
+	if ok {
+		c.emit(EventRemove, key, f)
+		c.unmap(key)
+	}
 	c.mu.Unlock()
 
-	if ok {
-		return f.remove()
+	if !ok {
+		return nil
+	}
+	return c.finishRemove(key, f)
+}
+
+// unmap drops key from the index and marks it as being removed, until
+// finishRemove is called with its entry. c.mu must be held.
+func (c *FSCache) unmap(key string) {
+	c.deleteFile(key)
+	c.removing[key]++
+	c.trace(key, OpRemove, nil)
+}
+
+// finishRemove deletes f, the entry key was unmapped from, blocking until its
+// files are no longer in use.
+func (c *FSCache) finishRemove(key string, f fileStream) error {
+	err := f.remove()
+
+	c.mu.Lock()
+	c.doneRemoving(key)
+	c.mu.Unlock()
+	return err
+}
+
+// doneRemoving allows key to be filled again once its last removal has finished. c.mu must be held.
+func (c *FSCache) doneRemoving(key string) {
+	if c.removing[key]--; c.removing[key] == 0 {
+		delete(c.removing, key)
+	}
+}
+
+// Copy makes the entry for src available under dst as well.
+// If the FileSystem is a FileSystemLinker and src has finished being written,
+// dst shares src's data. Otherwise the data is streamed into dst, which blocks until
+// src has been completely written.
+func (c *FSCache) Copy(src, dst string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	src, dst = c.mapKey(src), c.mapKey(dst)
+	f, ok := c.files[src]
+	if !ok {
+		c.mu.Unlock()
+		return ErrNotFound
+	}
+	if _, ok := c.files[dst]; ok {
+		c.mu.Unlock()
+		return ErrKeyExists
+	}
+
+	if l, ok := c.fs.(FileSystemLinker); ok && f.complete() && c.removing[dst] == 0 {
+		if name, err := l.Link(f.Name(), dst); err == nil {
+			c.setFile(dst, c.oldFile(name))
+			c.bump(dst)
+			c.emit(EventCreate, dst, nil)
+			c.emit(EventWrite, dst, c.files[dst])
+			c.mu.Unlock()
+			return nil
+		}
+	}
+
+	r, err := f.next()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dr, w, err := c.get(dst, "")
+	if err != nil {
+		return err
+	}
+	dr.Close()
+	if w == nil {
+		return ErrKeyExists
+	}
+
+	_, err = io.Copy(w, r)
+	w.Close()
+	if err != nil {
+		_ = c.remove(dst)
+	}
+	return err
+}
+
+// Ingest adds the os file at path to the cache as key. If the FileSystem is a
+// FileSystemIngester which can take it in without copying, such as a StandardFS with
+// path on the same device, the entry shares path's data. Otherwise path is copied in.
+// Either way the entry is the cache's own, path is left in place.
+func (c *FSCache) Ingest(path, key string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	dst := c.mapKey(key)
+	if _, ok := c.files[dst]; ok {
+		c.mu.Unlock()
+		return ErrKeyExists
+	}
+
+	if in, ok := c.fs.(FileSystemIngester); ok && c.removing[dst] == 0 {
+		if name, err := in.Ingest(path, dst); err == nil {
+			c.setFile(dst, c.oldFile(name))
+			c.bump(dst)
+			if c.originals != nil {
+				c.originals[dst] = key
+			}
+			c.emit(EventCreate, dst, nil)
+			c.emit(EventWrite, dst, c.files[dst])
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	c.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, w, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	if w == nil {
+		return ErrKeyExists
+	}
+
+	_, err = io.Copy(w, f)
+	w.Close()
+	if err != nil {
+		_ = c.Remove(key)
+	}
+	return err
+}
+
+// Rename moves the entry for oldKey to newKey, without copying its data.
+// The entry must have finished being written, and the FileSystem must be a
+// FileSystemRenamer. Readers which are already open are unaffected.
+func (c *FSCache) Rename(oldKey, newKey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	rn, ok := c.fs.(FileSystemRenamer)
+	if !ok {
+		return ErrUnsupported
+	}
+	src, dst := c.mapKey(oldKey), c.mapKey(newKey)
+	f, ok := c.files[src]
+	if !ok {
+		return ErrNotFound
+	}
+	if src == dst {
+		return nil
+	}
+	if err := c.checkMutable(src); err != nil {
+		return err
+	}
+	if _, ok := c.files[dst]; ok {
+		return ErrKeyExists
+	}
+	if c.removing[dst] > 0 {
+		return stream.ErrRemoving
+	}
+	if !f.complete() {
+		return ErrInProgress
 	}
+
+	name, err := rn.Rename(f.Name(), dst)
+	if err != nil {
+		return err
+	}
+	_, kept := c.originals[src]
+	c.emit(EventRemove, src, nil)
+	c.deleteFile(src)
+	c.trace(src, OpRemove, nil)
+
+	c.setFile(dst, c.oldFile(name))
+	c.bump(dst)
+	if kept {
+		c.originals[dst] = newKey
+	}
+	c.emit(EventCreate, dst, nil)
+	c.emit(EventWrite, dst, c.files[dst])
 	return nil
 }
 
@@ -212,12 +894,59 @@ func (c *FSCache) Remove(key string) error {
 func (c *FSCache) Clean() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.files = make(map[string]fileStream)
+	if c.closed {
+		return ErrClosed
+	}
+	for key, f := range c.files {
+		c.emit(EventRemove, key, f)
+		c.deleteFile(key)
+	}
+	for key := range c.partials {
+		delete(c.partials, key)
+	}
 	return c.fs.RemoveAll()
 }
 
+// setFile adds f to the cache's index as key. c.mu must be held.
+func (c *FSCache) setFile(key string, f fileStream) {
+	c.markSeen(key)
+	if _, ok := c.files[key]; !ok && c.usage != nil {
+		c.usage.add(key)
+	}
+	if _, ok := c.files[key]; !ok && c.soft != nil {
+		c.softAdd(key)
+	}
+	c.files[key] = f
+	if c.keyTree != nil {
+		c.keyTree.add(key)
+	}
+}
+
+// deleteFile drops key from the cache's index. c.mu must be held.
+func (c *FSCache) deleteFile(key string) {
+	if _, ok := c.files[key]; ok && c.usage != nil {
+		c.usage.remove(key)
+	}
+	if _, ok := c.files[key]; ok && c.soft != nil {
+		c.softRemove(key)
+	}
+	delete(c.files, key)
+	if c.keyTree != nil {
+		c.keyTree.remove(key)
+	}
+	delete(c.originals, key)
+	delete(c.gens, key)
+	delete(c.onExpire, key)
+	delete(c.priorities, key)
+	if c.dedup != nil {
+		c.dedup.remove(key)
+	}
+}
+
 type accessor struct {
-	c *FSCache
+	c       *FSCache
+	evicted []evicted // files to remove in the background after the haunt
+	expired []func()  // the OnExpire callbacks of the evicted entries
 }
 
 func (a *accessor) Stat(name string) (FileInfo, error) {
@@ -226,38 +955,96 @@ func (a *accessor) Stat(name string) (FileInfo, error) {
 
 func (a *accessor) EnumerateEntries(enumerator func(key string, e Entry) bool) {
 	for k, f := range a.c.files {
-		if !enumerator(k, Entry{name: f.Name(), inUse: f.InUse()}) {
+		if a.c.excluded(k) {
+			continue
+		}
+		if !enumerator(k, Entry{name: f.Name(), inUse: f.InUse(), gen: a.c.gens[k], priority: a.c.priorities[k]}) {
 			break
 		}
 	}
 }
 
+// RemoveFile removes key, which is already mapped as it came from EnumerateEntries.
 func (a *accessor) RemoveFile(key string) {
-	key = a.c.mapKey(key)
+	if a.c.excluded(key) {
+		return
+	}
 	f, ok := a.c.files[key]
-	delete(a.c.files, key)
 	if ok {
-		_ = a.c.fs.Remove(f.Name())
+		a.expired = append(a.expired, a.c.onExpire[key]...)
+	}
+	a.c.deleteFile(key)
+	if !ok {
+		return
+	}
+	a.c.emit(EventEvict, key, f)
+	if a.c.evictSem != nil {
+		a.c.removing[key]++
+		a.evicted = append(a.evicted, evicted{key: key, name: f.Name()})
+		return
 	}
+	_ = a.c.fs.Remove(f.Name())
 }
 
 type cachedFile struct {
 	handleCounter
-	stream *stream.Stream
+	c       *FSCache
+	key     string
+	stream  *stream.Stream
+	written int64
+	done    int32 // set once the writer has been closed
+	wrote   int64 // UnixNano of the last Write which made progress
+	aborted int32 // set if the writer was aborted instead of closed
+	once    sync.Once
+	times   atomic.Value // entryTimes, if set by SetTimes
+	tee     *teeSink     // set if fills are teed, see SetWriteTee
+
+	hmu sync.Mutex
+	h   hash.Hash // hashes the data written if dedup is enabled
+
+	resume     *partialFill // the aborted fill this entry continues
+	resumeOnce sync.Once
+	resumeErr  error
 }
 
-func (c *FSCache) newFile(name string) (fileStream, error) {
-	s, err := stream.NewStream(name, c.fs)
+func (c *FSCache) newFile(ctx context.Context, name string) (*cachedFile, error) {
+	var fs stream.FileSystem = c.fs
+	if cfs, ok := c.fs.(FileSystemContext); ok && ctx != context.Background() {
+		fs = createContextFS{FileSystem: c.fs, cfs: cfs, ctx: ctx}
+	}
+	s, err := stream.NewStream(name, fs)
 	if err != nil {
 		return nil, err
 	}
 	cf := &cachedFile{
+		c:      c,
+		key:    name,
 		stream: s,
+		wrote:  time.Now().UnixNano(),
+		h:      c.newDedupHash(),
 	}
 	cf.inc()
+	if c.orphanTimeout > 0 {
+		cf.watchOrphan(c.orphanTimeout, c.orphanTimeout)
+	}
 	return cf, nil
 }
 
+// watchOrphan aborts f after wait if its writer hasn't made progress for timeout by then.
+func (f *cachedFile) watchOrphan(timeout, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		last, _, done := f.progress()
+		if done || atomic.LoadInt32(&f.aborted) == 1 {
+			return
+		}
+		if idle := time.Since(last); idle < timeout {
+			f.watchOrphan(timeout, timeout-idle)
+			return
+		}
+		f.c.abort(f)
+	})
+}
+
 func (c *FSCache) oldFile(name string) fileStream {
 	return &reloadedFile{
 		fs:   c.fs,
@@ -274,24 +1061,61 @@ type reloadedFile struct {
 
 func (f *reloadedFile) Name() string { return f.name }
 
+func (f *reloadedFile) complete() bool { return true }
+
 func (f *reloadedFile) remove() error {
 	f.waitUntilFree()
 	return f.fs.Remove(f.name)
 }
 
 func (f *reloadedFile) next() (*CacheReader, error) {
-	r, err := f.fs.Open(f.name)
+	return f.nextContext(context.Background())
+}
+
+// nextContext is next, passing ctx to the FileSystem.
+func (f *reloadedFile) nextContext(ctx context.Context) (*CacheReader, error) {
+	var r stream.File
+	var err error
+	if cfs, ok := f.fs.(FileSystemContext); ok {
+		r, err = cfs.OpenContext(ctx, f.name)
+	} else {
+		r, err = f.fs.Open(f.name)
+	}
 	if err == nil {
 		f.inc()
 	}
 	return &CacheReader{
 		ReadAtCloser: r,
 		cnt:          &f.handleCounter,
+		fs:           f.fs,
+		name:         f.name,
 	}, err
 }
 
+// entryWriter is the writer handed out for a new entry, it is separate from the
+// cachedFile so that the entry can be abandoned if it becomes unreachable.
+type entryWriter struct {
+	*cachedFile
+}
+
+func newEntryWriter(f *cachedFile) *entryWriter {
+	w := &entryWriter{f}
+	runtime.SetFinalizer(w, func(w *entryWriter) {
+		go w.c.abort(w.cachedFile)
+	})
+	return w
+}
+
+// Close closes the entry's writer.
+func (w *entryWriter) Close() error {
+	runtime.SetFinalizer(w, nil)
+	return w.cachedFile.Close()
+}
+
 func (f *cachedFile) Name() string { return f.stream.Name() }
 
+func (f *cachedFile) complete() bool { return atomic.LoadInt32(&f.done) == 1 }
+
 func (f *cachedFile) remove() error { return f.stream.Remove() }
 
 func (f *cachedFile) next() (*CacheReader, error) {
@@ -303,27 +1127,260 @@ func (f *cachedFile) next() (*CacheReader, error) {
 	return &CacheReader{
 		ReadAtCloser: reader,
 		cnt:          &f.handleCounter,
+		fs:           f.c.fs,
+		name:         f.Name(),
+		timeout:      f.c.readTimeout,
+		progress:     f.progress,
 	}, nil
 }
 
+// progress returns the time of the writer's last progress, how much it has
+// written, and whether it is done.
+func (f *cachedFile) progress() (time.Time, int64, bool) {
+	return time.Unix(0, atomic.LoadInt64(&f.wrote)), atomic.LoadInt64(&f.written), f.complete()
+}
+
 func (f *cachedFile) Write(p []byte) (int, error) {
-	return f.stream.Write(p)
+	if atomic.LoadInt32(&f.aborted) == 1 {
+		return 0, ErrAborted
+	}
+	if err := f.resumed(); err != nil {
+		return 0, err
+	}
+	return f.write(p)
+}
+
+func (f *cachedFile) write(p []byte) (int, error) {
+	if f.h != nil {
+		// the hash must see the data in the same order as the stream.
+		f.hmu.Lock()
+		defer f.hmu.Unlock()
+	}
+	n, err := f.stream.Write(p)
+	if f.h != nil {
+		f.h.Write(p[:n])
+	}
+	if n > 0 {
+		atomic.AddInt64(&f.written, int64(n))
+		atomic.StoreInt64(&f.wrote, time.Now().UnixNano())
+		if f.tee != nil {
+			f.tee.write(p[:n])
+		}
+	}
+	return n, err
 }
 
-func (f *cachedFile) Close() error {
-	defer f.dec()
-	return f.stream.Close()
+func (f *cachedFile) Close() (err error) {
+	if atomic.LoadInt32(&f.aborted) == 1 {
+		return ErrAborted
+	}
+	if err := f.resumed(); err != nil {
+		return err
+	}
+	closed := false
+	f.once.Do(func() {
+		defer f.dec()
+		closed = true
+		err = f.stream.Close()
+		if f.tee != nil {
+			f.tee.close(false)
+		}
+		atomic.StoreInt32(&f.done, 1)
+		f.c.fileClosed(f)
+	})
+	if atomic.LoadInt32(&f.aborted) == 1 {
+		return ErrAborted
+	}
+	if closed {
+		// once the writer's handle is released, so the entry counts towards the budget.
+		f.c.evictAfterWrite()
+	}
+	return err
+}
+
+// fileClosed is called once the writer of f has been closed.
+func (c *FSCache) fileClosed(f *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := atomic.LoadInt64(&f.written)
+	if c.tracer != nil {
+		c.tracer.record(f.key, OpWrite, written)
+	}
+	if c.files[f.key] != f {
+		return
+	}
+	c.send(Event{Type: EventWrite, Key: f.key, Size: written})
+
+	// the entry's readers may belong to the writer's goroutine, so its
+	// files can't be deleted until after Close returns.
+	if (written == 0 && !c.keepEmpty || written < c.minSize) && !c.closed {
+		c.emit(EventRemove, f.key, nil)
+		c.unmap(f.key)
+		go c.finishRemove(f.key, f)
+		return
+	}
+
+	if t, ok := f.times.Load().(entryTimes); ok {
+		_ = c.fs.(FileSystemChtimes).Chtimes(f.Name(), t.rt, t.wt)
+	}
+	c.bump(f.key)
+	if c.dedup != nil && f.h != nil {
+		f.hmu.Lock()
+		digest := string(f.h.Sum(nil))
+		f.hmu.Unlock()
+		c.dedupFile(f, digest)
+	}
+}
+
+// abort cancels the writer of f if it hasn't been closed, and removes its entry.
+// It is used for writers which were garbage collected without being closed, or orphaned.
+func (c *FSCache) abort(f *cachedFile) {
+	aborted := false
+	f.once.Do(func() {
+		aborted = true
+		atomic.StoreInt32(&f.aborted, 1)
+		_ = f.stream.Cancel()
+		if f.tee != nil {
+			f.tee.close(true)
+		}
+		f.dec()
+	})
+	if !aborted {
+		return
+	}
+
+	c.mu.Lock()
+	if c.files[f.key] != f || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.emit(EventRemove, f.key, nil)
+	c.unmap(f.key)
+	resumable := c.partials != nil
+	c.mu.Unlock()
+
+	if resumable && atomic.LoadInt64(&f.written) > 0 {
+		if p, err := c.savePartial(f); err == nil {
+			c.mu.Lock()
+			if c.partials != nil {
+				c.partials[f.key] = p
+			} else {
+				_ = c.fs.Remove(p.name)
+			}
+			c.mu.Unlock()
+		}
+	}
+	_ = c.finishRemove(f.key, f)
+}
+
+// trace records an operation on key if there is a TraceRecorder, f is the key's
+// entry if it exists. c.mu must be held.
+func (c *FSCache) trace(key string, op Op, f fileStream) {
+	if c.tracer == nil || !c.tracer.sampled(key) {
+		return
+	}
+	var size int64
+	if f != nil {
+		if fi, err := c.fs.Stat(f.Name()); err == nil {
+			size = fi.Size()
+		}
+	}
+	c.tracer.record(key, op, size)
 }
 
 // CacheReader is a ReadAtCloser for a Cache key that also tracks open readers.
 type CacheReader struct {
 	ReadAtCloser
-	cnt *handleCounter
+	cnt  *handleCounter
+	fs   FileSystem
+	name string
+
+	timeout  time.Duration
+	progress func() (time.Time, int64, bool)
+	stalled  atomic.Value // *WriterStalledError, once timed out
+	sample   *readSample  // set if the reader is sampled, see SetReadSampler
+}
+
+// LastProgress returns when the stream's writer last wrote to it, and true if
+// the writer is done. Streams which were loaded from the FileSystem are always done.
+func (r *CacheReader) LastProgress() (time.Time, bool) {
+	if r.progress == nil {
+		return time.Time{}, true
+	}
+	last, _, done := r.progress()
+	return last, done
+}
+
+// Read reads from the stream, see SetReadTimeout.
+func (r *CacheReader) Read(p []byte) (int, error) {
+	n, err := r.watch(func() (int, error) { return r.ReadAtCloser.Read(p) })
+	if r.sample != nil {
+		r.sample.read(n)
+	}
+	return n, err
+}
+
+// ReadAt reads from the stream at off, see SetReadTimeout.
+func (r *CacheReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.watch(func() (int, error) { return r.ReadAtCloser.ReadAt(p, off) })
+	if r.sample != nil {
+		r.sample.read(n)
+	}
+	return n, err
+}
+
+// watch runs read, closing the underlying reader to unblock it if the writer
+// stops making progress for longer than r.timeout.
+func (r *CacheReader) watch(read func() (int, error)) (int, error) {
+	if err, ok := r.stalled.Load().(*WriterStalledError); ok {
+		return 0, err
+	}
+	if r.timeout <= 0 || r.progress == nil {
+		return read()
+	}
+
+	stop := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		t := time.NewTimer(r.timeout)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			last, offset, done := r.progress()
+			if done {
+				return
+			}
+			idle := time.Since(last)
+			if idle < r.timeout {
+				t.Reset(r.timeout - idle)
+				continue
+			}
+			r.stalled.Store(&WriterStalledError{Idle: idle, Offset: offset})
+			r.ReadAtCloser.Close()
+			return
+		}
+	}()
+
+	n, err := read()
+	close(stop)
+	<-watching
+	if err, ok := r.stalled.Load().(*WriterStalledError); ok {
+		return n, err
+	}
+	return n, err
 }
 
 // Close frees the underlying ReadAtCloser and updates the open reader counter.
 func (r *CacheReader) Close() error {
 	defer r.cnt.dec()
+	if r.sample != nil {
+		defer r.sample.closed()
+	}
 	return r.ReadAtCloser.Close()
 }
 
@@ -1,17 +1,33 @@
 package fscache
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/djherbis/fscache/protocol"
+	"github.com/djherbis/stream"
 )
 
 func createFile(name string) (*os.File, error) {
@@ -19,6 +35,9 @@ func createFile(name string) (*os.File, error) {
 }
 
 func init() {
+	if os.Getenv("FSCACHE_TEST_HANDOFF_CHILD") != "" {
+		return // the parent test process is serving localhost:10000
+	}
 	c, err := NewCache(NewMemFs(), nil)
 	if err != nil {
 		panic(err)
@@ -30,6 +49,21 @@ func init() {
 	}()
 }
 
+// waitForServer blocks until addr accepts connections.
+func waitForServer(t *testing.T, addr string) {
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func testCaches(t *testing.T, run func(c Cache)) {
 	c, err := New("./cache", 0700, 1*time.Hour)
 	if err != nil {
@@ -377,6 +411,77 @@ func TestLRUHaunterMaxSize(t *testing.T) {
 	}
 }
 
+// lruAccessor is a CacheAccessor of entries with fixed times, sizes and generations.
+type lruAccessor map[string]struct {
+	rt, wt time.Time
+	size   int64
+	gen    uint64
+}
+
+func (a lruAccessor) Stat(name string) (FileInfo, error) {
+	e := a[name]
+	return FileInfo{FileInfo: &fileInfo{name: name, size: e.size, wt: e.wt}, Atime: e.rt}, nil
+}
+
+func (a lruAccessor) EnumerateEntries(enumerator func(key string, e Entry) bool) {
+	for k, e := range a {
+		if !enumerator(k, Entry{name: k, gen: e.gen}) {
+			return
+		}
+	}
+}
+
+func (a lruAccessor) RemoveFile(key string) { delete(a, key) }
+
+func TestLRUHaunterAccessTimes(t *testing.T) {
+	t0 := time.Now().Truncate(time.Second)
+	entries := func() lruAccessor {
+		return lruAccessor{
+			// written last but never read, as where reads don't update atime.
+			"a": {rt: t0, wt: t0.Add(3 * time.Second), size: 10, gen: 6},
+			"b": {rt: t0.Add(time.Second), wt: t0, size: 10, gen: 1},
+			// the same times, as with coarse timestamps, so written order decides.
+			"c": {rt: t0.Add(2 * time.Second), wt: t0, size: 10, gen: 5},
+			"d": {rt: t0.Add(2 * time.Second), wt: t0, size: 10, gen: 4},
+		}
+	}
+
+	if got := fmt.Sprint(NewLRUHaunter(2, 0, time.Hour).Scrub(entries())); got != "[b d]" {
+		t.Errorf("maxItems scrubbed %s, expected [b d]", got)
+	}
+	if got := fmt.Sprint(NewLRUHaunter(0, 15, time.Hour).Scrub(entries())); got != "[b d c]" {
+		t.Errorf("maxSize scrubbed %s, expected [b d c]", got)
+	}
+	if got := NewLRUHaunter(4, 40, time.Hour).Scrub(entries()); len(got) != 0 {
+		t.Errorf("expected nothing scrubbed under the limits, got %v", got)
+	}
+}
+
+func TestLRUHaunterWatermarks(t *testing.T) {
+	t0 := time.Now()
+	entries := func() lruAccessor {
+		a := make(lruAccessor)
+		for i := 0; i < 4; i++ {
+			a[fmt.Sprint(i)] = struct {
+				rt, wt time.Time
+				size   int64
+				gen    uint64
+			}{rt: t0.Add(time.Duration(i) * time.Second), wt: t0, size: 10, gen: uint64(i)}
+		}
+		return a
+	}
+
+	if got := fmt.Sprint(NewLRUHaunterWithWatermarks(0, 35, 15, time.Hour).Scrub(entries())); got != "[0 1 2]" {
+		t.Errorf("expected scrubbing down to the low watermark, got %s", got)
+	}
+	if got := NewLRUHaunterWithWatermarks(0, 40, 15, time.Hour).Scrub(entries()); len(got) != 0 {
+		t.Errorf("expected nothing scrubbed at the high watermark, got %v", got)
+	}
+	if got := fmt.Sprint(NewLRUHaunterWithWatermarks(0, 35, 50, time.Hour).Scrub(entries())); got != "[0]" {
+		t.Errorf("expected a low watermark over the high one to be capped, got %s", got)
+	}
+}
+
 func TestReaper(t *testing.T) {
 	fs, err := NewFs("./cache1", 0700)
 	if err != nil {
@@ -591,3 +696,5360 @@ func check(t *testing.T, r io.Reader, data string) {
 		t.Errorf("unexpected output %q, want %q", buf.String(), data)
 	}
 }
+
+func TestGetRemoving(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+
+	// Remove waits for r, so it is in flight until r is closed.
+	removed := make(chan error, 1)
+	go func() { removed <- c.Remove("key") }()
+	for removing := false; !removing; {
+		time.Sleep(time.Millisecond)
+		c.mu.RLock()
+		removing = c.removing["key"] > 0
+		c.mu.RUnlock()
+	}
+	if _, _, err := c.Get("key"); err != stream.ErrRemoving {
+		t.Errorf("expected ErrRemoving while the key is being removed, got %v", err)
+	}
+	if _, _, err := c.GetContext(context.Background(), "key"); err != stream.ErrRemoving {
+		t.Errorf("expected GetContext to return ErrRemoving too, got %v", err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	r, w, err = c.Get("key")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss once removed, got %v", err)
+	}
+	w.Close()
+	r.Close()
+}
+
+func TestContentWriterRemoving(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func() (string, error) {
+		w, err := c.NewContentWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		return w.Commit()
+	}
+	key, err := commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove waits for the entry's reader, so it is in flight until r is closed.
+	r, _, err := c.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := make(chan error, 1)
+	go func() { removed <- c.Remove(key) }()
+	for removing := false; !removing; {
+		time.Sleep(time.Millisecond)
+		c.mu.RLock()
+		removing = c.removing[key] > 0
+		c.mu.RUnlock()
+	}
+
+	if _, err := commit(); err != stream.ErrRemoving {
+		t.Errorf("expected ErrRemoving while the key is being removed, got %v", err)
+	}
+	r.Close()
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit(); err != nil || !c.Exists(key) {
+		t.Errorf("expected the content to be committed once removed, got %v", err)
+	}
+}
+
+func TestContentWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscache-content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c, err := New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*FSCache{c, mc} {
+		var keys []string
+		for i := 0; i < 2; i++ {
+			w, err := c.NewContentWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("hello"))
+			key, err := w.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		if keys[0] != keys[1] {
+			t.Errorf("expected identical content to have the same key, got %s and %s", keys[0], keys[1])
+		}
+		if keys[0] != "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+			t.Errorf("unexpected key %s", keys[0])
+		}
+
+		r, w, err := c.Get(keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatal("expected committed content to be a hit")
+		}
+		check(t, r, "hello")
+		r.Close()
+
+		w2, err := c.NewContentWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w2.Write([]byte("discarded"))
+		w2.Close()
+		if n := len(c.files); n != 1 {
+			t.Errorf("expected 1 entry after discarding a ContentWriter, got %d", n)
+		}
+	}
+
+	nc, err := New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nc.Exists("sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824") {
+		t.Errorf("expected content entry to be reloaded")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscache-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c, err := New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*FSCache{c, mc} {
+		r, w, err := c.Get("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		w.Close()
+		r.Close()
+
+		if err := c.Copy("src", "dst"); err != nil {
+			t.Fatalf("failed to copy complete entry: %v", err)
+		}
+		if err := c.Copy("src", "dst"); err != ErrKeyExists {
+			t.Errorf("expected ErrKeyExists, got %v", err)
+		}
+		if err := c.Copy("missing", "other"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		c.Remove("src")
+
+		r, w, err = c.Get("dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatal("expected dst to be a hit")
+		}
+		check(t, r, "hello")
+		r.Close()
+
+		// in-progress entries are streamed into dst
+		r, w, err = c.Get("filling")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		go func() {
+			w.Write([]byte("hello"))
+			<-time.After(10 * time.Millisecond)
+			w.Write([]byte(" world"))
+			w.Close()
+		}()
+		if err := c.Copy("filling", "filled"); err != nil {
+			t.Fatalf("failed to copy filling entry: %v", err)
+		}
+		r, _, err = c.Get("filled")
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, r, "hello world")
+		r.Close()
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	start := time.Unix(0, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	lru := Simulate([]Access{
+		{Key: "a", Size: 10, Time: at(0)},
+		{Key: "b", Size: 20, Time: at(time.Second)},
+		{Key: "c", Size: 30, Time: at(2 * time.Second)},
+		{Key: "a", Size: 10, Time: at(3500 * time.Millisecond)},
+		{Key: "b", Size: 20, Time: at(3600 * time.Millisecond)},
+	}, NewLRUHaunterStrategy(NewLRUHaunter(2, 0, time.Second)))
+
+	if want := (SimulationResult{Hits: 1, Misses: 4, Evictions: 1, BytesEvicted: 10}); lru != want {
+		t.Errorf("lru: got %+v, want %+v", lru, want)
+	}
+
+	reaper := Simulate([]Access{
+		{Key: "a", Size: 10, Time: at(0)},
+		{Key: "a", Size: 10, Time: at(time.Second)},
+		{Key: "a", Size: 10, Time: at(3 * time.Second)},
+	}, NewReaperHaunterStrategy(NewReaper(1500*time.Millisecond, time.Second)))
+
+	if want := (SimulationResult{Hits: 1, Misses: 2, Evictions: 1, BytesEvicted: 10}); reaper != want {
+		t.Errorf("reaper: got %+v, want %+v", reaper, want)
+	}
+	if r := reaper.HitRatio(); r != 1.0/3 {
+		t.Errorf("expected hit ratio of 1/3, got %v", r)
+	}
+}
+
+func TestTraceRecorder(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTraceRecorder(NewTraceRecorder(buf, 1))
+
+	for i := 0; i < 2; i++ {
+		r, w, err := c.Get("stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			w.Write([]byte("hello"))
+			w.Close()
+		}
+		r.Close()
+	}
+	c.Remove("stream")
+
+	trace, err := ReadTrace(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []Op
+	for _, a := range trace {
+		ops = append(ops, a.Op)
+		if a.Key == "stream" || a.Key != trace[0].Key {
+			t.Errorf("expected every access to use the same anonymized key, got %q", a.Key)
+		}
+	}
+	if got := fmt.Sprint(ops); got != "[get write get remove]" {
+		t.Errorf("unexpected ops %s", got)
+	}
+	if trace[1].Size != 5 || trace[2].Size != 5 {
+		t.Errorf("expected write and hit to record the entry size, got %+v", trace)
+	}
+	if res := Simulate(trace, NewReaperHaunterStrategy(NewReaper(time.Hour, time.Hour))); res.Hits != 1 || res.Misses != 1 {
+		t.Errorf("unexpected simulation of recorded trace %+v", res)
+	}
+
+	buf.Reset()
+	c.SetTraceRecorder(NewTraceRecorder(buf, 0))
+	r, _, _ := c.Get("stream")
+	r.Close()
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be sampled, got %s", buf.String())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	wt := rt.Add(-time.Hour)
+	for _, key := range []string{"a", longString} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.(MetadataWriter).SetMetadata([]byte("meta\x00" + key)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.(TimesWriter).SetTimes(rt, wt); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data for " + key))
+		w.Close()
+		r.Close()
+	}
+	r, w, err := c.Get("filling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	defer w.Close()
+
+	buf := bytes.NewBuffer(nil)
+	if err := c.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "fscache-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic, err := ImportCache(fs, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ic.Exists("filling") {
+		t.Errorf("expected in-progress entry to be skipped")
+	}
+	for _, key := range []string{"a", longString} {
+		r, w, err := ic.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatalf("expected %q to be imported", key)
+		}
+		if meta, err := r.(MetadataReader).Metadata(); err != nil || string(meta) != "meta\x00"+key {
+			t.Errorf("expected the metadata to be imported, got %q, %v", meta, err)
+		}
+		// the Get has just touched the access time.
+		if _, gwt, err := r.(TimesReader).Times(); err != nil || !gwt.Equal(wt) {
+			t.Errorf("expected the write time %v to be imported, got %v, %v", wt, gwt, err)
+		}
+		check(t, r, "data for "+key)
+		r.Close()
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := NewAdaptiveLimiter(1, 4, time.Second)
+	if !l.Acquire() {
+		t.Fatal("expected the first fill to start")
+	}
+	if l.Acquire() {
+		t.Error("expected the limit to start at min")
+	}
+	l.Release(time.Millisecond, nil)
+	for i := 0; i < 20 && l.Limit() < 4; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, nil)
+	}
+	if l.Limit() != 4 {
+		t.Errorf("expected successes to raise the limit to max, got %d", l.Limit())
+	}
+	l.Acquire()
+	l.Release(2*time.Second, nil)
+	if l.Limit() != 2 {
+		t.Errorf("expected a slow fill to halve the limit, got %d", l.Limit())
+	}
+	l.Acquire()
+	l.Release(time.Millisecond, errors.New("failed"))
+	if l.Limit() != 1 {
+		t.Errorf("expected a failed fill to halve the limit, got %d", l.Limit())
+	}
+}
+
+func TestLayeredLimiter(t *testing.T) {
+	upper, _ := NewCache(NewMemFs(), nil)
+	lower, _ := NewCache(NewMemFs(), nil)
+	r, w, _ := lower.Get("key")
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	l := NewAdaptiveLimiter(1, 1, time.Second)
+	lc := NewLayeredWithLimiter(l, upper, lower)
+
+	// with the only slot taken, the hit is read from the lower layer.
+	l.Acquire()
+	r, w, err := lc.Get("key")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if upper.Exists("key") {
+		t.Error("expected the backfill to be skipped")
+	}
+
+	l.Release(0, nil)
+	r, _, err = lc.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if !upper.Exists("key") {
+		t.Error("expected the key to be backfilled")
+	}
+}
+
+// readOnlyCache is a layer which can't store a miss.
+type readOnlyCache struct{ Cache }
+
+func (readOnlyCache) Get(key string) (ReadAtCloser, io.WriteCloser, error) {
+	return nil, nil, ErrReadOnly
+}
+
+// plainWriterCache hides whether its writers are Aborters.
+type plainWriterCache struct{ Cache }
+
+func (c plainWriterCache) Get(key string) (ReadAtCloser, io.WriteCloser, error) {
+	r, w, err := c.Cache.Get(key)
+	if w != nil {
+		w = struct{ io.WriteCloser }{w}
+	}
+	return r, w, err
+}
+
+func TestLayeredLimiterSkipped(t *testing.T) {
+	skipped, _ := NewCache(NewMemFs(), nil)
+	upper, _ := NewCache(NewMemFs(), nil)
+	upper.SetKeepEmpty(true) // so only Remove drops the closed fill
+	lower, _ := NewCache(NewMemFs(), nil)
+	r, w, _ := lower.Get("key")
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	l := NewAdaptiveLimiter(1, 1, time.Second)
+	l.Acquire()
+	lc := NewLayeredWithLimiter(l, readOnlyCache{skipped}, plainWriterCache{upper}, lower)
+	r, w, err := lc.Get("key")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if upper.Exists("key") {
+		t.Error("expected the abandoned fill to be removed from the layer it was made in")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	failed := errors.New("fill failed")
+
+	err = c.Warm(keys, func(key string, w io.Writer) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		<-time.After(10 * time.Millisecond)
+		if key == "key-3" {
+			return failed
+		}
+		_, err := w.Write([]byte(key))
+		return err
+	}, 3)
+
+	if err != failed {
+		t.Errorf("expected the fill error, got %v", err)
+	}
+	if maxRunning > 3 {
+		t.Errorf("expected at most 3 concurrent fills, got %d", maxRunning)
+	}
+	for _, key := range keys {
+		if key == "key-3" {
+			if c.Exists(key) {
+				t.Errorf("expected failed fill to be removed")
+			}
+			continue
+		}
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatalf("expected %s to be warm", key)
+		}
+		check(t, r, key)
+		r.Close()
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	d := NewDistributor(NewRemote("a"), NewRemote("b"), NewRemote("c")).(*distrib)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if d.GetCache(key) != d.caches[Placement(key, 3)] {
+			t.Fatalf("Placement disagrees with the Distributor for %s", key)
+		}
+	}
+	// pinned, so that changes to the mapping bump PlacementVersion.
+	if p := Placement("stream", 7); p != 3 {
+		t.Errorf("Placement of stream changed to %d, update PlacementVersion", p)
+	}
+
+	var algorithm string
+	var version int
+	var err error
+	for i := 0; i < 10; i++ { // the server may still be starting up
+		if algorithm, version, err = RemotePlacement("localhost:10000"); err == nil {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != PlacementAlgorithm || version != PlacementVersion {
+		t.Errorf("unexpected placement %s %d", algorithm, version)
+	}
+}
+
+func TestClose(t *testing.T) {
+	var haunts int32
+	c, err := NewCacheWithHaunter(NewMemFs(), &countingHaunter{count: &haunts, period: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := atomic.LoadInt32(&haunts)
+	<-time.After(50 * time.Millisecond)
+	if m := atomic.LoadInt32(&haunts); m != n {
+		t.Errorf("expected haunting to stop after Close, but it ran %d more times", m-n)
+	}
+
+	if _, _, err := c.Get("stream"); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Get, got %v", err)
+	}
+	if c.Exists("stream") {
+		t.Errorf("expected nothing to exist in a closed cache")
+	}
+
+	// streams opened before Close still work.
+	w.Write([]byte("hello"))
+	w.Close()
+	check(t, r, "hello")
+	r.Close()
+}
+
+type countingHaunter struct {
+	count  *int32
+	period time.Duration
+}
+
+func (h *countingHaunter) Haunt(c CacheAccessor) { atomic.AddInt32(h.count, 1) }
+
+func (h *countingHaunter) Next() time.Duration { return h.period }
+
+func TestReadTimeout(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadTimeout(50 * time.Millisecond)
+
+	r, w, err := c.Get("stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Write([]byte("hello"))
+
+	// a writer which keeps making progress doesn't time out its readers.
+	go func() {
+		for i := 0; i < 4; i++ {
+			<-time.After(20 * time.Millisecond)
+			w.Write([]byte("."))
+		}
+	}()
+
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("expected to read while the writer progressed, got %v", err)
+	}
+	if string(buf) != "hello...." {
+		t.Errorf("expected hello...., got %q", buf)
+	}
+
+	// but once it stalls, they give up.
+	start := time.Now()
+	_, err = r.Read(buf)
+	if !errors.Is(err, ErrWriterTimeout) {
+		t.Errorf("expected ErrWriterTimeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("reader took too long to time out")
+	}
+	var stalled *WriterStalledError
+	if !errors.As(err, &stalled) || stalled.Offset != 9 || stalled.Idle < 50*time.Millisecond {
+		t.Errorf("unexpected stall details: %v", err)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, ErrWriterTimeout) {
+		t.Errorf("expected ErrWriterTimeout after timing out, got %v", err)
+	}
+	if last, done := r.(*CacheReader).LastProgress(); done || time.Since(last) < 50*time.Millisecond {
+		t.Errorf("unexpected LastProgress %v, %v", last, done)
+	}
+	w.Close()
+}
+
+func TestWindowsSafeName(t *testing.T) {
+	for name, safe := range map[string]bool{
+		"sxxxxxxxxa2V5": true,
+		"con":           false,
+		"Aux.txt":       false,
+		"LPT1":          false,
+		"COM10":         true,
+		"trailing.":     false,
+		"trailing ":     false,
+		"a:b":           false,
+		"a\x01b":        false,
+		"nul .key":      false,
+		"console":       true,
+		"":              false,
+		longName("key"): true,
+		longName("CON"): true,
+	} {
+		if windowsSafeName(name) != safe {
+			t.Errorf("windowsSafeName(%q) != %v", name, safe)
+		}
+	}
+}
+
+func TestB32EncodeKey(t *testing.T) {
+	for _, key := range []string{"", "a", "A", "stream", "STREAM", "long key which is hashed instead"} {
+		name, ok := B32OrMD5HashEncodeKey(key)
+		if strings.ToLower(name) != name {
+			t.Errorf("name for %q isn't lowercase: %s", key, name)
+		}
+		if !ok {
+			continue
+		}
+		if got, ok := B32DecodeKey(name); !ok || got != key {
+			t.Errorf("B32DecodeKey(%q) = %q, %v; want %q", name, got, ok, key)
+		}
+	}
+	a, _ := B32OrMD5HashEncodeKey("a")
+	A, _ := B32OrMD5HashEncodeKey("A")
+	if strings.EqualFold(a, A) {
+		t.Errorf("names for a and A collide: %s, %s", a, A)
+	}
+
+	legacy, _ := B64OrMD5HashEncodeKey("stream")
+	if got, ok := B32DecodeKey(legacy); !ok || got != "stream" {
+		t.Errorf("expected B32DecodeKey to decode legacy name %q, got %q, %v", legacy, got, ok)
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"/api/v1/users/1", "/api/v1/users/2", "/api/v1/groups/1", "/api/v2/users/1"}
+	for _, key := range keys {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+	}
+
+	if err := c.RemovePrefix("/api/v1/users/"); err != nil {
+		t.Fatal(err)
+	}
+	for i, exists := range []bool{false, false, true, true} {
+		if c.Exists(keys[i]) != exists {
+			t.Errorf("expected Exists(%q) == %v", keys[i], exists)
+		}
+	}
+
+	if err := c.RemoveMatching(func(key string) bool { return strings.HasSuffix(key, "/1") }); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if c.Exists(key) {
+			t.Errorf("expected %q to be removed", key)
+		}
+	}
+}
+
+func TestNormalizePercentEncoding(t *testing.T) {
+	for in, out := range map[string]string{
+		"/plain":     "/plain",
+		"/%7euser":   "/~user",
+		"/a%2fb":     "/a%2Fb",
+		"/%41%42%2d": "/AB-",
+		"/caf%c3%a9": "/caf%C3%A9",
+		"/bad%zz%4":  "/bad%zz%4",
+		"/end%":      "/end%",
+		"/%25%7E":    "/%25~",
+	} {
+		if got := NormalizePercentEncoding(in); got != out {
+			t.Errorf("NormalizePercentEncoding(%q) = %q, want %q", in, got, out)
+		}
+	}
+}
+
+func TestChainKeyMappers(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stands in for norm.NFC.String, composing "e" + U+0301 into U+00E9.
+	nfc := func(key string) string { return strings.Replace(key, "e\u0301", "\u00e9", -1) }
+	c.SetKeyMapper(ChainKeyMappers(nfc, NormalizePercentEncoding))
+
+	r, w, err := c.Get("/cafe\u0301/%7euser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	r, w, err = c.Get("/caf\u00e9/~user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		t.Fatal("expected canonically equal keys to share an entry")
+	}
+	check(t, r, "hello")
+	r.Close()
+}
+
+func TestKeyTransforms(t *testing.T) {
+	km := ChainKeyMappers(LowercaseHost, StripQueryParams("utm_source", "_"))
+	for in, out := range map[string]string{
+		"HTTP://Example.COM/Path?b=2&utm_source=x&a=1": "http://example.com/Path?a=1&b=2",
+		"http://example.com/?_=123":                    "http://example.com/",
+		"/not/a/url?_=1":                               "/not/a/url",
+		"plain key":                                    "plain key",
+	} {
+		if got := km(in); got != out {
+			t.Errorf("km(%q) = %q, want %q", in, got, out)
+		}
+	}
+}
+
+func TestOriginalKey(t *testing.T) {
+	c, err := NewCacheWithHaunter(NewMemFs(), NewLRUHaunterStrategy(NewLRUHaunter(1, 0, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetKeyMapper(func(key string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(key))) })
+	c.SetKeepOriginalKeys(true)
+
+	mapped := fmt.Sprintf("%x", sha256.Sum256([]byte("user/1234")))
+	r, w, err := c.Get("user/1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	if original, ok := c.OriginalKey(mapped); !ok || original != "user/1234" {
+		t.Errorf("OriginalKey(%q) = %q, %v", mapped, original, ok)
+	}
+
+	// haunters see mapped keys, and must still be able to evict them.
+	r, w, err = c.Get("user/5678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("world"))
+	w.Close()
+	r.Close()
+	c.haunt()
+	if c.Exists("user/1234") && c.Exists("user/5678") {
+		t.Errorf("expected an entry to be evicted")
+	}
+
+	c.Remove("user/1234")
+	c.Remove("user/5678")
+	if _, ok := c.OriginalKey(mapped); ok {
+		t.Errorf("expected OriginalKey to be forgotten after Remove")
+	}
+}
+
+func TestSizes(t *testing.T) {
+	testCaches(t, func(c Cache) {
+		fc, ok := c.(*FSCache)
+		if !ok {
+			return
+		}
+		defer fc.Clean()
+
+		for key, data := range map[string]string{"a": "hello", "b": "world!"} {
+			r, w, err := fc.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(data))
+			w.Close()
+			r.Close()
+		}
+
+		if size, err := fc.EntrySize("b"); err != nil || size != 6 {
+			t.Errorf("EntrySize(b) = %d, %v; want 6", size, err)
+		}
+		if _, err := fc.EntrySize("missing"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		if total := fc.TotalSize(); total != 11 {
+			t.Errorf("TotalSize() = %d, want 11", total)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	c, err := NewCacheWithHaunter(NewMemFs(), NewLRUHaunterStrategy(NewLRUHaunter(1, 0, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := c.Events()
+
+	write := func(key, data string) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			w.Write([]byte(data))
+			w.Close()
+		}
+		r.Close()
+	}
+	write("a", "hello")
+	write("a", "")
+	c.Remove("a")
+	write("b", "hi")
+	write("c", "hey")
+	c.haunt()
+
+	want := []Event{
+		{EventCreate, "a", 0},
+		{EventWrite, "a", 5},
+		{EventRead, "a", 5},
+		{EventRemove, "a", 5},
+		{EventCreate, "b", 0},
+		{EventWrite, "b", 2},
+		{EventCreate, "c", 0},
+		{EventWrite, "c", 3},
+	}
+	for _, e := range want {
+		if got := <-events; got != e {
+			t.Errorf("expected %v, got %v", e, got)
+		}
+	}
+	if got := <-events; got.Type != EventEvict {
+		t.Errorf("expected an evict event, got %v", got)
+	}
+
+	c.Close()
+	if _, ok := <-events; ok {
+		t.Errorf("expected Close to close the events channel")
+	}
+}
+
+func TestEmptyEntries(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := c.Get("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	check(t, r, "")
+	r.Close()
+	if c.Exists("empty") {
+		t.Errorf("expected an entry closed without writing to be removed")
+	}
+
+	// a writer which is dropped without being closed is removed once it is collected.
+	r, _, err = c.Get("leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	for i := 0; c.Exists("leaked") && i < 100; i++ {
+		runtime.GC()
+		<-time.After(10 * time.Millisecond)
+	}
+	if c.Exists("leaked") {
+		t.Errorf("expected an entry whose writer leaked to be removed")
+	}
+
+	c.SetKeepEmpty(true)
+	r, w, err = c.Get("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	r.Close()
+	if !c.Exists("kept") {
+		t.Errorf("expected SetKeepEmpty(true) to keep empty entries")
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	testCaches(t, func(c Cache) {
+		defer c.Clean()
+		r, w, err := c.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		w.Close()
+		r.Close()
+
+		results := GetMulti(c, []string{"a", "b", "c"})
+		if len(results) != 3 {
+			t.Fatalf("expected 3 results, got %d", len(results))
+		}
+		for i, res := range results {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if (res.Writer == nil) != (i == 0) {
+				t.Errorf("result %d: unexpected writer %v", i, res.Writer)
+			}
+			if res.Writer != nil {
+				res.Writer.Write([]byte("world"))
+				res.Writer.Close()
+			}
+		}
+		for i, data := range []string{"hello", "world", "world"} {
+			check(t, results[i].Reader, data)
+			results[i].Reader.Close()
+		}
+	})
+}
+
+func TestMinSize(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetMinSize(4)
+
+	for key, data := range map[string]string{"small": "hey", "big": "hello"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		check(t, r, data)
+		r.Close()
+	}
+
+	if c.Exists("small") {
+		t.Errorf("expected entries smaller than the minimum size to be removed")
+	}
+	if !c.Exists("big") {
+		t.Errorf("expected entries of at least the minimum size to be kept")
+	}
+}
+
+func TestRename(t *testing.T) {
+	testCaches(t, func(c Cache) {
+		fc, ok := c.(*FSCache)
+		if !ok {
+			return
+		}
+		defer fc.Clean()
+
+		r, w, err := fc.Get("staging")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		if err := fc.Rename("staging", "final"); err != ErrInProgress {
+			t.Errorf("expected ErrInProgress renaming an incomplete entry, got %v", err)
+		}
+		w.Close()
+		r.Close()
+
+		if err := fc.Rename("missing", "final"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		if err := fc.Rename("staging", "final"); err != nil {
+			t.Fatal(err)
+		}
+		if fc.Exists("staging") {
+			t.Errorf("expected the old key to be gone")
+		}
+
+		r, w, err = fc.Get("final")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatal("expected the new key to be a hit")
+		}
+		check(t, r, "hello")
+		r.Close()
+
+		r, w, err = fc.Get("other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("world"))
+		w.Close()
+		r.Close()
+		if err := fc.Rename("other", "final"); err != ErrKeyExists {
+			t.Errorf("expected ErrKeyExists, got %v", err)
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	testCaches(t, func(c Cache) {
+		fc, ok := c.(*FSCache)
+		if !ok {
+			return
+		}
+		defer fc.Clean()
+
+		r, w, err := fc.Get("meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.(MetadataWriter).SetMetadata([]byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		w.Close()
+		r.Close()
+
+		r, _, err = fc.Get("meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := r.(MetadataReader).Metadata()
+		r.Close()
+		if err != nil || string(meta) != "v1" {
+			t.Errorf("Metadata() = %q, %v; want v1", meta, err)
+		}
+
+		if err := fc.Copy("meta", "copy"); err != nil {
+			t.Fatal(err)
+		}
+		r, _, err = fc.Get("copy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ = r.(MetadataReader).Metadata()
+		r.Close()
+		if _, linked := fc.fs.(FileSystemLinker); linked && string(meta) != "v1" {
+			t.Errorf("expected a linked copy to share metadata, got %q", meta)
+		}
+	})
+}
+
+func TestHandlerHeaders(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	ts := httptest.NewServer(Handler(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/x-test")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, "Hello Client")
+	})))
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(p) != "Hello Client\n" {
+			t.Errorf("unexpected response %q", p)
+		}
+		if res.StatusCode != http.StatusCreated || res.Header.Get("Content-Type") != "text/x-test" {
+			t.Errorf("request %d: unexpected status %d, content type %q", i, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to be called once, got %d", calls)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(filepath.Join(dir, "cache"), 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ingest(src, "linked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ingest(src, "linked"); err != ErrKeyExists {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+	r, w, err := c.Get("linked")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	check(t, r, "hello")
+	r.Close()
+
+	srcInfo, _ := os.Stat(src)
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "cache"))
+	var shared bool
+	for _, fi := range files {
+		shared = shared || os.SameFile(srcInfo, fi)
+	}
+	if !shared && clone(src, filepath.Join(dir, "probe")) != nil {
+		t.Error("expected the entry to be a hard link of the source where it can't be cloned")
+	}
+	if err := c.Remove("linked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("expected the source to outlive its entry, got %v", err)
+	}
+
+	// a FileSystem which can't link copies the file in.
+	mc, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Ingest(src, "copied"); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = mc.Get("copied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, "hello")
+	r.Close()
+}
+
+func TestCloneOrLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clone(src, dst); err != nil {
+		if _, serr := os.Stat(dst); !os.IsNotExist(serr) {
+			t.Errorf("expected a failed clone to leave no file, got %v", serr)
+		}
+	} else {
+		// a clone is a separate file, changing src leaves it.
+		ioutil.WriteFile(src, []byte("world"), 0600)
+		if data, _ := ioutil.ReadFile(dst); string(data) != "hello" {
+			t.Errorf("expected the clone to keep its data, got %q", data)
+		}
+		os.Remove(dst)
+		ioutil.WriteFile(src, []byte("hello"), 0600)
+	}
+
+	if err := cloneOrLink(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", data)
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	testCaches(t, func(c Cache) {
+		fc, ok := c.(*FSCache)
+		if !ok {
+			return
+		}
+		defer fc.Clean()
+
+		dir, err := ioutil.TempDir("", "fscache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		r, w, err := fc.Get("copyto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			w.Write([]byte("hello"))
+			<-time.After(10 * time.Millisecond)
+			w.Write([]byte(" world"))
+			w.Close()
+		}()
+
+		// copying an incomplete entry waits for it to finish.
+		dst := filepath.Join(dir, "partial")
+		if err := fc.CopyTo("copyto", dst); err != nil {
+			t.Fatal(err)
+		}
+		check(t, r, "hello world")
+		r.Close()
+		if p, _ := ioutil.ReadFile(dst); string(p) != "hello world" {
+			t.Errorf("unexpected copy %q", p)
+		}
+
+		dst = filepath.Join(dir, "complete")
+		if err := fc.CopyTo("copyto", dst); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := ioutil.ReadFile(dst); string(p) != "hello world" {
+			t.Errorf("unexpected copy %q", p)
+		}
+		if err := fc.CopyTo("copyto", dst); err == nil {
+			t.Errorf("expected an error copying to an existing path")
+		}
+		if err := fc.CopyTo("missing", filepath.Join(dir, "missing")); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestPath(t *testing.T) {
+	fs, err := NewFs("./cachepath", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll("./cachepath") })
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ FilePather = c
+
+	r, w, err := c.Get("path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Write([]byte("hello"))
+	if _, ok := c.Path("path"); ok {
+		t.Errorf("expected no path for an incomplete entry")
+	}
+	w.Close()
+
+	path, ok := c.Path("path")
+	if !ok {
+		t.Fatal("expected a path for a complete entry")
+	}
+	if p, err := ioutil.ReadFile(path); err != nil || string(p) != "hello" {
+		t.Errorf("ReadFile(%s) = %q, %v", path, p, err)
+	}
+
+	mc, _ := NewCache(NewMemFs(), nil)
+	r, w, _ = mc.Get("path")
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+	if _, ok := mc.Path("path"); ok {
+		t.Errorf("expected no path for an in-memory entry")
+	}
+}
+
+func TestOrphanTimeout(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetOrphanTimeout(50 * time.Millisecond)
+
+	r, w, err := c.Get("orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Write([]byte("hello"))
+
+	// the blocked reader is released once the writer is aborted.
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != stream.ErrCanceled {
+			t.Errorf("expected stream.ErrCanceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader was not released")
+	}
+
+	if _, err := w.Write([]byte("world")); err != ErrAborted {
+		t.Errorf("expected ErrAborted writing after abort, got %v", err)
+	}
+	if err := w.Close(); err != ErrAborted {
+		t.Errorf("expected ErrAborted closing after abort, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		r, w, err := c.Get("orphan")
+		if err == stream.ErrRemoving {
+			<-time.After(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w == nil {
+			t.Fatal("expected the aborted entry to be removed")
+		}
+		w.Write([]byte("filled"))
+		w.Close()
+		check(t, r, "filled")
+		r.Close()
+		break
+	}
+
+	// writers which keep writing are left alone.
+	r, w, err = c.Get("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		<-time.After(20 * time.Millisecond)
+		if _, err := w.Write([]byte(".")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, "....")
+	r.Close()
+}
+
+func TestEvictionExclusions(t *testing.T) {
+	c, err := NewCacheWithHaunter(NewMemFs(), NewReaperHaunterStrategy(NewReaper(0, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetEvictionExclusions("config/*", "pinned-")
+
+	keys := []string{"config/a", "config/b/c", "pinned-1", "other"}
+	for _, key := range keys {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+	}
+	<-time.After(10 * time.Millisecond)
+	c.haunt()
+
+	// path.Match's * doesn't match /, so config/b/c isn't excluded.
+	for i, exists := range []bool{true, false, true, false} {
+		if c.Exists(keys[i]) != exists {
+			t.Errorf("expected Exists(%q) == %v", keys[i], exists)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	fs, err := NewFs("./cachededup", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll("./cachededup") })
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDedup(true)
+
+	for _, key := range []string{"a", "b", "c"} {
+		data := "same"
+		if key == "c" {
+			data = "different"
+		}
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+
+	stat := func(key string) os.FileInfo {
+		path, ok := c.Path(key)
+		if !ok {
+			t.Fatalf("no path for %s", key)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	if !os.SameFile(stat("a"), stat("b")) {
+		t.Errorf("expected a and b to share storage")
+	}
+	if os.SameFile(stat("a"), stat("c")) {
+		t.Errorf("expected a and c not to share storage")
+	}
+
+	if err := c.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("b")
+	if err != nil || w != nil {
+		t.Fatalf("expected b to be cached, got %v", err)
+	}
+	p, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(p) != "same" {
+		t.Errorf("expected b to still read same, got %q", p)
+	}
+
+	r, w, _ = c.Get("d")
+	w.Write([]byte("same"))
+	w.Close()
+	r.Close()
+	if !os.SameFile(stat("b"), stat("d")) {
+		t.Errorf("expected d to share storage with b once a was removed")
+	}
+}
+
+func TestWindowedHaunter(t *testing.T) {
+	night := TimeWindow{Start: 22 * time.Hour, End: 2 * time.Hour}
+	day := TimeWindow{Start: 9 * time.Hour, End: 17 * time.Hour}
+	at := func(h, m int) time.Time { return time.Date(2020, 1, 1, h, m, 0, 0, time.Local) }
+	for _, tc := range []struct {
+		w    TimeWindow
+		t    time.Time
+		want bool
+	}{
+		{night, at(23, 0), true},
+		{night, at(1, 59), true},
+		{night, at(2, 0), false},
+		{night, at(12, 0), false},
+		{day, at(9, 0), true},
+		{day, at(17, 0), false},
+		{day, at(3, 0), false},
+	} {
+		if got := tc.w.Contains(tc.t); got != tc.want {
+			t.Errorf("%v.Contains(%v) = %v, want %v", tc.w, tc.t.Format("15:04"), got, tc.want)
+		}
+	}
+
+	var heavy, emergency int32
+	h := NewWindowedHaunter(
+		&countingHaunter{count: &heavy, period: time.Hour},
+		&countingHaunter{count: &emergency, period: time.Minute},
+		night,
+	).(*windowedHaunter)
+	if next := h.Next(); next != time.Minute {
+		t.Errorf("expected Next to be the shorter period, got %v", next)
+	}
+
+	h.now = func() time.Time { return at(12, 0) }
+	h.Haunt(nil)
+	h.now = func() time.Time { return at(23, 30) }
+	h.Haunt(nil)
+	if heavy != 1 || emergency != 2 {
+		t.Errorf("expected 1 heavy and 2 emergency haunts, got %d and %d", heavy, emergency)
+	}
+}
+
+type evictAllHaunter struct{}
+
+func (evictAllHaunter) Haunt(c CacheAccessor) {
+	var keys []string
+	c.EnumerateEntries(func(key string, e Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		c.RemoveFile(key)
+	}
+}
+
+func (evictAllHaunter) Next() time.Duration { return time.Hour }
+
+func TestEvictionParallelism(t *testing.T) {
+	fs := NewMemFs()
+	c, err := NewCacheWithHaunter(fs, evictAllHaunter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetEvictionParallelism(4)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		r, w, err := c.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		w.Close()
+		r.Close()
+	}
+
+	c.haunt()
+	if c.Exists("key0") {
+		t.Errorf("expected evicted keys to leave the cache immediately")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.EvictionProgress().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p := c.EvictionProgress(); p.Pending != 0 || p.Removed != n || p.Failed != 0 {
+		t.Errorf("expected all %d files removed, got %+v", n, p)
+	}
+	if _, err := fs.Stat("key0"); err == nil {
+		t.Errorf("expected the evicted file to be removed")
+	}
+
+	r, w, err := c.Get("key0")
+	if err != nil || w == nil {
+		t.Fatalf("expected key0 to be refilled, got %v", err)
+	}
+	w.Close()
+	r.Close()
+}
+
+func TestReaperRefresh(t *testing.T) {
+	now := time.Now()
+	recentRead, oldWrite := now.Add(-time.Minute), now.Add(-2*time.Hour)
+	for _, tc := range []struct {
+		mode   RefreshMode
+		rt, wt time.Time
+		reap   bool
+	}{
+		{RefreshOnRead, recentRead, oldWrite, false},
+		{RefreshOnWrite, recentRead, oldWrite, true},
+		{RefreshOnAny, recentRead, oldWrite, false},
+		{RefreshOnRead, oldWrite, recentRead, true},
+		{RefreshOnWrite, oldWrite, recentRead, false},
+		{RefreshOnAny, oldWrite, oldWrite, true},
+	} {
+		r := NewReaperWithRefresh(time.Hour, time.Hour, tc.mode)
+		if got := r.Reap("key", tc.rt, tc.wt); got != tc.reap {
+			t.Errorf("mode %d: Reap(read %v ago, write %v ago) = %v, want %v",
+				tc.mode, now.Sub(tc.rt).Round(time.Minute), now.Sub(tc.wt).Round(time.Minute), got, tc.reap)
+		}
+	}
+}
+
+func TestImmutablePrefixes(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetImmutablePrefixes("sha256:")
+
+	r, w, err := c.Get("sha256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("artifact"))
+	w.Close()
+	r.Close()
+
+	var ierr *ImmutableError
+	if err := c.Remove("sha256:abc"); !errors.As(err, &ierr) || ierr.Key != "sha256:abc" {
+		t.Errorf("expected an ImmutableError from Remove, got %v", err)
+	}
+	if err := c.Rename("sha256:abc", "other"); !errors.Is(err, ErrImmutable) {
+		t.Errorf("expected ErrImmutable from Rename, got %v", err)
+	}
+
+	r, w, _ = c.Get("mutable")
+	w.Close()
+	r.Close()
+	if err := c.RemovePrefix(""); !errors.Is(err, ErrImmutable) {
+		t.Errorf("expected ErrImmutable from RemovePrefix, got %v", err)
+	}
+	if !c.Exists("sha256:abc") {
+		t.Errorf("expected the immutable entry to remain")
+	}
+
+	// an unfinished entry can still be removed, so a failed fill can be retried.
+	r, w, _ = c.Get("sha256:def")
+	r.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Remove("sha256:def") }()
+	for c.Exists("sha256:def") {
+		time.Sleep(time.Millisecond)
+	}
+	w.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("expected an unfinished entry to be removable, got %v", err)
+	}
+}
+
+func TestResumableFills(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetResumableFills(true)
+
+	r, w, err := c.Get("resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if off := w.(Resumer).Offset(); off != 0 {
+		t.Errorf("expected a new fill to start at 0, got %d", off)
+	}
+	w.Write([]byte("hello "))
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err != ErrAborted {
+		t.Errorf("expected ErrAborted after Abort, got %v", err)
+	}
+	if c.Exists("resume") {
+		t.Errorf("expected the aborted entry to be removed")
+	}
+
+	r, w, err = c.Get("resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := w.(Resumer).Offset(); off != 6 {
+		t.Errorf("expected the fill to resume at 6, got %d", off)
+	}
+	w.Write([]byte("world"))
+	w.Close()
+	p, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(p) != "hello world" {
+		t.Errorf("expected the resumed entry to read hello world, got %q", p)
+	}
+
+	// Remove discards the kept data.
+	r, w, _ = c.Get("discard")
+	r.Close()
+	w.Write([]byte("partial"))
+	w.(Aborter).Abort()
+	c.Remove("discard")
+	r, w, _ = c.Get("discard")
+	if off := w.(Resumer).Offset(); off != 0 {
+		t.Errorf("expected Remove to discard the partial fill, got offset %d", off)
+	}
+	w.Close()
+	r.Close()
+}
+
+func TestTiered(t *testing.T) {
+	remote, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ListenAndServe(remote, "localhost:10010")
+	waitForServer(t, "localhost:10010")
+
+	dir1, _ := ioutil.TempDir("", "tiered1")
+	dir2, _ := ioutil.TempDir("", "tiered2")
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+
+	// an earlier run's entry may have been invalidated while it was down.
+	earlier, err := New(dir1, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, _ := earlier.Get("stale")
+	w.Write([]byte("stale"))
+	w.Close()
+	r.Close()
+	earlier.Close()
+
+	t1, err := NewTiered(dir1, "localhost:10010", TieredRetry(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t1.Close()
+	if t1.Local().Exists("stale") {
+		t.Error("expected the local tier to be emptied on startup")
+	}
+	t2, err := NewTiered(dir2, "localhost:10010", TieredRetry(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t2.Close()
+
+	r, w, err = t1.Get("tiered")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	w.Write([]byte("shared"))
+	w.Close()
+	r.Close()
+
+	r, w, err = t2.Get("tiered")
+	if err != nil || w != nil {
+		t.Fatalf("expected a remote hit, got %v", err)
+	}
+	p, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(p) != "shared" {
+		t.Errorf("expected shared, got %q", p)
+	}
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 200 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+	if !waitFor(func() bool { return t2.Local().Exists("tiered") }) {
+		t.Fatal("expected the remote hit to be copied locally")
+	}
+	if err := t1.Remove("tiered"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return !t2.Local().Exists("tiered") }) {
+		t.Errorf("expected the remote's invalidation to remove the local copy")
+	}
+
+	dir3, _ := ioutil.TempDir("", "tiered3")
+	defer os.RemoveAll(dir3)
+	down, err := NewTiered(dir3, "localhost:1", TieredRetry(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	r, w, err = down.Get("local")
+	if err != nil || w == nil {
+		t.Fatalf("expected a local fill while the remote is down, got %v", err)
+	}
+	w.Write([]byte("alone"))
+	w.Close()
+	r.Close()
+	if !down.Exists("local") {
+		t.Errorf("expected the local entry to exist")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "touch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fs := range []FileSystem{fs, NewMemFs()} {
+		c, err := NewCache(fs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Touch("missing"); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+
+		r, w, _ := c.Get("touch")
+		w.Write([]byte("warm"))
+		w.Close()
+		r.Close()
+
+		name := c.files["touch"].Name()
+		old := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if mfs, ok := fs.(*memFS); ok {
+			mfs.files[name].rt = old
+		} else if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Touch("touch"); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if at := fi.AccessTime(); time.Since(at) > time.Minute {
+			t.Errorf("%T: expected Touch to refresh the access time, got %v", fs, at)
+		}
+		if _, ok := fs.(*memFS); !ok && !fi.ModTime().Equal(old) {
+			t.Errorf("expected Touch to keep the modification time, got %v", fi.ModTime())
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	fs := NewMemFs()
+	c, err := NewCache(fs, NewReaperWithRefresh(time.Hour, time.Hour, RefreshOnWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.ExpiresAt("missing"); ok {
+		t.Errorf("expected no expiry for a missing key")
+	}
+
+	r, w, _ := c.Get("ttl")
+	w.Write([]byte("data"))
+	w.Close()
+	r.Close()
+
+	fi, err := fs.Stat("ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, ok := c.ExpiresAt("ttl")
+	if !ok || !at.Equal(fi.ModTime().Add(time.Hour)) {
+		t.Errorf("expected the entry to expire an hour after it was written, got %v, %v", at, ok)
+	}
+
+	c.SetEvictionExclusions("ttl")
+	if _, ok := c.ExpiresAt("ttl"); ok {
+		t.Errorf("expected no expiry for an excluded key")
+	}
+
+	nc, _ := NewCache(NewMemFs(), nil)
+	r, w, _ = nc.Get("forever")
+	w.Write([]byte("data"))
+	w.Close()
+	r.Close()
+	if !nc.Exists("forever") {
+		t.Fatal("expected the entry to be cached")
+	}
+	if _, ok := nc.ExpiresAt("forever"); ok {
+		t.Errorf("expected no expiry without a Reaper")
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "a", "a"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			w.Write([]byte("12345"))
+			w.Close()
+		}
+		r.Close()
+	}
+	s := c.Stats()
+	if s.Entries != 2 || s.Size != 10 || s.Hits != 2 || s.Misses != 2 || s.HitRatio() != 0.5 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+// blockedStatFs holds Stat, once armed, until release is closed.
+type blockedStatFs struct {
+	*StandardFS
+	armed   int32
+	stating chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockedStatFs) Stat(name string) (FileInfo, error) {
+	if atomic.CompareAndSwapInt32(&fs.armed, 1, 0) {
+		close(fs.stating)
+		<-fs.release
+	}
+	return fs.StandardFS.Stat(name)
+}
+
+func TestStatsUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsunlocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sfs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &blockedStatFs{StandardFS: sfs, stating: make(chan struct{}), release: make(chan struct{})}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r, w, _ := c.Get("a")
+	w.Write([]byte("12345"))
+	w.Close()
+	r.Close()
+
+	atomic.StoreInt32(&fs.armed, 1)
+	done := make(chan Stats)
+	go func() { done <- c.Stats() }()
+	<-fs.stating
+
+	// a miss takes the cache's lock, which Stats mustn't hold while it stats entries.
+	got := make(chan struct{})
+	go func() {
+		r, w, err := c.Get("b")
+		if err == nil {
+			w.Close()
+			r.Close()
+		}
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error("expected Get not to wait for Stats")
+	}
+	close(fs.release)
+	if s := <-done; s.Entries != 1 || s.Size != 5 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"img/a", "img/b", "doc/c"} {
+		r, w, _ := c.Get(key)
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+	}
+	h := NewAdminHandler(c, time.Millisecond)
+	defer h.Close()
+	ts := httptest.NewServer(http.StripPrefix("/cache", h))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "<title>fscache</title>") {
+		t.Errorf("expected the UI page, got %q", page)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	resp, err = http.Get(ts.URL + "/cache/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats adminStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 3 || stats.Misses != 3 || len(stats.Sizes) == 0 || len(stats.History) == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	resp, err = http.Get(ts.URL + "/cache/keys?q=img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []entrySize
+	json.NewDecoder(resp.Body).Decode(&keys)
+	resp.Body.Close()
+	if len(keys) != 2 || keys[0].Key != "img/a" || keys[0].Size != 5 {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	// a limit keeps the first keys, every time.
+	for i := 0; i < 10; i++ {
+		resp, err = http.Get(ts.URL + "/cache/keys?q=img&limit=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&keys)
+		resp.Body.Close()
+		if len(keys) != 1 || keys[0].Key != "img/a" {
+			t.Fatalf("expected the first key, got %+v", keys)
+		}
+	}
+	NewAdminHandler(c, 0).Close()
+
+	if resp, err := http.Get(ts.URL + "/cache/purge?prefix=img"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected a GET purge to be refused, got %v", err)
+	}
+	resp, err = http.PostForm(ts.URL+"/cache/purge", map[string][]string{"prefix": {"img/"}})
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if c.Exists("img/a") || c.Exists("img/b") || !c.Exists("doc/c") {
+		t.Errorf("expected only the img/ keys to be purged")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(data string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}
+	}
+	read := func(key string) string {
+		r, w, err := c.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be cached, got %v", key, err)
+		}
+		defer r.Close()
+		p, _ := ioutil.ReadAll(r)
+		return string(p)
+	}
+
+	g1, err := c.Replace("cas", 0, fill("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen, ok := c.Generation("cas"); !ok || gen != g1 {
+		t.Errorf("Generation = %d, %v, want %d", gen, ok, g1)
+	}
+	if _, err := c.Replace("cas", 0, fill("stale")); err != ErrGenerationMismatch {
+		t.Errorf("expected ErrGenerationMismatch, got %v", err)
+	}
+
+	old, _, _ := c.Get("cas")
+	defer old.Close()
+	g2, err := c.Replace("cas", g1, fill("two"))
+	if err != nil || g2 == g1 {
+		t.Fatalf("Replace = %d, %v", g2, err)
+	}
+	if got := read("cas"); got != "two" {
+		t.Errorf("expected the replaced content, got %q", got)
+	}
+	if p, _ := ioutil.ReadAll(old); string(p) != "one" {
+		t.Errorf("expected an open reader to keep the old content, got %q", p)
+	}
+
+	// only one of several writers expecting the same generation wins.
+	var wins int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.Replace("cas", g2, fill(fmt.Sprint(i))); err == nil {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("expected exactly one Replace to win, got %d", wins)
+	}
+
+	if err := c.Copy("cas", "copied"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rename("copied", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Generation("copied"); ok {
+		t.Errorf("expected no generation for a renamed key")
+	}
+	if gen, ok := c.Generation("renamed"); !ok || gen <= g2 {
+		t.Errorf("expected Rename to give a new generation, got %d, %v", gen, ok)
+	}
+
+	r, w, _ := c.Get("filling")
+	defer r.Close()
+	if _, err := c.Replace("filling", 0, fill("x")); err != ErrInProgress {
+		t.Errorf("expected ErrInProgress, got %v", err)
+	}
+	if _, ok := c.Generation("filling"); ok {
+		t.Errorf("expected no generation while the entry is written")
+	}
+	w.Write([]byte("done"))
+	w.Close()
+	if _, ok := c.Generation("filling"); !ok {
+		t.Errorf("expected a generation once the entry is written")
+	}
+}
+
+func TestServerTraceContext(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type span struct {
+		traceparent string
+		action      protocol.Action
+		key         string
+	}
+	spans := make(chan span, 10)
+	srv := &Server{
+		Cache: c,
+		StartSpan: func(ctx context.Context, action protocol.Action, key string) func() {
+			tp, _ := TraceParentFromContext(ctx)
+			return func() { spans <- span{tp, action, key} }
+		},
+	}
+	go srv.ListenAndServe("localhost:10011")
+	waitForServer(t, "localhost:10011")
+
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	rmt := NewRemote("localhost:10011").(ContextGetter)
+	r, w, err := rmt.GetContext(ContextWithTraceParent(context.Background(), tp), "traced")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	ioutil.ReadAll(r)
+	r.Close()
+
+	select {
+	case s := <-spans:
+		if s.traceparent != tp || s.action != protocol.ActionGet || s.key != "traced" {
+			t.Errorf("unexpected span %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a span for the request")
+	}
+
+	NewRemote("localhost:10011").Exists("traced")
+	select {
+	case s := <-spans:
+		if s.traceparent != "" || s.action != protocol.ActionExists {
+			t.Errorf("unexpected span %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a span for the request")
+	}
+}
+
+func TestRemoteResolveInterval(t *testing.T) {
+	waitForServer(t, "127.0.0.1:10000")
+	rmt := NewRemote("cache.internal:10000", RemoteResolveInterval(time.Hour)).(*remote)
+	d := rmt.dialer.(*multiDialer).targets[0]
+	var lookups int
+	addrs := []string{"127.0.0.1", "127.0.0.2"}
+	d.lookup = func(ctx context.Context, host string) ([]string, error) {
+		if host != "cache.internal" {
+			t.Errorf("unexpected lookup of %q", host)
+		}
+		lookups++
+		return addrs, nil
+	}
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		addrs, err := d.candidates(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, addrs[0])
+	}
+	want := []string{"127.0.0.1:10000", "127.0.0.2:10000", "127.0.0.1:10000", "127.0.0.2:10000"}
+	if fmt.Sprint(picked) != fmt.Sprint(want) || lookups != 1 {
+		t.Errorf("picked %v with %d lookups, want %v with 1", picked, lookups, want)
+	}
+
+	addrs = []string{"127.0.0.1"}
+	d.expire()
+	if got, _ := d.candidates(context.Background()); fmt.Sprint(got) != "[127.0.0.1:10000]" || lookups != 2 {
+		t.Errorf("expected a new lookup after expire, got %v after %d lookups", got, lookups)
+	}
+
+	// requests dial the resolved addresses.
+	r, w, err := rmt.Get("resolved")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss from the resolved server, got %v", err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	ioutil.ReadAll(r)
+	r.Close()
+}
+
+func TestRemoteFallbackAddrs(t *testing.T) {
+	waitForServer(t, "127.0.0.1:10000")
+	// nothing listens on port 1, so the request falls back to the replica.
+	rmt := NewRemote("127.0.0.1:1", RemoteFallbackAddrs("127.0.0.1:10000"), RemoteFallbackDelay(time.Hour))
+	r, w, err := rmt.Get("fallback")
+	if err != nil {
+		t.Fatalf("expected the fallback address to be dialed, got %v", err)
+	}
+	if w != nil {
+		w.Write([]byte("data"))
+		w.Close()
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+
+	if _, _, err := NewRemote("127.0.0.1:1", RemoteFallbackDelay(-1)).Get("down"); err == nil {
+		t.Errorf("expected an error when no address can be dialed")
+	}
+
+	attempts := func(addrs ...string) []dialAttempt {
+		var out []dialAttempt
+		for _, addr := range addrs {
+			out = append(out, dialAttempt{addr: addr})
+		}
+		return out
+	}
+	var got []string
+	for _, a := range interleaveFamilies(attempts("[::1]:1", "[::2]:1", "127.0.0.1:1", "127.0.0.2:1", "127.0.0.3:1")) {
+		got = append(got, a.addr)
+	}
+	if want := "[[::1]:1 127.0.0.1:1 [::2]:1 127.0.0.2:1 127.0.0.3:1]"; fmt.Sprint(got) != want {
+		t.Errorf("interleaveFamilies = %v, want %s", got, want)
+	}
+}
+
+func TestSpillFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemFs().(*memFS)
+	fs := NewSpillFs(mem, disk, 10, 0)
+	defer fs.Close()
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"cold1", "cold2", "hot"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("12345678"))
+		w.Close()
+		r.Close()
+	}
+	time.Sleep(10 * time.Millisecond)
+	mem.files["cold1"].rt = time.Now().Add(-time.Hour)
+	mem.files["cold2"].rt = time.Now().Add(-time.Hour)
+
+	if err := fs.Spill(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.MemoryUsage(); n != 8 {
+		t.Errorf("expected 8 bytes in memory, got %d", n)
+	}
+	if _, ok := mem.files["hot"]; !ok {
+		t.Error("hot entry should stay in memory")
+	}
+	for _, key := range []string{"cold1", "cold2", "hot"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			t.Fatalf("%s should still be cached", key)
+		}
+		check(t, r, "12345678")
+		r.Close()
+	}
+
+	if err := c.Remove("cold2"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// spilled entries are reloaded from disk.
+	c, err = NewCache(NewSpillFs(NewMemFs(), disk, 10, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Clean()
+	if !c.Exists("cold1") || c.Exists("cold2") || c.Exists("hot") {
+		t.Errorf("expected only cold1 to be reloaded")
+	}
+}
+
+func TestTwoPhaseClean(t *testing.T) {
+	remote, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: remote, CleanConfirmWindow: 200 * time.Millisecond}
+	go srv.ListenAndServe("localhost:10012")
+	waitForServer(t, "localhost:10012")
+
+	local, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(c Cache, key string) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			w.Write([]byte("data"))
+			w.Close()
+		}
+		ioutil.ReadAll(r)
+		r.Close()
+	}
+	fill(remote, "a")
+	fill(local, "b")
+
+	rmt := NewRemote("localhost:10012")
+	if err := rmt.Clean(); err != ErrCleanNotConfirmed {
+		t.Errorf("expected a single Clean to be refused with ErrCleanNotConfirmed, got %v", err)
+	}
+	if !remote.Exists("a") {
+		t.Fatal("a single Clean shouldn't clean a server which requires confirmation")
+	}
+
+	p := NewPartition(NewDistributor(rmt, local)).(CleanPreparer)
+	if err := p.ConfirmClean("bogus,"); err != ErrCleanNotConfirmed {
+		t.Errorf("expected ErrCleanNotConfirmed for an unknown token, got %v", err)
+	}
+	if !remote.Exists("a") {
+		t.Fatal("an unknown token shouldn't clean the server")
+	}
+	fill(local, "b")
+
+	token, err := p.PrepareClean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := p.ConfirmClean(token); err != ErrCleanNotConfirmed {
+		t.Errorf("expected ErrCleanNotConfirmed for an expired token, got %v", err)
+	}
+	fill(local, "b")
+
+	token, err = p.PrepareClean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remote.Exists("a") || !local.Exists("b") {
+		t.Fatal("preparing shouldn't clean anything")
+	}
+	if err := p.ConfirmClean(token); err != nil {
+		t.Fatal(err)
+	}
+	if remote.Exists("a") || local.Exists("b") {
+		t.Error("expected every cache to be cleaned")
+	}
+	if err := p.ConfirmClean(token); err != ErrCleanNotConfirmed {
+		t.Errorf("expected a token to only confirm one Clean, got %v", err)
+	}
+}
+
+func TestServerAllow(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	srv := &Server{Cache: c, Allow: DenyDestructive(trusted)}
+	go srv.ListenAndServe("localhost:10013")
+	waitForServer(t, "localhost:10013")
+
+	rmt := NewRemote("localhost:10013")
+	r, w, err := rmt.Get("kept")
+	if err != nil || w == nil {
+		t.Fatalf("expected Get to be allowed, got %v", err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	ioutil.ReadAll(r)
+	r.Close()
+
+	if err := rmt.Remove("kept"); err == nil {
+		t.Error("expected Remove to be refused")
+	}
+	if err := rmt.Clean(); err == nil {
+		t.Error("expected Clean to be refused")
+	}
+	if token, err := rmt.(CleanPreparer).PrepareClean(); err != nil {
+		t.Fatal(err)
+	} else if err := rmt.(CleanPreparer).ConfirmClean(token); err == nil {
+		t.Error("expected ConfirmClean to be refused")
+	}
+	if !rmt.Exists("kept") {
+		t.Error("expected Remove and Clean to be refused")
+	}
+
+	allow := DenyDestructive(trusted)
+	if !allow(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, protocol.ActionClean) {
+		t.Error("expected Clean to be allowed from a trusted network")
+	}
+	if allow(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}, protocol.ActionRemove) {
+		t.Error("expected Remove to be refused from an untrusted network")
+	}
+	if !DenyDestructive()(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, protocol.ActionExists) {
+		t.Error("expected Exists to be allowed from every network")
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c, AcceptLoops: 4}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe("localhost:10014") }()
+	waitForServer(t, "localhost:10014")
+
+	rmt := NewRemote("localhost:10014")
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		r, w, err := rmt.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		check(t, r, key)
+		if !rmt.Exists(key) {
+			t.Errorf("expected %s to exist", key)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ListenAndServe to return after Shutdown")
+	}
+}
+
+func TestServerGetFails(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c}
+	go srv.ListenAndServe("localhost:10017")
+	defer srv.Shutdown(context.Background())
+	waitForServer(t, "localhost:10017")
+	c.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := NewRemote("localhost:10017").Get("key")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Get to fail when the server's cache does")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Get to return when the server's cache fails")
+	}
+	if err := NewRemote("localhost:10017").Remove("key"); err != ErrNotRemoved {
+		t.Errorf("expected ErrNotRemoved when the server's cache fails, got %v", err)
+	}
+	if err := NewRemote("localhost:10017").Clean(); err != ErrCleanNotConfirmed {
+		t.Errorf("expected Clean to fail when the server's cache does, got %v", err)
+	}
+	token, err := NewRemote("localhost:10017").(CleanPreparer).PrepareClean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRemote("localhost:10017").(CleanPreparer).ConfirmClean(token); err != ErrCleanNotConfirmed {
+		t.Errorf("expected ConfirmClean to fail when the server's cache does, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:10017")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protocol.WriteAction(conn, protocol.ActionExists)
+	protocol.WriteKey(conn, "key")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(conn); err != nil || string(b) != "0\n" {
+		t.Errorf("expected the server to reply and close the connection, got %q, %v", b, err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c, ChunkSize: 3, FlushInterval: 10 * time.Millisecond}
+	go srv.ListenAndServe("localhost:10015")
+	defer srv.Shutdown(context.Background())
+	waitForServer(t, "localhost:10015")
+
+	rmt := NewRemote("localhost:10015", RemoteChunkSize(1024, 10*time.Millisecond))
+	r, w, err := rmt.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// partial chunks reach the reader before the entry is complete.
+	w.Write([]byte("hello"))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "hello" {
+		t.Fatalf("expected %q, got %q, %v", "hello", got, err)
+	}
+	w.Write([]byte(" world"))
+	w.Close()
+	check(t, r, " world")
+
+	r, w, err = rmt.Get("key")
+	if err != nil || w != nil {
+		t.Fatalf("expected a cached entry, got %v", err)
+	}
+	check(t, r, "hello world")
+}
+
+func TestRemoteHeaders(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c}
+	go srv.ListenAndServe("localhost:10016")
+	defer srv.Shutdown(context.Background())
+	waitForServer(t, "localhost:10016")
+
+	r, w, err := c.Get("page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(MetadataWriter).SetMetadata([]byte(`{"header":{"Content-Type":["text/plain"]}}`))
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	cw, err := c.NewContentWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write([]byte("content"))
+	digest, err := cw.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rmt := NewRemote("localhost:10016", RemoteHeaders())
+	r, w, err = rmt.Get("page")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	h, ok := r.(HeaderReader).Header()
+	if !ok || h.Size != 5 || h.ContentType != "text/plain" || h.Digest != "" {
+		t.Errorf("unexpected header %+v", h)
+	}
+	check(t, r, "hello")
+	r.Close()
+
+	r, _, err = rmt.Get(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := r.(HeaderReader).Header(); h.Digest != digest || h.Size != 7 {
+		t.Errorf("unexpected header %+v", h)
+	}
+	check(t, r, "content")
+	r.Close()
+
+	r, w, err = rmt.Get("missing")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	if _, ok := r.(HeaderReader).Header(); ok {
+		t.Error("expected no header for an entry being filled")
+	}
+	w.Write([]byte("filled"))
+	w.Close()
+	check(t, r, "filled")
+	r.Close()
+}
+
+func TestAtomicCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.AtomicCreate = true
+
+	f, err := fs.Create("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hel"))
+	if _, err := os.Stat(f.Name()); err == nil {
+		f.Close()
+		t.Skip("AtomicCreate isn't supported here")
+	}
+	r, err := fs.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(f.Name()); err != nil || fi.Size() != 3 {
+		t.Errorf("expected the unlinked file's size, got %v", err)
+	}
+	f.Write([]byte("lo"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if data, err := ioutil.ReadFile(f.Name()); err != nil || string(data) != "hello" {
+		t.Errorf("expected the closed file to be linked, got %q, %v", data, err)
+	}
+
+	// a removed file is never linked.
+	f, _ = fs.Create("removed")
+	f.Write([]byte("partial"))
+	fs.Remove(f.Name())
+	f.Close()
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the removed file not to be linked, got %v", err)
+	}
+
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Exists("key") || c.Exists("removed") {
+		t.Error("expected Reload to find only the closed file")
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncNever, SyncOnClose, SyncPeriodic} {
+		dir, err := ioutil.TempDir("", "sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fs, err := NewFs(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.Sync, fs.SyncInterval, fs.SyncDir = policy, time.Nanosecond, true
+
+		c, err := NewCache(fs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, w, err := c.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		w.Write([]byte(" world"))
+		if err := w.Close(); err != nil {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+		check(t, r, "hello world")
+		r.Close()
+
+		if err := c.Rename("key", "renamed"); err != nil {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+		if err := c.Remove("renamed"); err != nil {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("policy %d: expected an empty directory, got %d files", policy, len(files))
+		}
+	}
+}
+
+func TestMinFree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minfree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FreeSpace(); err == ErrUnsupported {
+		t.Skip("free space isn't known on this platform")
+	}
+	fs.MinFree = 1 << 62
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Get("key"); err != ErrLowDiskSpace {
+		t.Errorf("expected ErrLowDiskSpace, got %v", err)
+	}
+	fs.MinFree = 1
+	r, w, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	r.Close()
+}
+
+func TestMinFreeHaunter(t *testing.T) {
+	var free int64 = 100
+	h := NewMinFreeHaunter(NewLRUHaunterStrategy(NewLRUHaunter(0, 0, time.Hour)), 110,
+		func() (int64, error) { return free, nil })
+	c, err := NewCacheWithHaunter(NewMemFs(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"oldest", "older", "newest"} {
+		r, w, _ := c.Get(key)
+		w.Write([]byte("12345"))
+		w.Close()
+		r.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.haunt()
+	if c.Exists("oldest") || c.Exists("older") || !c.Exists("newest") {
+		t.Error("expected the least recently read entries to be evicted until enough space is free")
+	}
+}
+
+func TestFreePercentHaunter(t *testing.T) {
+	// 10% of 1000 bytes should be free, and 95 are.
+	h := NewFreePercentHaunter(NewLRUHaunterStrategy(NewLRUHaunter(0, 0, time.Hour)), 10,
+		func() (int64, int64, error) { return 95, 1000, nil })
+	c, err := NewCacheWithHaunter(NewMemFs(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"oldest", "older", "newest"} {
+		r, w, _ := c.Get(key)
+		w.Write([]byte("12345"))
+		w.Close()
+		r.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.haunt()
+	if c.Exists("oldest") || !c.Exists("older") || !c.Exists("newest") {
+		t.Error("expected the least recently read entry to be evicted to free 10% of the volume")
+	}
+
+	dir, err := ioutil.TempDir("", "diskspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free, total, err := fs.DiskSpace(); err != ErrUnsupported && (err != nil || total <= 0 || free > total) {
+		t.Errorf("unexpected disk space %d of %d, %v", free, total, err)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.DirectIOSize = 10000
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3<<20+1234)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	r, w, err := c.Get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for p := data; len(p) > 0; {
+			n := 4567
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		w.Close()
+	}()
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected the streamed data back, got %d bytes, %v", len(got), err)
+	}
+
+	r, _, err = c.Get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 10000)
+	for _, off := range []int64{0, 1, 4095, 4097, 1 << 20, int64(len(data)) - 5000} {
+		n, err := r.ReadAt(buf, off)
+		want := data[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+		if n != len(want) || !bytes.Equal(buf[:n], want) || (err != nil && err != io.EOF) {
+			t.Errorf("ReadAt(%d) = %d, %v", off, n, err)
+		}
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("expected the data back, got %d bytes, %v", len(got), err)
+	}
+
+	// reloaded entries are read with direct I/O.
+	c2, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, _, err := c2.Get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if _, ok := r2.(*CacheReader).ReadAtCloser.(*directReader); !ok {
+		t.Fatalf("expected a reloaded entry to be read with direct I/O, got %T", r2.(*CacheReader).ReadAtCloser)
+	}
+	if size, done, err := r2.(*CacheReader).Size(); err != nil || !done || size != int64(len(data)) {
+		t.Errorf("expected the entry's size, got %d, %v, %v", size, done, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 100000)
+			for j := 0; j < 20; j++ {
+				if n, err := r2.ReadAt(buf, off); n != len(buf) || !bytes.Equal(buf, data[off:off+int64(n)]) {
+					t.Errorf("concurrent ReadAt(%d) = %d, %v", off, n, err)
+					return
+				}
+			}
+		}(int64(i) * 300001)
+	}
+	wg.Wait()
+}
+
+func TestDirectIOTailing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.DirectIOSize = 10000
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := c.Get("tailed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// the whole blocks of each write must reach the reader before the next, including
+	// those past DirectIOSize, and a partial last block once the writer is closed.
+	for i := 0; i < 20; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 4096)
+		w.Write(chunk)
+		got := make([]byte, len(chunk))
+		read := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(r, got)
+			read <- err
+		}()
+		select {
+		case err := <-read:
+			if err != nil || !bytes.Equal(got, chunk) {
+				t.Fatalf("write %d: expected the written data, got %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			w.Close()
+			t.Fatalf("write %d: expected the reader to see the data before the writer is closed", i)
+		}
+	}
+	w.Write([]byte("tail"))
+	w.Close()
+	check(t, r, "tail")
+}
+
+func TestReloadDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same key under the old base64 names, and the current base32 ones.
+	write := func(encode func(string) (string, bool), data string, mtime time.Time) {
+		fs, err := NewFs(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.EncodeKey = encode
+		f, err := fs.Create("dup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+		f.Close()
+		if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(B64OrMD5HashEncodeKey, "old", time.Now().Add(-time.Hour))
+	write(B32OrMD5HashEncodeKey, "new", time.Now())
+	count := func() int {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	fs, _ := NewFs(dir, 0700)
+	fs.Duplicates = DuplicatesError
+	_, err = NewCache(fs, nil)
+	var dupErr *DuplicateError
+	if !errors.Is(err, ErrDuplicateKeys) || !errors.As(err, &dupErr) || len(dupErr.Files["dup"]) != 2 {
+		t.Fatalf("expected a DuplicateError for dup, got %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("expected DuplicatesError to leave both files, found %d", n)
+	}
+
+	fs, _ = NewFs(dir, 0700)
+	fs.Duplicates = DuplicatesKeepAll
+	var reported []string
+	fs.OnDuplicate = func(key, newest string, others []string) {
+		reported = append(reported, key)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0] != "dup" {
+		t.Errorf("expected dup to be reported, got %v", reported)
+	}
+	r, _, _ := c.Get("dup")
+	check(t, r, "new")
+	r.Close()
+	if n := count(); n != 2 {
+		t.Fatalf("expected DuplicatesKeepAll to leave both files, found %d", n)
+	}
+
+	fs, _ = NewFs(dir, 0700)
+	c, err = NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, _ = c.Get("dup")
+	check(t, r, "new")
+	r.Close()
+	if n := count(); n != 1 {
+		t.Errorf("expected DuplicatesNewest to remove the older file, found %d", n)
+	}
+}
+
+// osSFTPClient serves an SFTPClient from the local filesystem.
+type osSFTPClient struct {
+	stats int
+}
+
+func (c *osSFTPClient) OpenFile(path string, flag int) (SFTPFile, error) {
+	return os.OpenFile(path, flag, 0600)
+}
+
+func (c *osSFTPClient) Stat(path string) (os.FileInfo, error) {
+	c.stats++
+	return os.Stat(path)
+}
+
+func (c *osSFTPClient) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+func (c *osSFTPClient) Remove(path string) error                   { return os.Remove(path) }
+func (c *osSFTPClient) MkdirAll(path string) error                 { return os.MkdirAll(path, 0700) }
+
+func TestSFTPFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &osSFTPClient{}
+	fs, err := NewSFTPFs(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCacheWithHaunter(fs, NewLRUHaunterStrategy(NewLRUHaunter(0, 100, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("k", 200)
+	for _, key := range []string{"short", long} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("remote data"))
+		w.Close()
+		check(t, r, "remote data")
+		r.Close()
+	}
+	if size, err := c.EntrySize("short"); err != nil || size != 11 {
+		t.Errorf("EntrySize = %d, %v", size, err)
+	}
+	if client.stats != 0 {
+		t.Errorf("expected sizes to be known locally, made %d remote stats", client.stats)
+	}
+
+	fs, err = NewSFTPFs(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"short", long} {
+		r, w, err := c.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %q to be reloaded, got %v", key, err)
+		}
+		check(t, r, "remote data")
+		r.Close()
+	}
+	if err := c.Remove(long); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected Remove to delete the file and its key, %d files left", len(files))
+	}
+	if err := c.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected Clean to empty the directory, %d files left", len(files))
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := func() bool {
+		_, err := os.Stat(filepath.Join(dir, ownerFile))
+		return err == nil
+	}
+
+	if err := fs.Lock(nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Exists(ownerFile) || !owned() {
+		t.Fatal("expected Reload to leave the owner file alone")
+	}
+	if err := c.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if !owned() {
+		t.Fatal("expected Clean to keep the directory locked")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if owned() {
+		t.Fatal("expected Close to release the directory")
+	}
+
+	host, _ := os.Hostname()
+	other := DirOwner{PID: 1, Host: host, Start: time.Now()}
+	if err := fs.writeOwner(other, false); err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Lock(nil)
+	var locked *LockedError
+	if !errors.Is(err, ErrDirLocked) || !errors.As(err, &locked) || locked.Owner.PID != 1 {
+		t.Fatalf("expected a LockedError naming pid 1, got %v", err)
+	}
+	var warned error
+	if err := fs.Lock(func(err error) { warned = err }); err != nil || !errors.Is(warned, ErrDirLocked) {
+		t.Fatalf("expected Lock to warn and take over, got %v, %v", err, warned)
+	}
+	if owner, err := fs.readOwner(); err != nil || owner.PID != os.Getpid() {
+		t.Errorf("expected this process to own the directory, got %+v, %v", owner, err)
+	}
+	fs.Close()
+
+	// owners which have exited are replaced.
+	if err := fs.writeOwner(DirOwner{PID: 1<<30 + 7, Host: host}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Lock(nil); err != nil {
+		t.Errorf("expected a stale owner file to be replaced, got %v", err)
+	}
+	fs.Close()
+
+	// as are owners which had this pid in an earlier run, e.g. pid 1 of a restarted container.
+	earlier := DirOwner{PID: os.Getpid(), Host: host, Start: processStart.Add(-time.Hour)}
+	if err := fs.writeOwner(earlier, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Lock(nil); err != nil {
+		t.Errorf("expected an earlier run's owner file to be replaced, got %v", err)
+	}
+	if owner, err := fs.readOwner(); err != nil || !owner.Start.Equal(processStart) {
+		t.Errorf("expected this run to own the directory, got %+v, %v", owner, err)
+	}
+	fs.Close()
+}
+
+// mapKVStore is a KVStore held in a map.
+type mapKVStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (s *mapKVStore) Get(key []byte) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.m[string(key)]
+	return v, ok, nil
+}
+
+func (s *mapKVStore) Set(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *mapKVStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, string(key))
+	return nil
+}
+
+func (s *mapKVStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.m {
+		if strings.HasPrefix(k, string(prefix)) {
+			if err := fn([]byte(k), v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestKVFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	large, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mapKVStore{m: make(map[string][]byte)}
+	c, err := NewCache(NewKVFs(store, large, 8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]string{"tiny": "1234", "big": "0123456789abcdef"}
+	for key, data := range entries {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// readers follow the data as it's written, across the move to the large FileSystem.
+		done := make(chan struct{})
+		go func(r io.Reader, data string) {
+			check(t, r, data)
+			close(done)
+		}(r, data)
+		for i := 0; i < len(data); i += 3 {
+			end := i + 3
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write([]byte(data[i:end]))
+		}
+		w.Close()
+		<-done
+		r.Close()
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the big entry to have a file, found %d", len(files))
+	}
+	if len(store.m) != 2 {
+		t.Errorf("expected both entries in the store, found %d", len(store.m))
+	}
+	if size, err := c.EntrySize("big"); err != nil || size != 16 {
+		t.Errorf("EntrySize = %d, %v", size, err)
+	}
+
+	c, err = NewCache(NewKVFs(store, large, 8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range entries {
+		r, w, err := c.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be reloaded, got %v", key, err)
+		}
+		check(t, r, data)
+		r.Close()
+	}
+	if err := c.Remove("big"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || len(store.m) != 1 {
+		t.Errorf("expected Remove to delete the file and value, %d files and %d values left", len(files), len(store.m))
+	}
+	if err := c.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.m) != 0 {
+		t.Errorf("expected Clean to empty the store, %d values left", len(store.m))
+	}
+}
+
+func TestChaos(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chaos := NewChaos(c)
+	r, w, err := chaos.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	r.Close()
+
+	chaos.SetConfig(ChaosConfig{Ops: ChaosGet | ChaosExists, Rate: 1, ErrorRate: 1})
+	if _, _, err := chaos.Get("key"); err != ErrChaos {
+		t.Errorf("expected ErrChaos, got %v", err)
+	}
+	if chaos.Exists("key") {
+		t.Error("expected a failed Exists to report false")
+	}
+	if err := chaos.Remove("other"); err != nil {
+		t.Errorf("expected Remove to be unaffected, got %v", err)
+	}
+
+	chaos.SetConfig(ChaosConfig{Ops: ChaosAll, Rate: 1, Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if !chaos.Exists("key") {
+		t.Error("expected a delayed Exists to succeed")
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("expected Exists to be delayed, took %v", d)
+	}
+
+	chaos.SetConfig(ChaosConfig{})
+	r, w, err = chaos.Get("key")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit once disabled, got %v", err)
+	}
+	check(t, r, "data")
+	r.Close()
+}
+
+func TestHandlerExpiry(t *testing.T) {
+	c, err := NewCache(NewMemFs(), NewReaper(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(Handler(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		fmt.Fprintln(w, "Hello Client")
+	})))
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	if res := get("/"); res.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("expected a miss to keep the handler's Cache-Control, got %q", res.Header.Get("Cache-Control"))
+	}
+	res := get("/")
+	if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=3600" && cc != "public, max-age=3599" {
+		t.Errorf("expected a hit's max-age to follow the cache's expiry, got %q", cc)
+	}
+	expires, err := http.ParseTime(res.Header.Get("Expires"))
+	if err != nil || time.Until(expires) < 59*time.Minute || time.Until(expires) > time.Hour {
+		t.Errorf("unexpected Expires %q, %v", res.Header.Get("Expires"), err)
+	}
+
+	get("/private")
+	if res := get("/private"); res.Header.Get("Cache-Control") != "private, max-age=60" || res.Header.Get("Expires") != "" {
+		t.Errorf("expected a private response's headers to be left alone, got %v", res.Header)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file descriptors can't be inherited on windows")
+	}
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, _ := c.Get("warm")
+	w.Write([]byte("data"))
+	w.Close()
+	r.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener(l) }()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffChild$")
+	cmd.Env = append(os.Environ(), "FSCACHE_TEST_HANDOFF_CHILD=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Handoff(ctx, l, cmd); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ServeListener to return ErrServerClosed, got %v", err)
+	}
+
+	// the successor serves the same address, with the entries it was handed.
+	r, w, err = NewRemote(l.Addr().String()).Get("warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		t.Fatal("expected the successor to have the warm entry")
+	}
+	check(t, r, "data")
+	r.Close()
+}
+
+func TestHandoffNotReady(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file descriptors can't be inherited on windows")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Cache: c}
+
+	// the successor never says it is ready.
+	cmd := exec.Command("sleep", "30")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Handoff(ctx, l, cmd); err != context.DeadlineExceeded {
+		t.Fatalf("expected the handoff to time out, got %v", err)
+	}
+	if cmd.ProcessState == nil || cmd.ProcessState.Success() {
+		t.Errorf("expected the successor to be killed, got %v", cmd.ProcessState)
+	}
+}
+
+// TestHandoffChild is the successor started by TestHandoff.
+func TestHandoffChild(t *testing.T) {
+	if os.Getenv("FSCACHE_TEST_HANDOFF_CHILD") == "" {
+		t.Skip("only run by TestHandoff")
+	}
+	l, err := InheritedListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportHandoff(c); err != nil {
+		t.Fatal(err)
+	}
+	go (&Server{Cache: c}).ServeListener(l)
+	if err := HandoffReady(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Second)
+}
+
+func TestDropPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droppages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.DropPagesSize = 1000
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{10, 1 << 20} {
+		key := fmt.Sprintf("entry-%d", size)
+		data := bytes.Repeat([]byte{'x'}, size)
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+		check(t, r, string(data))
+
+		var name string
+		fs.Reload(func(k, n string) {
+			if k == key {
+				name = n
+			}
+		})
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(f)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected %d bytes back, got %d, %v", size, len(got), err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackgroundLimit(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	l := NewBackgroundLimit(0.5)
+	if n := l.Limit(); n != 2 {
+		t.Fatalf("expected a limit of 2 with GOMAXPROCS 4, got %d", n)
+	}
+	if n := NewBackgroundLimit(0.01).Limit(); n != 1 {
+		t.Fatalf("expected a limit of at least 1, got %d", n)
+	}
+
+	var mu sync.Mutex
+	var running, most int
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Do(func() {
+				mu.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("expected at most 2 tasks at once, got %d", most)
+	}
+	if n := l.Running(); n != 0 {
+		t.Errorf("expected no tasks running, got %d", n)
+	}
+
+	fs := NewMemFs()
+	c, err := NewCacheWithHaunter(fs, evictAllHaunter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetEvictionParallelism(4).SetBackgroundLimit(l)
+	for i := 0; i < 10; i++ {
+		r, w, err := c.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		w.Close()
+		r.Close()
+	}
+	c.scheduleHaunt()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.EvictionProgress().Pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p := c.EvictionProgress(); p.Pending != 0 || p.Removed != 10 {
+		t.Errorf("expected all 10 files removed under the limit, got %+v", p)
+	}
+}
+
+func TestArchiveFS(t *testing.T) {
+	entries := map[string]string{"a": "hello", "b": strings.Repeat("world", 1000)}
+	name := func(key string) string {
+		n, _ := B32OrMD5HashEncodeKey(key)
+		return "cache/" + n
+	}
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	for key, data := range entries {
+		tw.WriteHeader(&tar.Header{Name: name(key), Mode: 0600, Size: int64(len(data)), ModTime: time.Now()})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	tfs, err := NewTarFs(bytes.NewReader(tbuf.Bytes()), int64(tbuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	for key, data := range entries {
+		method := zip.Store
+		if key == "b" {
+			method = zip.Deflate
+		}
+		f, _ := zw.CreateHeader(&zip.FileHeader{Name: name(key), Method: method})
+		f.Write([]byte(data))
+	}
+	zw.Close()
+	zfs, err := NewZipFs(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fs := range []*ArchiveFS{tfs, zfs} {
+		seed, err := NewCache(fs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		top, err := NewCache(NewMemFs(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewLayered(top, seed)
+
+		for key, data := range entries {
+			r, w, err := c.Get(key)
+			if err != nil || w != nil {
+				t.Fatalf("expected a hit for %s, got %v", key, err)
+			}
+			check(t, r, data)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !top.Exists("b") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !top.Exists("b") {
+			t.Errorf("expected the seed entry to be loaded into the top layer")
+		}
+
+		r, w, err := c.Get("c")
+		if err != nil || w == nil {
+			t.Fatalf("expected a miss to be written to the top layer, got %v", err)
+		}
+		w.Write([]byte("new"))
+		w.Close()
+		check(t, r, "new")
+		if seed.Exists("c") {
+			t.Errorf("expected the archive to be left alone")
+		}
+		if _, err := fs.Create("c"); err != ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+		if err := c.Clean(); err != nil {
+			t.Errorf("expected Clean to pass over the archive, got %v", err)
+		}
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		c, err := NewCache(NewMemFs(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetPrefixIndex(indexed)
+		for _, key := range []string{"a/b/c", "a/b/d", "a/e", "a/b", "f"} {
+			r, w, err := c.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(key))
+			w.Close()
+			r.Close()
+		}
+
+		for prefix, want := range map[string]string{
+			"":     "a/ f",
+			"a/":   "a/b a/b/ a/e",
+			"a/b/": "a/b/c a/b/d",
+			"g/":   "",
+		} {
+			if got := strings.Join(c.ListPrefix(prefix), " "); got != want {
+				t.Errorf("indexed %v: expected ListPrefix(%q) to be %q, got %q", indexed, prefix, want, got)
+			}
+		}
+
+		c.Remove("a/b/c")
+		c.Remove("a/b/d")
+		if got := strings.Join(c.ListPrefix("a/"), " "); got != "a/b a/e" {
+			t.Errorf("indexed %v: expected the emptied prefix to go, got %q", indexed, got)
+		}
+	}
+}
+
+func TestMemFsOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memoverflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewMemFsWithOverflow(1000, disk)
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := c.Get("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	check(t, r, "hello")
+	r.Close()
+
+	data := strings.Repeat("0123456789", 1000)
+	r, w, err = c.Get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < len(data); i += 300 {
+			end := i + 300
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write([]byte(data[i:end]))
+		}
+		w.Close()
+	}()
+	check(t, r, data)
+	r.Close()
+
+	if used := atomic.LoadInt64(&fs.(*memFS).used); used > 1000 {
+		t.Errorf("expected at most 1000 bytes in memory, got %d", used)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected the large entry to spill to disk, got %d files", len(files))
+	}
+	if size, err := c.EntrySize("large"); err != nil || size != int64(len(data)) {
+		t.Errorf("expected the spilled entry's size, got %d, %v", size, err)
+	}
+
+	r, _, err = c.Get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, data)
+	r.Close()
+
+	if err := c.Remove("large"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the spilled file to be removed, got %d files", len(files))
+	}
+}
+
+func TestTxn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("old"))
+	w.Close()
+	r.Close()
+
+	put := func(data string) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}
+	}
+
+	errFailed := errors.New("failed")
+	err = c.Txn(func(tx Txn) error {
+		if err := tx.Put("manifest", put("blob")); err != nil {
+			return err
+		}
+		tx.Remove("old")
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the function's error, got %v", err)
+	}
+	if c.Exists("manifest") || !c.Exists("old") {
+		t.Errorf("expected a failed transaction to change nothing")
+	}
+
+	err = c.Txn(func(tx Txn) error {
+		if err := tx.Put("blob", put("data")); err != nil {
+			return err
+		}
+		if c.Exists("blob") {
+			t.Errorf("expected the staged entry to be hidden until commit")
+		}
+		if err := tx.Put("manifest", put("blob")); err != nil {
+			return err
+		}
+		tx.Remove("old")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range map[string]string{"blob": "data", "manifest": "blob"} {
+		r, w, err := c.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be committed, got %v", key, err)
+		}
+		check(t, r, data)
+		r.Close()
+	}
+	if c.Exists("old") {
+		t.Errorf("expected the removed entry to go")
+	}
+
+	_, w, err = c.Get("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Txn(func(tx Txn) error { return tx.Put("busy", put("data")) })
+	if err != ErrInProgress {
+		t.Errorf("expected ErrInProgress, got %v", err)
+	}
+	w.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("expected no staged files left behind, got %d files", len(files))
+	}
+}
+
+func TestMemFsReplaceReleases(t *testing.T) {
+	fs := NewMemFs()
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 100))
+		return err
+	}
+	var gen uint64
+	for i := 0; i < 10; i++ {
+		if gen, err = c.Replace("key", gen, fill); err != nil {
+			t.Fatal(err)
+		}
+		if used := atomic.LoadInt64(&fs.(*memFS).used); used != 100 {
+			t.Fatalf("replace %d: expected 100 bytes in memory, got %d", i, used)
+		}
+	}
+}
+
+func TestMemFsChunks(t *testing.T) {
+	fs := NewMemFs()
+	f, err := fs.Create("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*memChunkSize+1234)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for p := data; len(p) > 0; {
+		n := 10007
+		if n > len(p) {
+			n = len(p)
+		}
+		f.Write(p[:n])
+		p = p[n:]
+	}
+	f.Close()
+
+	r, err := fs.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, off := range []int{0, memChunkSize - 10, 2*memChunkSize + 5, len(data) - 3} {
+		p := make([]byte, 100)
+		n, err := r.ReadAt(p, int64(off))
+		want := data[off:]
+		if len(want) > len(p) {
+			want = want[:len(p)]
+		}
+		if !bytes.Equal(p[:n], want) || (n < len(p) && err != io.EOF) {
+			t.Errorf("unexpected ReadAt at %d: %d bytes, %v", off, n, err)
+		}
+	}
+
+	var got []byte
+	p := make([]byte, 333)
+	for {
+		n, err := r.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %d bytes back in small reads, got %d", len(data), len(got))
+	}
+	if fi, err := fs.Stat("large"); err != nil || fi.Size() != int64(len(data)) {
+		t.Errorf("expected size %d, got %v", len(data), err)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	filled := make(map[string]int)
+	fill := func(part string, w io.Writer) error {
+		mu.Lock()
+		filled[part]++
+		mu.Unlock()
+		_, err := io.WriteString(w, strings.Repeat(part, 100))
+		return err
+	}
+
+	if err := PutComposite(c, "obj", []string{"a", "b", "c", "d"}, fill, 2); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenComposite(c, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("a", 100) + strings.Repeat("b", 100) + strings.Repeat("c", 100) + strings.Repeat("d", 100)
+	check(t, r, want)
+	p := make([]byte, 4)
+	if n, err := r.ReadAt(p, 98); err != nil || string(p[:n]) != "aabb" {
+		t.Errorf("expected a read across parts, got %q, %v", p[:n], err)
+	}
+	r.Close()
+
+	if err := PutComposite(c, "obj", []string{"a", "b", "e", "d"}, fill, 2); err != nil {
+		t.Fatal(err)
+	}
+	if filled["a"] != 1 || filled["e"] != 1 {
+		t.Errorf("expected the unchanged parts to be reused, got %v", filled)
+	}
+	r, err = OpenComposite(c, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, strings.Repeat("a", 100)+strings.Repeat("b", 100)+strings.Repeat("e", 100)+strings.Repeat("d", 100))
+	r.Close()
+
+	c.Remove("d")
+	r, err = OpenComposite(c, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrMissingPart {
+		t.Errorf("expected ErrMissingPart, got %v", err)
+	}
+	r.Close()
+
+	errFill := errors.New("fill failed")
+	err = PutComposite(c, "other", []string{"f"}, func(string, io.Writer) error { return errFill }, 1)
+	if err != errFill || c.Exists("f") || c.Exists("other") {
+		t.Errorf("expected a failed fill to leave nothing behind, got %v", err)
+	}
+}
+
+func TestCollectContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := func(data string) string {
+		w, err := c.NewContentWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, data)
+		key, err := w.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	b1, b2, b3 := blob("one"), blob("two"), blob("three")
+
+	noFill := func(part string, w io.Writer) error { return fmt.Errorf("unexpected fill of %s", part) }
+	if err := PutComposite(c, "obj", []string{b1, b2}, noFill, 1); err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("not a manifest"))
+	w.Close()
+	r.Close()
+
+	var b4 string
+	removed, err := c.CollectContent(func(key string, r io.Reader) ([]string, error) {
+		if key == "plain" && b4 == "" {
+			if _, err := c.CollectContent(CompositeRefs); err != ErrCollecting {
+				t.Errorf("expected ErrCollecting, got %v", err)
+			}
+			// a blob uploaded during the collection, before what references it.
+			b4 = blob("four")
+		}
+		return CompositeRefs(key, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != b3 {
+		t.Errorf("expected only %s to be collected, got %v", b3, removed)
+	}
+	for _, key := range []string{b1, b2, b4, "obj", "plain"} {
+		if !c.Exists(key) {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+	if c.Exists(b3) {
+		t.Errorf("expected %s to be removed", b3)
+	}
+
+	removed, err = c.CollectContent(CompositeRefs)
+	if err != nil || len(removed) != 1 || removed[0] != b4 {
+		t.Errorf("expected the unreferenced upload to go in the next collection, got %v, %v", removed, err)
+	}
+}
+
+func TestKeyEncodings(t *testing.T) {
+	for _, key := range []string{"report.pdf", "a/b", "x.key", strings.Repeat("ab", 32), "\x00staged"} {
+		name, ok := PlainEncodeKey(key)
+		if ok && name != key {
+			t.Errorf("expected %q to be named as it is, got %q", key, name)
+		}
+		if !ok && !isHexSHA256(name) {
+			t.Errorf("expected %q to fall back to its sha256, got %q", key, name)
+		}
+	}
+	if _, ok := PlainEncodeKey("report.pdf"); !ok {
+		t.Errorf("expected a plain file name to be used as it is")
+	}
+
+	dir, err := ioutil.TempDir("", "keyenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// populated out-of-band
+	ioutil.WriteFile(filepath.Join(dir, "report.pdf"), []byte("pdf"), 0600)
+	hashed, _ := SHA256EncodeKey("a/b")
+	ioutil.WriteFile(filepath.Join(dir, hashed), []byte("ab"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, hashed+".key"), []byte("a/b"), 0600)
+
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.EncodeKey, fs.DecodeKey = PlainEncodeKey, PlainDecodeKey
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range map[string]string{"report.pdf": "pdf", "a/b": "ab"} {
+		r, w, err := c.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be reloaded, got %v", key, err)
+		}
+		check(t, r, data)
+		r.Close()
+	}
+
+	r, w, err := c.Get("new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	w.Close()
+	r.Close()
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "new.txt")); err != nil || string(data) != "new" {
+		t.Errorf("expected a predictable file name, got %q, %v", data, err)
+	}
+}
+
+func TestHandlerDecompress(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("Hello Client"))
+	zw.Close()
+	h := Handler(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+
+	serve := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/doc", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("gzip"); !bytes.Equal(rec.Body.Bytes(), gz.Bytes()) {
+		t.Fatalf("expected the compressed response on a miss")
+	}
+	for _, accept := range []string{"identity", "br, gzip;q=0"} {
+		rec := serve(accept)
+		if rec.Body.String() != "Hello Client" || rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("expected a decompressed hit for %q, got %q, %q", accept, rec.Body.String(), rec.Header().Get("Content-Encoding"))
+		}
+	}
+	for _, accept := range []string{"gzip, deflate", "*", ""} {
+		rec := serve(accept)
+		if !bytes.Equal(rec.Body.Bytes(), gz.Bytes()) || rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected the stored encoding for %q", accept)
+		}
+	}
+
+	r, w, err := c.Get(httptest.NewRequest("GET", "/doc", nil).URL.String())
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	ir, err := NewIdentityReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, ir, "Hello Client")
+	ir.Close()
+}
+
+func TestKeyXattr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyxattr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	probe := filepath.Join(dir, "probe")
+	ioutil.WriteFile(probe, nil, 0600)
+	if err := setKeyXattr(probe, "probe"); err != nil {
+		t.Skipf("extended attributes aren't supported: %v", err)
+	}
+	os.Remove(probe)
+
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.EncodeKey, fs.KeyXattr = SHA256EncodeKey, true
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ab"))
+	w.Close()
+	r.Close()
+	if err := c.Txn(func(tx Txn) error {
+		return tx.Put("c/d", func(w io.Writer) error {
+			_, err := w.Write([]byte("cd"))
+			return err
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".key") {
+			t.Errorf("expected no .key files, found %s", fi.Name())
+		}
+	}
+
+	fs2, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs2.EncodeKey = SHA256EncodeKey
+	c2, err := NewCache(fs2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range map[string]string{"a/b": "ab", "c/d": "cd"} {
+		r, w, err := c2.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be reloaded from its attribute, got %v", key, err)
+		}
+		check(t, r, data)
+		r.Close()
+	}
+}
+
+// blockedReloadFs holds Reload until release is closed.
+type blockedReloadFs struct {
+	*StandardFS
+	release chan struct{}
+}
+
+func (fs *blockedReloadFs) Reload(add func(key, name string)) error {
+	<-fs.release
+	return fs.StandardFS.Reload(add)
+}
+
+func TestNewCacheLazy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("long", 100)
+	for _, key := range []string{"a", "b", "d", long} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+	}
+
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfs := &blockedReloadFs{StandardFS: fs, release: make(chan struct{})}
+	c2, err := NewCacheLazy(bfs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", long} {
+		r, w, err := c2.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s to be found before Reload, got %v", key[:4], err)
+		}
+		check(t, r, key)
+		r.Close()
+	}
+	if !c2.Exists("d") {
+		t.Errorf("expected d to be found before Reload")
+	}
+	if err := c2.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(bfs.release)
+	if err := c2.WaitLoaded(); err != nil {
+		t.Fatal(err)
+	}
+	if c2.Exists("b") {
+		t.Errorf("expected b to stay removed after Reload")
+	}
+	if !c2.Exists("d") || !c2.Exists(long) {
+		t.Errorf("expected the other keys to be loaded")
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	c, err := NewCacheWithHaunter(NewMemFs(), evictAllHaunter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OnExpire("missing", func(string) {}); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing key, got %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+	}
+
+	var expired []string
+	record := func(key string) {
+		// the cache is usable from the callback.
+		if c.Exists(key) {
+			t.Errorf("expected %s to be gone when its callback runs", key)
+		}
+		expired = append(expired, key)
+	}
+	c.OnExpire("a", record)
+	c.OnExpire("a", record)
+	c.OnExpire("b", record)
+	if err := c.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	c.haunt()
+	if len(expired) != 2 || expired[0] != "a" || expired[1] != "a" {
+		t.Errorf("expected both callbacks of a only, got %v", expired)
+	}
+}
+
+func TestGetScoped(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(ctx context.Context, key string) ReadAtCloser {
+		r, w, err := c.GetScoped(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			w.Write([]byte(key))
+			w.Close()
+		}
+		return r
+	}
+	waitGone := func(key string) bool {
+		for i := 0; i < 50; i++ {
+			if !c.Exists(key) {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fill(ctx, "tmp").Close()
+	if !c.Exists("tmp") {
+		t.Fatalf("expected the scoped entry while its context is live")
+	}
+	cancel()
+	if !waitGone("tmp") {
+		t.Errorf("expected the scoped entry to be removed with its context")
+	}
+
+	// in use by another reader, so it's kept.
+	ctx, cancel = context.WithCancel(context.Background())
+	fill(ctx, "shared").Close()
+	r, _, err := c.Get("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if waitGone("shared") {
+		t.Errorf("expected an entry in use to be kept")
+	}
+	r.Close()
+
+	// already cached, so not scoped.
+	ctx, cancel = context.WithCancel(context.Background())
+	fill(ctx, "shared").Close()
+	cancel()
+	if waitGone("shared") {
+		t.Errorf("expected an existing entry not to be scoped")
+	}
+
+	if _, _, err := c.GetScoped(ctx, "done"); err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+}
+
+func TestReloadReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloadreport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, encode := range []func(string) (string, bool){B64OrMD5HashEncodeKey, B32OrMD5HashEncodeKey} {
+		fs, err := NewFs(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.EncodeKey = encode
+		f, err := fs.Create("dup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("dup"))
+		f.Close()
+		mtime := time.Now().Add(time.Duration(i-1) * time.Hour)
+		os.Chtimes(f.Name(), mtime, mtime)
+	}
+	lost, _ := SHA256EncodeKey("lost")
+	ioutil.WriteFile(filepath.Join(dir, lost), []byte("lost"), 0600)
+	os.Mkdir(filepath.Join(dir, "subdir"), 0700)
+
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls, last, total int
+	fs.ReloadProgress = func(done, n int) {
+		calls++
+		last, total = done, n
+	}
+	if _, err := NewCache(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || last != 4 || total != 4 {
+		t.Errorf("expected progress to finish at 4 of 4, got %d of %d in %d calls", last, total, calls)
+	}
+	report := fs.LastReload()
+	if report.Loaded != 1 {
+		t.Errorf("expected 1 entry to be loaded, got %d", report.Loaded)
+	}
+	if len(report.Removed) != 2 {
+		t.Errorf("expected the lost and the old duplicate files to be removed, got %v", report.Removed)
+	}
+	if len(report.Duplicates["dup"]) != 1 {
+		t.Errorf("expected a duplicate for dup, got %v", report.Duplicates)
+	}
+	if len(report.Skipped) != 1 || filepath.Base(report.Skipped[0]) != "subdir" {
+		t.Errorf("expected subdir to be skipped, got %v", report.Skipped)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "subdir")); err != nil {
+		t.Errorf("expected subdir to be left in place: %v", err)
+	}
+}
+
+func TestContainerMemoryLimit(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, data string) {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := containerMemoryLimit(root); ok {
+		t.Errorf("expected no limit without cgroups")
+	}
+
+	// v2, limited by a parent
+	write("proc/self/cgroup", "0::/pod/app\n")
+	write("sys/fs/cgroup/pod/app/memory.max", "max\n")
+	write("sys/fs/cgroup/pod/memory.max", "1048576\n")
+	if n, ok := containerMemoryLimit(root); !ok || n != 1<<20 {
+		t.Errorf("expected the parent's v2 limit, got %d, %v", n, ok)
+	}
+
+	// v1, with the container's cgroup mounted as the root
+	os.RemoveAll(filepath.Join(root, "sys"))
+	write("proc/self/cgroup", "12:cpu,cpuacct:/kubepods/x\n4:memory:/kubepods/x\n")
+	write("sys/fs/cgroup/memory/memory.limit_in_bytes", "2097152\n")
+	if n, ok := containerMemoryLimit(root); !ok || n != 2<<20 {
+		t.Errorf("expected the v1 limit, got %d, %v", n, ok)
+	}
+	write("sys/fs/cgroup/memory/memory.limit_in_bytes", "9223372036854771712\n")
+	if _, ok := containerMemoryLimit(root); ok {
+		t.Errorf("expected v1's unlimited value to be no limit")
+	}
+}
+
+// slowSFTPClient holds OpenFile until release is closed.
+type slowSFTPClient struct {
+	osSFTPClient
+	release chan struct{}
+}
+
+func (c *slowSFTPClient) OpenFile(path string, flag int) (SFTPFile, error) {
+	<-c.release
+	return c.osSFTPClient.OpenFile(path, flag)
+}
+
+func TestGetContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &slowSFTPClient{release: make(chan struct{})}
+	fs, err := NewSFTPFs(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.GetContext(ctx, "key"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to end the Create, got %v", err)
+	}
+	if c.Exists("key") {
+		t.Errorf("expected no entry after a canceled Create")
+	}
+
+	close(client.release)
+	// the abandoned File is removed once the remote host finishes creating it.
+	for i := 0; i < 100; i++ {
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the abandoned File to be removed, found %d files", len(files))
+	}
+
+	r, w, err := c.GetContext(context.Background(), "key")
+	if err != nil || w == nil {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	check(t, r, "data")
+	r.Close()
+}
+
+func TestUsage(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, data string) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+	put("a/1", "12345")
+	if c.Usage() != nil {
+		t.Errorf("expected no usage before it is tracked")
+	}
+	c.SetUsageNamespaces(PrefixNamespace("/"))
+	put("a/2", "123")
+	put("b/1", "1")
+	put("top", "12")
+
+	r, w, err := c.Get("b/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("in progress"))
+	expect := map[string]Usage{"a": {2, 8}, "b": {2, 1}, "": {1, 2}}
+	if got := c.Usage(); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	w.Close()
+	r.Close()
+
+	c.Remove("a/1")
+	c.Remove("top")
+	expect = map[string]Usage{"a": {1, 3}, "b": {2, 12}}
+	if got := c.Usage(); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestSoftLimits(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := c.Events()
+	c.SetSoftLimits(3, 10)
+	put := func(key, data string) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+	put("a", "12345")
+	put("b", "123456")
+	if items, size := c.OverSoftLimit(); items || !size {
+		t.Errorf("expected to be over the size limit only, got %v %v", items, size)
+	}
+	c.Remove("a")
+	put("c", "1")
+	put("d", "1")
+	put("e", "1")
+	if items, size := c.OverSoftLimit(); !items || size {
+		t.Errorf("expected to be over the item limit only, got %v %v", items, size)
+	}
+	c.SetSoftLimits(0, 0)
+	if items, size := c.OverSoftLimit(); items || size {
+		t.Errorf("expected no limits once cleared, got %v %v", items, size)
+	}
+	c.SetSoftLimits(0, 5)
+	c.Close()
+
+	var got []Event
+	for e := range events {
+		if e.Type == EventOverSoftLimit || e.Type == EventUnderSoftLimit {
+			got = append(got, e)
+		}
+	}
+	expect := []Event{
+		{EventOverSoftLimit, "b", 11},
+		{EventUnderSoftLimit, "a", 6},
+		{EventOverSoftLimit, "e", 8},
+		{EventOverSoftLimit, "", 9},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows doesn't have unix permissions")
+	}
+	dir, err := ioutil.TempDir("", "filemode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.FileMode = 0644
+	fs.ChownFiles, fs.Uid, fs.Gid = true, os.Getuid(), os.Getgid()
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"short", strings.Repeat("long", 100)} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.(MetadataWriter).SetMetadata([]byte("meta"))
+		w.Write([]byte("data"))
+		w.Close()
+		r.Close()
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 5 {
+		t.Errorf("expected 2 entries, with 2 .meta files and a .key file, got %d files", len(files))
+	}
+	for _, fi := range files {
+		if fi.Mode().Perm() != 0644 {
+			t.Errorf("expected %s to have mode 0644, got %v", fi.Name(), fi.Mode().Perm())
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := New(dir, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a FileSystem without FileSystemMetadata
+	dst, err := NewCache(struct{ FileSystem }{NewMemFs()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(c Cache, key, data string, meta []byte) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != nil {
+			if err := w.(MetadataWriter).SetMetadata(meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+	put(src, "a", "aaa", nil)
+	put(src, "b", "bbb", nil)
+	put(dst, "b", "old", nil)
+	put(src, "meta", "mmm", []byte("m"))
+
+	// dst can't store metadata, so that entry stays where it is.
+	if err := Move(src, dst, "a", "b", "missing", "meta"); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported for the entry with metadata, got %v", err)
+	}
+	for key, data := range map[string]string{"a": "aaa", "b": "old"} {
+		if src.Exists(key) {
+			t.Errorf("expected %s to be removed from the source", key)
+		}
+		r, w, err := dst.Get(key)
+		if err != nil || w != nil {
+			t.Fatalf("expected %s in the destination, got %v", key, err)
+		}
+		check(t, r, data)
+		r.Close()
+	}
+	if !src.Exists("meta") || dst.Exists("meta") || dst.Exists("missing") {
+		t.Errorf("expected only the movable entries to move")
+	}
+
+	// and back, with its metadata.
+	dir2, err := ioutil.TempDir("", "move2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+	dst2, err := New(dir2, 0700, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(src, dst2, "meta"); err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := dst2.Get("meta")
+	if err != nil || w != nil {
+		t.Fatalf("expected meta to move, got %v", err)
+	}
+	if meta, _ := r.(MetadataReader).Metadata(); string(meta) != "m" {
+		t.Errorf("expected the metadata to move, got %q", meta)
+	}
+	check(t, r, "mmm")
+	r.Close()
+}
+
+func TestAtomicCreateStaging(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("AtomicCreate doesn't stage files on windows")
+	}
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file staged the way createTmp does where unnamed files aren't supported.
+	sf, err := fs.createStaged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := fs.encodeName("staged")
+	f := &tmpFile{File: sf, fs: fs, name: filepath.Join(dir, name), staged: true}
+	fs.pending = map[string]*tmpFile{f.name: f}
+	f.Write([]byte("hel"))
+	r, err := fs.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the staged file not to be in place yet, got %v", err)
+	}
+	f.Write([]byte("lo"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, r, "hello")
+	r.Close()
+	if data, err := ioutil.ReadFile(f.Name()); err != nil || string(data) != "hello" {
+		t.Errorf("expected the closed file to be renamed into place, got %q, %v", data, err)
+	}
+
+	// left by a crash
+	crashed, err := fs.createStaged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.Write([]byte("partial"))
+	crashed.Close()
+
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Exists("staged") || len(c.ListPrefix("")) != 1 {
+		t.Errorf("expected Reload to find only the closed file, got %v", c.ListPrefix(""))
+	}
+	if removed := fs.LastReload().Removed; len(removed) != 1 || removed[0] != crashed.Name() {
+		t.Errorf("expected Reload to remove the crashed writer's file, got %v", removed)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	a, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDistributor(a, b)
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		r, w, err := a.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("0123456789"))
+		w.Close()
+		r.Close()
+	}
+
+	var calls int
+	start := time.Now()
+	p, err := a.Rebalance(d, RebalanceOptions{
+		BytesPerSecond: 1000,
+		Progress:       func(RebalanceProgress) { calls++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Keys != 20 || p.Scanned != 20 || calls != 20 {
+		t.Errorf("expected 20 keys scanned with progress for each, got %+v after %d calls", p, calls)
+	}
+	if p.Moved == 0 || p.Moved == 20 || p.Bytes != int64(p.Moved)*10 {
+		t.Errorf("expected some entries moved with their bytes counted, got %+v", p)
+	}
+	if elapsed, min := time.Since(start), time.Duration(p.Bytes-10)*time.Millisecond; elapsed < min {
+		t.Errorf("expected copying %d bytes at 1000/s to take at least %v, took %v", p.Bytes, min, elapsed)
+	}
+	for _, key := range keys {
+		owner, other := a, b
+		if d.GetCache(key) == Cache(b) {
+			owner, other = b, a
+		}
+		if !owner.Exists(key) || other.Exists(key) {
+			t.Errorf("expected %s only on the cache it is placed on", key)
+		}
+	}
+}
+
+func TestRebalanceMappedKeys(t *testing.T) {
+	a, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetKeyMapper(func(key string) string { return "m/" + key })
+	b, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDistributor(a, b)
+	for i := 0; i < 20; i++ {
+		r, w, err := a.Get(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		w.Close()
+		r.Close()
+	}
+
+	// keys which aren't kept are moved as the cache tracks them, without mapping them again.
+	p, err := a.Rebalance(d, RebalanceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if d.GetCache("m/"+key) == Cache(b) {
+			moved++
+			if a.Exists(key) || !b.Exists("m/"+key) {
+				t.Errorf("expected %s to be moved to b", key)
+			}
+		} else if !a.Exists(key) {
+			t.Errorf("expected %s to stay", key)
+		}
+	}
+	if p.Moved != moved || p.Bytes != int64(moved)*4 {
+		t.Errorf("expected %d entries moved, got %+v", moved, p)
+	}
+	if stats := a.Stats(); stats.Misses != 20 {
+		t.Errorf("expected rebalancing not to miss, got %d misses", stats.Misses)
+	}
+
+	r, w, err := (&throttledCache{Cache: b, t: &throttle{}}).Get("aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := w.(Aborter); !ok {
+		t.Fatal("expected a throttled writer to be an Aborter")
+	}
+	w.Write([]byte("partial"))
+	w.(Aborter).Abort()
+	if b.Exists("aborted") {
+		t.Error("expected an aborted copy not to be published")
+	}
+}
+
+type failingManifester struct{}
+
+func (failingManifester) Manifest() ([]ManifestEntry, error) { return nil, errors.New("unreachable") }
+
+func TestTakeSnapshot(t *testing.T) {
+	put := func(c Cache, key, data string) {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+	a, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(a, "same", "data")
+	put(b, "same", "data")
+	put(a, "diverged", "one")
+	put(b, "diverged", "two!")
+	put(b, "only-b", "b")
+
+	s, err := TakeSnapshot(map[string]Manifester{"a": a, "b": b, "down": failingManifester{}})
+	if err == nil || err.Error() != "unreachable" {
+		t.Errorf("expected the failing node's error, got %v", err)
+	}
+	if _, ok := s.Nodes["down"]; ok || len(s.Nodes) != 2 {
+		t.Errorf("expected only the reachable nodes, got %v", s.Nodes)
+	}
+	if got := fmt.Sprint(len(s.Nodes["a"]), len(s.Nodes["b"])); got != "2 3" {
+		t.Errorf("expected 2 and 3 entries, got %s", got)
+	}
+	e := s.Nodes["b"][0]
+	if e.Key != "diverged" || e.Size != 4 || e.Digest != fmt.Sprintf("%x", sha256.Sum256([]byte("two!"))) || e.Age < 0 {
+		t.Errorf("unexpected manifest entry %+v", e)
+	}
+	if len(s.Divergent) != 1 || len(s.Divergent["diverged"]) != 2 {
+		t.Errorf("expected only diverged to diverge, got %v", s.Divergent)
+	}
+}
+
+func TestLayeredKeepsTimes(t *testing.T) {
+	bottomFs := NewMemFs()
+	bottom, err := NewCache(bottomFs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := bottom.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(MetadataWriter).SetMetadata([]byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	r.Close()
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := bottomFs.(FileSystemChtimes).Chtimes("k", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err = NewLayered(top, bottom).Get("k")
+	if err != nil || w != nil {
+		t.Fatalf("expected a hit, got %v", err)
+	}
+	check(t, r, "data")
+	r.Close()
+
+	for i := 0; i < 100 && !top.Exists("k"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r, w, err = top.Get("k")
+	if err != nil || w != nil {
+		t.Fatalf("expected k to be loaded into the top layer, got %v", err)
+	}
+	defer r.Close()
+	check(t, r, "data")
+	if meta, err := r.(MetadataReader).Metadata(); err != nil || string(meta) != "meta" {
+		t.Errorf("expected the metadata to be loaded, got %q %v", meta, err)
+	}
+	// the times are set once the load's writer is closed.
+	var wt time.Time
+	for i := 0; i < 100; i++ {
+		if _, wt, err = r.(TimesReader).Times(); err != nil || wt.Equal(old) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || !wt.Equal(old) {
+		t.Errorf("expected the write time %v to be kept, got %v %v", old, wt, err)
+	}
+}
+
+type teeBuffer struct {
+	bytes.Buffer
+	closed, aborted bool
+}
+
+func (b *teeBuffer) Close() error { b.closed = true; return nil }
+func (b *teeBuffer) Abort() error { b.aborted = true; return nil }
+
+func TestWriteTee(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	sinks := make(map[string]*teeBuffer)
+	c.SetWriteTee(func(key string) io.WriteCloser {
+		if key == "skipped" {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sinks[key] = &teeBuffer{}
+		return sinks[key]
+	})
+
+	for _, key := range []string{"a", "skipped", "aborted"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello "))
+		w.Write([]byte(key))
+		if key == "aborted" {
+			w.(Aborter).Abort()
+		} else {
+			w.Close()
+		}
+		r.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if a := sinks["a"]; a == nil || a.String() != "hello a" || !a.closed || a.aborted {
+		t.Errorf("expected a to be teed and closed, got %+v", a)
+	}
+	if _, ok := sinks["skipped"]; ok || len(sinks) != 2 {
+		t.Errorf("expected only a and aborted to be teed, got %v", sinks)
+	}
+	if ab := sinks["aborted"]; ab == nil || !ab.aborted || ab.closed {
+		t.Errorf("expected aborted's sink to be aborted, got %+v", ab)
+	}
+	r, w, err := c.Get("a")
+	if err != nil || w != nil {
+		t.Fatalf("expected a to be cached, got %v", err)
+	}
+	check(t, r, "hello a")
+	r.Close()
+}
+
+func TestSetPriority(t *testing.T) {
+	fs := NewMemFs()
+	c, err := NewCacheWithHaunter(fs, NewLRUHaunterStrategy(NewLRUHaunter(1, 0, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SetPriority("missing", 1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	now := time.Now()
+	for key, e := range map[string]struct {
+		priority int
+		age      time.Duration
+	}{
+		"expensive": {3, 2 * time.Hour},    // as old as 30m
+		"cheap":     {-1, time.Hour},       // as old as 2h
+		"other":     {0, 45 * time.Minute}, // as old as 45m
+	} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(key))
+		w.Close()
+		r.Close()
+		if err := c.SetPriority(key, e.priority); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.(FileSystemChtimes).Chtimes(key, now.Add(-e.age), now.Add(-e.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.haunt()
+	if !c.Exists("expensive") || c.Exists("cheap") || c.Exists("other") {
+		t.Errorf("expected only the expensive entry to be kept")
+	}
+}
+
+func TestReadSampler(t *testing.T) {
+	c, err := NewCache(NewMemFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := c.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	r.Close()
+
+	var mu sync.Mutex
+	var samples []string
+	c.SetReadSampler(0.5, func(key string, size int64, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d < 0 {
+			t.Errorf("expected a positive duration, got %v", d)
+		}
+		samples = append(samples, fmt.Sprint(key, size))
+	})
+	for i := 0; i < 4; i++ {
+		r, _, err := c.Get("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2+i%2)
+		io.ReadFull(r, buf)
+		r.Close()
+	}
+	c.SetReadSampler(0, nil)
+	r, _, _ = c.Get("k")
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(samples); got != "[k3 k3]" {
+		t.Errorf("expected every other reader sampled, got %s", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost, wrong := strings.Repeat("l", 300), strings.Repeat("w", 300)
+	corrupt := ContentKeyPrefix + fmt.Sprintf("%x", sha256.Sum256([]byte("abc")))
+	for key, data := range map[string]string{"good": "good", lost: "lost", wrong: "wrong", corrupt: "abd"} {
+		r, w, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+		r.Close()
+	}
+	c.Close()
+
+	name := func(key string) string {
+		name, _ := fs.encodeName(key)
+		return filepath.Join(dir, name)
+	}
+	os.Remove(name(lost) + ".key")
+	ioutil.WriteFile(name(wrong)+".key", []byte("other"), 0600)
+	for _, orphan := range []string{"gone.key", "gone.meta", name("good") + ".meta.tmp"} {
+		ioutil.WriteFile(filepath.Join(dir, filepath.Base(orphan)), nil, 0600)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Files != 4 || len(report.Repaired) != 0 {
+		t.Errorf("expected problems in 4 files, and nothing repaired, got %+v", report)
+	}
+	got := fmt.Sprint(report.LostKeys, report.WrongKeys, report.Corrupt, len(report.Orphans))
+	if want := fmt.Sprint([]string{name(lost)}, []string{name(wrong)}, []string{name(corrupt)}, 3); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if _, err := os.Stat(name(corrupt)); err != nil {
+		t.Errorf("expected Verify to leave the directory as it was, %v", err)
+	}
+
+	fs, err = NewFs(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.VerifyOnLoad = VerifyAndRepair
+	c, err = NewCache(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := fs.LastVerify(); v == nil || len(v.Repaired) != 6 {
+		t.Errorf("expected the 6 bad files to be repaired, got %+v", v)
+	}
+	if report, err := fs.Verify(false); err != nil || !report.OK() || report.Files != 1 {
+		t.Errorf("expected only the good file after repairing, got %+v %v", report, err)
+	}
+	if !c.Exists("good") || c.Exists(corrupt) {
+		t.Errorf("expected only the good entry to be loaded")
+	}
+}
+
+func TestEvictOnWrite(t *testing.T) {
+	c, err := NewCacheWithHaunter(NewMemFs(), NewLRUHaunterStrategy(NewLRUHaunter(2, 0, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetEvictOnWrite(true)
+	for i := 0; i < 4; i++ {
+		r, w, err := c.Get(fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		w.Write([]byte("data"))
+		w.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Exists("0") || c.Exists("1") || !c.Exists("2") || !c.Exists("3") {
+		t.Errorf("expected the oldest entries to be evicted as soon as the budget was exceeded")
+	}
+}
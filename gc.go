@@ -0,0 +1,171 @@
+package fscache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrCollecting is returned by CollectContent when another collection is running.
+var ErrCollecting = errors.New("fscache: content collection already running")
+
+// CollectContent removes the content-addressed entries, those whose keys start with
+// ContentKeyPrefix, which aren't referenced by any other entry, directly or through other
+// content-addressed entries. refs returns the keys referenced by the entry key, reading
+// its data from r as needed; CompositeRefs finds the parts of composite entries.
+// It returns the keys removed.
+//
+// Collection runs alongside writes: entries written or replaced while it marks are marked
+// too, and content-addressed entries committed, or looked up with Get or Exists, since it
+// started are kept, so that a writer can check for or upload its blobs and then write the
+// entry which references them. Entries being written are read once they are complete.
+// Keys are matched as the cache stores them, after SetKeyMapper's mapping.
+func (c *FSCache) CollectContent(refs func(key string, r io.Reader) ([]string, error)) ([]string, error) {
+	c.gcMu.Lock()
+	if c.gcLive != nil {
+		c.gcMu.Unlock()
+		return nil, ErrCollecting
+	}
+	c.gcLive = make(map[string]bool)
+	atomic.StoreInt32(&c.collecting, 1)
+	c.gcMu.Unlock()
+	defer func() {
+		c.gcMu.Lock()
+		atomic.StoreInt32(&c.collecting, 0)
+		c.gcLive = nil
+		c.gcMu.Unlock()
+	}()
+
+	scanned := make(map[string]uint64) // key => generation whose references were marked
+	marked := make(map[string]bool)    // content-addressed keys which are referenced
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClosed
+		}
+		c.gcMu.Lock()
+		var todo []string
+		for key, f := range c.files {
+			if strings.HasPrefix(key, ContentKeyPrefix) && !marked[key] && !c.gcLive[key] {
+				continue // unreferenced so far, its references only matter once it is
+			}
+			if gen, ok := scanned[key]; ok && f.complete() && gen == c.gens[key] {
+				continue
+			}
+			todo = append(todo, key)
+		}
+		if len(todo) > 0 {
+			c.gcMu.Unlock()
+			c.mu.Unlock()
+			for _, key := range todo {
+				if err := c.markRefs(key, refs, scanned, marked); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// nothing changed since everything was marked, and nothing can while c.mu is held.
+		var removed []string
+		swept := make(map[string]fileStream)
+		for key, f := range c.files {
+			if strings.HasPrefix(key, ContentKeyPrefix) && !marked[key] && !c.gcLive[key] {
+				removed = append(removed, key)
+				swept[key] = f
+				c.emit(EventRemove, key, f)
+				c.unmap(key)
+			}
+		}
+		c.gcMu.Unlock()
+		c.mu.Unlock()
+
+		var err error
+		for key, f := range swept {
+			if err2 := c.finishRemove(key, f); err == nil {
+				err = err2
+			}
+		}
+		return removed, err
+	}
+}
+
+// markRefs marks the content-addressed keys referenced by the current entry of key.
+func (c *FSCache) markRefs(key string, refs func(key string, r io.Reader) ([]string, error), scanned map[string]uint64, marked map[string]bool) error {
+	c.mu.RLock()
+	f, ok := c.files[key]
+	gen := c.gens[key]
+	var r *CacheReader
+	var err error
+	if ok {
+		r, err = f.next()
+	}
+	c.mu.RUnlock()
+	if !ok || err != nil {
+		// the entry is gone, so it references nothing.
+		scanned[key] = gen
+		return nil
+	}
+	defer r.Close()
+
+	keys, err := refs(key, r)
+	if err != nil {
+		c.mu.RLock()
+		cur := c.files[key]
+		c.mu.RUnlock()
+		if cur == f {
+			return err
+		}
+		keys = nil // the entry was aborted or replaced while it was read
+	}
+	scanned[key] = gen
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, ref := range keys {
+		if mapped := c.mapKey(ref); strings.HasPrefix(mapped, ContentKeyPrefix) {
+			marked[mapped] = true
+		}
+	}
+	return nil
+}
+
+// keepContent keeps the content-addressed key through a running CollectContent.
+func (c *FSCache) keepContent(key string) {
+	if atomic.LoadInt32(&c.collecting) == 0 || !strings.HasPrefix(key, ContentKeyPrefix) {
+		return
+	}
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+	if c.gcLive != nil {
+		c.gcLive[key] = true
+	}
+}
+
+// compositePrefix starts the data of every manifest written by PutComposite.
+var compositePrefix = []byte(`{"parts":`)
+
+// CompositeRefs is a refs function for CollectContent, which returns the parts of
+// the composite entries written by PutComposite, and nothing for other entries.
+func CompositeRefs(key string, r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(len(compositePrefix))
+	if err == io.EOF || (err == nil && !bytes.Equal(prefix, compositePrefix)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest compositeManifest
+	if err := json.NewDecoder(br).Decode(&manifest); err != nil {
+		return nil, nil
+	}
+	keys := make([]string, len(manifest.Parts))
+	for i, p := range manifest.Parts {
+		keys[i] = p.Key
+	}
+	return keys, nil
+}
@@ -1,14 +1,25 @@
 package fscache
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Handler is a caching middle-ware for http Handlers.
 // It responds to http requests via the passed http.Handler, and caches the response
 // using the passed cache. The cache key for the request is the req.URL.String().
-// Note: It does not cache http headers. It is more efficient to set them yourself.
+// If the cache can store metadata (see MetadataWriter) the response's headers and status
+// code are cached too, otherwise they are not and it is more efficient to set them yourself.
+// Hits stored with a Content-Encoding which the request doesn't accept are decompressed,
+// see RegisterDecoder.
+// If the cache knows when an entry expires (see FSCache.ExpiresAt), hits carry Cache-Control
+// max-age and Expires headers for that time, so that downstream caches keep them as long as it does.
 func Handler(c Cache, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		url := req.URL.String()
@@ -20,22 +31,130 @@ func Handler(c Cache, h http.Handler) http.Handler {
 		defer r.Close()
 		if w != nil {
 			go func() {
-				defer w.Close()
-				h.ServeHTTP(&respWrapper{
+				resp := &respWrapper{
 					ResponseWriter: rw,
 					Writer:         w,
-				}, req)
+				}
+				defer w.Close()
+				defer resp.saveHeader()
+				h.ServeHTTP(resp, req)
 			}()
+			io.Copy(rw, r)
+			return
+		}
+
+		mr, ok := r.(MetadataReader)
+		if !ok {
+			setExpiry(rw.Header(), c, url)
+			io.Copy(rw, r)
+			return
+		}
+
+		// the writer saves the headers before writing the body, so they're
+		// available once the first read returns.
+		buf := make([]byte, 32*1024)
+		n, err := r.Read(buf)
+		var hdr cachedHeader
+		if meta, _ := mr.Metadata(); meta != nil && json.Unmarshal(meta, &hdr) == nil {
+			for k, v := range hdr.Header {
+				rw.Header()[k] = v
+			}
 		}
-		io.Copy(rw, r)
+		setExpiry(rw.Header(), c, url)
+		var body io.Reader = bytes.NewReader(buf[:n])
+		if err == nil {
+			body = io.MultiReader(body, r)
+		}
+		dr, err := decodeBody(req, rw.Header(), body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if dr != nil {
+			defer dr.Close()
+			body = dr
+		}
+		if hdr.Status != 0 {
+			rw.WriteHeader(hdr.Status)
+		}
+		io.Copy(rw, body)
 	})
 }
 
+// setExpiry sets the Cache-Control max-age and Expires headers of a hit on key to when
+// c expires it. Responses which mustn't be shared or stored are left alone, as are the
+// other Cache-Control directives.
+func setExpiry(h http.Header, c Cache, key string) {
+	e, ok := c.(interface {
+		ExpiresAt(key string) (time.Time, bool)
+	})
+	if !ok {
+		return
+	}
+	expires, ok := e.ExpiresAt(key)
+	if !ok {
+		return
+	}
+
+	var directives []string
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+		name := strings.ToLower(strings.SplitN(d, "=", 2)[0])
+		switch name {
+		case "no-store", "no-cache", "private":
+			return
+		case "max-age", "s-maxage", "":
+			continue
+		}
+		directives = append(directives, d)
+	}
+	maxAge := int64(time.Until(expires) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	directives = append(directives, "max-age="+strconv.FormatInt(maxAge, 10))
+	h.Set("Cache-Control", strings.Join(directives, ", "))
+	h.Set("Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+// cachedHeader is the metadata Handler stores with a response.
+type cachedHeader struct {
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header"`
+}
+
 type respWrapper struct {
 	http.ResponseWriter
 	io.Writer
+
+	once   sync.Once
+	status int
+}
+
+func (r *respWrapper) WriteHeader(status int) {
+	r.status = status
+	r.saveHeader()
+	r.ResponseWriter.WriteHeader(status)
 }
 
 func (r *respWrapper) Write(p []byte) (int, error) {
+	r.saveHeader()
 	return r.Writer.Write(p)
 }
+
+// saveHeader stores the response's headers with the cache entry, the first time it is called.
+func (r *respWrapper) saveHeader() {
+	r.once.Do(func() {
+		mw, ok := r.Writer.(MetadataWriter)
+		if !ok {
+			return
+		}
+		meta, err := json.Marshal(cachedHeader{
+			Status: r.status,
+			Header: r.ResponseWriter.Header(),
+		})
+		if err == nil {
+			_ = mw.SetMetadata(meta)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package fscache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The environment variables which pass the descriptors of a hand-off to the successor.
+const (
+	handoffListenerEnv = "FSCACHE_HANDOFF_LISTENER_FD"
+	handoffStateEnv    = "FSCACHE_HANDOFF_STATE_FD"
+	handoffReadyEnv    = "FSCACHE_HANDOFF_READY_FD"
+)
+
+// ErrNoHandoff is returned by InheritedListener when the process wasn't started by Handoff.
+var ErrNoHandoff = errors.New("fscache: process was not started by a handoff")
+
+// handoffReady is the line a successor writes once it is serving.
+const handoffReady = "ready"
+
+// Handoff starts cmd as the successor of the Server, e.g. a new version of the same binary,
+// and passes it l, so that a deploy doesn't refuse connections or cold-start the cache.
+// The successor calls InheritedListener and ServeListener, ImportHandoff if its cache is an
+// *FSCache, then HandoffReady. Once it is ready, Handoff shuts the Server down as Shutdown
+// does: the kernel hands new connections to the successor, while the requests in progress here
+// complete, for up to HandoffDrainTimeout. If the Server's Cache is an *FSCache its entries
+// are exported to the successor, which matters for memory-backed caches. Handoff returns an
+// error, and the Server keeps serving, if the successor fails to start or exits, or ctx is
+// done, before it is ready; the successor is then killed. File descriptors can't be
+// inherited on Windows.
+func (s *Server) Handoff(ctx context.Context, l net.Listener, cmd *exec.Cmd) error {
+	lf, err := listenerFile(l)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateR.Close()
+	defer stateW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, lf, stateR, readyW)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		handoffListenerEnv+"="+strconv.Itoa(fd),
+		handoffStateEnv+"="+strconv.Itoa(fd+1),
+		handoffReadyEnv+"="+strconv.Itoa(fd+2),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// only the successor holds these ends now, so reads see EOF if it exits.
+	stateR.Close()
+	readyW.Close()
+
+	go func() {
+		if c, ok := s.Cache.(*FSCache); ok {
+			_ = c.Export(stateW)
+		}
+		stateW.Close()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyR).ReadString('\n')
+		if err == nil && strings.TrimSpace(line) != handoffReady {
+			err = fmt.Errorf("fscache: unexpected handoff reply %q", line)
+		} else if err == io.EOF {
+			err = errors.New("fscache: successor exited before it was ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	drain := context.Background()
+	if s.HandoffDrainTimeout > 0 {
+		var cancel context.CancelFunc
+		drain, cancel = context.WithTimeout(drain, s.HandoffDrainTimeout)
+		defer cancel()
+	}
+	return s.Shutdown(drain)
+}
+
+// inheritedFile returns the file whose descriptor is in the environment variable env.
+func inheritedFile(env, name string) (*os.File, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil, ErrNoHandoff
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("fscache: bad %s %q", env, v)
+	}
+	os.Unsetenv(env)
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// InheritedListener returns the listener passed to this process by Handoff,
+// or ErrNoHandoff if it wasn't started by one.
+func InheritedListener() (net.Listener, error) {
+	f, err := inheritedFile(handoffListenerEnv, "fscache-listener")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// ImportHandoff adds the entries exported by the Server which started this process with
+// Handoff to c, see Import. It does nothing if this process wasn't started by a Handoff.
+func ImportHandoff(c *FSCache) error {
+	f, err := inheritedFile(handoffStateEnv, "fscache-state")
+	if err == ErrNoHandoff {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Import(f)
+}
+
+// HandoffReady tells the Server which started this process with Handoff that it is serving,
+// so the Server can stop. It does nothing if this process wasn't started by a Handoff.
+func HandoffReady() error {
+	f, err := inheritedFile(handoffReadyEnv, "fscache-ready")
+	if err == ErrNoHandoff {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.WriteString(f, handoffReady+"\n")
+	return err
+}
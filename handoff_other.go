@@ -0,0 +1,19 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package fscache
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenerFile returns a dup of l's socket to pass to a child process.
+func listenerFile(l net.Listener) (*os.File, error) {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("fscache: can't hand off a %T", l)
+	}
+	return filer.File()
+}
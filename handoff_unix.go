@@ -0,0 +1,40 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fscache
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenerFile returns a dup of l's socket to pass to a child process. Unlike l's File method
+// it leaves the socket non-blocking: the dup shares that mode with l, and a blocking Accept
+// running on l meanwhile could no longer be interrupted by Close.
+func listenerFile(l net.Listener) (*os.File, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("fscache: can't hand off a %T", l)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	cerr := rc.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, err = syscall.Dup(int(s)); err == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	return os.NewFile(uintptr(fd), l.Addr().String()), nil
+}
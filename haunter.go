@@ -8,6 +8,9 @@ import (
 type Entry struct {
 	name  string
 	inUse bool
+	gen   uint64 // the generation of the entry, which orders entries by when they were written
+
+	priority int
 }
 
 // InUse returns if this Cache entry is in use.
@@ -87,6 +90,13 @@ func (h *reaperHaunterStrategy) Haunt(c CacheAccessor) {
 	})
 }
 
+func (h *reaperHaunterStrategy) ExpiresAt(key string, lastRead, lastWrite time.Time) (time.Time, bool) {
+	if e, ok := h.reaper.(Expirer); ok {
+		return e.ExpiresAt(key, lastRead, lastWrite)
+	}
+	return time.Time{}, false
+}
+
 func (h *reaperHaunterStrategy) Next() time.Duration {
 	return h.reaper.Next()
 }
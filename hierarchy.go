@@ -0,0 +1,130 @@
+package fscache
+
+import (
+	"sort"
+	"strings"
+)
+
+// keyTree indexes the keys of a cache by their "/" separated segments.
+type keyTree struct {
+	children map[string]*keyTree
+	leaf     bool // a key ends here
+	n        int  // keys at or below this node
+}
+
+func newKeyTree() *keyTree {
+	return &keyTree{children: make(map[string]*keyTree)}
+}
+
+// add adds key to the tree if it isn't there yet.
+func (t *keyTree) add(key string) {
+	if n := t.find(key); n != nil && n.leaf {
+		return
+	}
+	node := t
+	node.n++
+	for _, seg := range strings.Split(key, "/") {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newKeyTree()
+			node.children[seg] = child
+		}
+		node = child
+		node.n++
+	}
+	node.leaf = true
+}
+
+// remove removes key from the tree, dropping the nodes left without keys.
+func (t *keyTree) remove(key string) {
+	if n := t.find(key); n == nil || !n.leaf {
+		return
+	}
+	node := t
+	node.n--
+	for _, seg := range strings.Split(key, "/") {
+		child := node.children[seg]
+		child.n--
+		if child.n == 0 {
+			delete(node.children, seg)
+			return
+		}
+		node = child
+	}
+	node.leaf = false
+}
+
+// find returns the node of path, or nil if there are no keys under it.
+func (t *keyTree) find(path string) *keyTree {
+	node := t
+	for _, seg := range strings.Split(path, "/") {
+		node = node.children[seg]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// SetPrefixIndex makes the cache index its keys by their "/" separated segments, so that
+// ListPrefix only visits the children it returns instead of every key in the cache.
+func (c *FSCache) SetPrefixIndex(enabled bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !enabled {
+		c.keyTree = nil
+		return c
+	}
+	if c.keyTree == nil {
+		c.keyTree = newKeyTree()
+		for key := range c.files {
+			c.keyTree.add(key)
+		}
+	}
+	return c
+}
+
+// ListPrefix lists the immediate children of prefix, which should be "" or end in "/",
+// treating keys like a/b/c as paths. Keys directly under prefix are returned as they are,
+// and deeper ones once as the prefix of their next segment, e.g. ListPrefix("a/") returns
+// "a/b/" for a/b/c and a/b/d, and "a/e" for a/e. The result is sorted. Keys are matched as
+// the cache stores them, after SetKeyMapper's mapping.
+func (c *FSCache) ListPrefix(prefix string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var list []string
+	if c.keyTree != nil && (prefix == "" || strings.HasSuffix(prefix, "/")) {
+		node := c.keyTree
+		if prefix != "" {
+			node = c.keyTree.find(strings.TrimSuffix(prefix, "/"))
+		}
+		if node == nil {
+			return nil
+		}
+		for seg, child := range node.children {
+			if child.leaf {
+				list = append(list, prefix+seg)
+			}
+			if len(child.children) > 0 {
+				list = append(list, prefix+seg+"/")
+			}
+		}
+	} else {
+		seen := make(map[string]bool)
+		for key := range c.files {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			child := key
+			if i := strings.IndexByte(key[len(prefix):], '/'); i >= 0 {
+				child = key[:len(prefix)+i+1]
+			}
+			if !seen[child] {
+				seen[child] = true
+				list = append(list, child)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,49 @@
+package fscache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrImmutable matches an ImmutableError with errors.Is.
+var ErrImmutable = errors.New("entry is immutable")
+
+// ImmutableError is returned when an operation would change or remove an immutable entry.
+type ImmutableError struct {
+	Key string
+}
+
+func (e *ImmutableError) Error() string {
+	return fmt.Sprintf("entry %q is immutable", e.Key)
+}
+
+// Is makes errors.Is(err, ErrImmutable) true.
+func (e *ImmutableError) Is(target error) bool { return target == ErrImmutable }
+
+// SetImmutablePrefixes makes the entries of keys which start with any of prefixes immutable
+// once they have been completely written: Remove, RemovePrefix and Rename return an
+// *ImmutableError instead of changing them. This suits content-addressed data, which
+// can never legitimately change. Keys are matched as the cache stores them, after
+// SetKeyMapper's mapping. The Haunter may still evict immutable entries, and Clean
+// still removes them, so they can be filled again with the same data.
+func (c *FSCache) SetImmutablePrefixes(prefixes ...string) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.immutable = prefixes
+	return c
+}
+
+// checkMutable returns an *ImmutableError if the entry for key is immutable. c.mu must be held.
+func (c *FSCache) checkMutable(key string) error {
+	f, ok := c.files[key]
+	if !ok || !f.complete() {
+		return nil
+	}
+	for _, prefix := range c.immutable {
+		if strings.HasPrefix(key, prefix) {
+			return &ImmutableError{Key: key}
+		}
+	}
+	return nil
+}
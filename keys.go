@@ -0,0 +1,99 @@
+package fscache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ChainKeyMappers returns a key mapper for SetKeyMapper which applies each of kms in order.
+// It can be used to canonicalize keys before mapping them to file names, for example
+// so that keys which differ only by Unicode normalization share an entry:
+//
+//	c.SetKeyMapper(ChainKeyMappers(norm.NFC.String, NormalizePercentEncoding))
+//
+// where norm is golang.org/x/text/unicode/norm.
+func ChainKeyMappers(kms ...func(string) string) func(string) string {
+	return func(key string) string {
+		for _, km := range kms {
+			key = km(key)
+		}
+		return key
+	}
+}
+
+// StripQueryParams returns a key mapper for URL keys which removes the named query
+// parameters, for example volatile ones like cache busters or tracking ids.
+// Keys which aren't URLs are left as they are.
+func StripQueryParams(params ...string) func(string) string {
+	return func(key string) string {
+		u, err := url.Parse(key)
+		if err != nil || u.RawQuery == "" {
+			return key
+		}
+		q := u.Query()
+		for _, p := range params {
+			q.Del(p)
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+}
+
+// LowercaseHost is a key mapper for URL keys which lowercases the scheme and host,
+// which are case-insensitive. Keys which aren't URLs are left as they are.
+func LowercaseHost(key string) string {
+	u, err := url.Parse(key)
+	if err != nil || u.Host == "" {
+		return key
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// NormalizePercentEncoding canonicalizes the percent-encoding of a URL or path key
+// as described by RFC 3986 section 6.2.2.2. Escaped unreserved characters are decoded,
+// and the hex digits of other escapes are uppercased, so "/%7euser/a%2fb" becomes "/~user/a%2Fb".
+// Invalid escapes are left as they are.
+func NormalizePercentEncoding(key string) string {
+	if strings.IndexByte(key, '%') < 0 {
+		return key
+	}
+	var b strings.Builder
+	b.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		if key[i] != '%' || i+2 >= len(key) || !isHex(key[i+1]) || !isHex(key[i+2]) {
+			b.WriteByte(key[i])
+			continue
+		}
+		c := unhex(key[i+1])<<4 | unhex(key[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(key[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
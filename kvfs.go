@@ -0,0 +1,368 @@
+package fscache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/djherbis/stream"
+)
+
+// KVStore is the part of a key-value store which NewKVFs uses. An embedded store such as
+// github.com/dgraph-io/badger provides it with a small wrapper, e.g. Get and Set in their
+// own transactions, and Iterate over an Iterator with Prefix set.
+type KVStore interface {
+	// Get returns the value of key, and false if it has none.
+	Get(key []byte) (value []byte, ok bool, err error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+
+	// Iterate calls fn for every key starting with prefix. The slices are only valid during fn.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// kvPrefix starts the KVStore keys of a KVFS.
+const kvPrefix = "fscache/"
+
+// kvData and kvFile mark whether a KVStore value holds the data itself, or the name
+// of a File in the large FileSystem.
+const (
+	kvData byte = iota
+	kvFile
+)
+
+// KVFS is a FileSystem which stores small Files in a KVStore, and larger ones in
+// another FileSystem, see NewKVFs.
+type KVFS struct {
+	store     KVStore
+	large     FileSystem
+	threshold int64
+
+	mu      sync.Mutex
+	entries map[string]*kvEntry
+}
+
+// kvEntry is what KVFS knows about a File, its data is in the KVStore or the large FileSystem.
+type kvEntry struct {
+	size      int64
+	rt, wt    time.Time
+	largeName string
+	w         *kvWriter // set while the File is being written
+}
+
+// NewKVFs returns a FileSystem which keeps Files of up to threshold bytes as values of
+// store, and writes larger ones to large. Caches of many tiny entries then use a few
+// large files of the store, rather than a file and an inode for every entry.
+// Files are named by their keys. Access times are only kept in memory.
+func NewKVFs(store KVStore, large FileSystem, threshold int64) *KVFS {
+	return &KVFS{
+		store:     store,
+		large:     large,
+		threshold: threshold,
+		entries:   make(map[string]*kvEntry),
+	}
+}
+
+func kvKey(name string) []byte { return []byte(kvPrefix + name) }
+
+// kvValue encodes a KVStore value: the modification time, kind, and the data or large File name.
+func kvValue(wt time.Time, kind byte, payload []byte) []byte {
+	v := make([]byte, 9+len(payload))
+	binary.BigEndian.PutUint64(v, uint64(wt.UnixNano()))
+	v[8] = kind
+	copy(v[9:], payload)
+	return v
+}
+
+func parseKVValue(v []byte) (wt time.Time, kind byte, payload []byte, err error) {
+	if len(v) < 9 {
+		return wt, 0, nil, errors.New("kvfs: short value")
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))), v[8], v[9:], nil
+}
+
+// Create creates a File for name, which is held in memory until it outgrows the threshold.
+func (fs *KVFS) Create(name string) (stream.File, error) {
+	now := time.Now()
+	w := &kvWriter{fs: fs, name: name}
+	fs.mu.Lock()
+	old := fs.entries[name]
+	fs.entries[name] = &kvEntry{rt: now, wt: now, w: w}
+	fs.mu.Unlock()
+	if old != nil && old.largeName != "" {
+		_ = fs.large.Remove(old.largeName)
+	}
+	return w, nil
+}
+
+// kvWriter buffers a File until it is closed and stored, or moves to the large FileSystem.
+type kvWriter struct {
+	fs   *KVFS
+	name string
+
+	mu        sync.Mutex
+	buf       []byte
+	large     stream.File
+	largeName string
+	off       int64
+}
+
+func (w *kvWriter) Name() string { return w.name }
+
+func (w *kvWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.large == nil && int64(len(w.buf)+len(p)) > w.fs.threshold {
+		f, err := w.fs.large.Create(w.name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(w.buf); err != nil {
+			f.Close()
+			return 0, err
+		}
+		w.large, w.largeName, w.buf = f, f.Name(), nil
+	}
+
+	var n int
+	var err error
+	if w.large != nil {
+		n, err = w.large.Write(p)
+	} else {
+		n = len(p)
+		w.buf = append(w.buf, p...)
+	}
+
+	w.fs.mu.Lock()
+	if e, ok := w.fs.entries[w.name]; ok && e.w == w {
+		e.size += int64(n)
+		e.wt = time.Now()
+		e.largeName = w.largeName
+	}
+	w.fs.mu.Unlock()
+	return n, err
+}
+
+func (w *kvWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *kvWriter) ReadAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.large != nil {
+		return w.large.ReadAt(p, off)
+	}
+	return bytes.NewReader(w.buf).ReadAt(p, off)
+}
+
+// Close stores the File in the KVStore, or closes it in the large FileSystem and stores its name.
+func (w *kvWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wt := time.Now()
+	var err error
+	if w.large != nil {
+		err = w.large.Close()
+		if err == nil {
+			err = w.fs.store.Set(kvKey(w.name), kvValue(wt, kvFile, []byte(w.largeName)))
+		}
+	} else {
+		err = w.fs.store.Set(kvKey(w.name), kvValue(wt, kvData, w.buf))
+	}
+
+	w.fs.mu.Lock()
+	if e, ok := w.fs.entries[w.name]; ok && e.w == w {
+		e.w = nil
+		e.wt = wt
+	}
+	w.fs.mu.Unlock()
+	return err
+}
+
+// kvReader reads a File while it is being written, from the writer's buffer until
+// it moves to the large FileSystem.
+type kvReader struct {
+	w   *kvWriter
+	r   stream.File
+	off int64
+}
+
+func (r *kvReader) Name() string                { return r.w.name }
+func (r *kvReader) Write(p []byte) (int, error) { return 0, errors.New("kvfs: file is read only") }
+
+func (r *kvReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *kvReader) ReadAt(p []byte, off int64) (int, error) {
+	r.w.mu.Lock()
+	if r.w.largeName == "" {
+		defer r.w.mu.Unlock()
+		return bytes.NewReader(r.w.buf).ReadAt(p, off)
+	}
+	largeName := r.w.largeName
+	r.w.mu.Unlock()
+	if r.r == nil {
+		f, err := r.w.fs.large.Open(largeName)
+		if err != nil {
+			return 0, err
+		}
+		r.r = f
+	}
+	return r.r.ReadAt(p, off)
+}
+
+func (r *kvReader) Close() error {
+	if r.r != nil {
+		return r.r.Close()
+	}
+	return nil
+}
+
+// kvDataReader reads a File stored in the KVStore.
+type kvDataReader struct {
+	*bytes.Reader
+	name string
+}
+
+func (r *kvDataReader) Name() string                { return r.name }
+func (r *kvDataReader) Write(p []byte) (int, error) { return 0, errors.New("kvfs: file is read only") }
+func (r *kvDataReader) Close() error                { return nil }
+
+// Open opens the File name for reading.
+func (fs *KVFS) Open(name string) (stream.File, error) {
+	fs.mu.Lock()
+	e, ok := fs.entries[name]
+	if ok {
+		e.rt = time.Now()
+	}
+	var w *kvWriter
+	if ok {
+		w = e.w
+	}
+	fs.mu.Unlock()
+	if !ok {
+		return nil, errors.New("file does not exist")
+	}
+	if w != nil {
+		return &kvReader{w: w}, nil
+	}
+
+	v, ok, err := fs.store.Get(kvKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("file does not exist")
+	}
+	_, kind, payload, err := parseKVValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if kind == kvFile {
+		return fs.large.Open(string(payload))
+	}
+	return &kvDataReader{Reader: bytes.NewReader(payload), name: name}, nil
+}
+
+// Stat returns the FileInfo of name from memory.
+func (fs *KVFS) Stat(name string) (FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return FileInfo{}, errors.New("file does not exist")
+	}
+	return FileInfo{
+		FileInfo: &fileInfo{
+			name: name,
+			size: e.size,
+			wt:   e.wt,
+		},
+		Atime: e.rt,
+	}, nil
+}
+
+// Touch sets the access time of name to now.
+func (fs *KVFS) Touch(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return errors.New("file does not exist")
+	}
+	e.rt = time.Now()
+	return nil
+}
+
+// Remove deletes name from the KVStore, and the large FileSystem if it is there.
+func (fs *KVFS) Remove(name string) error {
+	fs.mu.Lock()
+	e, ok := fs.entries[name]
+	delete(fs.entries, name)
+	fs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := fs.store.Delete(kvKey(name))
+	if e.largeName != "" {
+		if err2 := fs.large.Remove(e.largeName); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Reload returns the Files in the KVStore.
+func (fs *KVFS) Reload(add func(key, name string)) error {
+	return fs.store.Iterate([]byte(kvPrefix), func(k, v []byte) error {
+		name := string(k[len(kvPrefix):])
+		wt, kind, payload, err := parseKVValue(v)
+		if err != nil {
+			return nil
+		}
+		e := &kvEntry{size: int64(len(payload)), rt: wt, wt: wt}
+		if kind == kvFile {
+			e.largeName = string(payload)
+			fi, err := fs.large.Stat(e.largeName)
+			if err != nil {
+				return nil
+			}
+			e.size = fi.Size()
+		}
+		fs.mu.Lock()
+		fs.entries[name] = e
+		fs.mu.Unlock()
+		add(name, name)
+		return nil
+	})
+}
+
+// RemoveAll deletes every File from the KVStore and the large FileSystem.
+func (fs *KVFS) RemoveAll() error {
+	fs.mu.Lock()
+	fs.entries = make(map[string]*kvEntry)
+	fs.mu.Unlock()
+
+	var keys [][]byte
+	err := fs.store.Iterate([]byte(kvPrefix), func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := fs.store.Delete(k); err != nil {
+			return err
+		}
+	}
+	return fs.large.RemoveAll()
+}
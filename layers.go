@@ -4,24 +4,44 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 )
 
 type layeredCache struct {
-	layers []Cache
+	layers  []Cache
+	limiter *AdaptiveLimiter
 }
 
 // NewLayered returns a Cache which stores its data in all the passed
 // caches, when a key is requested it is loaded into all the caches above the first hit.
+// Loaded entries keep the metadata and access times of the hit, in the caches which can
+// store them, so that an entry's age isn't reset by moving it up.
+// Layers which can't store a miss, such as caches of an ArchiveFS, are passed over.
 func NewLayered(caches ...Cache) Cache {
 	return &layeredCache{layers: caches}
 }
 
+// NewLayeredWithLimiter returns a Cache like NewLayered, whose loads into the caches above
+// the first hit are limited by l. A hit which can't be loaded is read from where it was found.
+func NewLayeredWithLimiter(l *AdaptiveLimiter, caches ...Cache) Cache {
+	return &layeredCache{layers: caches, limiter: l}
+}
+
 func (l *layeredCache) Get(key string) (r ReadAtCloser, w io.WriteCloser, err error) {
 	var last ReadAtCloser
 	var writers []io.WriteCloser
+	var filling []Cache // the layer of each of writers
 
 	for i, layer := range l.layers {
 		r, w, err = layer.Get(key)
+		if errors.Is(err, ErrReadOnly) {
+			if i < len(l.layers)-1 {
+				continue
+			}
+			if last != nil {
+				return last, multiWC(writers...), nil
+			}
+		}
 		if err != nil {
 			if len(writers) > 0 {
 				last.Close()
@@ -33,11 +53,22 @@ func (l *layeredCache) Get(key string) (r ReadAtCloser, w io.WriteCloser, err er
 		// hit
 		if w == nil {
 			if len(writers) > 0 {
-				go func(r io.ReadCloser) {
+				if l.limiter != nil && !l.limiter.Acquire() {
+					last.Close()
+					for j, w := range writers {
+						abandonFill(filling[j], key, w)
+					}
+					return r, nil, nil
+				}
+				go func(r ReadAtCloser) {
+					start := time.Now()
 					wc := multiWC(writers...)
 					defer r.Close()
 					defer wc.Close()
-					io.Copy(wc, r)
+					err := copyEntry(wc, r)
+					if l.limiter != nil {
+						l.limiter.Release(time.Since(start), err)
+					}
 				}(r)
 				return last, nil, nil
 			}
@@ -46,6 +77,7 @@ func (l *layeredCache) Get(key string) (r ReadAtCloser, w io.WriteCloser, err er
 
 		// miss
 		writers = append(writers, w)
+		filling = append(filling, layer)
 
 		if i == len(l.layers)-1 {
 			if last != nil {
@@ -89,7 +121,7 @@ func (l *layeredCache) Exists(key string) bool {
 
 func (l *layeredCache) Clean() error {
 	for _, layer := range l.layers {
-		if err := layer.Clean(); err != nil {
+		if err := layer.Clean(); err != nil && !errors.Is(err, ErrReadOnly) {
 			return err
 		}
 	}
@@ -120,6 +152,30 @@ func (t *multiWriteCloser) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// SetMetadata sets the metadata of the writers which can store it.
+func (t *multiWriteCloser) SetMetadata(data []byte) error {
+	for _, w := range t.writers {
+		if mw, ok := w.(MetadataWriter); ok {
+			if err := mw.SetMetadata(data); err != nil && err != ErrUnsupported {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetTimes sets the times of the writers which can keep them.
+func (t *multiWriteCloser) SetTimes(rt, wt time.Time) error {
+	for _, w := range t.writers {
+		if tw, ok := w.(TimesWriter); ok {
+			if err := tw.SetTimes(rt, wt); err != nil && err != ErrUnsupported {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (t *multiWriteCloser) Close() error {
 	for _, w := range t.writers {
 		w.Close()
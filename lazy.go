@@ -0,0 +1,94 @@
+package fscache
+
+import "strings"
+
+// lazyLoad is the state of a Reload running in the background, see NewCacheLazy.
+type lazyLoad struct {
+	seen map[string]bool // keys which were looked up or changed since it started
+	done chan struct{}
+	err  error
+}
+
+// NewCacheLazy creates a new Cache based on FileSystem fs, like NewCacheWithHaunter, but
+// returns without waiting for fs.Reload, which runs in the background instead, so that a
+// cache directory with millions of entries is usable at once. If fs is a FileSystemFinder,
+// keys which Get, Exists and Remove are called with before Reload reaches them are found
+// directly, otherwise they miss until it does. Other methods, and those which list or
+// total the entries, only see the entries found so far. Keys changed while Reload runs
+// keep their new entry. Use WaitLoaded to wait for Reload to finish.
+func NewCacheLazy(fs FileSystem, haunter Haunter) (*FSCache, error) {
+	l := &lazyLoad{seen: make(map[string]bool), done: make(chan struct{})}
+	c := &FSCache{
+		files:    make(map[string]fileStream),
+		removing: make(map[string]int),
+		gens:     make(map[string]uint64),
+		haunter:  haunter,
+		fs:       fs,
+		lazy:     l,
+	}
+	go c.loadLazy(l)
+	if haunter != nil {
+		c.scheduleHaunt()
+	}
+	return c, nil
+}
+
+// WaitLoaded blocks until the Reload started by NewCacheLazy has finished, and returns
+// its error. It returns nil at once for other caches.
+func (c *FSCache) WaitLoaded() error {
+	c.mu.RLock()
+	l := c.lazy
+	c.mu.RUnlock()
+	if l == nil {
+		return nil
+	}
+	<-l.done
+	return l.err
+}
+
+func (c *FSCache) loadLazy(l *lazyLoad) {
+	err := c.fs.Reload(func(key, name string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed || l.seen[key] {
+			return
+		}
+		if strings.HasPrefix(key, stagedPrefix) {
+			_ = c.fs.Remove(name)
+			return
+		}
+		c.setFile(key, c.oldFile(name))
+		c.bump(key)
+	})
+	c.mu.Lock()
+	c.lazy = nil
+	c.mu.Unlock()
+	l.err = err
+	close(l.done)
+}
+
+// markSeen stops a running lazy Reload from loading key, whose entry is newer. c.mu must be held.
+func (c *FSCache) markSeen(key string) {
+	if c.lazy != nil {
+		c.lazy.seen[key] = true
+	}
+}
+
+// resolve loads key from the FileSystem if a lazy Reload hasn't yet. c.mu must be held for writing.
+func (c *FSCache) resolve(key string) {
+	if c.lazy == nil || c.lazy.seen[key] {
+		return
+	}
+	c.markSeen(key)
+	if _, ok := c.files[key]; ok {
+		return
+	}
+	finder, ok := c.fs.(FileSystemFinder)
+	if !ok {
+		return
+	}
+	if name, err := finder.Find(key); err == nil {
+		c.setFile(key, c.oldFile(name))
+		c.bump(key)
+	}
+}
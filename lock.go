@@ -0,0 +1,125 @@
+package fscache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ownerFile is the name of the file Lock writes into the directory of a StandardFS.
+const ownerFile = ".fscache-owner"
+
+// processStart identifies this run of the process, along with its pid.
+var processStart = time.Now()
+
+// ErrDirLocked matches a LockedError with errors.Is.
+var ErrDirLocked = errors.New("cache directory is owned by another process")
+
+// DirOwner identifies the process which holds the directory of a StandardFS, see Lock.
+type DirOwner struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Start time.Time `json:"start"`
+}
+
+// LockedError is returned by Lock when the directory is owned by another live process.
+type LockedError struct {
+	Dir   string
+	Owner DirOwner
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("cache directory %s is owned by pid %d on %s, running since %s",
+		e.Dir, e.Owner.PID, e.Owner.Host, e.Owner.Start.Format(time.RFC3339))
+}
+
+// Is makes errors.Is(err, ErrDirLocked) true.
+func (e *LockedError) Is(target error) bool { return target == ErrDirLocked }
+
+// Lock claims fs's directory for this process by writing an owner file into it, identifying
+// the process by its pid, host and start time. Two caches writing the same directory corrupt
+// each other silently, so if a live process already owns it Lock returns a *LockedError.
+// If warn is set it is called with that error instead, and the directory is claimed anyway.
+// Owners on other hosts are always assumed to be alive, and owner files left by processes
+// which have exited, or by an earlier run of this process's pid, are replaced. Close
+// releases the directory.
+func (fs *StandardFS) Lock(warn func(err error)) error {
+	host, _ := os.Hostname()
+	me := DirOwner{PID: os.Getpid(), Host: host, Start: processStart}
+
+	for {
+		err := fs.writeOwner(me, true)
+		if !os.IsExist(err) {
+			if err == nil {
+				fs.owner = &me
+			}
+			return err
+		}
+
+		owner, err := fs.readOwner()
+		if err == nil && owner.PID == me.PID && owner.Host == me.Host && owner.Start.Equal(me.Start) {
+			fs.owner = &me
+			return nil
+		}
+		// an owner with this pid and host but another start time is an earlier run which
+		// reused the pid, e.g. a container restarted on the same volume.
+		if err == nil && (owner.Host != host || owner.PID != me.PID && processAlive(owner.PID)) {
+			locked := &LockedError{Dir: fs.root, Owner: owner}
+			if warn == nil {
+				return locked
+			}
+			warn(locked)
+		}
+		// the owner has exited, its file can't be read, or warn allowed taking over.
+		if err := os.Remove(filepath.Join(fs.root, ownerFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// Close releases the directory if Lock claimed it.
+func (fs *StandardFS) Close() error {
+	if fs.owner == nil {
+		return nil
+	}
+	fs.owner = nil
+	err := os.Remove(filepath.Join(fs.root, ownerFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeOwner writes the owner file, failing if it exists when exclusive is set.
+func (fs *StandardFS) writeOwner(owner DirOwner, exclusive bool) error {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag |= os.O_EXCL
+	}
+	f, err := os.OpenFile(filepath.Join(fs.root, ownerFile), flag, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *StandardFS) readOwner() (owner DirOwner, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(fs.root, ownerFile))
+	if err != nil {
+		return owner, err
+	}
+	err = json.Unmarshal(data, &owner)
+	return owner, err
+}
@@ -8,6 +8,8 @@ import (
 type lruHaunterKV struct {
 	Key   string
 	Value Entry
+	size  int64
+	used  time.Time
 }
 
 // LRUHaunter is used to control when there are too many streams
@@ -23,9 +25,17 @@ type LRUHaunter interface {
 }
 
 // NewLRUHaunter returns a simple haunter which runs every "period"
-// and scrubs older files when the total file size is over maxSize or
+// and scrubs the least recently used files when the total file size is over maxSize or
 // total item count is over maxItems.
-// If maxItems or maxSize are 0, they won't be checked
+// If maxItems or maxSize are 0, they won't be checked.
+// Use it with NewCacheWithHaunter(fs, NewLRUHaunterStrategy(NewLRUHaunter(...))).
+//
+// An entry was last used at the later of its access and modification times, so entries
+// written recently are kept even where reads don't update access times (e.g. noatime
+// mounts); Touch marks an entry as read there. Entries used at the same time, e.g. on file
+// systems with coarse timestamps like HFS+, are scrubbed in the order they were written.
+// Entries age slower the higher their priority, see FSCache.SetPriority: one of priority 1
+// unused for 2h is as old as one of priority 0 unused for 1h.
 func NewLRUHaunter(maxItems int, maxSize int64, period time.Duration) LRUHaunter {
 	return &lruHaunter{
 		period:   period,
@@ -34,10 +44,26 @@ func NewLRUHaunter(maxItems int, maxSize int64, period time.Duration) LRUHaunter
 	}
 }
 
+// NewLRUHaunterWithWatermarks returns a haunter like NewLRUHaunter, which once the total
+// file size is over highSize scrubs files until it is at most lowSize, so that a cache under
+// steady write pressure isn't trimmed by a little every period. lowSize is capped at highSize.
+func NewLRUHaunterWithWatermarks(maxItems int, highSize, lowSize int64, period time.Duration) LRUHaunter {
+	if lowSize > highSize {
+		lowSize = highSize
+	}
+	return &lruHaunter{
+		period:   period,
+		maxItems: maxItems,
+		maxSize:  highSize,
+		lowSize:  lowSize,
+	}
+}
+
 type lruHaunter struct {
 	period   time.Duration
 	maxItems int
 	maxSize  int64
+	lowSize  int64 // once over maxSize, the size to scrub down to, maxSize if 0
 }
 
 func (j *lruHaunter) Next() time.Duration {
@@ -48,6 +74,7 @@ func (j *lruHaunter) Scrub(c CacheAccessor) (keysToReap []string) {
 	var count int
 	var size int64
 	var okFiles []lruHaunterKV
+	now := time.Now()
 
 	c.EnumerateEntries(func(key string, e Entry) bool {
 		if e.InUse() {
@@ -59,79 +86,48 @@ func (j *lruHaunter) Scrub(c CacheAccessor) (keysToReap []string) {
 			return true
 		}
 
+		used := fileInfo.AccessTime()
+		if mt := fileInfo.ModTime(); mt.After(used) {
+			used = mt
+		}
+		if p := e.Priority(); p != 0 {
+			used = now.Add(-time.Duration(float64(now.Sub(used)) / weight(p)))
+		}
+
 		count++
 		size = size + fileInfo.Size()
 		okFiles = append(okFiles, lruHaunterKV{
 			Key:   key,
 			Value: e,
+			size:  fileInfo.Size(),
+			used:  used,
 		})
 
 		return true
 	})
 
 	sort.Slice(okFiles, func(i, j int) bool {
-		iFileInfo, err := c.Stat(okFiles[i].Value.Name())
-		if err != nil {
-			return false
+		a, b := okFiles[i], okFiles[j]
+		if !a.used.Equal(b.used) {
+			return a.used.Before(b.used)
 		}
-
-		iLastRead := iFileInfo.AccessTime()
-
-		jFileInfo, err := c.Stat(okFiles[j].Value.Name())
-		if err != nil {
-			return false
+		if a.Value.gen != b.Value.gen {
+			return a.Value.gen < b.Value.gen
 		}
-
-		jLastRead := jFileInfo.AccessTime()
-
-		return iLastRead.Before(jLastRead)
+		return a.Key < b.Key
 	})
 
-	collectKeysToReapFn := func() bool {
-		var key *string
-		var err error
-		key, count, size, err = j.removeFirst(c, &okFiles, count, size)
-		if err != nil {
-			return false
-		}
-		if key != nil {
-			keysToReap = append(keysToReap, *key)
-		}
-
-		return true
+	target := j.maxSize
+	if j.lowSize > 0 && size > j.maxSize {
+		target = j.lowSize
 	}
-
-	if j.maxItems > 0 {
-		for count > j.maxItems {
-			if !collectKeysToReapFn() {
-				break
-			}
-		}
-	}
-
-	if j.maxSize > 0 {
-		for size > j.maxSize {
-			if !collectKeysToReapFn() {
-				break
-			}
-		}
+	for len(okFiles) > 0 && ((j.maxItems > 0 && count > j.maxItems) || (j.maxSize > 0 && size > target)) {
+		f := okFiles[0]
+		okFiles = okFiles[1:]
+		count--
+		size -= f.size
+		keysToReap = append(keysToReap, f.Key)
 	}
 
 	return keysToReap
 }
-
-func (j *lruHaunter) removeFirst(fsStater FileSystemStater, items *[]lruHaunterKV, count int, size int64) (*string, int, int64, error) {
-	var f lruHaunterKV
-
-	f, *items = (*items)[0], (*items)[1:]
-
-	fileInfo, err := fsStater.Stat(f.Value.Name())
-	if err != nil {
-		return nil, count, size, err
-	}
-
-	count--
-	size = size - fileInfo.Size()
-
-	return &f.Key, count, size, nil
-}
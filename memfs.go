@@ -1,19 +1,24 @@
 package fscache
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/djherbis/stream"
 )
 
 type memFS struct {
+	used int64 // bytes of Files in memory, accessed atomically, first for alignment on 32-bit platforms
+
 	mu    sync.RWMutex
 	files map[string]*memFile
+
+	budget   int64
+	overflow FileSystem
 }
 
 // NewMemFs creates an in-memory FileSystem.
@@ -24,6 +29,33 @@ func NewMemFs() FileSystem {
 	}
 }
 
+// NewMemFsWithOverflow creates an in-memory FileSystem which holds up to budget bytes of
+// Files in memory. A File whose next Write would go over the budget moves to overflow, e.g.
+// a StandardFS, and is written and read there from then on, so one large entry can't exhaust
+// the process's memory. The spilled Files aren't kept across restarts, so overflow should be
+// dedicated to it: it is emptied here.
+func NewMemFsWithOverflow(budget int64, overflow FileSystem) FileSystem {
+	_ = overflow.RemoveAll()
+	return &memFS{
+		files:    make(map[string]*memFile),
+		budget:   budget,
+		overflow: overflow,
+	}
+}
+
+// reserve takes n bytes of the budget, it returns false if they would go over it.
+func (fs *memFS) reserve(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&fs.used)
+		if fs.budget > 0 && used+n > fs.budget {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&fs.used, used, used+n) {
+			return true
+		}
+	}
+}
+
 func (fs *memFS) Stat(name string) (FileInfo, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
@@ -32,7 +64,14 @@ func (fs *memFS) Stat(name string) (FileInfo, error) {
 		return FileInfo{}, errors.New("file has not been read")
 	}
 
-	size := int64(len(f.Bytes()))
+	size := f.Size()
+	if diskName, ok := f.spilled(); ok {
+		fi, err := fs.overflow.Stat(diskName)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		size = fi.Size()
+	}
 
 	return FileInfo{
 		FileInfo: &fileInfo{
@@ -58,8 +97,8 @@ func (fs *memFS) Create(key string) (stream.File, error) {
 		return nil, errors.New("file exists")
 	}
 	file := &memFile{
+		fs:   fs,
 		name: key,
-		r:    bytes.NewBuffer(nil),
 		wt:   time.Now(),
 	}
 	file.memReader.memFile = file
@@ -77,29 +116,205 @@ func (fs *memFS) Open(name string) (stream.File, error) {
 	return nil, errors.New("file does not exist")
 }
 
+func (fs *memFS) Touch(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return errors.New("file does not exist")
+	}
+	f.rt = time.Now()
+	return nil
+}
+
+func (fs *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return errors.New("file does not exist")
+	}
+	f.rt, f.wt = atime, mtime
+	return nil
+}
+
 func (fs *memFS) Remove(key string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	f, ok := fs.files[key]
 	delete(fs.files, key)
+	if ok {
+		return f.release()
+	}
+	return nil
+}
+
+func (fs *memFS) Rename(name, key string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return "", errors.New("file does not exist")
+	}
+	if old, ok := fs.files[key]; ok && old != f {
+		// the replaced File's memory or overflow File is freed, as Remove would.
+		delete(fs.files, key)
+		if err := old.release(); err != nil {
+			return "", err
+		}
+	}
+	f.mu.Lock()
+	if f.disk != nil {
+		rn, ok := fs.overflow.(FileSystemRenamer)
+		if !ok {
+			f.mu.Unlock()
+			return "", errors.New("can't rename a spilled file")
+		}
+		diskName, err := rn.Rename(f.diskName, key)
+		if err != nil {
+			f.mu.Unlock()
+			return "", err
+		}
+		f.diskName = diskName
+	}
+	delete(fs.files, name)
+	f.name = key
+	f.mu.Unlock()
+	fs.files[key] = f
+	return key, nil
+}
+
+// Link shares the buffer of name with a new file for key.
+func (fs *memFS) Link(name, key string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return "", errors.New("file does not exist")
+	}
+	if _, ok := fs.files[key]; ok {
+		return "", errors.New("file exists")
+	}
+	f.mu.RLock()
+	file := &memFile{
+		fs:   fs,
+		name: key,
+		data: f.data.clone(),
+		meta: f.meta,
+		wt:   f.wt,
+	}
+	diskName := f.diskName
+	f.mu.RUnlock()
+	if diskName != "" {
+		ln, ok := fs.overflow.(FileSystemLinker)
+		if !ok {
+			return "", errors.New("can't link a spilled file")
+		}
+		linked, err := ln.Link(diskName, key)
+		if err != nil {
+			return "", err
+		}
+		file.diskName = linked
+	} else {
+		// the shared buffer is counted for both files, so removing either leaves the other's share.
+		atomic.AddInt64(&fs.used, file.data.size)
+	}
+	file.memReader.memFile = file
+	fs.files[key] = file
+	return key, nil
+}
+
+func (fs *memFS) WriteMetadata(name string, data []byte) error {
+	fs.mu.RLock()
+	f, ok := fs.files[name]
+	fs.mu.RUnlock()
+	if !ok {
+		return errors.New("file does not exist")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.meta = append([]byte(nil), data...)
 	return nil
 }
 
+func (fs *memFS) ReadMetadata(name string) ([]byte, error) {
+	fs.mu.RLock()
+	f, ok := fs.files[name]
+	fs.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("file does not exist")
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.meta, nil
+}
+
 func (fs *memFS) RemoveAll() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	fs.files = make(map[string]*memFile)
+	atomic.StoreInt64(&fs.used, 0)
+	if fs.overflow != nil {
+		return fs.overflow.RemoveAll()
+	}
 	return nil
 }
 
+// memChunkSize is the size of the chunks a memFile's data is kept in.
+const memChunkSize = 64 << 10
+
+// memData is the data of a memFile, as chunks of memChunkSize bytes, the last may be shorter.
+// Written bytes never change, so readers copy them from their chunk without holding a lock.
+type memData struct {
+	chunks [][]byte
+	size   int64
+}
+
+func (d *memData) write(p []byte) {
+	for len(p) > 0 {
+		if n := len(d.chunks); n == 0 || len(d.chunks[n-1]) == memChunkSize {
+			d.chunks = append(d.chunks, nil)
+		}
+		last := &d.chunks[len(d.chunks)-1]
+		n := memChunkSize - len(*last)
+		if n > len(p) {
+			n = len(p)
+		}
+		*last = append(*last, p[:n]...)
+		d.size += int64(n)
+		p = p[n:]
+	}
+}
+
+// from returns the bytes from off to the end of their chunk.
+func (d *memData) from(off int64) []byte {
+	if off >= d.size {
+		return nil
+	}
+	return d.chunks[off/memChunkSize][off%memChunkSize:]
+}
+
+// clone returns a memData which shares the chunks of d.
+func (d *memData) clone() memData {
+	return memData{chunks: append([][]byte(nil), d.chunks...), size: d.size}
+}
+
 type memFile struct {
+	fs   *memFS
 	mu   sync.RWMutex
 	name string
-	r    *bytes.Buffer
+	data memData
+	meta []byte
 	memReader
 	rt, wt time.Time
+
+	disk     stream.File // the writer in the overflow FileSystem, once spilled
+	diskName string
 }
 
 func (f *memFile) Name() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.name
 }
 
@@ -107,41 +322,148 @@ func (f *memFile) Write(p []byte) (int, error) {
 	if len(p) > 0 {
 		f.mu.Lock()
 		defer f.mu.Unlock()
-		return f.r.Write(p)
+		if f.disk == nil && !f.fs.reserve(int64(len(p))) {
+			if f.fs.overflow == nil {
+				return 0, errors.New("memory budget exceeded")
+			}
+			if err := f.spill(); err != nil {
+				return 0, err
+			}
+		}
+		if f.disk != nil {
+			return f.disk.Write(p)
+		}
+		f.data.write(p)
+		return len(p), nil
 	}
 	return len(p), nil
 }
 
-func (f *memFile) Bytes() []byte {
+// spill moves the File to the overflow FileSystem. f.mu must be held.
+func (f *memFile) spill() error {
+	disk, err := f.fs.overflow.Create(f.name)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range f.data.chunks {
+		if _, err := disk.Write(chunk); err != nil {
+			disk.Close()
+			_ = f.fs.overflow.Remove(disk.Name())
+			return err
+		}
+	}
+	atomic.AddInt64(&f.fs.used, -f.data.size)
+	f.disk, f.diskName = disk, disk.Name()
+	f.data = memData{}
+	return nil
+}
+
+// spilled returns the name of the File in the overflow FileSystem, and false if it is in memory.
+func (f *memFile) spilled() (string, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.diskName, f.diskName != ""
+}
+
+// release frees the memory or overflow File of a removed File.
+func (f *memFile) release() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.diskName != "" {
+		return f.fs.overflow.Remove(f.diskName)
+	}
+	atomic.AddInt64(&f.fs.used, -f.data.size)
+	return nil
+}
+
+// Size returns the number of bytes written to the File while it is in memory.
+func (f *memFile) Size() int64 {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return f.r.Bytes()
+	return f.data.size
 }
 
 func (f *memFile) Close() error {
+	f.mu.RLock()
+	disk := f.disk
+	f.mu.RUnlock()
+	f.memReader.Close()
+	if disk != nil {
+		return disk.Close()
+	}
 	return nil
 }
 
 type memReader struct {
 	*memFile
-	n int
+	n     int
+	spill stream.File // the File in the overflow FileSystem, once spilled
+}
+
+// overflow returns the overflow File to read if the File has been spilled.
+func (r *memReader) overflow() (stream.File, error) {
+	if r.spill != nil {
+		return r.spill, nil
+	}
+	diskName, ok := r.spilled()
+	if !ok {
+		return nil, nil
+	}
+	f, err := r.fs.overflow.Open(diskName)
+	if err != nil {
+		return nil, err
+	}
+	r.spill = f
+	return f, nil
+}
+
+// readAt reads the File's data in memory at off. The lock is only held to find each chunk.
+func (r *memReader) readAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		r.mu.RLock()
+		chunk := r.data.from(off)
+		r.mu.RUnlock()
+		if len(chunk) == 0 {
+			return n, io.EOF
+		}
+		k := copy(p[n:], chunk)
+		n += k
+		off += int64(k)
+	}
+	return n, nil
 }
 
 func (r *memReader) ReadAt(p []byte, off int64) (n int, err error) {
-	data := r.Bytes()
-	if int64(len(data)) < off {
-		return 0, io.EOF
+	spill, err := r.overflow()
+	if err != nil {
+		return 0, err
 	}
-	n, err = bytes.NewReader(data[off:]).ReadAt(p, 0)
-	return n, err
+	if spill != nil {
+		return spill.ReadAt(p, off)
+	}
+	return r.readAt(p, off)
 }
 
 func (r *memReader) Read(p []byte) (n int, err error) {
-	n, err = bytes.NewReader(r.Bytes()[r.n:]).Read(p)
+	spill, err := r.overflow()
+	if err != nil {
+		return 0, err
+	}
+	if spill != nil {
+		n, err = spill.ReadAt(p, int64(r.n))
+	} else {
+		n, err = r.readAt(p, int64(r.n))
+	}
 	r.n += n
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
 	return n, err
 }
 
 func (r *memReader) Close() error {
+	if r.spill != nil {
+		return r.spill.Close()
+	}
 	return nil
 }
@@ -0,0 +1,101 @@
+package fscache
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NewMemFsWithContainerLimit creates an in-memory FileSystem, like NewMemFsWithOverflow, whose
+// budget is fraction of the memory limit of the container it runs in, see ContainerMemoryLimit,
+// so that the cache can't get the process OOM-killed under default settings. Without a limit,
+// the budget is unlimited. If overflow is nil, Writes which would go over the budget fail.
+func NewMemFsWithContainerLimit(fraction float64, overflow FileSystem) FileSystem {
+	var budget int64
+	if limit, ok := ContainerMemoryLimit(); ok {
+		budget = int64(fraction * float64(limit))
+		if budget < 1 {
+			budget = 1
+		}
+	}
+	if overflow == nil {
+		return &memFS{files: make(map[string]*memFile), budget: budget}
+	}
+	return NewMemFsWithOverflow(budget, overflow)
+}
+
+// ContainerMemoryLimit returns the memory limit, in bytes, of the cgroup the process runs in,
+// the lowest set on it or its parents, reading cgroup v2 or v1 on Linux. It returns false if
+// there is no limit, or it can't be read, e.g. on other platforms.
+func ContainerMemoryLimit() (int64, bool) {
+	return containerMemoryLimit("/")
+}
+
+// unlimitedMemory is above which a cgroup v1 limit is treated as none, v1 reports no
+// limit as the largest page aligned int64.
+const unlimitedMemory = 1 << 62
+
+func containerMemoryLimit(root string) (int64, bool) {
+	f, err := os.Open(filepath.Join(root, "proc", "self", "cgroup"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	limit := int64(math.MaxInt64)
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path, the controllers are empty for v2.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		var dir, file string
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			dir, file = filepath.Join(root, "sys", "fs", "cgroup"), "memory.max"
+		case hasController(fields[1], "memory"):
+			dir, file = filepath.Join(root, "sys", "fs", "cgroup", "memory"), "memory.limit_in_bytes"
+		default:
+			continue
+		}
+		// in a container the cgroup's own directory is usually mounted as the root.
+		for p := path.Clean("/" + fields[2]); ; p = path.Dir(p) {
+			if n, ok := readMemoryLimit(filepath.Join(dir, filepath.FromSlash(p), file)); ok && n < limit {
+				limit, found = n, true
+			}
+			if p == "/" {
+				break
+			}
+		}
+	}
+	return limit, found
+}
+
+func hasController(controllers, name string) bool {
+	for _, c := range strings.Split(controllers, ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readMemoryLimit reads a cgroup memory limit file, it returns false if there is no limit.
+func readMemoryLimit(file string) (int64, bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || n <= 0 || n >= unlimitedMemory {
+		return 0, false // "max" for v2
+	}
+	return n, true
+}
@@ -0,0 +1,72 @@
+package fscache
+
+import "time"
+
+// MetadataWriter is implemented by the writers of Caches which can store metadata with an entry.
+type MetadataWriter interface {
+	// SetMetadata replaces the entry's metadata. Readers may not see it until
+	// the first byte of the entry is written, so set it before writing the data.
+	SetMetadata(data []byte) error
+}
+
+// MetadataReader is implemented by the readers of Caches which can store metadata with an entry.
+type MetadataReader interface {
+	// Metadata returns the entry's metadata, or nil if it has none.
+	Metadata() ([]byte, error)
+}
+
+// TimesWriter is implemented by the writers of Caches which can keep the access and
+// modification times of an entry copied from another Cache, so that it keeps its age.
+type TimesWriter interface {
+	// SetTimes sets the entry's access and modification times once its writer is closed.
+	SetTimes(rt, wt time.Time) error
+}
+
+// TimesReader is implemented by the readers of Caches which record when an entry was
+// last read and written.
+type TimesReader interface {
+	// Times returns when the entry was last read and written.
+	Times() (rt, wt time.Time, err error)
+}
+
+// SetMetadata stores data with the entry, the FileSystem must be a FileSystemMetadata.
+func (w *entryWriter) SetMetadata(data []byte) error {
+	fm, ok := w.c.fs.(FileSystemMetadata)
+	if !ok {
+		return ErrUnsupported
+	}
+	return fm.WriteMetadata(w.Name(), data)
+}
+
+// Metadata returns the metadata stored with the entry, see MetadataWriter.
+func (r *CacheReader) Metadata() ([]byte, error) {
+	fm, ok := r.fs.(FileSystemMetadata)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return fm.ReadMetadata(r.name)
+}
+
+// entryTimes are the times set by SetTimes.
+type entryTimes struct {
+	rt, wt time.Time
+}
+
+// SetTimes sets the entry's access and modification times once the writer is closed,
+// the FileSystem must be a FileSystemChtimes.
+func (w *entryWriter) SetTimes(rt, wt time.Time) error {
+	if _, ok := w.c.fs.(FileSystemChtimes); !ok {
+		return ErrUnsupported
+	}
+	w.times.Store(entryTimes{rt: rt, wt: wt})
+	return nil
+}
+
+// Times returns the entry's access and modification times, see TimesReader.
+func (r *CacheReader) Times() (rt, wt time.Time, err error) {
+	fi, err := r.fs.Stat(r.name)
+	if err != nil {
+		return rt, wt, err
+	}
+	return fi.AccessTime(), fi.ModTime(), nil
+}
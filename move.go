@@ -0,0 +1,84 @@
+package fscache
+
+import "io"
+
+// Move streams the entries of keys, with their metadata and access times, from src to dst,
+// and removes each from src once dst has it, e.g. to rebalance caches or demote entries to
+// a slower tier. Entries keep their age if dst can keep their times, see TimesWriter.
+// Keys which aren't in src are skipped, and keys which dst already has are only removed
+// from src. If an entry can't be moved, e.g. because dst can't store its metadata, it is
+// left in src and the others are still moved. Move returns the first error encountered.
+func Move(src, dst Cache, keys ...string) error {
+	var err1 error
+	for _, key := range keys {
+		if err := move(src, dst, key); err != nil && err1 == nil {
+			err1 = err
+		}
+	}
+	return err1
+}
+
+func move(src, dst Cache, key string) error {
+	r, w, err := src.Get(key)
+	if err != nil {
+		return err
+	}
+	if w != nil {
+		r.Close()
+		abandonFill(src, key, w)
+		return nil
+	}
+	err = fillFrom(dst, key, r)
+	// Remove waits for the entry's readers.
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return src.Remove(key)
+}
+
+// fillFrom writes the entry read by r to key in dst, unless dst has it already.
+func fillFrom(dst Cache, key string, r ReadAtCloser) error {
+	dr, dw, err := dst.Get(key)
+	if err != nil {
+		return err
+	}
+	dr.Close()
+	if dw == nil {
+		return nil
+	}
+	if err := copyEntry(dw, r); err != nil {
+		abandonFill(dst, key, dw)
+		return err
+	}
+	return dw.Close()
+}
+
+// copyEntry writes the metadata, access times and data read by r to w. Times are only
+// kept if w can keep them.
+func copyEntry(w io.Writer, r ReadAtCloser) error {
+	if tr, ok := r.(TimesReader); ok {
+		if tw, ok := w.(TimesWriter); ok {
+			if rt, wt, err := tr.Times(); err == nil {
+				_ = tw.SetTimes(rt, wt)
+			}
+		}
+	}
+	if mr, ok := r.(MetadataReader); ok {
+		meta, err := mr.Metadata()
+		if err != nil && err != ErrUnsupported {
+			return err
+		}
+		if meta != nil {
+			mw, ok := w.(MetadataWriter)
+			if !ok {
+				return ErrUnsupported
+			}
+			if err := mw.SetMetadata(meta); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,62 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+)
+
+// GetResult is the result of a Get of one of the keys given to GetMulti.
+type GetResult struct {
+	Reader ReadAtCloser
+	Writer io.WriteCloser
+	Err    error
+}
+
+// MultiGetter is implemented by Caches which can Get many keys at once more
+// cheaply than one at a time.
+type MultiGetter interface {
+	GetMulti(keys []string) []GetResult
+}
+
+// GetMulti calls Get for each of keys, using c.GetMulti if c is a MultiGetter.
+// The results are in the same order as keys.
+func GetMulti(c Cache, keys []string) []GetResult {
+	if mg, ok := c.(MultiGetter); ok {
+		return mg.GetMulti(keys)
+	}
+	results := make([]GetResult, len(keys))
+	for i, key := range keys {
+		r, w, err := c.Get(key)
+		results[i] = GetResult{Reader: r, Writer: w, Err: err}
+	}
+	return results
+}
+
+// GetMulti works like Get for each of keys, but only acquires the cache's lock once.
+// If a key is repeated, only its first result can have a Writer.
+func (c *FSCache) GetMulti(keys []string) []GetResult {
+	results := make([]GetResult, len(keys))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, key := range keys {
+		r, w, err := c.getLocked(c.mapKey(key), key)
+		results[i] = GetResult{Reader: r, Writer: w, Err: err}
+	}
+	return results
+}
+
+// GetMulti makes the requests for keys concurrently, each over its own connection.
+func (rmt *remote) GetMulti(keys []string) []GetResult {
+	results := make([]GetResult, len(keys))
+	var grp sync.WaitGroup
+	for i, key := range keys {
+		grp.Add(1)
+		go func(i int, key string) {
+			defer grp.Done()
+			r, w, err := rmt.Get(key)
+			results[i] = GetResult{Reader: r, Writer: w, Err: err}
+		}(i, key)
+	}
+	grp.Wait()
+	return results
+}
@@ -0,0 +1,76 @@
+package fscache
+
+import (
+	"io"
+	"os"
+)
+
+// FilePather is implemented by Caches which can expose the os file of an entry, for
+// integrations which need a path rather than an io.Reader.
+type FilePather interface {
+	// Path returns the os path of key's data, and false if key is not in the cache,
+	// has not finished being written, or is not stored in an os file.
+	Path(key string) (string, bool)
+}
+
+// Path returns the os path of key's completed data if the FileSystem is a FileSystemPather.
+//
+// The file belongs to the cache: it must not be modified, and it may be deleted as soon as
+// key is removed or evicted. To use it safely, Get key and keep its reader open until you're
+// done with the path. Open readers stop the Reaper from evicting key, and make Remove wait.
+// Once opened, an os file can still be read after it has been deleted, except on Windows where
+// an open file can't be deleted. Use CopyTo if you need a file which outlives the entry.
+func (c *FSCache) Path(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.files[c.mapKey(key)]
+	if !ok || !f.complete() {
+		return "", false
+	}
+	p, ok := c.fs.(FileSystemPather)
+	if !ok {
+		return "", false
+	}
+	return p.Path(f.Name())
+}
+
+// CopyTo writes the data of key to a new file at destPath, which must not already exist.
+// If the entry has finished being written and the FileSystem is a FileSystemPather,
+// destPath is hard linked to the entry's file, which avoids copying its data but means
+// the file must not be modified. Otherwise the data is copied, which blocks until the
+// entry has been completely written.
+func (c *FSCache) CopyTo(key, destPath string) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return ErrClosed
+	}
+	f, ok := c.files[c.mapKey(key)]
+	if !ok {
+		c.mu.RUnlock()
+		return ErrNotFound
+	}
+	if p, ok := c.fs.(FileSystemPather); ok && f.complete() {
+		if path, ok := p.Path(f.Name()); ok && os.Link(path, destPath) == nil {
+			c.mu.RUnlock()
+			return nil
+		}
+	}
+	r, err := f.next()
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dst, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(destPath)
+		return err
+	}
+	return dst.Close()
+}
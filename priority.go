@@ -0,0 +1,41 @@
+package fscache
+
+// SetPriority sets the eviction priority of key's current entry, 0 by default. Haunters
+// which choose between entries, like NewLRUHaunter's, keep entries with a higher priority
+// longer, e.g. ones which are expensive to fill again, and evict those with a negative one
+// sooner. Priorities are only kept in memory, and are dropped with the entry when it is
+// removed or replaced. It returns ErrNotFound if key isn't cached.
+func (c *FSCache) SetPriority(key string, priority int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	mapped := c.mapKey(key)
+	if _, ok := c.files[mapped]; !ok {
+		return ErrNotFound
+	}
+	if priority == 0 {
+		delete(c.priorities, mapped)
+		return nil
+	}
+	if c.priorities == nil {
+		c.priorities = make(map[string]int)
+	}
+	c.priorities[mapped] = priority
+	return nil
+}
+
+// Priority returns the entry's eviction priority, see FSCache.SetPriority.
+func (e *Entry) Priority() int {
+	return e.priority
+}
+
+// weight returns how much slower than an entry of priority 0 an entry of priority p ages:
+// p+1 for positive priorities, and 1/(1-p) for negative ones.
+func weight(p int) float64 {
+	if p >= 0 {
+		return float64(p + 1)
+	}
+	return 1 / float64(1-p)
+}
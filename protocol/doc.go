@@ -0,0 +1,70 @@
+// Package protocol describes the wire format spoken between fscache.ListenAndServe
+// and fscache.NewRemote, so that clients can be written in other languages.
+// It holds no networking code, only the types and the functions which read and
+// write them.
+//
+// Each TCP connection carries one request. The client starts it with an Action
+// written as a decimal integer and a newline:
+//
+//	"0\n"
+//
+// Requests which name a key follow the Action with the key sent as a stream.
+//
+// Streams are sequences of Packets. A Packet is a JSON object followed by a
+// newline, whose Data is base64 encoded (the encoding/json encoding of []byte):
+//
+//	{"Err":0,"Data":"aGVsbG8="}
+//
+// A Packet with Err set to FlagEOF ends the stream, its Data is ignored:
+//
+//	{"Err":1,"Data":null}
+//
+// Packets can hold any amount of Data, senders choose how to split a stream
+// (see NewChunkEncoder) and readers must accept any split.
+//
+// The requests are:
+//
+//	ActionGet       key stream, then the server replies with a Status.
+//	                StatusFill means the client must write the entry as a stream,
+//	                on the same connection. Either way the server then streams
+//	                the entry back as it is written. If the server can't get
+//	                the entry, it closes the connection without a Status.
+//	ActionRemove    key stream, then the server removes the key and replies "1\n", or
+//	                replies "0\n" if it couldn't.
+//	ActionExists    key stream, then the server replies "1\n" or "0\n".
+//	ActionClean     no key, then the server cleans the cache and replies "1\n", or
+//	                replies "0\n" if it couldn't or only cleans with ActionCleanConfirm.
+//	ActionPlacement no key, the server replies with its placement algorithm
+//	                and version, "sha1-uvarint-mod 1\n".
+//	ActionSubscribe no key, the server keeps the connection open and sends an
+//	                Invalidation, one JSON object per line, whenever a key is removed
+//	                or the cache is cleaned by a request:
+//
+//	                {"action":1,"key":"a"}
+//	                {"action":3}
+//
+//	                A subscriber which falls too far behind is disconnected, and
+//	                should assume it missed invalidations.
+//	ActionCleanPrepare
+//	                no key, the server replies with a token line, "9f86d081884c7d65\n".
+//	ActionCleanConfirm
+//	                a token line from ActionCleanPrepare, then the server cleans the
+//	                cache and replies "1\n", or replies "0\n" if the token is unknown
+//	                or has expired, or the cache couldn't be cleaned. Each token
+//	                confirms one Clean.
+//	ActionGetHeader key stream, then the server replies as to ActionGet, but follows
+//	                StatusCached with a Header line before the entry's stream, so the
+//	                client knows about the entry before its data arrives:
+//
+//	                {"size":11,"digest":"sha256:b94d...","contentType":"text/plain"}
+//
+//	                Size is -1 while the entry is being written.
+//
+// Any request may be prefixed with ActionTrace and a W3C traceparent line, so that the
+// server can continue the caller's trace:
+//
+//	"6\n00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\n0\n"
+//
+// The server closes the connection when the request is complete, and may refuse a
+// request by closing the connection before replying.
+package protocol
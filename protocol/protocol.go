@@ -0,0 +1,428 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Action is the request made by a connection.
+type Action int
+
+// Actions understood by the server.
+const (
+	ActionGet Action = iota
+	ActionRemove
+	ActionExists
+	ActionClean
+	ActionPlacement
+	ActionSubscribe
+
+	// ActionTrace prefixes another request with the W3C trace context of the caller.
+	ActionTrace
+
+	// ActionCleanPrepare asks for a token, which ActionCleanConfirm sends back to clean the cache.
+	ActionCleanPrepare
+	ActionCleanConfirm
+
+	// ActionGetHeader is ActionGet, but the server follows StatusCached with a Header.
+	ActionGetHeader
+)
+
+// Status is the server's reply to ActionGet.
+type Status int
+
+const (
+	// StatusCached means the entry already exists and will be streamed back.
+	StatusCached Status = 0
+
+	// StatusFill means the entry was created, and the client must stream its contents.
+	StatusFill Status = 1
+)
+
+// FlagEOF is the Packet.Err of the last Packet of a stream.
+const FlagEOF = 1
+
+// Packet is a single frame of a stream.
+type Packet struct {
+	Err  int
+	Data []byte
+}
+
+// WriteAction starts a request.
+func WriteAction(w io.Writer, a Action) error {
+	_, err := fmt.Fprintf(w, "%d\n", a)
+	return err
+}
+
+// ReadAction reads the Action which starts a request.
+func ReadAction(r io.Reader) (a Action, err error) {
+	_, err = fmt.Fscanf(r, "%d\n", &a)
+	return a, err
+}
+
+// WriteStatus replies to ActionGet.
+func WriteStatus(w io.Writer, s Status) error {
+	_, err := fmt.Fprintf(w, "%d\n", s)
+	return err
+}
+
+// ReadStatus reads the reply to ActionGet.
+func ReadStatus(r io.Reader) (s Status, err error) {
+	if _, err = fmt.Fscanf(r, "%d\n", &s); err != nil {
+		return s, err
+	}
+	if s != StatusCached && s != StatusFill {
+		return s, fmt.Errorf("protocol: bad status %d", s)
+	}
+	return s, nil
+}
+
+// WriteBool replies to ActionExists, ActionRemove and ActionClean.
+func WriteBool(w io.Writer, b bool) error {
+	i := 0
+	if b {
+		i = 1
+	}
+	_, err := fmt.Fprintf(w, "%d\n", i)
+	return err
+}
+
+// ReadBool reads the reply to ActionExists, ActionRemove and ActionClean.
+func ReadBool(r io.Reader) (bool, error) {
+	var i int
+	_, err := fmt.Fscanf(r, "%d\n", &i)
+	return i == 1, err
+}
+
+// WritePlacement replies to ActionPlacement.
+func WritePlacement(w io.Writer, algorithm string, version int) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", algorithm, version)
+	return err
+}
+
+// ReadPlacement reads the reply to ActionPlacement.
+func ReadPlacement(r io.Reader) (algorithm string, version int, err error) {
+	_, err = fmt.Fscanf(r, "%s %d\n", &algorithm, &version)
+	return algorithm, version, err
+}
+
+// WriteToken replies to ActionCleanPrepare, and follows ActionCleanConfirm.
+// The reply to ActionCleanConfirm is a bool, see WriteBool.
+func WriteToken(w io.Writer, token string) error {
+	_, err := fmt.Fprintf(w, "%s\n", token)
+	return err
+}
+
+// ReadToken reads a token sent by WriteToken.
+func ReadToken(r io.Reader) (token string, err error) {
+	_, err = fmt.Fscanf(r, "%s\n", &token)
+	return token, err
+}
+
+// Header describes a cached entry, the server sends it before the entry's stream
+// in reply to ActionGetHeader.
+type Header struct {
+	// Size is the size of the entry, or -1 if it is still being written.
+	Size int64 `json:"size"`
+
+	// Digest identifies the entry's content, e.g. "sha256:<hex>", if the server knows it.
+	Digest string `json:"digest,omitempty"`
+
+	// ContentType is the entry's media type, if the server knows it.
+	ContentType string `json:"contentType,omitempty"`
+
+	// Metadata is the metadata stored with the entry, if it has any.
+	Metadata []byte `json:"metadata,omitempty"`
+}
+
+// WriteHeader sends h as a JSON object and a newline.
+func WriteHeader(w io.Writer, h Header) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// ReadHeader reads a Header sent by WriteHeader. It doesn't read past the Header,
+// so the entry's stream can be read from r afterwards.
+func ReadHeader(r io.Reader) (h Header, err error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return h, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	err = json.Unmarshal(line, &h)
+	return h, err
+}
+
+// TraceParent is a W3C trace context traceparent, version 00.
+type TraceParent struct {
+	TraceID  [16]byte
+	ParentID [8]byte
+	Flags    byte
+}
+
+// String formats tp as a traceparent header value.
+func (tp TraceParent) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tp.TraceID, tp.ParentID, tp.Flags)
+}
+
+// ParseTraceParent parses a traceparent header value.
+func ParseTraceParent(s string) (tp TraceParent, err error) {
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tp, fmt.Errorf("protocol: bad traceparent %q", s)
+	}
+	version, err := hex.DecodeString(s[:2])
+	if err != nil || version[0] == 0xff || version[0] == 0 && len(s) != 55 {
+		return tp, fmt.Errorf("protocol: bad traceparent version %q", s)
+	}
+	if _, err := hex.Decode(tp.TraceID[:], []byte(s[3:35])); err != nil || tp.TraceID == [16]byte{} {
+		return tp, fmt.Errorf("protocol: bad trace-id %q", s)
+	}
+	if _, err := hex.Decode(tp.ParentID[:], []byte(s[36:52])); err != nil || tp.ParentID == [8]byte{} {
+		return tp, fmt.Errorf("protocol: bad parent-id %q", s)
+	}
+	flags, err := hex.DecodeString(s[53:55])
+	if err != nil {
+		return tp, fmt.Errorf("protocol: bad trace-flags %q", s)
+	}
+	tp.Flags = flags[0]
+	return tp, nil
+}
+
+// WriteTraceParent starts a request with ActionTrace and tp, the request's own Action follows.
+func WriteTraceParent(w io.Writer, tp TraceParent) error {
+	_, err := fmt.Fprintf(w, "%d\n%s\n", ActionTrace, tp)
+	return err
+}
+
+// ReadTraceParent reads the traceparent which follows ActionTrace.
+func ReadTraceParent(r io.Reader) (TraceParent, error) {
+	var s string
+	if _, err := fmt.Fscanf(r, "%s\n", &s); err != nil {
+		return TraceParent{}, err
+	}
+	return ParseTraceParent(s)
+}
+
+// Invalidation is sent to subscribers when a key is removed from the server's
+// cache (Action is ActionRemove), or the cache is cleaned (ActionClean).
+type Invalidation struct {
+	Action Action `json:"action"`
+	Key    string `json:"key,omitempty"`
+}
+
+// WriteInvalidation sends inv to a subscriber.
+func WriteInvalidation(w io.Writer, inv Invalidation) error {
+	return json.NewEncoder(w).Encode(inv)
+}
+
+// InvalidationReader reads the Invalidations sent to a subscriber.
+type InvalidationReader struct {
+	dec *json.Decoder
+}
+
+// NewInvalidationReader returns a reader of the Invalidations in r.
+func NewInvalidationReader(r io.Reader) *InvalidationReader {
+	return &InvalidationReader{dec: json.NewDecoder(r)}
+}
+
+// Next blocks until the next Invalidation is read.
+func (r *InvalidationReader) Next() (inv Invalidation, err error) {
+	err = r.dec.Decode(&inv)
+	return inv, err
+}
+
+// WriteKey sends key as a stream.
+func WriteKey(w io.Writer, key string) error {
+	enc := NewEncoder(w)
+	if _, err := enc.Write([]byte(key)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// ReadKey reads a key sent by WriteKey.
+func ReadKey(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, NewDecoder(r))
+	return buf.String(), err
+}
+
+type encoder struct {
+	enc *json.Encoder
+}
+
+// NewEncoder returns a writer which sends each Write as a Packet to w,
+// Close ends the stream but does not close w.
+func NewEncoder(w io.Writer) io.WriteCloser {
+	return &encoder{enc: json.NewEncoder(w)}
+}
+
+func (e *encoder) Write(p []byte) (int, error) {
+	if err := e.enc.Encode(Packet{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *encoder) Close() error {
+	return e.enc.Encode(Packet{Err: FlagEOF})
+}
+
+// ChunkEncoder is a writer which sends its data as Packets of a fixed size, see NewChunkEncoder.
+type ChunkEncoder struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	size     int
+	interval time.Duration
+	buf      []byte
+	timer    *time.Timer
+	err      error
+	closed   bool
+}
+
+// NewChunkEncoder returns a writer which sends its data to w in Packets of size bytes,
+// whatever the size of each Write, so large frames can be used for throughput.
+// Data which doesn't fill a Packet is sent once it has waited for flushInterval, by Flush,
+// or by Close, so small frames and a short flushInterval deliver bytes promptly.
+// A flushInterval of 0 only sends partial Packets on Flush and Close.
+// Close ends the stream but does not close w. The stream is read by NewDecoder.
+func NewChunkEncoder(w io.Writer, size int, flushInterval time.Duration) *ChunkEncoder {
+	if size <= 0 {
+		size = 1
+	}
+	return &ChunkEncoder{
+		enc:      json.NewEncoder(w),
+		size:     size,
+		interval: flushInterval,
+		buf:      make([]byte, 0, size),
+	}
+}
+
+func (e *ChunkEncoder) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return 0, e.err
+	}
+	var n int
+	for len(p) > 0 {
+		m := e.size - len(e.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		e.buf = append(e.buf, p[:m]...)
+		p = p[m:]
+		if len(e.buf) == e.size {
+			if err := e.flush(); err != nil {
+				return n, err
+			}
+		}
+		n += m
+	}
+	if len(e.buf) > 0 && e.interval > 0 && e.timer == nil {
+		e.timer = time.AfterFunc(e.interval, func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.timer = nil
+			if !e.closed {
+				_ = e.flush()
+			}
+		})
+	}
+	return n, nil
+}
+
+// Flush sends the data buffered so far as a Packet.
+func (e *ChunkEncoder) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	return e.flush()
+}
+
+func (e *ChunkEncoder) flush() error {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if len(e.buf) == 0 {
+		return nil
+	}
+	if err := e.enc.Encode(Packet{Data: e.buf}); err != nil {
+		e.err = err
+		return err
+	}
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Close sends the buffered data and ends the stream.
+func (e *ChunkEncoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err != nil {
+		return e.err
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.enc.Encode(Packet{Err: FlagEOF})
+}
+
+type decoder struct {
+	dec  *json.Decoder
+	data []byte
+	eof  bool
+}
+
+// NewDecoder returns a reader of the stream of Packets in r.
+// The decoder may read past the end of the stream, so r should not be read
+// directly afterwards.
+func NewDecoder(r io.Reader) io.ReadCloser {
+	return &decoder{dec: json.NewDecoder(r)}
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.data) == 0 {
+		if d.eof {
+			return 0, io.EOF
+		}
+		var pkt Packet
+		if err := d.dec.Decode(&pkt); err != nil {
+			return 0, err
+		}
+		if pkt.Err == FlagEOF {
+			d.eof = true
+			continue
+		}
+		d.data = pkt.Data
+	}
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+func (d *decoder) Close() error {
+	return nil
+}
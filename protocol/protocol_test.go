@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Write([]byte("hello"))
+	enc.Write(nil)
+	enc.Write([]byte(" world"))
+	enc.Close()
+
+	want := `{"Err":0,"Data":"aGVsbG8="}
+{"Err":0,"Data":null}
+{"Err":0,"Data":"IHdvcmxk"}
+{"Err":1,"Data":null}
+`
+	if buf.String() != want {
+		t.Errorf("wire format changed, got:\n%s", buf.String())
+	}
+
+	dec := NewDecoder(&buf)
+	small := make([]byte, 3)
+	var got []byte
+	for {
+		n, err := dec.Read(small)
+		got = append(got, small[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(got) != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", got)
+	}
+}
+
+func TestChunkEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewChunkEncoder(&buf, 4, 0)
+	enc.Write([]byte("hel"))
+	enc.Write([]byte("lo world"))
+	enc.Close()
+
+	want := `{"Err":0,"Data":"aGVsbA=="}
+{"Err":0,"Data":"byB3bw=="}
+{"Err":0,"Data":"cmxk"}
+{"Err":1,"Data":null}
+`
+	if buf.String() != want {
+		t.Errorf("unexpected packets:\n%s", buf.String())
+	}
+	if got, err := ioutil.ReadAll(NewDecoder(&buf)); err != nil || string(got) != "hello world" {
+		t.Errorf("expected %q, got %q, %v", "hello world", got, err)
+	}
+
+	// a partial packet is sent once it has waited for the flush interval.
+	r, w := io.Pipe()
+	enc = NewChunkEncoder(w, 1024, 10*time.Millisecond)
+	enc.Write([]byte("hi"))
+	got := make([]byte, 2)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(NewDecoder(r), got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || string(got) != "hi" {
+			t.Errorf("expected %q, got %q, %v", "hi", got, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the partial packet to be flushed")
+	}
+	r.Close()
+	enc.Close()
+}
+
+func TestRequest(t *testing.T) {
+	var buf bytes.Buffer
+	WriteAction(&buf, ActionExists)
+	WriteKey(&buf, "key")
+	if buf.String() != "2\n{\"Err\":0,\"Data\":\"a2V5\"}\n{\"Err\":1,\"Data\":null}\n" {
+		t.Errorf("wire format changed, got:\n%s", buf.String())
+	}
+
+	a, err := ReadAction(&buf)
+	if err != nil || a != ActionExists {
+		t.Fatalf("ReadAction = %v, %v", a, err)
+	}
+	key, err := ReadKey(&buf)
+	if err != nil || key != "key" {
+		t.Fatalf("ReadKey = %q, %v", key, err)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	var buf bytes.Buffer
+	WriteStatus(&buf, StatusFill)
+	WriteBool(&buf, true)
+	WritePlacement(&buf, "algo", 2)
+	WriteToken(&buf, "0a1b")
+	WriteHeader(&buf, Header{Size: 5, Digest: "sha256:00", ContentType: "text/plain"})
+	WriteToken(&buf, "2c3d")
+
+	if s, err := ReadStatus(&buf); err != nil || s != StatusFill {
+		t.Errorf("ReadStatus = %v, %v", s, err)
+	}
+	if b, err := ReadBool(&buf); err != nil || !b {
+		t.Errorf("ReadBool = %v, %v", b, err)
+	}
+	if a, v, err := ReadPlacement(&buf); err != nil || a != "algo" || v != 2 {
+		t.Errorf("ReadPlacement = %v, %v, %v", a, v, err)
+	}
+	if tok, err := ReadToken(&buf); err != nil || tok != "0a1b" {
+		t.Errorf("ReadToken = %v, %v", tok, err)
+	}
+	if h, err := ReadHeader(&buf); err != nil || h.Size != 5 || h.Digest != "sha256:00" || h.ContentType != "text/plain" {
+		t.Errorf("ReadHeader = %+v, %v", h, err)
+	}
+	if tok, err := ReadToken(&buf); err != nil || tok != "2c3d" {
+		t.Errorf("expected ReadHeader not to read past the header, got %v, %v", tok, err)
+	}
+
+	if _, err := ReadStatus(bytes.NewBufferString("7\n")); err == nil {
+		t.Errorf("expected an error for an unknown status")
+	}
+	if _, err := ioutil.ReadAll(NewDecoder(bytes.NewBufferString("{"))); err == nil {
+		t.Errorf("expected an error for a truncated packet")
+	}
+}
+
+func TestInvalidations(t *testing.T) {
+	var buf bytes.Buffer
+	want := []Invalidation{
+		{Action: ActionRemove, Key: "a"},
+		{Action: ActionClean},
+		{Action: ActionRemove, Key: "b\nc"},
+	}
+	for _, inv := range want {
+		WriteInvalidation(&buf, inv)
+	}
+
+	r := NewInvalidationReader(&buf)
+	for _, w := range want {
+		if inv, err := r.Next(); err != nil || inv != w {
+			t.Errorf("Next() = %+v, %v, want %+v", inv, err, w)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end, got %v", err)
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tp, err := ParseTraceParent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.String() != s || tp.Flags != 1 {
+		t.Errorf("ParseTraceParent(%q) = %v", s, tp)
+	}
+
+	var buf bytes.Buffer
+	WriteTraceParent(&buf, tp)
+	WriteAction(&buf, ActionGet)
+	if a, err := ReadAction(&buf); err != nil || a != ActionTrace {
+		t.Errorf("ReadAction = %v, %v", a, err)
+	}
+	if got, err := ReadTraceParent(&buf); err != nil || got != tp {
+		t.Errorf("ReadTraceParent = %v, %v", got, err)
+	}
+	if a, err := ReadAction(&buf); err != nil || a != ActionGet {
+		t.Errorf("expected the request's Action after the trace context, got %v, %v", a, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
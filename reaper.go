@@ -14,18 +14,48 @@ type Reaper interface {
 	Reap(key string, lastRead, lastWrite time.Time) bool
 }
 
+// Expirer is implemented by Reapers and Haunters which can predict when an entry expires.
+type Expirer interface {
+	// ExpiresAt returns when the entry for key, with the given last r/w times,
+	// becomes eligible for removal, or false if it never expires.
+	ExpiresAt(key string, lastRead, lastWrite time.Time) (time.Time, bool)
+}
+
+// RefreshMode controls which accesses extend the life of an entry.
+type RefreshMode int
+
+const (
+	// RefreshOnRead expires entries "expiry" after they were last read.
+	RefreshOnRead RefreshMode = iota
+
+	// RefreshOnWrite expires entries "expiry" after they were last written,
+	// regardless of reads.
+	RefreshOnWrite
+
+	// RefreshOnAny expires entries "expiry" after they were last read or written.
+	RefreshOnAny
+)
+
 // NewReaper returns a simple reaper which runs every "Period"
 // and reaps files which are older than "expiry".
 func NewReaper(expiry, period time.Duration) Reaper {
+	return NewReaperWithRefresh(expiry, period, RefreshOnRead)
+}
+
+// NewReaperWithRefresh is like NewReaper, but mode chooses whether reads, writes
+// or both reset an entry's age.
+func NewReaperWithRefresh(expiry, period time.Duration, mode RefreshMode) Reaper {
 	return &reaper{
 		expiry: expiry,
 		period: period,
+		mode:   mode,
 	}
 }
 
 type reaper struct {
 	period time.Duration
 	expiry time.Duration
+	mode   RefreshMode
 }
 
 func (g *reaper) Next() time.Duration {
@@ -33,5 +63,22 @@ func (g *reaper) Next() time.Duration {
 }
 
 func (g *reaper) Reap(key string, lastRead, lastWrite time.Time) bool {
-	return lastRead.Before(time.Now().Add(-g.expiry))
+	return g.last(lastRead, lastWrite).Before(time.Now().Add(-g.expiry))
+}
+
+func (g *reaper) ExpiresAt(key string, lastRead, lastWrite time.Time) (time.Time, bool) {
+	return g.last(lastRead, lastWrite).Add(g.expiry), true
+}
+
+// last returns the access time which the entry's age is measured from.
+func (g *reaper) last(lastRead, lastWrite time.Time) time.Time {
+	switch g.mode {
+	case RefreshOnWrite:
+		return lastWrite
+	case RefreshOnAny:
+		if lastWrite.After(lastRead) {
+			return lastWrite
+		}
+	}
+	return lastRead
 }
@@ -0,0 +1,171 @@
+package fscache
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// RebalanceOptions configures FSCache.Rebalance.
+type RebalanceOptions struct {
+	// BytesPerSecond limits how fast entries are copied, 0 means no limit.
+	BytesPerSecond int64
+
+	// Progress, if set, is called after each key is looked at.
+	Progress func(p RebalanceProgress)
+}
+
+// RebalanceProgress reports how far a Rebalance has got.
+type RebalanceProgress struct {
+	Keys    int   // keys in the cache when Rebalance started
+	Scanned int   // keys looked at so far
+	Moved   int   // entries moved to another cache
+	Bytes   int64 // bytes of entry data copied
+}
+
+// Rebalance moves the entries which d places on another cache to that cache, e.g. after
+// caches are added to or removed from a cluster, so that they are found there instead of
+// being filled again on a miss. c should be one of d's caches; entries which d places on
+// c stay. Entries are moved as Move moves them, one at a time, and entries which are
+// being written are skipped. Keys are placed as they were given to Get if they are kept,
+// see SetKeepOriginalKeys, and otherwise as the cache tracks them.
+// It returns the progress made and the first error encountered. The rebalance command of
+// cmd/fscachectl runs it on a cache directory, against the servers of a cluster.
+func (c *FSCache) Rebalance(d Distributor, opts RebalanceOptions) (RebalanceProgress, error) {
+	type entry struct{ key, mapped string }
+	c.mu.RLock()
+	entries := make([]entry, 0, len(c.files))
+	for k, f := range c.files {
+		if !f.complete() {
+			continue
+		}
+		e := entry{key: k, mapped: k}
+		if original, ok := c.originals[k]; ok {
+			e.key = original
+		}
+		entries = append(entries, e)
+	}
+	c.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	p := RebalanceProgress{Keys: len(entries)}
+	t := &throttle{rate: opts.BytesPerSecond, start: time.Now()}
+	var err1 error
+	for _, e := range entries {
+		if dst := d.GetCache(e.key); dst != Cache(c) {
+			moved, err := c.moveOut(&throttledCache{Cache: dst, t: t}, e.mapped, e.key)
+			if moved {
+				p.Moved++
+			}
+			if err != nil && err1 == nil {
+				err1 = err
+			}
+		}
+		p.Scanned++
+		p.Bytes = t.n
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	return p, err1
+}
+
+// moveOut moves the entry the cache tracks as mapped to key in dst, as move does, without
+// mapping it again. It reports whether the entry left the cache for dst, and not if it was
+// removed since it was listed.
+func (c *FSCache) moveOut(dst Cache, mapped, key string) (bool, error) {
+	r, w, err := c.get(mapped, key)
+	if err != nil {
+		return false, err
+	}
+	if w != nil {
+		r.Close()
+		if a, ok := w.(Aborter); ok {
+			_ = a.Abort()
+		} else {
+			w.Close()
+			_ = c.remove(mapped)
+		}
+		return false, nil
+	}
+	err = fillFrom(dst, key, r)
+	// remove waits for the entry's readers.
+	r.Close()
+	if err != nil {
+		return false, err
+	}
+	return true, c.remove(mapped)
+}
+
+// throttle counts the bytes written through it, and delays writes to keep under rate.
+type throttle struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttle) wrote(n int) {
+	t.n += int64(n)
+	if t.rate <= 0 {
+		return
+	}
+	due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+	if d := due - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// throttledCache is a Cache whose writers write through t.
+type throttledCache struct {
+	Cache
+	t *throttle
+}
+
+func (c *throttledCache) Get(key string) (ReadAtCloser, io.WriteCloser, error) {
+	r, w, err := c.Cache.Get(key)
+	if w != nil {
+		tw := &throttledWriter{WriteCloser: w, t: c.t}
+		if _, ok := w.(Aborter); ok {
+			// so that a failed copy is aborted rather than published, see abandonFill.
+			return r, throttledAborter{tw}, err
+		}
+		w = tw
+	}
+	return r, w, err
+}
+
+type throttledWriter struct {
+	io.WriteCloser
+	t *throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.t.wrote(n)
+	return n, err
+}
+
+func (w *throttledWriter) SetMetadata(meta []byte) error {
+	mw, ok := w.WriteCloser.(MetadataWriter)
+	if !ok {
+		return ErrUnsupported
+	}
+	return mw.SetMetadata(meta)
+}
+
+func (w *throttledWriter) SetTimes(rt, wt time.Time) error {
+	tw, ok := w.WriteCloser.(TimesWriter)
+	if !ok {
+		return ErrUnsupported
+	}
+	return tw.SetTimes(rt, wt)
+}
+
+// throttledAborter is a throttledWriter whose writer is an Aborter.
+type throttledAborter struct {
+	*throttledWriter
+}
+
+func (w throttledAborter) Abort() error {
+	return w.WriteCloser.(Aborter).Abort()
+}
@@ -0,0 +1,108 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+
+	"github.com/djherbis/stream"
+)
+
+// ErrGenerationMismatch is returned by Replace when the key's entry is not the expected generation.
+var ErrGenerationMismatch = errors.New("entry generation does not match")
+
+// Generation returns the generation of the entry for key, it changes every time an
+// entry is completely written under key. It returns false if the key isn't cached,
+// or its entry is still being written.
+// Generations are unique within a cache, but do not survive a Reload.
+func (c *FSCache) Generation(key string) (uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	gen, ok := c.gens[c.mapKey(key)]
+	return gen, ok
+}
+
+// Replace writes a new entry for key with fill, and swaps it in only if the current entry
+// is still generation expected, so that two writers refreshing the same key can't replace
+// each other's newer content. An expected generation of 0 means key must not be cached.
+// The new entry is not visible until fill returns, readers of the old entry are unaffected.
+// It returns the new entry's generation, or ErrGenerationMismatch if the key changed, in
+// which case the new data is discarded. The FileSystem must be a FileSystemRenamer.
+func (c *FSCache) Replace(key string, expected uint64, fill func(w io.Writer) error) (uint64, error) {
+	c.mu.RLock()
+	key = c.mapKey(key)
+	err := c.checkReplace(key, expected)
+	c.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	s, err := c.newStaged()
+	if err != nil {
+		return 0, err
+	}
+	if err := fill(s); err != nil {
+		s.abort()
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkReplace(key, expected); err != nil {
+		s.abort()
+		return 0, err
+	}
+	name, err := s.commit(key)
+	if err != nil {
+		return 0, err
+	}
+	_, existed := c.files[key]
+	original, kept := c.originals[key]
+	c.deleteFile(key)
+	if existed {
+		c.emit(EventRemove, key, nil)
+	}
+	c.setFile(key, c.oldFile(name))
+	if kept {
+		c.originals[key] = original
+	}
+	gen := c.bump(key)
+	c.emit(EventCreate, key, nil)
+	c.emit(EventWrite, key, c.files[key])
+	c.trace(key, OpWrite, c.files[key])
+	return gen, nil
+}
+
+// checkReplace returns an error if the entry for key can't be replaced. c.mu must be held.
+func (c *FSCache) checkReplace(key string, expected uint64) error {
+	if c.closed {
+		return ErrClosed
+	}
+	if err := c.checkMutable(key); err != nil {
+		return err
+	}
+	if c.removing[key] > 0 {
+		return stream.ErrRemoving
+	}
+	f, ok := c.files[key]
+	if ok && !f.complete() {
+		return ErrInProgress
+	}
+	if c.gens[key] != expected {
+		return ErrGenerationMismatch
+	}
+	return nil
+}
+
+// bump gives the entry for key, which is complete, a new generation, and counts its
+// size in its Usage. c.mu must be held.
+func (c *FSCache) bump(key string) uint64 {
+	if f, ok := c.files[key]; ok && c.usage != nil {
+		c.usage.setSize(key, c.entrySize(f))
+	}
+	if f, ok := c.files[key]; ok && c.soft != nil {
+		c.softSetSize(key, c.entrySize(f))
+	}
+	c.gen++
+	c.gens[key] = c.gen
+	return c.gen
+}
@@ -0,0 +1,131 @@
+package fscache
+
+import (
+	"io"
+	"runtime"
+)
+
+// Resumer is implemented by the writers Get returns. Offset is the number of bytes of an
+// aborted fill which the new entry already holds, so the writer should only be given the
+// rest of the data, e.g. by fetching it with an HTTP Range request.
+type Resumer interface {
+	Offset() int64
+}
+
+// Aborter is implemented by the writers Get returns. Abort abandons the fill instead of
+// completing the entry with the data written so far, as Close would.
+type Aborter interface {
+	Abort() error
+}
+
+// partialFill is the data of an aborted fill, kept in a staged file until the key is filled again.
+type partialFill struct {
+	name string
+	size int64
+}
+
+// SetResumableFills keeps the data written by aborted fills, so that the next Get
+// of the key returns a writer which continues from where the aborted one stopped,
+// see Resumer. A fill is aborted by its writer's Abort, or when it times out (see
+// SetOrphanTimeout) or is garbage collected without being closed.
+// The kept data is discarded by Remove and Clean, and is not kept across Reloads.
+func (c *FSCache) SetResumableFills(enabled bool) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !enabled {
+		for key := range c.partials {
+			c.dropPartial(key)
+		}
+		c.partials = nil
+	} else if c.partials == nil {
+		c.partials = make(map[string]partialFill)
+	}
+	return c
+}
+
+// Abort abandons the fill, readers of the entry fail with stream.ErrCanceled and
+// the entry is removed. If SetResumableFills is enabled the data written so far is
+// kept for the next writer of the key.
+func (w *entryWriter) Abort() error {
+	runtime.SetFinalizer(w, nil)
+	w.c.abort(w.cachedFile)
+	return nil
+}
+
+// Offset returns the size of the aborted fill this writer resumes, or 0.
+func (w *entryWriter) Offset() int64 {
+	if w.resume == nil {
+		return 0
+	}
+	return w.resume.size
+}
+
+// savePartial copies the data written to f, whose writer was aborted, to a staged file.
+func (c *FSCache) savePartial(f *cachedFile) (partialFill, error) {
+	key, err := c.stagedKey()
+	if err != nil {
+		return partialFill{}, err
+	}
+	r, err := c.fs.Open(f.Name())
+	if err != nil {
+		return partialFill{}, err
+	}
+	defer r.Close()
+	w, err := c.fs.Create(key)
+	if err != nil {
+		return partialFill{}, err
+	}
+	n, err := io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = c.fs.Remove(w.Name())
+		return partialFill{}, err
+	}
+	return partialFill{name: w.Name(), size: n}, nil
+}
+
+// dropPartial discards the kept data of an aborted fill of key. c.mu must be held.
+func (c *FSCache) dropPartial(key string) {
+	if p, ok := c.partials[key]; ok {
+		delete(c.partials, key)
+		_ = c.fs.Remove(p.name)
+	}
+}
+
+// resumed copies the data of the aborted fill f resumes into it, the first time it is called.
+func (f *cachedFile) resumed() error {
+	if f.resume == nil {
+		return nil
+	}
+	f.resumeOnce.Do(func() {
+		var r io.ReadCloser
+		r, f.resumeErr = f.c.fs.Open(f.resume.name)
+		if f.resumeErr == nil {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					if _, werr := f.write(buf[:n]); werr != nil {
+						f.resumeErr = werr
+						break
+					}
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					f.resumeErr = err
+					break
+				}
+			}
+			r.Close()
+		}
+		_ = f.c.fs.Remove(f.resume.name)
+	})
+	if f.resumeErr != nil {
+		f.c.abort(f)
+	}
+	return f.resumeErr
+}
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package fscache
+
+// soReusePort is SO_REUSEPORT, which package syscall doesn't define on linux.
+const soReusePort = 0xf
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package fscache
+
+import "syscall"
+
+func reusePort(network, address string, c syscall.RawConn) error { return nil }
+
+const reusePortSupported = false
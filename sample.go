@@ -0,0 +1,58 @@
+package fscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// readSampler picks the read streams passed to fn, see SetReadSampler.
+type readSampler struct {
+	fraction float64
+	fn       func(key string, size int64, d time.Duration)
+	n        uint64 // streams seen, accessed atomically
+}
+
+// SetReadSampler calls fn for fraction (0 to 1) of the readers returned by Get and
+// GetContext, spread evenly over them, once each is closed, with the key it was opened
+// with, the bytes read through it and how long it was open, e.g. to find out which
+// content is actually consumed. fn is called in the goroutine which closes the reader.
+// Pass 0 or a nil fn to stop sampling. Readers which aren't sampled cost nothing.
+func (c *FSCache) SetReadSampler(fraction float64, fn func(key string, size int64, d time.Duration)) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fraction <= 0 || fn == nil {
+		c.sampler = nil
+		return c
+	}
+	c.sampler = &readSampler{fraction: fraction, fn: fn}
+	return c
+}
+
+// sample makes r, returned by Get for key, report to s if it is picked.
+func (s *readSampler) sample(key string, r ReadAtCloser) {
+	cr, ok := r.(*CacheReader)
+	if !ok {
+		return
+	}
+	n := atomic.AddUint64(&s.n, 1)
+	if s.fraction < 1 && uint64(float64(n)*s.fraction) == uint64(float64(n-1)*s.fraction) {
+		return
+	}
+	cr.sample = &readSample{fn: s.fn, key: key, start: time.Now()}
+}
+
+// readSample tracks a sampled reader.
+type readSample struct {
+	fn    func(key string, size int64, d time.Duration)
+	key   string
+	start time.Time
+	n     int64 // bytes read, accessed atomically
+}
+
+func (s *readSample) read(n int) {
+	atomic.AddInt64(&s.n, int64(n))
+}
+
+func (s *readSample) closed() {
+	s.fn(s.key, atomic.LoadInt64(&s.n), time.Since(s.start))
+}
@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"time"
+)
+
+// TimeWindow is a daily window of local time, Start and End are offsets from midnight.
+// If End is before Start the window wraps past midnight, e.g. {22h, 2h} runs from 22:00 to 02:00.
+type TimeWindow struct {
+	Start, End time.Duration
+}
+
+// Contains returns if the local time of t is inside the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.End < w.Start {
+		return d >= w.Start || d < w.End
+	}
+	return d >= w.Start && d < w.End
+}
+
+type windowedHaunter struct {
+	heavy     Haunter
+	emergency Haunter
+	windows   []TimeWindow
+	now       func() time.Time
+}
+
+// NewWindowedHaunter returns a Haunter which only runs heavy while the local time is
+// inside one of windows, so that large eviction passes happen off-peak.
+// emergency, if not nil, runs on every haunt regardless of the time; it should only
+// evict under real pressure, e.g. an LRUHaunter with a hard size limit.
+// Next is the shorter of the two Haunters' periods.
+func NewWindowedHaunter(heavy, emergency Haunter, windows ...TimeWindow) Haunter {
+	return &windowedHaunter{
+		heavy:     heavy,
+		emergency: emergency,
+		windows:   windows,
+		now:       time.Now,
+	}
+}
+
+func (h *windowedHaunter) Haunt(c CacheAccessor) {
+	if h.emergency != nil {
+		h.emergency.Haunt(c)
+	}
+	now := h.now()
+	for _, w := range h.windows {
+		if w.Contains(now) {
+			h.heavy.Haunt(c)
+			return
+		}
+	}
+}
+
+func (h *windowedHaunter) Next() time.Duration {
+	next := h.heavy.Next()
+	if h.emergency != nil {
+		if e := h.emergency.Next(); e > 0 && (next <= 0 || e < next) {
+			next = e
+		}
+	}
+	return next
+}
@@ -0,0 +1,44 @@
+package fscache
+
+import (
+	"context"
+	"io"
+)
+
+// GetScoped is Get for request-scoped entries, like intermediate artifacts, which shouldn't
+// outlive ctx. If it creates key's entry, the entry is removed once ctx is done, unless it is
+// in use then, by readers other than the caller's or by an unfinished writer, in which case
+// it is left like any other entry. The caller should close its reader and writer before ctx
+// is done. An entry which was already cached isn't scoped.
+func (c *FSCache) GetScoped(ctx context.Context, key string) (ReadAtCloser, io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	mapped := c.mapKey(key)
+	c.keepContent(mapped)
+	r, w, err := c.getLockedContext(ctx, mapped, key)
+	f := c.files[mapped]
+	c.mu.Unlock()
+	if err != nil || w == nil {
+		return r, w, err
+	}
+	go func() {
+		<-ctx.Done()
+		c.dropScoped(mapped, f)
+	}()
+	return r, w, nil
+}
+
+// dropScoped removes f, the entry GetScoped created for key, if it is still key's entry and unused.
+func (c *FSCache) dropScoped(key string, f fileStream) {
+	c.mu.Lock()
+	if c.closed || c.files[key] != f || f.InUse() || c.checkMutable(key) != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.emit(EventRemove, key, f)
+	c.unmap(key)
+	c.mu.Unlock()
+	_ = c.finishRemove(key, f)
+}
@@ -1,155 +1,515 @@
 package fscache
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djherbis/fscache/protocol"
 )
 
 // ListenAndServe hosts a Cache for access via NewRemote
 func ListenAndServe(c Cache, addr string) error {
-	return (&server{c: c}).ListenAndServe(addr)
+	return (&Server{Cache: c}).ListenAndServe(addr)
 }
 
 // NewRemote returns a Cache run via ListenAndServe
-func NewRemote(raddr string) Cache {
-	return &remote{raddr: raddr}
+func NewRemote(raddr string, opts ...RemoteOption) Cache {
+	rmt := &remote{raddr: raddr}
+	for _, opt := range opts {
+		opt(rmt)
+	}
+	rmt.dialer = rmt.newDialer()
+	return rmt
 }
 
-type server struct {
-	c Cache
+// Server hosts a Cache for access via NewRemote.
+type Server struct {
+	Cache Cache
+
+	// StartSpan, if set, is called at the start of every request, with a context carrying the
+	// caller's trace context if it sent one (see TraceParentFromContext), the request's Action,
+	// and its key if it has one. The returned func is called once the request is complete.
+	StartSpan func(ctx context.Context, action protocol.Action, key string) (end func())
+
+	// CleanConfirmWindow, if set, makes the server refuse single requests to Clean its Cache.
+	// It is only cleaned by a client which prepares the Clean, then confirms it within
+	// CleanConfirmWindow, see CleanPreparer.
+	CleanConfirmWindow time.Duration
+
+	// Allow, if set, is called with the client's address and the Action of every request,
+	// and the request is refused by closing the connection when it returns false.
+	// By default any client which can connect can make any request, see DenyDestructive.
+	Allow func(addr net.Addr, action protocol.Action) bool
+
+	// AcceptLoops is how many listeners ListenAndServe opens on its address, each with its
+	// own accept loop. They share the address with SO_REUSEPORT so the kernel spreads
+	// connections across them, which helps many-core hosts serving lots of small requests.
+	// Platforms without SO_REUSEPORT use one listener.
+	AcceptLoops int
+
+	// ChunkSize, if set, is the size of the Packets entries are streamed to clients in,
+	// and FlushInterval how long a partial Packet waits for more data before it is sent,
+	// see protocol.NewChunkEncoder. By default each write to the entry is sent as a Packet.
+	ChunkSize     int
+	FlushInterval time.Duration
+
+	// HandoffDrainTimeout is how long Handoff waits for the requests in progress once the
+	// successor is ready, 0 waits until they are complete.
+	HandoffDrainTimeout time.Duration
+
+	mu        sync.Mutex
+	subs      map[chan protocol.Invalidation]struct{}
+	tokens    map[string]time.Time // the prepared Cleans, and when they expire
+	listeners map[net.Listener]struct{}
+	shutdown  bool
+	active    sync.WaitGroup // requests accepted by ServeListener
 }
 
-func (s *server) ListenAndServe(addr string) error {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// ErrServerClosed is returned by ListenAndServe and ServeListener after Shutdown.
+var ErrServerClosed = errors.New("fscache: server closed")
+
+// ErrNotRemoved is returned by the Remove of a remote Cache when the server's Cache failed to
+// remove the key. A server which refuses the request, see Server.Allow, closes the connection.
+var ErrNotRemoved = errors.New("fscache: server did not remove the key")
+
+// ListenAndServe accepts connections on addr and serves them.
+func (s *Server) ListenAndServe(addr string) error {
+	if s.AcceptLoops <= 1 || !reusePortSupported {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return s.ServeListener(l)
 	}
 
+	lc := net.ListenConfig{Control: reusePort}
+	ls := make([]net.Listener, 0, s.AcceptLoops)
+	for len(ls) < s.AcceptLoops {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		if len(ls) == 0 {
+			// the others must bind the same port if addr asked for any.
+			addr = l.Addr().String()
+		}
+		ls = append(ls, l)
+	}
+
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) { errs <- s.ServeListener(l) }(l)
+	}
+	err := <-errs
+	for _, l := range ls {
+		l.Close()
+	}
+	for range ls[1:] {
+		<-errs
+	}
+	return err
+}
+
+// ServeListener accepts connections on l and serves them, until l fails or Shutdown is called.
+func (s *Server) ServeListener(l net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			s.mu.Lock()
+			delete(s.listeners, l)
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		go s.Serve(c)
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.active.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.active.Done()
+			s.Serve(c)
+		}()
 	}
 }
 
-const (
-	actionGet    = iota
-	actionRemove = iota
-	actionExists = iota
-	actionClean  = iota
-)
+// Shutdown stops the Server accepting connections, disconnects its subscribers, and waits
+// until the requests in progress are complete, or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
 
-func getKey(r io.Reader) string {
-	dec := newDecoder(r)
-	buf := bytes.NewBufferString("")
-	io.Copy(buf, dec)
-	return buf.String()
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func sendKey(w io.Writer, key string) {
-	enc := newEncoder(w)
-	_, _ = enc.Write([]byte(key))
-	_ = enc.Close()
+func getKey(r io.Reader) string {
+	key, _ := protocol.ReadKey(r)
+	return key
 }
 
-func (s *server) Serve(c net.Conn) {
-	var action int
-	fmt.Fscanf(c, "%d\n", &action)
+// Serve handles the request on c, and closes c once it is complete.
+func (s *Server) Serve(c net.Conn) {
+	subscribed := false
+	defer func() {
+		// subscribe closes c itself, once the subscriber leaves.
+		if !subscribed {
+			c.Close()
+		}
+	}()
+
+	action, err := protocol.ReadAction(c)
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if action == protocol.ActionTrace {
+		if tp, err := protocol.ReadTraceParent(c); err == nil {
+			ctx = ContextWithTraceParent(ctx, tp.String())
+		}
+		if action, err = protocol.ReadAction(c); err != nil {
+			return
+		}
+	}
+
+	if s.Allow != nil && !s.Allow(c.RemoteAddr(), action) {
+		return
+	}
 
+	var key string
 	switch action {
-	case actionGet:
-		s.get(c, getKey(c))
-	case actionRemove:
-		_ = s.c.Remove(getKey(c))
-	case actionExists:
-		s.exists(c, getKey(c))
-	case actionClean:
-		_ = s.c.Clean()
+	case protocol.ActionGet, protocol.ActionGetHeader, protocol.ActionRemove, protocol.ActionExists:
+		key = getKey(c)
+	}
+	if s.StartSpan != nil {
+		defer s.StartSpan(ctx, action, key)()
+	}
+
+	switch action {
+	case protocol.ActionGet, protocol.ActionGetHeader:
+		s.get(c, key, action == protocol.ActionGetHeader)
+	case protocol.ActionRemove:
+		err := s.Cache.Remove(key)
+		if err == nil {
+			s.invalidate(protocol.Invalidation{Action: action, Key: key})
+		}
+		_ = protocol.WriteBool(c, err == nil)
+	case protocol.ActionExists:
+		_ = protocol.WriteBool(c, s.Cache.Exists(key))
+	case protocol.ActionClean:
+		ok := s.CleanConfirmWindow <= 0
+		if ok {
+			ok = s.clean() == nil
+		}
+		_ = protocol.WriteBool(c, ok)
+	case protocol.ActionCleanPrepare:
+		_ = protocol.WriteToken(c, s.prepareClean())
+	case protocol.ActionCleanConfirm:
+		if token, err := protocol.ReadToken(c); err == nil {
+			ok := s.confirmClean(token)
+			if ok {
+				ok = s.clean() == nil
+			}
+			_ = protocol.WriteBool(c, ok)
+		}
+	case protocol.ActionPlacement:
+		_ = protocol.WritePlacement(c, PlacementAlgorithm, PlacementVersion)
+	case protocol.ActionSubscribe:
+		subscribed = true
+		s.subscribe(c)
 	}
 }
 
-func (s *server) exists(c net.Conn, key string) {
-	if s.c.Exists(key) {
-		fmt.Fprintf(c, "%d\n", 1)
-	} else {
-		fmt.Fprintf(c, "%d\n", 0)
+// DenyDestructive returns a Server.Allow func which refuses the requests that remove entries,
+// ActionRemove, ActionClean and ActionCleanConfirm, unless the client's IP address is in one of
+// the trusted networks. With no trusted networks they're refused from every client.
+func DenyDestructive(trusted ...*net.IPNet) func(addr net.Addr, action protocol.Action) bool {
+	return func(addr net.Addr, action protocol.Action) bool {
+		switch action {
+		case protocol.ActionRemove, protocol.ActionClean, protocol.ActionCleanConfirm:
+		default:
+			return true
+		}
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip = a.IP
+		case *net.UDPAddr:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		for _, n := range trusted {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// subscribe sends Invalidations to c until it disconnects or falls behind.
+func (s *Server) subscribe(c net.Conn) {
+	defer c.Close()
+	ch := make(chan protocol.Invalidation, 256)
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan protocol.Invalidation]struct{})
+	}
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+
+	// subscribers never send anything, so a read only returns once c is closed.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = c.Read(make([]byte, 1))
+		close(gone)
+	}()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case inv, ok := <-ch:
+			if !ok {
+				return // fell behind
+			}
+			if protocol.WriteInvalidation(c, inv) != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// invalidate sends inv to every subscriber, those which are too far behind are dropped.
+func (s *Server) invalidate(inv protocol.Invalidation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- inv:
+		default:
+			delete(s.subs, ch)
+			close(ch)
+		}
 	}
 }
 
-func (s *server) get(c net.Conn, key string) {
-	r, w, err := s.c.Get(key)
+func (s *Server) get(c net.Conn, key string, header bool) {
+	r, w, err := s.Cache.Get(key)
 	if err != nil {
-		return // handle this better
+		// Serve closes c, which tells the client the request failed.
+		return
 	}
 	defer r.Close()
 
 	if w != nil {
 		go func() {
-			fmt.Fprintf(c, "%d\n", 1)
+			_ = protocol.WriteStatus(c, protocol.StatusFill)
 			io.Copy(w, newDecoder(c))
 			w.Close()
 		}()
 	} else {
-		fmt.Fprintf(c, "%d\n", 0)
+		_ = protocol.WriteStatus(c, protocol.StatusCached)
 	}
 
-	enc := newEncoder(c)
+	enc := newEncoder(c, s.ChunkSize, s.FlushInterval)
+	if w == nil && header {
+		// like Handler, wait for the first data so that the writer has set the metadata.
+		buf := make([]byte, 32*1024)
+		n, err := r.Read(buf)
+		_ = protocol.WriteHeader(c, s.entryHeader(key, r))
+		if n > 0 {
+			enc.Write(buf[:n])
+		}
+		if err != nil {
+			enc.Close()
+			return
+		}
+	}
 	io.Copy(enc, r)
 	enc.Close()
 }
 
+// entryHeader describes the entry for key, which is being read by r, see protocol.ActionGetHeader.
+func (s *Server) entryHeader(key string, r ReadAtCloser) protocol.Header {
+	h := protocol.Header{Size: -1}
+	if fc, ok := s.Cache.(*FSCache); ok {
+		h.Size = fc.completeSize(key)
+	}
+	if strings.HasPrefix(key, ContentKeyPrefix) {
+		h.Digest = key
+	}
+	if mr, ok := r.(MetadataReader); ok {
+		if meta, err := mr.Metadata(); err == nil && meta != nil {
+			h.Metadata = meta
+			var hdr cachedHeader
+			if json.Unmarshal(meta, &hdr) == nil {
+				h.ContentType = hdr.Header.Get("Content-Type")
+			}
+		}
+	}
+	return h
+}
+
+// HeaderReader is implemented by the readers of remote Caches made with RemoteHeaders.
+type HeaderReader interface {
+	// Header returns the Header the server sent before the entry, and false if it sent none.
+	Header() (protocol.Header, bool)
+}
+
 type remote struct {
-	raddr string
+	raddr  string
+	dialer dialer
+
+	resolveInterval time.Duration
+	fallbacks       []string
+	fallbackDelay   time.Duration
+
+	chunkSize     int
+	flushInterval time.Duration
+	headers       bool
 }
 
 func (rmt *remote) Get(key string) (r ReadAtCloser, w io.WriteCloser, err error) {
-	c, err := net.Dial("tcp", rmt.raddr)
+	return rmt.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, which sends the trace context of ctx (see ContextWithTraceParent)
+// to the server so that it can continue the caller's trace.
+func (rmt *remote) GetContext(ctx context.Context, key string) (r ReadAtCloser, w io.WriteCloser, err error) {
+	c, err := rmt.dialer.DialContext(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
-	fmt.Fprintf(c, "%d\n", actionGet)
-	sendKey(c, key)
+	if s, ok := TraceParentFromContext(ctx); ok {
+		if tp, err := protocol.ParseTraceParent(s); err == nil {
+			protocol.WriteTraceParent(c, tp)
+		}
+	}
+	action := protocol.ActionGet
+	if rmt.headers {
+		action = protocol.ActionGetHeader
+	}
+	protocol.WriteAction(c, action)
+	protocol.WriteKey(c, key)
 
-	var i int
-	fmt.Fscanf(c, "%d\n", &i)
+	status, err := protocol.ReadStatus(c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	var hdr *protocol.Header
+	if rmt.headers && status == protocol.StatusCached {
+		h, err := protocol.ReadHeader(c)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		hdr = &h
+	}
 
 	var ch chan struct{}
 
-	switch i {
-	case 0:
+	switch status {
+	case protocol.StatusCached:
 		ch = make(chan struct{}) // close net.Conn on reader close
-	case 1:
+	case protocol.StatusFill:
 		ch = make(chan struct{}, 1) // two closes before net.Conn close
 
 		w = &safeCloser{
 			c:  c,
 			ch: ch,
-			w:  newEncoder(c),
+			w:  newEncoder(c, rmt.chunkSize, rmt.flushInterval),
 		}
-	default:
-		return nil, nil, errors.New("bad bad bad")
 	}
 
 	r = &safeCloser{
-		c:  c,
-		ch: ch,
-		r:  newDecoder(c),
+		c:   c,
+		ch:  ch,
+		r:   newDecoder(c),
+		hdr: hdr,
 	}
 
 	return r, w, nil
 }
 
 type safeCloser struct {
-	c  net.Conn
-	ch chan<- struct{}
-	r  ReadAtCloser
-	w  io.WriteCloser
+	c   net.Conn
+	ch  chan<- struct{}
+	r   ReadAtCloser
+	w   io.WriteCloser
+	hdr *protocol.Header
+}
+
+func (s *safeCloser) Header() (protocol.Header, bool) {
+	if s.hdr == nil {
+		return protocol.Header{}, false
+	}
+	return *s.hdr, true
+}
+
+// Metadata returns the metadata the server sent in the Header, see RemoteHeaders.
+func (s *safeCloser) Metadata() ([]byte, error) {
+	if s.hdr == nil {
+		return nil, ErrUnsupported
+	}
+	return s.hdr.Metadata, nil
 }
 
 func (s *safeCloser) ReadAt(p []byte, off int64) (int, error) {
@@ -175,32 +535,86 @@ func (s *safeCloser) Close() (err error) {
 }
 
 func (rmt *remote) Exists(key string) bool {
-	c, err := net.Dial("tcp", rmt.raddr)
+	c, err := rmt.dialer.DialContext(context.Background())
 	if err != nil {
 		return false
 	}
-	fmt.Fprintf(c, "%d\n", actionExists)
-	sendKey(c, key)
-	var i int
-	fmt.Fscanf(c, "%d\n", &i)
-	return i == 1
+	defer c.Close()
+	protocol.WriteAction(c, protocol.ActionExists)
+	protocol.WriteKey(c, key)
+	ok, _ := protocol.ReadBool(c)
+	return ok
 }
 
 func (rmt *remote) Remove(key string) error {
-	c, err := net.Dial("tcp", rmt.raddr)
+	c, err := rmt.dialer.DialContext(context.Background())
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(c, "%d\n", actionRemove)
-	sendKey(c, key)
+	defer c.Close()
+	if err := protocol.WriteAction(c, protocol.ActionRemove); err != nil {
+		return err
+	}
+	if err := protocol.WriteKey(c, key); err != nil {
+		return err
+	}
+	ok, err := protocol.ReadBool(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotRemoved
+	}
 	return nil
 }
 
+// RemotePlacement returns the PlacementAlgorithm and PlacementVersion
+// reported by the server at raddr.
+func RemotePlacement(raddr string) (algorithm string, version int, err error) {
+	c, err := net.Dial("tcp", raddr)
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.Close()
+	protocol.WriteAction(c, protocol.ActionPlacement)
+	return protocol.ReadPlacement(c)
+}
+
 func (rmt *remote) Clean() error {
-	c, err := net.Dial("tcp", rmt.raddr)
+	c, err := rmt.dialer.DialContext(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := protocol.WriteAction(c, protocol.ActionClean); err != nil {
+		return err
+	}
+	ok, err := protocol.ReadBool(c)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(c, "%d\n", actionClean)
+	if !ok {
+		return ErrCleanNotConfirmed
+	}
 	return nil
 }
+
+// ContextGetter is implemented by Caches which can pass a context along with a Get,
+// such as the Cache returned by NewRemote.
+type ContextGetter interface {
+	GetContext(ctx context.Context, key string) (ReadAtCloser, io.WriteCloser, error)
+}
+
+type traceParentKey struct{}
+
+// ContextWithTraceParent returns a copy of ctx carrying a W3C traceparent header value,
+// which remote Caches send to their server along with requests made with ctx.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceparent)
+}
+
+// TraceParentFromContext returns the traceparent carried by ctx.
+func TraceParentFromContext(ctx context.Context) (string, bool) {
+	tp, ok := ctx.Value(traceParentKey{}).(string)
+	return tp, ok
+}
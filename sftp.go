@@ -0,0 +1,295 @@
+package fscache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djherbis/stream"
+)
+
+// SFTPClient is the part of an SFTP client which NewSFTPFs uses. A *sftp.Client from
+// github.com/pkg/sftp provides all of it, but its OpenFile returns a *sftp.File,
+// so it needs a small wrapper:
+//
+//	type sftpClient struct{ *sftp.Client }
+//
+//	func (c sftpClient) OpenFile(path string, flag int) (fscache.SFTPFile, error) {
+//		f, err := c.Client.OpenFile(path, flag)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return f, nil
+//	}
+type SFTPClient interface {
+	OpenFile(path string, flag int) (SFTPFile, error)
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Remove(path string) error
+	MkdirAll(path string) error
+}
+
+// SFTPFile is a file opened by an SFTPClient.
+type SFTPFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+}
+
+// SFTPFS is a FileSystem which stores Files in a directory of a remote host, see NewSFTPFs.
+type SFTPFS struct {
+	client SFTPClient
+	root   string
+
+	mu    sync.Mutex
+	stats map[string]*sftpStat
+}
+
+// sftpStat is what SFTPFS knows about a File without asking the remote host.
+type sftpStat struct {
+	size   int64
+	rt, wt time.Time
+}
+
+// NewSFTPFs returns a FileSystem which stores Files in the directory dir of the host
+// client is connected to, so that a small node can cache onto a larger storage server.
+// Files are named like those of NewFs. The sizes and access times of Files are
+// kept locally once known, since the Haunters stat every File often and SFTP servers
+// rarely report access times. Only one SFTPFS should use dir at a time.
+func NewSFTPFs(client SFTPClient, dir string) (*SFTPFS, error) {
+	if err := client.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	return &SFTPFS{
+		client: client,
+		root:   dir,
+		stats:  make(map[string]*sftpStat),
+	}, nil
+}
+
+// Create creates a File for key on the remote host.
+func (fs *SFTPFS) Create(key string) (stream.File, error) {
+	name, decodable := B32OrMD5HashEncodeKey(key)
+	if !validName(name) {
+		name, decodable = longName(key), false
+	}
+	name = path.Join(fs.root, name)
+	if !decodable {
+		if err := fs.writeFile(name+".key", []byte(key)); err != nil {
+			return nil, err
+		}
+	}
+	f, err := fs.client.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	st := &sftpStat{rt: now, wt: now}
+	fs.mu.Lock()
+	fs.stats[name] = st
+	fs.mu.Unlock()
+	return &sftpWriter{SFTPFile: f, fs: fs, name: name, st: st}, nil
+}
+
+func (fs *SFTPFS) writeFile(name string, data []byte) error {
+	f, err := fs.client.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sftpWriter keeps the size of the File it writes up to date.
+type sftpWriter struct {
+	SFTPFile
+	fs   *SFTPFS
+	name string
+	st   *sftpStat
+}
+
+func (w *sftpWriter) Name() string { return w.name }
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	n, err := w.SFTPFile.Write(p)
+	w.fs.mu.Lock()
+	w.st.size += int64(n)
+	w.st.wt = time.Now()
+	w.fs.mu.Unlock()
+	return n, err
+}
+
+type sftpReader struct {
+	SFTPFile
+	name string
+}
+
+func (r *sftpReader) Name() string { return r.name }
+
+// Open opens a File.Name() returned by Create.
+func (fs *SFTPFS) Open(name string) (stream.File, error) {
+	f, err := fs.client.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	_ = fs.Touch(name)
+	return &sftpReader{SFTPFile: f, name: name}, nil
+}
+
+// CreateContext is Create, giving up once ctx is done. Operations on the remote host
+// can't be interrupted, so a File created after that is removed again.
+func (fs *SFTPFS) CreateContext(ctx context.Context, key string) (stream.File, error) {
+	return withContext(ctx, func() (stream.File, error) { return fs.Create(key) }, func(f stream.File) {
+		f.Close()
+		_ = fs.Remove(f.Name())
+	})
+}
+
+// OpenContext is Open, giving up once ctx is done.
+func (fs *SFTPFS) OpenContext(ctx context.Context, name string) (stream.File, error) {
+	return withContext(ctx, func() (stream.File, error) { return fs.Open(name) }, func(f stream.File) { f.Close() })
+}
+
+// Touch sets the access time of name to now, it is only recorded locally.
+func (fs *SFTPFS) Touch(name string) error {
+	st, err := fs.stat(name)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	st.rt = time.Now()
+	fs.mu.Unlock()
+	return nil
+}
+
+// stat returns the local stat of name, asking the remote host the first time.
+func (fs *SFTPFS) stat(name string) (*sftpStat, error) {
+	fs.mu.Lock()
+	st, ok := fs.stats[name]
+	fs.mu.Unlock()
+	if ok {
+		return st, nil
+	}
+	fi, err := fs.client.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if st, ok := fs.stats[name]; ok {
+		return st, nil
+	}
+	st = &sftpStat{size: fi.Size(), rt: fi.ModTime(), wt: fi.ModTime()}
+	fs.stats[name] = st
+	return st, nil
+}
+
+// Stat returns the FileInfo of name, from the local stat once it is known.
+func (fs *SFTPFS) Stat(name string) (FileInfo, error) {
+	st, err := fs.stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return FileInfo{
+		FileInfo: &fileInfo{
+			name: path.Base(name),
+			size: st.size,
+			wt:   st.wt,
+		},
+		Atime: st.rt,
+	}, nil
+}
+
+// Remove removes name and its key file from the remote host.
+func (fs *SFTPFS) Remove(name string) error {
+	fs.mu.Lock()
+	delete(fs.stats, name)
+	fs.mu.Unlock()
+	_ = fs.client.Remove(name + ".key")
+	return fs.client.Remove(name)
+}
+
+// Reload returns the Files in the remote directory, keeping the newest File of
+// keys which have several.
+func (fs *SFTPFS) Reload(add func(key, name string)) error {
+	files, err := fs.client.ReadDir(fs.root)
+	if err != nil {
+		return err
+	}
+
+	newest := make(map[string]os.FileInfo)
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".key") {
+			continue
+		}
+		name := path.Join(fs.root, f.Name())
+		key, err := fs.key(f.Name())
+		if err != nil {
+			_ = fs.Remove(name)
+			continue
+		}
+		if fi, ok := newest[key]; ok {
+			if !fi.ModTime().Before(f.ModTime()) {
+				_ = fs.Remove(name)
+				continue
+			}
+			_ = fs.Remove(path.Join(fs.root, fi.Name()))
+		}
+		newest[key] = f
+	}
+
+	for key, f := range newest {
+		name := path.Join(fs.root, f.Name())
+		fs.mu.Lock()
+		fs.stats[name] = &sftpStat{size: f.Size(), rt: f.ModTime(), wt: f.ModTime()}
+		fs.mu.Unlock()
+		add(key, name)
+	}
+	return nil
+}
+
+// key returns the key of the File named base in the remote directory.
+func (fs *SFTPFS) key(base string) (string, error) {
+	if key, ok := B32DecodeKey(base); ok {
+		return key, nil
+	}
+	f, err := fs.client.OpenFile(path.Join(fs.root, base+".key"), os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
+}
+
+// RemoveAll removes every File from the remote directory.
+func (fs *SFTPFS) RemoveAll() error {
+	files, err := fs.client.ReadDir(fs.root)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	fs.stats = make(map[string]*sftpStat)
+	fs.mu.Unlock()
+	var err1 error
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err2 := fs.client.Remove(path.Join(fs.root, f.Name())); err2 != nil && err1 == nil {
+			err1 = err2
+		}
+	}
+	return err1
+}
@@ -0,0 +1,152 @@
+package fscache
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// Op is the kind of operation an Access records.
+type Op string
+
+// Ops recorded in an access trace.
+const (
+	// OpGet is a Get of the key, an empty Op is treated the same way.
+	OpGet Op = "get"
+
+	// OpWrite is the end of a fill, Size is the final size of the entry.
+	OpWrite Op = "write"
+
+	// OpRemove is an explicit Remove of the key.
+	OpRemove Op = "remove"
+)
+
+// Access is a single operation on a key in an access trace.
+type Access struct {
+	Key  string    `json:"key"`
+	Op   Op        `json:"op,omitempty"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// SimulationResult summarizes the replay of an access trace.
+type SimulationResult struct {
+	Hits         int
+	Misses       int
+	Evictions    int
+	BytesEvicted int64
+}
+
+// HitRatio returns the fraction of accesses which were hits.
+func (r SimulationResult) HitRatio() float64 {
+	if total := r.Hits + r.Misses; total > 0 {
+		return float64(r.Hits) / float64(total)
+	}
+	return 0
+}
+
+// Simulate replays trace against h as if every OpGet was a Get on a cache
+// using h, and every miss was filled with Access.Size bytes (or the size of the
+// OpWrite which follows it).
+// Like a cache, h is run before the first access and then every h.Next()
+// of trace time. Entries are never in use, and the times h sees are shifted so that
+// the trace's current time is time.Now(), so Reapers behave as they would live.
+func Simulate(trace []Access, h Haunter) SimulationResult {
+	sim := &simAccessor{entries: make(map[string]*simEntry)}
+	if len(trace) == 0 {
+		return sim.result
+	}
+
+	next := trace[0].Time
+	for _, a := range trace {
+		for !a.Time.Before(next) {
+			sim.haunt(h, next)
+			period := h.Next()
+			if period <= 0 {
+				next = time.Unix(1<<62, 0)
+				break
+			}
+			next = next.Add(period)
+		}
+		sim.access(a)
+	}
+	return sim.result
+}
+
+type simEntry struct {
+	size   int64
+	rt, wt time.Time
+}
+
+type simAccessor struct {
+	entries map[string]*simEntry
+	shift   time.Duration
+	result  SimulationResult
+}
+
+func (s *simAccessor) haunt(h Haunter, now time.Time) {
+	s.shift = time.Since(now)
+	h.Haunt(s)
+}
+
+func (s *simAccessor) access(a Access) {
+	switch a.Op {
+	case OpWrite:
+		if e, ok := s.entries[a.Key]; ok {
+			e.size = a.Size
+			e.wt = a.Time
+		}
+		return
+
+	case OpRemove:
+		delete(s.entries, a.Key)
+		return
+	}
+
+	if e, ok := s.entries[a.Key]; ok {
+		s.result.Hits++
+		e.rt = a.Time
+		return
+	}
+	s.result.Misses++
+	s.entries[a.Key] = &simEntry{size: a.Size, rt: a.Time, wt: a.Time}
+}
+
+func (s *simAccessor) Stat(name string) (FileInfo, error) {
+	e, ok := s.entries[name]
+	if !ok {
+		return FileInfo{}, errors.New("file does not exist")
+	}
+	return FileInfo{
+		FileInfo: &fileInfo{
+			name:     name,
+			size:     e.size,
+			fileMode: os.ModeIrregular,
+			wt:       e.wt.Add(s.shift),
+		},
+		Atime: e.rt.Add(s.shift),
+	}, nil
+}
+
+// EnumerateEntries visits keys in sorted order so that replays are deterministic.
+func (s *simAccessor) EnumerateEntries(enumerator func(key string, e Entry) bool) {
+	keys := make([]string, 0, len(s.entries))
+	for k := range s.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !enumerator(k, Entry{name: k}) {
+			break
+		}
+	}
+}
+
+func (s *simAccessor) RemoveFile(key string) {
+	if e, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.result.Evictions++
+		s.result.BytesEvicted += e.size
+	}
+}
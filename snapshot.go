@@ -0,0 +1,144 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ManifestEntry describes an entry of a cache, see FSCache.Manifest.
+type ManifestEntry struct {
+	Key    string        `json:"key"`
+	Size   int64         `json:"size"`
+	Digest string        `json:"digest"` // the hex encoded sha256 of the entry's data
+	Age    time.Duration `json:"age"`    // since the entry was last written
+}
+
+// Manifester implementers can list the entries they hold, e.g. the nodes of a cluster.
+type Manifester interface {
+	Manifest() ([]ManifestEntry, error)
+}
+
+// Manifest lists the cache's complete entries, sorted by key. Each entry is read to
+// compute its digest. Keys are listed as the cache tracks them, see SetKeyMapper.
+func (c *FSCache) Manifest() ([]ManifestEntry, error) {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.files))
+	for k := range c.files {
+		keys = append(keys, k)
+	}
+	c.mu.RUnlock()
+	sort.Strings(keys)
+
+	entries := make([]ManifestEntry, 0, len(keys))
+	for _, key := range keys {
+		e, ok, err := c.manifestEntry(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (c *FSCache) manifestEntry(key string) (ManifestEntry, bool, error) {
+	c.mu.RLock()
+	f, ok := c.files[key]
+	if !ok || !f.complete() {
+		c.mu.RUnlock()
+		return ManifestEntry{}, false, nil
+	}
+	r, err := f.next()
+	c.mu.RUnlock()
+	if err != nil {
+		// removed since the keys were listed.
+		return ManifestEntry{}, false, nil
+	}
+	defer r.Close()
+
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return ManifestEntry{}, false, nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return ManifestEntry{}, false, err
+	}
+	return ManifestEntry{
+		Key:    key,
+		Size:   n,
+		Digest: hex.EncodeToString(h.Sum(nil)),
+		Age:    time.Since(fi.ModTime()),
+	}, true, nil
+}
+
+// Snapshot is the state of the nodes of a cluster, see TakeSnapshot.
+type Snapshot struct {
+	Taken time.Time                  `json:"taken"`
+	Nodes map[string][]ManifestEntry `json:"nodes"` // node => its entries
+
+	// Divergent holds the keys which nodes hold with different data, by key and then
+	// node, with the digest each node holds.
+	Divergent map[string]map[string]string `json:"divergent"`
+}
+
+// TakeSnapshot collects the manifests of nodes, by name, at the same time, for auditing
+// what a cluster holds and finding replicas which diverged. A node whose manifest can't
+// be collected is left out, and the first such error is returned with the snapshot.
+func TakeSnapshot(nodes map[string]Manifester) (*Snapshot, error) {
+	s := &Snapshot{
+		Taken:     time.Now(),
+		Nodes:     make(map[string][]ManifestEntry, len(nodes)),
+		Divergent: make(map[string]map[string]string),
+	}
+	var (
+		grp  sync.WaitGroup
+		mu   sync.Mutex
+		err1 error
+	)
+	for name, node := range nodes {
+		grp.Add(1)
+		go func(name string, node Manifester) {
+			defer grp.Done()
+			entries, err := node.Manifest()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if err1 == nil {
+					err1 = err
+				}
+				return
+			}
+			s.Nodes[name] = entries
+		}(name, node)
+	}
+	grp.Wait()
+
+	digests := make(map[string]map[string]string) // key => node => digest
+	for name, entries := range s.Nodes {
+		for _, e := range entries {
+			if digests[e.Key] == nil {
+				digests[e.Key] = make(map[string]string)
+			}
+			digests[e.Key][name] = e.Digest
+		}
+	}
+	for key, byNode := range digests {
+		var first string
+		for _, digest := range byNode {
+			if first == "" {
+				first = digest
+			} else if digest != first {
+				s.Divergent[key] = byNode
+				break
+			}
+		}
+	}
+	return s, err1
+}
@@ -0,0 +1,89 @@
+package fscache
+
+// softLimits tracks the cache's entries and bytes against the limits of SetSoftLimits.
+type softLimits struct {
+	maxItems int
+	maxSize  int64
+
+	entries int
+	bytes   int64
+	sizes   map[string]int64 // key => the bytes counted for it
+	over    bool
+}
+
+func (s *softLimits) exceeded() (items, size bool) {
+	return s.maxItems > 0 && s.entries > s.maxItems, s.maxSize > 0 && s.bytes > s.maxSize
+}
+
+// SetSoftLimits makes the cache send an EventOverSoftLimit when it grows past maxItems
+// entries or maxSize bytes, and an EventUnderSoftLimit once it is back within both, without
+// evicting anything. Set them under the Haunter's limits, e.g. at 80% of NewLRUHaunter's
+// maxSize, to be warned before eviction starts to cost hits. Entries count while they are
+// written, and bytes once they are complete. A zero limit is ignored, and zero for both stops
+// tracking. If the cache is already past a limit, an EventOverSoftLimit is sent with no Key.
+func (c *FSCache) SetSoftLimits(maxItems int, maxSize int64) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxItems <= 0 && maxSize <= 0 {
+		c.soft = nil
+		return c
+	}
+	c.soft = &softLimits{
+		maxItems: maxItems,
+		maxSize:  maxSize,
+		sizes:    make(map[string]int64),
+	}
+	for key, f := range c.files {
+		c.soft.entries++
+		if f.complete() {
+			c.soft.sizes[key] = c.entrySize(f)
+			c.soft.bytes += c.soft.sizes[key]
+		}
+	}
+	c.checkSoftLimits("")
+	return c
+}
+
+// OverSoftLimit reports whether the cache is past the maxItems and maxSize of SetSoftLimits.
+func (c *FSCache) OverSoftLimit() (items, size bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.soft == nil {
+		return false, false
+	}
+	return c.soft.exceeded()
+}
+
+// softAdd, softRemove and softSetSize keep the soft limits up to date. c.mu must be held.
+func (c *FSCache) softAdd(key string) {
+	c.soft.entries++
+	c.soft.sizes[key] = 0
+	c.checkSoftLimits(key)
+}
+
+func (c *FSCache) softRemove(key string) {
+	c.soft.entries--
+	c.soft.bytes -= c.soft.sizes[key]
+	delete(c.soft.sizes, key)
+	c.checkSoftLimits(key)
+}
+
+func (c *FSCache) softSetSize(key string, size int64) {
+	c.soft.bytes += size - c.soft.sizes[key]
+	c.soft.sizes[key] = size
+	c.checkSoftLimits(key)
+}
+
+// checkSoftLimits sends an event if the change to key took the cache across its soft
+// limits. c.mu must be held.
+func (c *FSCache) checkSoftLimits(key string) {
+	items, size := c.soft.exceeded()
+	if over := items || size; over != c.soft.over {
+		c.soft.over = over
+		typ := EventUnderSoftLimit
+		if over {
+			typ = EventOverSoftLimit
+		}
+		c.send(Event{Type: typ, Key: key, Size: c.soft.bytes})
+	}
+}
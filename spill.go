@@ -0,0 +1,263 @@
+package fscache
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/djherbis/stream"
+)
+
+// SpillFS is a FileSystem which writes Files to memory, and moves the least recently
+// read ones to disk once more than its memory budget is in use. Files keep their names
+// when they move, so a cache using it sees a single FileSystem with the speed of memory
+// for its hot entries and the capacity of disk for the rest. Only Files whose writers have
+// closed are moved, and their open readers are unaffected.
+// Reload returns the Files on disk, so spilled entries survive a restart.
+type SpillFS struct {
+	mem, disk FileSystem
+	maxMemory int64
+
+	mu    sync.Mutex
+	files map[string]*spillFile
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// spillFile is where the data of a SpillFS File currently is.
+type spillFile struct {
+	name     string // the File.Name() of the mem File, or the disk File if it was reloaded
+	diskName string // set once the File is on disk
+	done     bool   // the writer has been closed
+}
+
+// NewSpillFs returns a SpillFS which keeps up to maxMemory bytes of Files in mem, and moves
+// the rest to disk every period. Close stops the periodic spilling.
+func NewSpillFs(mem, disk FileSystem, maxMemory int64, period time.Duration) *SpillFS {
+	fs := &SpillFS{
+		mem:       mem,
+		disk:      disk,
+		maxMemory: maxMemory,
+		files:     make(map[string]*spillFile),
+		stop:      make(chan struct{}),
+	}
+	if period > 0 {
+		go fs.spillEvery(period)
+	}
+	return fs
+}
+
+// Close stops the periodic spilling.
+func (fs *SpillFS) Close() error {
+	fs.once.Do(func() { close(fs.stop) })
+	return nil
+}
+
+func (fs *SpillFS) spillEvery(period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-fs.stop:
+			return
+		case <-t.C:
+			_ = fs.Spill()
+		}
+	}
+}
+
+// MemoryUsage returns the number of bytes of Files held in memory.
+func (fs *SpillFS) MemoryUsage() int64 {
+	var total int64
+	for _, c := range fs.inMemory() {
+		total += c.size
+	}
+	return total
+}
+
+type spillCandidate struct {
+	f     *spillFile
+	size  int64
+	atime time.Time
+	done  bool
+}
+
+// inMemory returns the Files in memory.
+func (fs *SpillFS) inMemory() []spillCandidate {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var files []spillCandidate
+	for _, f := range fs.files {
+		if f.diskName != "" {
+			continue
+		}
+		fi, err := fs.mem.Stat(f.name)
+		if err != nil {
+			continue
+		}
+		files = append(files, spillCandidate{f: f, size: fi.Size(), atime: fi.AccessTime(), done: f.done})
+	}
+	return files
+}
+
+// Spill moves the least recently read Files to disk until no more than the memory budget
+// is in use, or only Files which are still being written are left in memory.
+func (fs *SpillFS) Spill() error {
+	files := fs.inMemory()
+	var used int64
+	for _, c := range files {
+		used += c.size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].atime.Before(files[j].atime) })
+
+	var err error
+	for _, c := range files {
+		if used <= fs.maxMemory {
+			break
+		}
+		if !c.done {
+			continue
+		}
+		if err2 := fs.move(c.f); err2 != nil {
+			if err == nil {
+				err = err2
+			}
+			continue
+		}
+		used -= c.size
+	}
+	return err
+}
+
+// move copies f to disk, then removes it from memory.
+func (fs *SpillFS) move(f *spillFile) error {
+	r, err := fs.mem.Open(f.name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := fs.disk.Create(f.name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = fs.disk.Remove(w.Name())
+		return err
+	}
+
+	fs.mu.Lock()
+	if fs.files[f.name] != f {
+		// removed while it was copied
+		fs.mu.Unlock()
+		return fs.disk.Remove(w.Name())
+	}
+	f.diskName = w.Name()
+	fs.mu.Unlock()
+	return fs.mem.Remove(f.name)
+}
+
+// Create creates a File in memory.
+func (fs *SpillFS) Create(name string) (stream.File, error) {
+	file, err := fs.mem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &spillFile{name: file.Name()}
+	fs.mu.Lock()
+	old := fs.files[f.name]
+	fs.files[f.name] = f
+	fs.mu.Unlock()
+	if old != nil && old.diskName != "" {
+		_ = fs.disk.Remove(old.diskName)
+	}
+	return &spillWriter{File: file, fs: fs, f: f}, nil
+}
+
+// spillWriter marks its File as movable once it is closed.
+type spillWriter struct {
+	stream.File
+	fs *SpillFS
+	f  *spillFile
+}
+
+func (w *spillWriter) Close() error {
+	err := w.File.Close()
+	w.fs.mu.Lock()
+	w.f.done = true
+	w.fs.mu.Unlock()
+	return err
+}
+
+// location returns the FileSystem and name which hold the File name.
+func (fs *SpillFS) location(name string) (FileSystem, string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, "", errors.New("file does not exist")
+	}
+	if f.diskName != "" {
+		return fs.disk, f.diskName, nil
+	}
+	return fs.mem, f.name, nil
+}
+
+// Open opens the File name wherever it is.
+func (fs *SpillFS) Open(name string) (stream.File, error) {
+	sub, subName, err := fs.location(name)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Open(subName)
+}
+
+// Stat returns the FileInfo of the File name wherever it is.
+func (fs *SpillFS) Stat(name string) (FileInfo, error) {
+	sub, subName, err := fs.location(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return sub.Stat(subName)
+}
+
+// Remove deletes the File name wherever it is.
+func (fs *SpillFS) Remove(name string) error {
+	fs.mu.Lock()
+	f, ok := fs.files[name]
+	delete(fs.files, name)
+	fs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if f.diskName != "" {
+		return fs.disk.Remove(f.diskName)
+	}
+	return fs.mem.Remove(f.name)
+}
+
+// Reload returns the Files on disk.
+func (fs *SpillFS) Reload(add func(key, name string)) error {
+	return fs.disk.Reload(func(key, name string) {
+		fs.mu.Lock()
+		fs.files[key] = &spillFile{name: key, diskName: name, done: true}
+		fs.mu.Unlock()
+		add(key, key)
+	})
+}
+
+// RemoveAll deletes every File in memory and on disk.
+func (fs *SpillFS) RemoveAll() error {
+	fs.mu.Lock()
+	fs.files = make(map[string]*spillFile)
+	fs.mu.Unlock()
+	if err := fs.mem.RemoveAll(); err != nil {
+		return err
+	}
+	return fs.disk.RemoveAll()
+}
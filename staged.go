@@ -0,0 +1,75 @@
+package fscache
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/djherbis/stream"
+)
+
+// ErrUnsupported is returned when the Cache's FileSystem does not support an operation.
+var ErrUnsupported = errors.New("operation not supported by FileSystem")
+
+// stagedPrefix is the key prefix of files which are being written outside of the
+// cache's index. Any such files found by Reload were abandoned and are removed.
+const stagedPrefix = "\x00fscache-staged-"
+
+// stagedFile is written outside of the cache's index, and then renamed into
+// place under its final key once it is complete.
+type stagedFile struct {
+	fs   FileSystem
+	file stream.File
+}
+
+func (c *FSCache) newStaged() (*stagedFile, error) {
+	if _, ok := c.fs.(FileSystemRenamer); !ok {
+		return nil, ErrUnsupported
+	}
+	key, err := c.stagedKey()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.markSeen(key)
+	c.mu.Unlock()
+	f, err := c.fs.Create(key)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{fs: c.fs, file: f}, nil
+}
+
+// stagedKey returns a new random key for a file outside of the cache's index.
+func (c *FSCache) stagedKey() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x", stagedPrefix, id), nil
+}
+
+func (s *stagedFile) Write(p []byte) (int, error) {
+	return s.file.Write(p)
+}
+
+// commit closes the staged file and moves it to key, it returns the name of
+// the file which should be indexed under key.
+func (s *stagedFile) commit(key string) (string, error) {
+	if err := s.file.Close(); err != nil {
+		s.abort()
+		return "", err
+	}
+	name, err := s.fs.(FileSystemRenamer).Rename(s.file.Name(), key)
+	if err != nil {
+		s.abort()
+		return "", err
+	}
+	return name, nil
+}
+
+// abort closes and removes the staged file.
+func (s *stagedFile) abort() {
+	_ = s.file.Close()
+	_ = s.fs.Remove(s.file.Name())
+}
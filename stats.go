@@ -0,0 +1,78 @@
+package fscache
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of a cache's contents and usage.
+type Stats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`   // total size of the entries, see TotalSize
+	Hits    int64 `json:"hits"`   // Gets which found an entry, since the cache was created
+	Misses  int64 `json:"misses"` // Gets which created an entry
+}
+
+// HitRatio returns the fraction of Gets which were hits.
+func (s Stats) HitRatio() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+// Stats returns the cache's current Stats.
+func (c *FSCache) Stats() Stats {
+	return c.stats(c.entrySizes(everyKey, 0))
+}
+
+// stats returns the Stats of a cache whose entries are those of entrySizes.
+func (c *FSCache) stats(entries []entrySize) Stats {
+	s := Stats{
+		Entries: len(entries),
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+	}
+	for _, e := range entries {
+		s.Size += e.Size
+	}
+	return s
+}
+
+func everyKey(string) bool { return true }
+
+// entrySize is a key and the size of its entry.
+type entrySize struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// entrySizes returns the first limit entries whose keys match, sorted by key, with their
+// sizes. A limit <= 0 returns every match. Only the matching keys and their files' names are
+// read under c.mu, so that a large cache doesn't hold up Gets while its entries are stat'd.
+func (c *FSCache) entrySizes(match func(key string) bool, limit int) []entrySize {
+	names := make(map[string]string)
+	var keys []string
+	c.mu.RLock()
+	for key, f := range c.files {
+		if match(key) {
+			keys = append(keys, key)
+			names[key] = f.Name()
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	entries := make([]entrySize, 0, len(keys))
+	for _, key := range keys {
+		var size int64
+		if fi, err := c.fs.Stat(names[key]); err == nil {
+			size = fi.Size()
+		}
+		entries = append(entries, entrySize{Key: key, Size: size})
+	}
+	return entries
+}
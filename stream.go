@@ -1,72 +1,31 @@
 package fscache
 
 import (
-	"encoding/json"
 	"errors"
 	"io"
-)
-
-type decoder interface {
-	Decode(interface{}) error
-}
+	"time"
 
-type encoder interface {
-	Encode(interface{}) error
-}
+	"github.com/djherbis/fscache/protocol"
+)
 
 type pktReader struct {
-	dec decoder
+	io.ReadCloser
 }
 
-type pktWriter struct {
-	enc encoder
-}
-
-type packet struct {
-	Err  int
-	Data []byte
-}
-
-const eof = 1
-
 func (t *pktReader) ReadAt(p []byte, off int64) (n int, err error) {
 	// TODO not implemented
 	return 0, errors.New("not implemented")
 }
 
-func (t *pktReader) Read(p []byte) (int, error) {
-	var pkt packet
-	err := t.dec.Decode(&pkt)
-	if err != nil {
-		return 0, err
+// newEncoder returns the encoder of entry data sent to w, which sends each Write as a
+// Packet unless chunkSize is set, see protocol.NewChunkEncoder.
+func newEncoder(w io.Writer, chunkSize int, flushInterval time.Duration) io.WriteCloser {
+	if chunkSize <= 0 {
+		return protocol.NewEncoder(w)
 	}
-	if pkt.Err == eof {
-		return 0, io.EOF
-	}
-	return copy(p, pkt.Data), nil
-}
-
-func (t *pktReader) Close() error {
-	return nil
-}
-
-func (t *pktWriter) Write(p []byte) (int, error) {
-	pkt := packet{Data: p}
-	err := t.enc.Encode(pkt)
-	if err != nil {
-		return 0, err
-	}
-	return len(p), nil
-}
-
-func (t *pktWriter) Close() error {
-	return t.enc.Encode(packet{Err: eof})
-}
-
-func newEncoder(w io.Writer) io.WriteCloser {
-	return &pktWriter{enc: json.NewEncoder(w)}
+	return protocol.NewChunkEncoder(w, chunkSize, flushInterval)
 }
 
 func newDecoder(r io.Reader) ReadAtCloser {
-	return &pktReader{dec: json.NewDecoder(r)}
+	return &pktReader{protocol.NewDecoder(r)}
 }
@@ -0,0 +1,10 @@
+// Package stress holds randomized concurrency tests for fscache.
+//
+// The tests interleave Get, Remove, Clean and haunting across many goroutines
+// and verify every completed read byte-for-byte. They are meant to be run under
+// the race detector:
+//
+//	go test -race ./stress -seed=1234 -rounds=50
+//
+// A failing run logs its seed so the schedule can be replayed.
+package stress
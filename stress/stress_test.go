@@ -0,0 +1,150 @@
+package stress
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/djherbis/fscache"
+)
+
+var (
+	seed   = flag.Int64("seed", 0, "seed for the random schedules, 0 picks one from the clock")
+	rounds = flag.Int("rounds", 5, "number of schedules to run per cache")
+)
+
+const (
+	workers = 8
+	ops     = 200
+	keys    = 6
+)
+
+func TestStress(t *testing.T) {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", s)
+
+	for i := 0; i < *rounds; i++ {
+		round := s + int64(i)
+
+		t.Run(fmt.Sprintf("memfs/%d", round), func(t *testing.T) {
+			c, err := fscache.NewCacheWithHaunter(fscache.NewMemFs(), haunter())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			run(t, c, round)
+		})
+
+		t.Run(fmt.Sprintf("stdfs/%d", round), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fscache-stress")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fs, err := fscache.NewFs(dir, 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := fscache.NewCacheWithHaunter(fs, haunter())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			run(t, c, round)
+		})
+	}
+}
+
+func haunter() fscache.Haunter {
+	return fscache.NewLRUHaunterStrategy(fscache.NewLRUHaunter(keys/2, 0, time.Millisecond))
+}
+
+func run(t *testing.T, c *fscache.FSCache, seed int64) {
+	var grp sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		grp.Add(1)
+		go func(rnd *rand.Rand) {
+			defer grp.Done()
+			for j := 0; j < ops; j++ {
+				key := fmt.Sprintf("key-%d", rnd.Intn(keys))
+				switch n := rnd.Intn(100); {
+				case n < 80:
+					get(t, c, key, rnd)
+				case n < 98:
+					c.Remove(key)
+				default:
+					c.Clean()
+				}
+			}
+		}(rand.New(rand.NewSource(seed + int64(i))))
+	}
+	grp.Wait()
+}
+
+// get reads key, filling it if this is a miss. Every fill writes a nonce followed
+// by a body derived from the key and the nonce, so a reader can detect data
+// from different fills being mixed together.
+func get(t *testing.T, c *fscache.FSCache, key string, rnd *rand.Rand) {
+	r, w, err := c.Get(key)
+	if err != nil {
+		return
+	}
+
+	if w != nil {
+		go func(nonce int64, chunks []int) {
+			defer w.Close()
+			data := content(key, nonce)
+			for _, n := range chunks {
+				if n > len(data) {
+					n = len(data)
+				}
+				if _, err := w.Write(data[:n]); err != nil {
+					return
+				}
+				data = data[n:]
+				runtime.Gosched()
+			}
+			w.Write(data)
+		}(rnd.Int63(), []int{rnd.Intn(32), rnd.Intn(64), rnd.Intn(128)})
+	}
+
+	buf := bytes.NewBuffer(nil)
+	_, err = io.Copy(buf, r)
+	r.Close()
+	if err != nil {
+		return
+	}
+	verify(t, key, buf.Bytes())
+}
+
+func content(key string, nonce int64) []byte {
+	buf := bytes.NewBufferString(fmt.Sprintf("%d\n", nonce))
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/%d", key, nonce)))
+	for i := 0; i < 16; i++ {
+		buf.Write(sum[:])
+	}
+	return buf.Bytes()
+}
+
+func verify(t *testing.T, key string, data []byte) {
+	var nonce int64
+	if _, err := fmt.Sscanf(string(data), "%d\n", &nonce); err != nil {
+		t.Errorf("%s: unreadable nonce in %q", key, data)
+		return
+	}
+	if want := content(key, nonce); !bytes.Equal(data, want) {
+		t.Errorf("%s: read %d bytes which don't match the fill they started with", key, len(data))
+	}
+}
@@ -0,0 +1,61 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+)
+
+// SetWriteTee makes every fill of the cache also stream its data to the WriteCloser tee
+// returns for the fill's key, e.g. to back entries up or feed an analytics pipeline, without
+// wrapping each writer. tee is called when the fill first writes, so empty fills aren't
+// teed, and if it returns nil the fill isn't either. The sink is closed when the fill's
+// writer is, or aborted if it is an Aborter and the fill is aborted. A sink which fails to
+// write is closed, and the fill carries on without it. Pass nil to stop teeing new fills.
+func (c *FSCache) SetWriteTee(tee func(key string) io.WriteCloser) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tee = tee
+	return c
+}
+
+// teeSink is the sink a fill is teed to, see SetWriteTee.
+type teeSink struct {
+	fn  func(key string) io.WriteCloser
+	key string
+
+	mu     sync.Mutex
+	opened bool
+	w      io.WriteCloser // nil once closed or failed
+}
+
+func (t *teeSink) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.opened {
+		t.opened = true
+		t.w = t.fn(t.key)
+	}
+	if t.w == nil {
+		return
+	}
+	if _, err := t.w.Write(p); err != nil {
+		t.w.Close()
+		t.w = nil
+	}
+}
+
+// close closes the sink, aborting it instead if aborted and it is an Aborter.
+func (t *teeSink) close(aborted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.opened = true
+	if t.w == nil {
+		return
+	}
+	if a, ok := t.w.(Aborter); ok && aborted {
+		a.Abort()
+	} else {
+		t.w.Close()
+	}
+	t.w = nil
+}
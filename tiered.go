@@ -0,0 +1,245 @@
+package fscache
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/djherbis/fscache/protocol"
+)
+
+// Tiered is a Cache which keeps a local copy of the entries of a remote Cache, see NewTiered.
+type Tiered struct {
+	local  *FSCache
+	remote Cache
+	raddr  string
+	retry  time.Duration
+	fills  *AdaptiveLimiter
+
+	mu     sync.Mutex
+	down   time.Time // the remote is not used until this time
+	conn   net.Conn  // the invalidation subscription
+	closed bool
+	done   chan struct{}
+}
+
+// TieredOption configures a Tiered cache.
+type TieredOption func(*tieredConfig)
+
+type tieredConfig struct {
+	perm    os.FileMode
+	haunter Haunter
+	retry   time.Duration
+	fills   *AdaptiveLimiter
+}
+
+// TieredPerm sets the permissions of the local cache directory, 0700 by default.
+func TieredPerm(perm os.FileMode) TieredOption {
+	return func(c *tieredConfig) { c.perm = perm }
+}
+
+// TieredHaunter sets the Haunter of the local cache, by default local entries never expire.
+func TieredHaunter(h Haunter) TieredOption {
+	return func(c *tieredConfig) { c.haunter = h }
+}
+
+// TieredRetry sets how long the remote is skipped after it fails, 5s by default.
+// It is also the delay between attempts to reconnect the invalidation subscription.
+func TieredRetry(d time.Duration) TieredOption {
+	return func(c *tieredConfig) { c.retry = d }
+}
+
+// TieredFillLimiter limits the copies of remote entries into the local tier with l, an entry
+// which can't be copied is read from the remote. By default every remote hit is copied.
+func TieredFillLimiter(l *AdaptiveLimiter) TieredOption {
+	return func(c *tieredConfig) { c.fills = l }
+}
+
+// NewTiered returns a Cache which stores entries in localDir and shares them with the
+// Cache served at remoteAddr by ListenAndServe.
+// Gets are served locally when possible. On a local miss the entry is fetched from the
+// remote, or filled by the caller and written to both. If the remote fails, the Tiered cache
+// carries on with its local copy alone, and retries the remote once TieredRetry has passed.
+// Keys removed at the remote, by any of its clients, are removed locally too. The local copy
+// is emptied when NewTiered starts, and after losing the connection to the remote, since
+// invalidations may have been missed meanwhile. Each process needs its own localDir.
+// Close stops the subscription.
+func NewTiered(localDir, remoteAddr string, opts ...TieredOption) (*Tiered, error) {
+	cfg := tieredConfig{perm: 0700, retry: 5 * time.Second}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	fs, err := NewFs(localDir, cfg.perm)
+	if err != nil {
+		return nil, err
+	}
+	// entries left by an earlier run may have been invalidated since.
+	if err := fs.RemoveAll(); err != nil {
+		return nil, err
+	}
+	local, err := NewCacheWithHaunter(fs, cfg.haunter)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tiered{
+		local:  local,
+		remote: NewRemote(remoteAddr),
+		raddr:  remoteAddr,
+		retry:  cfg.retry,
+		fills:  cfg.fills,
+		done:   make(chan struct{}),
+	}
+	go t.subscribe()
+	return t, nil
+}
+
+// Local returns the local tier.
+func (t *Tiered) Local() *FSCache {
+	return t.local
+}
+
+// Get returns the local entry for key, fetching it from the remote on a miss.
+func (t *Tiered) Get(key string) (ReadAtCloser, io.WriteCloser, error) {
+	r, w, err := t.local.Get(key)
+	if err != nil || w == nil {
+		return r, w, err
+	}
+	if !t.healthy() {
+		return r, w, nil
+	}
+
+	rr, rw, err := t.remote.Get(key)
+	if err != nil {
+		t.failed()
+		return r, w, nil
+	}
+
+	// miss in both, the caller fills them together.
+	if rw != nil {
+		rr.Close()
+		return r, multiWC(w, rw), nil
+	}
+
+	if t.fills != nil && !t.fills.Acquire() {
+		r.Close()
+		abandonFill(t.local, key, w)
+		return rr, nil, nil
+	}
+	go func() {
+		start := time.Now()
+		defer rr.Close()
+		defer w.Close()
+		_, err := io.Copy(w, rr)
+		if err != nil {
+			if a, ok := w.(Aborter); ok {
+				a.Abort()
+			}
+		}
+		if t.fills != nil {
+			t.fills.Release(time.Since(start), err)
+		}
+	}()
+	return r, nil, nil
+}
+
+// Remove removes key from both tiers, and from the other clients of the remote.
+func (t *Tiered) Remove(key string) error {
+	if t.healthy() {
+		if err := t.remote.Remove(key); err != nil {
+			t.failed()
+		}
+	}
+	return t.local.Remove(key)
+}
+
+// Exists returns if key is in either tier.
+func (t *Tiered) Exists(key string) bool {
+	return t.local.Exists(key) || t.healthy() && t.remote.Exists(key)
+}
+
+// Clean empties both tiers.
+func (t *Tiered) Clean() error {
+	if t.healthy() {
+		if err := t.remote.Clean(); err != nil {
+			t.failed()
+		}
+	}
+	return t.local.Clean()
+}
+
+// Close stops the invalidation subscription and closes the local tier.
+func (t *Tiered) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}
+	t.mu.Unlock()
+	return t.local.Close()
+}
+
+func (t *Tiered) healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().After(t.down)
+}
+
+func (t *Tiered) failed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down = time.Now().Add(t.retry)
+}
+
+// subscribe removes the keys invalidated at the remote from the local tier, reconnecting until Close.
+func (t *Tiered) subscribe() {
+	lost := false
+	for {
+		if conn, err := net.Dial("tcp", t.raddr); err == nil {
+			t.mu.Lock()
+			if t.closed {
+				t.mu.Unlock()
+				conn.Close()
+				return
+			}
+			t.conn = conn
+			t.mu.Unlock()
+
+			if protocol.WriteAction(conn, protocol.ActionSubscribe) == nil {
+				if lost {
+					_ = t.local.Clean()
+				}
+				t.invalidations(conn)
+			}
+			conn.Close()
+		}
+		lost = true
+
+		select {
+		case <-t.done:
+			return
+		case <-time.After(t.retry):
+		}
+	}
+}
+
+func (t *Tiered) invalidations(conn net.Conn) {
+	r := protocol.NewInvalidationReader(conn)
+	for {
+		inv, err := r.Next()
+		if err != nil {
+			return
+		}
+		switch inv.Action {
+		case protocol.ActionRemove:
+			// Remove blocks while the entry is being read.
+			go t.local.Remove(inv.Key)
+		case protocol.ActionClean:
+			_ = t.local.Clean()
+		}
+	}
+}
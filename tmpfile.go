@@ -0,0 +1,167 @@
+package fscache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// stagingDir is the subdirectory of a StandardFS where AtomicCreate writes Files, where
+// they can't be made unnamed.
+const stagingDir = ".fscache-tmp"
+
+// tmpFile is a File made by AtomicCreate, which isn't in the cache directory under its name
+// until it is closed: it was created with O_TMPFILE and has no name, or it is in stagingDir.
+type tmpFile struct {
+	*os.File
+	fs     *StandardFS
+	name   string
+	staged bool // the File is in stagingDir, rather than unnamed
+}
+
+func (f *tmpFile) Name() string { return f.name }
+
+// Close moves the file into the cache directory under its name, unless it was removed.
+func (f *tmpFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.pending[f.name] != f {
+		return f.File.Close()
+	}
+	delete(f.fs.pending, f.name)
+	var err error
+	if f.staged {
+		// Windows can't rename open files.
+		err = f.File.Close()
+		if err == nil {
+			err = os.Rename(f.File.Name(), f.name)
+		}
+		if err != nil {
+			os.Remove(f.File.Name())
+		}
+	} else {
+		os.Remove(f.name)
+		err = linkTmpFile(f.File, f.name)
+		if cerr := f.File.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = f.fs.syncDir()
+	}
+	return err
+}
+
+// discard closes the file, which is never moved into place.
+func (f *tmpFile) discard() {
+	f.File.Close()
+	if f.staged {
+		os.Remove(f.File.Name())
+	}
+}
+
+// createTmp creates a tmpFile for name. Where the platform or filesystem can't make
+// unnamed files it is created in stagingDir instead, except on Windows, where it fails.
+func (fs *StandardFS) createTmp(name string) (*tmpFile, error) {
+	tf := &tmpFile{fs: fs, name: filepath.Join(fs.root, name)}
+	f, err := openTmpFile(fs.root)
+	if err == nil {
+		// readers open the file through /proc until it is linked.
+		if _, err = os.Stat(tmpFilePath(f)); err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		if runtime.GOOS == "windows" {
+			// files in use can't be renamed, so the readers of one would stop it being moved.
+			return nil, err
+		}
+		if f, err = fs.createStaged(); err != nil {
+			return nil, err
+		}
+		tf.staged = true
+	}
+	tf.File = f
+	if err := fs.setPerms(f); err != nil {
+		tf.discard()
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.pending == nil {
+		fs.pending = make(map[string]*tmpFile)
+	}
+	if old, ok := fs.pending[tf.name]; ok {
+		old.discard()
+	}
+	fs.pending[tf.name] = tf
+	return tf, nil
+}
+
+// createStaged creates a new file in stagingDir.
+func (fs *StandardFS) createStaged() (*os.File, error) {
+	dir := filepath.Join(fs.root, stagingDir)
+	f, err := ioutil.TempFile(dir, "entry")
+	if os.IsNotExist(err) {
+		if err = os.Mkdir(dir, 0700); err == nil || os.IsExist(err) {
+			f, err = ioutil.TempFile(dir, "entry")
+		}
+	}
+	return f, err
+}
+
+// withPath calls fn with the os path of a File.Name(), which is the name unless the
+// File is a tmpFile which hasn't been moved into place.
+func (fs *StandardFS) withPath(name string, fn func(path string) error) error {
+	fs.mu.Lock()
+	f, ok := fs.pending[name]
+	if !ok {
+		fs.mu.Unlock()
+		return fn(name)
+	}
+	// the descriptor must stay open while fn uses its path.
+	defer fs.mu.Unlock()
+	if f.staged {
+		return fn(f.File.Name())
+	}
+	return fn(tmpFilePath(f.File))
+}
+
+// dropPending forgets the tmpFile name, if there is one, so it is never moved into place.
+// It returns if there was one.
+func (fs *StandardFS) dropPending(name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.pending[name]
+	if ok {
+		delete(fs.pending, name)
+		f.discard()
+	}
+	return ok
+}
+
+// cleanStaging removes the files left in stagingDir by writers which crashed, and returns their paths.
+func (fs *StandardFS) cleanStaging() []string {
+	dir := filepath.Join(fs.root, stagingDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	inUse := make(map[string]bool)
+	for _, f := range fs.pending {
+		if f.staged {
+			inUse[f.File.Name()] = true
+		}
+	}
+	var removed []string
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+		if !inUse[path] && os.Remove(path) == nil {
+			removed = append(removed, path)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,46 @@
+package fscache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// oTmpFile is O_TMPFILE, which package syscall doesn't define. __O_TMPFILE is the
+// same on every architecture Go supports.
+const oTmpFile = 0x400000 | syscall.O_DIRECTORY
+
+// atSymlinkFollow is AT_SYMLINK_FOLLOW, which package syscall doesn't export.
+const atSymlinkFollow = 0x400
+
+// atFdcwd is AT_FDCWD, a variable since it is negative and passed as a uintptr.
+var atFdcwd = -0x64
+
+// openTmpFile creates an unnamed file in dir.
+func openTmpFile(dir string) (*os.File, error) {
+	return os.OpenFile(dir, os.O_RDWR|oTmpFile, 0600)
+}
+
+// tmpFilePath returns a path which opens the same file as f.
+func tmpFilePath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// linkTmpFile gives the unnamed file f the path name.
+func linkTmpFile(f *os.File, name string) error {
+	oldp, err := syscall.BytePtrFromString(tmpFilePath(f))
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(atFdcwd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(newp)), atSymlinkFollow, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "linkat", Old: tmpFilePath(f), New: name, Err: errno}
+	}
+	return nil
+}
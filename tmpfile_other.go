@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package fscache
+
+import (
+	"errors"
+	"os"
+)
+
+func openTmpFile(dir string) (*os.File, error) {
+	return nil, errors.New("unnamed files are not supported on this platform")
+}
+
+func tmpFilePath(f *os.File) string { return f.Name() }
+
+func linkTmpFile(f *os.File, name string) error {
+	return errors.New("unnamed files are not supported on this platform")
+}
@@ -0,0 +1,81 @@
+package fscache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// TraceRecorder writes an anonymized access trace of a cache, which can be
+// read back with ReadTrace and replayed with Simulate.
+type TraceRecorder struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	fraction float64
+	err      error
+}
+
+// NewTraceRecorder returns a TraceRecorder which writes a JSON encoded Access per line to w.
+// Keys are replaced by their sha1 hash. Only keys whose hash falls within fraction
+// (0 to 1) of the hash space are recorded, so sampled keys keep all their accesses.
+func NewTraceRecorder(w io.Writer, fraction float64) *TraceRecorder {
+	return &TraceRecorder{
+		enc:      json.NewEncoder(w),
+		fraction: fraction,
+	}
+}
+
+func traceKey(key string) []byte {
+	sum := sha1.Sum([]byte(key))
+	return sum[:]
+}
+
+func (t *TraceRecorder) sampled(key string) bool {
+	if t.fraction >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint16(traceKey(key))) < t.fraction*(1<<16)
+}
+
+func (t *TraceRecorder) record(key string, op Op, size int64) {
+	if !t.sampled(key) {
+		return
+	}
+	a := Access{
+		Key:  hex.EncodeToString(traceKey(key)),
+		Op:   op,
+		Size: size,
+		Time: time.Now(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.enc.Encode(a)
+	}
+}
+
+// Err returns the first error encountered writing the trace, recording stops after an error.
+func (t *TraceRecorder) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// ReadTrace reads a trace written by a TraceRecorder.
+func ReadTrace(r io.Reader) (trace []Access, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		var a Access
+		if err := dec.Decode(&a); err == io.EOF {
+			return trace, nil
+		} else if err != nil {
+			return trace, err
+		}
+		trace = append(trace, a)
+	}
+}
@@ -0,0 +1,180 @@
+package fscache
+
+import (
+	"io"
+
+	"github.com/djherbis/stream"
+)
+
+// Txn stages the changes of a transaction, see FSCache.Txn.
+type Txn interface {
+	// Put writes a new entry for key with fill. It isn't visible until the transaction commits.
+	Put(key string, fill func(w io.Writer) error) error
+
+	// Remove removes the entry of key when the transaction commits.
+	Remove(key string)
+}
+
+type txn struct {
+	c         *FSCache
+	puts      map[string]*stagedFile // by mapped key
+	originals map[string]string      // mapped key => key given to Put
+	removes   map[string]bool
+}
+
+// Txn runs fn, and then makes all the entries it Puts, and Removes, visible at once, so
+// that readers never see part of a group of related entries, e.g. a manifest without its
+// blobs. If fn returns an error nothing changes. Commit fails, changing nothing, if one of
+// the keys is immutable, or is being written or removed. If moving a staged entry into
+// place fails, the ones already moved are removed too, so a partial group is never visible.
+// Readers of replaced entries are unaffected. The FileSystem must be a FileSystemRenamer.
+func (c *FSCache) Txn(fn func(tx Txn) error) error {
+	if _, ok := c.fs.(FileSystemRenamer); !ok {
+		return ErrUnsupported
+	}
+	tx := &txn{
+		c:         c,
+		puts:      make(map[string]*stagedFile),
+		originals: make(map[string]string),
+		removes:   make(map[string]bool),
+	}
+	if err := fn(tx); err != nil {
+		tx.abort()
+		return err
+	}
+	return tx.commit()
+}
+
+func (tx *txn) mapKey(key string) string {
+	tx.c.mu.RLock()
+	defer tx.c.mu.RUnlock()
+	return tx.c.mapKey(key)
+}
+
+func (tx *txn) Put(key string, fill func(w io.Writer) error) error {
+	mapped := tx.mapKey(key)
+	s, err := tx.c.newStaged()
+	if err != nil {
+		return err
+	}
+	if err := fill(s); err != nil {
+		s.abort()
+		return err
+	}
+	if old, ok := tx.puts[mapped]; ok {
+		old.abort()
+	}
+	tx.puts[mapped] = s
+	tx.originals[mapped] = key
+	delete(tx.removes, mapped)
+	return nil
+}
+
+func (tx *txn) Remove(key string) {
+	mapped := tx.mapKey(key)
+	if old, ok := tx.puts[mapped]; ok {
+		old.abort()
+		delete(tx.puts, mapped)
+	}
+	tx.removes[mapped] = true
+}
+
+// abort removes the staged entries.
+func (tx *txn) abort() {
+	for _, s := range tx.puts {
+		s.abort()
+	}
+}
+
+// check returns an error if key can't be changed by the transaction. c.mu must be held.
+func (tx *txn) check(key string) error {
+	c := tx.c
+	if c.closed {
+		return ErrClosed
+	}
+	if err := c.checkMutable(key); err != nil {
+		return err
+	}
+	if c.removing[key] > 0 {
+		return stream.ErrRemoving
+	}
+	if f, ok := c.files[key]; ok && !f.complete() {
+		return ErrInProgress
+	}
+	return nil
+}
+
+func (tx *txn) commit() error {
+	c := tx.c
+	c.mu.Lock()
+	for key := range tx.puts {
+		if err := tx.check(key); err != nil {
+			c.mu.Unlock()
+			tx.abort()
+			return err
+		}
+	}
+	for key := range tx.removes {
+		if err := tx.check(key); err != nil {
+			c.mu.Unlock()
+			tx.abort()
+			return err
+		}
+	}
+
+	names := make(map[string]string, len(tx.puts))
+	var err error
+	for key, s := range tx.puts {
+		if err != nil {
+			s.abort()
+			continue
+		}
+		var name string
+		if name, err = s.commit(key); err == nil {
+			names[key] = name
+		}
+	}
+
+	// if a staged entry couldn't be moved, the keys already written are removed instead.
+	removed := make(map[string]fileStream)
+	for key := range tx.removes {
+		if f, ok := c.files[key]; ok && err == nil {
+			removed[key] = f
+			c.emit(EventRemove, key, f)
+			c.unmap(key)
+		}
+	}
+	for key, name := range names {
+		f, existed := c.files[key]
+		if err != nil {
+			if existed {
+				removed[key] = f
+				c.emit(EventRemove, key, f)
+				c.unmap(key)
+			} else {
+				_ = c.fs.Remove(name)
+			}
+			continue
+		}
+		if existed {
+			c.emit(EventRemove, key, nil)
+		}
+		c.deleteFile(key)
+		c.setFile(key, c.oldFile(name))
+		if c.originals != nil {
+			c.originals[key] = tx.originals[key]
+		}
+		c.bump(key)
+		c.emit(EventCreate, key, nil)
+		c.emit(EventWrite, key, c.files[key])
+		c.trace(key, OpWrite, c.files[key])
+	}
+	c.mu.Unlock()
+
+	for key, f := range removed {
+		if err2 := c.finishRemove(key, f); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
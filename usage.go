@@ -0,0 +1,112 @@
+package fscache
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Usage is the consumption of a namespace of a cache, see FSCache.Usage.
+type Usage struct {
+	Entries int   // entries, including those being written
+	Bytes   int64 // bytes of the complete entries
+}
+
+// usageIndex keeps the Usage of every namespace up to date as entries change.
+type usageIndex struct {
+	namespace func(key string) string
+	spaces    map[string]Usage
+	sizes     map[string]int64 // key => the bytes counted for it
+}
+
+func (u *usageIndex) add(key string) {
+	ns := u.namespace(key)
+	s := u.spaces[ns]
+	s.Entries++
+	u.spaces[ns] = s
+	u.sizes[key] = 0
+}
+
+func (u *usageIndex) remove(key string) {
+	ns := u.namespace(key)
+	s := u.spaces[ns]
+	s.Entries--
+	s.Bytes -= u.sizes[key]
+	if s.Entries == 0 {
+		delete(u.spaces, ns)
+	} else {
+		u.spaces[ns] = s
+	}
+	delete(u.sizes, key)
+}
+
+func (u *usageIndex) setSize(key string, size int64) {
+	ns := u.namespace(key)
+	s := u.spaces[ns]
+	s.Bytes += size - u.sizes[key]
+	u.spaces[ns] = s
+	u.sizes[key] = size
+}
+
+// SetUsageNamespaces makes the cache track the Usage of each namespace, as named by
+// namespace for every key, e.g. PrefixNamespace("/") for keys like "tenant/object".
+// It is kept up to date as entries are written and removed, so Usage doesn't walk the
+// FileSystem. Keys are as the cache stores them, after SetKeyMapper's mapping.
+// A nil namespace stops tracking.
+func (c *FSCache) SetUsageNamespaces(namespace func(key string) string) *FSCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if namespace == nil {
+		c.usage = nil
+		return c
+	}
+	c.usage = &usageIndex{
+		namespace: namespace,
+		spaces:    make(map[string]Usage),
+		sizes:     make(map[string]int64),
+	}
+	for key, f := range c.files {
+		c.usage.add(key)
+		if f.complete() {
+			c.usage.setSize(key, c.entrySize(f))
+		}
+	}
+	return c
+}
+
+// Usage returns the Usage of every namespace which has entries, see SetUsageNamespaces.
+// It returns nil if usage isn't tracked.
+func (c *FSCache) Usage() map[string]Usage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.usage == nil {
+		return nil
+	}
+	spaces := make(map[string]Usage, len(c.usage.spaces))
+	for ns, s := range c.usage.spaces {
+		spaces[ns] = s
+	}
+	return spaces
+}
+
+// PrefixNamespace returns a namespace function for SetUsageNamespaces which names the
+// namespace of a key by its part before the first sep, keys without sep are in "".
+func PrefixNamespace(sep string) func(key string) string {
+	return func(key string) string {
+		if i := strings.Index(key, sep); i >= 0 {
+			return key[:i]
+		}
+		return ""
+	}
+}
+
+// entrySize returns the size of f's data, or 0 if it can't be stat'd. c.mu must be held.
+func (c *FSCache) entrySize(f fileStream) int64 {
+	if cf, ok := f.(*cachedFile); ok {
+		return atomic.LoadInt64(&cf.written)
+	}
+	fi, err := c.fs.Stat(f.Name())
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
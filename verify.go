@@ -0,0 +1,195 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyPolicy is what StandardFS.Reload does to check the directory before loading it.
+type VerifyPolicy int
+
+const (
+	// VerifyNone doesn't check the directory. This is the default.
+	VerifyNone VerifyPolicy = iota
+
+	// VerifyCheck runs Verify without repairing anything, see LastVerify for the report.
+	VerifyCheck
+
+	// VerifyAndRepair runs Verify and repairs the problems it finds before loading.
+	VerifyAndRepair
+)
+
+// VerifyReport is the result of StandardFS.Verify. Paths are in the directory given to NewFs.
+type VerifyReport struct {
+	Files int   `json:"files"` // entry files checked
+	Bytes int64 `json:"bytes"` // their total size
+
+	LostKeys   []string            `json:"lostKeys,omitempty"`   // files whose key can't be recovered
+	WrongKeys  []string            `json:"wrongKeys,omitempty"`  // files whose stored key doesn't give their name
+	Orphans    []string            `json:"orphans,omitempty"`    // .key and .meta files without their file, and leftover temporary files
+	Duplicates map[string][]string `json:"duplicates,omitempty"` // key => its files, newest first
+	Corrupt    []string            `json:"corrupt,omitempty"`    // content-addressed files whose data doesn't hash to their key
+
+	Repaired []string `json:"repaired,omitempty"` // files removed to repair the above
+}
+
+// OK reports whether Verify found no problems.
+func (r *VerifyReport) OK() bool {
+	return len(r.LostKeys) == 0 && len(r.WrongKeys) == 0 && len(r.Orphans) == 0 &&
+		len(r.Duplicates) == 0 && len(r.Corrupt) == 0
+}
+
+// Verify checks the cache directory dir, written by a StandardFS with the default
+// EncodeKey and DecodeKey, without changing it, see StandardFS.Verify.
+func Verify(dir string) (*VerifyReport, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	fs, err := NewFs(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Verify(false)
+}
+
+// Verify cross-checks the files of the directory with their .key and .meta files: it finds
+// files whose key is lost or doesn't match their name, sidecars without their file, files
+// left by interrupted writes, keys with several files, and content-addressed entries, see
+// ContentKeyPrefix, whose data doesn't match their digest. With repair, the files at fault
+// are removed, and of the keys with several files only the newest is kept. It should run
+// before a cache uses the directory, see VerifyOnLoad.
+func (fs *StandardFS) Verify(repair bool) (*VerifyReport, error) {
+	files, err := ioutil.ReadDir(fs.root)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	removeFile := func(path string) {
+		if repair && fs.Remove(path) == nil {
+			report.Repaired = append(report.Repaired, path)
+		}
+	}
+
+	exists := make(map[string]bool)
+	keyfiles := make(map[string]bool)
+	for _, f := range files {
+		exists[f.Name()] = true
+		if strings.HasSuffix(f.Name(), ".key") {
+			keyfiles[strings.TrimSuffix(f.Name(), ".key")] = true
+		}
+	}
+
+	byKey := make(map[string][]os.FileInfo)
+	var keys []string
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(fs.root, name)
+		switch {
+		case name == ownerFile:
+			continue
+		case name == stagingDir:
+			staged, _ := ioutil.ReadDir(path)
+			for _, s := range staged {
+				report.Orphans = append(report.Orphans, filepath.Join(path, s.Name()))
+			}
+			if repair {
+				report.Repaired = append(report.Repaired, fs.cleanStaging()...)
+			}
+			continue
+		case f.IsDir():
+			continue
+		case strings.HasSuffix(name, ".meta.tmp"):
+			report.Orphans = append(report.Orphans, path)
+			if repair && os.Remove(path) == nil {
+				report.Repaired = append(report.Repaired, path)
+			}
+			continue
+		case strings.HasSuffix(name, ".key") || strings.HasSuffix(name, ".meta"):
+			if !exists[name[:strings.LastIndexByte(name, '.')]] {
+				report.Orphans = append(report.Orphans, path)
+				if repair && os.Remove(path) == nil {
+					report.Repaired = append(report.Repaired, path)
+				}
+			}
+			continue
+		}
+
+		report.Files++
+		report.Bytes += f.Size()
+		_, decodable := fs.DecodeKey(name)
+		decodable = decodable && !keyfiles[name]
+		key, err := fs.getKey(name, keyfiles[name])
+		if err != nil {
+			report.LostKeys = append(report.LostKeys, path)
+			removeFile(path)
+			continue
+		}
+		if encoded, _ := fs.encodeName(key); !decodable && encoded != name {
+			report.WrongKeys = append(report.WrongKeys, path)
+			removeFile(path)
+			continue
+		}
+		if ok, err := contentMatches(path, key); err == nil && !ok {
+			report.Corrupt = append(report.Corrupt, path)
+			removeFile(path)
+			continue
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], f)
+	}
+
+	for _, key := range keys {
+		fis := byKey[key]
+		if len(fis) < 2 {
+			continue
+		}
+		// newest first
+		sort.SliceStable(fis, func(i, j int) bool { return fis[j].ModTime().Before(fis[i].ModTime()) })
+		if report.Duplicates == nil {
+			report.Duplicates = make(map[string][]string)
+		}
+		for i, fi := range fis {
+			path := filepath.Join(fs.root, fi.Name())
+			report.Duplicates[key] = append(report.Duplicates[key], path)
+			if i > 0 {
+				removeFile(path)
+			}
+		}
+	}
+	return report, nil
+}
+
+// contentMatches reports whether the data of the file at path hashes to key, if key is
+// content-addressed, and true otherwise.
+func contentMatches(path, key string) (bool, error) {
+	digest := strings.TrimPrefix(key, ContentKeyPrefix)
+	if digest == key || !isHexSHA256(digest) {
+		return true, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(digest), nil
+}
+
+// LastVerify returns the report of the Verify run by the last Reload, or nil if
+// VerifyOnLoad is VerifyNone.
+func (fs *StandardFS) LastVerify() *VerifyReport {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.verified
+}
@@ -0,0 +1,64 @@
+package fscache
+
+import (
+	"io"
+	"sync"
+)
+
+// Warm fills each of keys which isn't already in the cache by calling fill,
+// running at most concurrency fills at once. If fill returns an error the entry
+// is removed. Warm returns once every fill has finished, with the first error encountered.
+func (c *FSCache) Warm(keys []string, fill func(key string, w io.Writer) error, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		grp  sync.WaitGroup
+		mu   sync.Mutex
+		err1 error
+	)
+	sem := make(chan struct{}, concurrency)
+
+	for _, key := range keys {
+		// cheap check under the read lock, so hits don't contend for a slot or the write lock.
+		if c.Exists(key) {
+			continue
+		}
+
+		sem <- struct{}{}
+		grp.Add(1)
+		go func(key string) {
+			defer grp.Done()
+			defer func() { <-sem }()
+			if err2 := c.warm(key, fill); err2 != nil {
+				mu.Lock()
+				if err1 == nil {
+					err1 = err2
+				}
+				mu.Unlock()
+			}
+		}(key)
+	}
+
+	grp.Wait()
+	return err1
+}
+
+func (c *FSCache) warm(key string, fill func(key string, w io.Writer) error) error {
+	r, w, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	if w == nil {
+		return nil
+	}
+
+	err = fill(key, w)
+	w.Close()
+	if err != nil {
+		c.Remove(key)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package fscache
+
+import "syscall"
+
+// keyXattr is the extended attribute which holds the key of a File, see StandardFS.KeyXattr.
+const keyXattr = "user.fscache.key"
+
+func setKeyXattr(path, key string) error {
+	return syscall.Setxattr(path, keyXattr, []byte(key), 0)
+}
+
+func getKeyXattr(path string) (string, error) {
+	for {
+		n, err := syscall.Getxattr(path, keyXattr, nil)
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		m, err := syscall.Getxattr(path, keyXattr, buf)
+		if err == syscall.ERANGE {
+			continue // the key was replaced with a longer one
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(buf[:m]), nil
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package fscache
+
+func setKeyXattr(path, key string) error { return ErrUnsupported }
+
+func getKeyXattr(path string) (string, error) { return "", ErrUnsupported }